@@ -15,13 +15,20 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/openSUSE/helm-mirror/service"
 	"github.com/spf13/cobra"
@@ -37,6 +44,7 @@ var (
 	AllVersions  bool
 	chartName    string
 	chartVersion string
+	chartNames   []string
 	folder       string
 	repoURL      *url.URL
 	flags        = log.Ldate | log.Lmicroseconds | log.Lshortfile
@@ -48,8 +56,94 @@ var (
 	certFile     string
 	keyFile      string
 	newRootURL   string
+	concurrency  int
+	retries      int
+	retryDelay   time.Duration
+	verify       bool
+	versionRange string
+	skipExisting bool
+	timeout      time.Duration
+	summaryFile  string
+	provenance   bool
+	pushTo       string
+	regUsername  string
+	regPassword  string
+	plainHTTP    bool
+	rewriteURLs  []string
+	dryRun       bool
+	fileMode     string
+	include      string
+	exclude      string
+	skipPre      bool
+	maxVersions  int
+	rateLimit    int64
+	flatLayout   bool
+	regenerate   bool
+	dependencies bool
+	logFormat    string
+	validate     bool
+	since        string
+	compress     bool
+	checksums    bool
+	s3Target     string
+	s3Region     string
+	s3Endpoint   string
+	gcsTarget    string
+	keywords     []string
+	annotations  []string
+	userAgent    string
+	mergeIndex   bool
+	failMissing  bool
+	latestOnly   bool
+	exactMatch   bool
+	namePattern  string
+	specFile     string
+	extraArts    bool
+	extraArtsKey string
+	maxSize      int64
+	skipUnknown  bool
+	prune        bool
+	appRange     string
+	contentAddr  bool
+	credsFile    string
+	deprecated   bool
+	urlFilename  bool
+	layout       string
+	fsync        bool
+	afterCmd     string
+	tarOutput    string
+	stateFile    string
+	indexRetries int
+	blocklist    []string
+	blockFile    string
+	reproIndex   bool
+	indexTime    string
+	indexOnly    bool
+	idleConns    int
+	quiet        bool
+	minTLS       string
+	signKey      string
+	keyring      string
+	keepRaw      bool
+	indexName    string
+	rawIndexName string
+	maintainer   string
+	sourcePrefix string
+	runTimeout   time.Duration
+	repoName     string
+	perHost      int
+	condIndex    bool
+	recheck      bool
 )
 
+// tlsVersions are the values of --min-tls-version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 const rootDesc = `Mirror Helm Charts from an index file into a local folder.
 
 For example:
@@ -112,6 +206,7 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&IgnoreErrors, "ignore-errors", "i", false, "ignores errors while downloading or processing charts")
 	rootCmd.PersistentFlags().BoolVarP(&AllVersions, "all-versions", "a", false, "gets all the versions of the charts in the chart repository")
 	rootCmd.Flags().StringVar(&chartName, "chart-name", "", "name of the chart that gets mirrored")
+	rootCmd.Flags().StringSliceVar(&chartNames, "chart-names", nil, "comma separated list of charts that get mirrored")
 	rootCmd.Flags().StringVar(&chartVersion, "chart-version", "", "specific version of the chart that is going to be mirrored")
 	rootCmd.Flags().StringVar(&username, "username", "", "chart repository username")
 	rootCmd.Flags().StringVar(&password, "password", "", "chart repository password")
@@ -119,6 +214,84 @@ func init() {
 	rootCmd.Flags().StringVar(&certFile, "cert-file", "", "identify HTTPS client using this SSL certificate file")
 	rootCmd.Flags().StringVar(&keyFile, "key-file", "", "identify HTTPS client using this SSL key file")
 	rootCmd.Flags().StringVar(&newRootURL, "new-root-url", "", "New root url of the chart repository (eg: `https://mirror.local.lan/charts`)")
+	rootCmd.Flags().IntVarP(&concurrency, "concurrency", "c", service.DefaultConcurrency, "number of charts downloaded in parallel")
+	rootCmd.Flags().IntVar(&perHost, "max-concurrent-per-host", 0, "number of charts downloaded in parallel from each host, within the concurrency, no limit by default")
+	rootCmd.Flags().IntVar(&retries, "retries", 0, "number of times a failed chart download is retried")
+	rootCmd.Flags().DurationVar(&retryDelay, "retry-delay", service.DefaultRetryBaseDelay, "maximum delay before the first retry, doubled on each attempt, the actual delay is random up to it")
+	rootCmd.Flags().BoolVar(&verify, "verify", false, "verify the downloaded charts against the digests of the index file")
+	rootCmd.Flags().StringVar(&versionRange, "version-constraint", "", "semver constraint of the chart versions that get mirrored (eg: `>=1.2.0, <2.0.0`)")
+	rootCmd.Flags().BoolVar(&skipExisting, "skip-existing", false, "skip the charts already mirrored that match the digests of the index file")
+	rootCmd.Flags().DurationVar(&timeout, "download-timeout", service.DefaultDownloadTimeout, "maximum time to download a single chart")
+	rootCmd.Flags().DurationVar(&runTimeout, "overall-timeout", 0, "maximum time of the whole run, it fails once exceeded (eg: `30m`), no limit by default")
+	rootCmd.Flags().StringVar(&summaryFile, "summary-file", "", "write a JSON summary of the mirrored charts to this file in the destination folder (eg: `mirror-summary.json`)")
+	rootCmd.Flags().BoolVar(&provenance, "provenance", false, "also download the provenance (.prov) files of the charts")
+	rootCmd.Flags().StringVar(&pushTo, "push-to", "", "push the charts to this OCI registry instead of the destination folder (eg: `oci://registry.local/charts`)")
+	rootCmd.Flags().StringVar(&regUsername, "registry-username", "", "OCI registry username")
+	rootCmd.Flags().StringVar(&regPassword, "registry-password", "", "OCI registry password")
+	rootCmd.Flags().BoolVar(&plainHTTP, "plain-http", false, "use plain HTTP to talk to the OCI registries")
+	rootCmd.Flags().StringArrayVar(&rewriteURLs, "rewrite-url", nil, "rewrite another URL of the index file, in the form old=new, can be repeated")
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only log the charts that would be downloaded and their estimated size")
+	rootCmd.Flags().StringVar(&fileMode, "file-mode", "0644", "octal permissions of the written files, folders get the matching execute bits")
+	rootCmd.Flags().StringVar(&include, "version-include", "", "regular expression of the chart versions that get mirrored (eg: `^\\d+\\.\\d+\\.\\d+$`)")
+	rootCmd.Flags().StringVar(&exclude, "version-exclude", "", "regular expression of the chart versions that are not mirrored (eg: `-alpha|-rc`)")
+	rootCmd.Flags().BoolVar(&skipPre, "skip-prereleases", false, "skip the chart versions with a semver pre-release, like 1.0.0-rc1")
+	rootCmd.Flags().IntVar(&maxVersions, "max-versions", 0, "number of newest versions of each chart that get mirrored, 0 for all")
+	rootCmd.Flags().Int64Var(&rateLimit, "rate-limit", 0, "maximum download throughput in bytes per second shared by all the concurrent downloads, 0 for no limit")
+	rootCmd.Flags().BoolVar(&flatLayout, "flat-layout", false, "write all the charts directly in the target folder, without the subfolders of their URLs")
+	rootCmd.Flags().BoolVar(&regenerate, "regenerate-index", false, "build the index file from the mirrored charts instead of rewriting the upstream one")
+	rootCmd.Flags().BoolVar(&dependencies, "resolve-dependencies", false, "also mirror the dependencies of the charts, from their repositories")
+	rootCmd.Flags().StringVar(&logFormat, "log-format", "text", "format of the logs of the mirror run, text or json")
+	rootCmd.Flags().BoolVar(&validate, "validate-charts", false, "check that the downloaded charts are valid archives matching the name and version of the index file")
+	rootCmd.Flags().StringVar(&since, "since", "", "only mirror the chart versions created after this date of the index file, RFC 3339 or YYYY-MM-DD (eg: `2019-06-01`)")
+	rootCmd.Flags().BoolVar(&compress, "compress-index", false, "also write the index file gzip compressed as index.yaml.gz")
+	rootCmd.Flags().BoolVar(&checksums, "checksums", false, "write a SHA256SUMS file of the mirrored charts and index file, to check with sha256sum -c")
+	rootCmd.Flags().StringVar(&s3Target, "s3", "", "write the charts and the index file to this S3 bucket and prefix instead of the destination folder (eg: `s3://bucket/charts`)")
+	rootCmd.Flags().StringVar(&s3Region, "s3-region", "", "region of the S3 bucket, AWS_REGION by default")
+	rootCmd.Flags().StringVar(&s3Endpoint, "s3-endpoint", "", "URL of an S3 compatible server to use instead of AWS (eg: `http://minio.local.lan:9000`)")
+	rootCmd.Flags().StringVar(&gcsTarget, "gcs", "", "write the charts and the index file to this Google Cloud Storage bucket and prefix instead of the destination folder (eg: `gs://bucket/charts`)")
+	rootCmd.Flags().StringSliceVar(&keywords, "keywords", nil, "comma separated list of keywords that the mirrored charts must all have (eg: `database`)")
+	rootCmd.Flags().StringArrayVar(&annotations, "annotation", nil, "annotation that the mirrored charts must have, in the form key=value, can be repeated")
+	rootCmd.Flags().StringVar(&userAgent, "user-agent", "", "User-Agent header of the requests (default helm-mirror/<version>)")
+	rootCmd.Flags().BoolVar(&mergeIndex, "merge-index", false, "keeps the charts of the index file of a previous run that are no longer in the repository index")
+	rootCmd.Flags().BoolVar(&failMissing, "fail-on-missing", false, "downloads all the charts it can, then fails when some of them could not be downloaded")
+	rootCmd.Flags().BoolVar(&latestOnly, "latest-only", false, "only mirrors the newest version of each chart that passes the other filters, even with --all-versions")
+	rootCmd.Flags().BoolVar(&exactMatch, "exact-match", true, "matches the chart names exactly, otherwise the charts whose name contains one of them get mirrored")
+	rootCmd.Flags().StringVar(&namePattern, "name-pattern", "", "regular expression that the names of the mirrored charts must match")
+	rootCmd.Flags().StringVar(&specFile, "spec", "", "YAML file listing the charts to mirror and their versions, instead of --chart-name")
+	rootCmd.Flags().BoolVar(&extraArts, "extra-artifacts", false, "also downloads the artifacts listed by URL in the extra artifacts annotation of each chart")
+	rootCmd.Flags().StringVar(&extraArtsKey, "extra-artifacts-annotation", service.DefaultExtraArtifactsAnnotation, "chart annotation listing the extra artifacts, comma or space separated")
+	rootCmd.Flags().Int64Var(&maxSize, "max-size", 0, "skips the charts larger than this size in bytes, asked with a HEAD request, 0 for no limit")
+	rootCmd.Flags().BoolVar(&skipUnknown, "skip-unknown-size", false, "with --max-size, also skips the charts whose size cannot be known")
+	rootCmd.Flags().BoolVar(&prune, "prune", false, "deletes the charts of the target directory that are no longer in the repository index, after a run where every chart was downloaded")
+	rootCmd.Flags().StringVar(&appRange, "app-version-constraint", "", "semver constraint of the app versions of the charts that get mirrored (eg: `~1.25.0`), the charts without a semver app version are skipped")
+	rootCmd.Flags().BoolVar(&contentAddr, "content-addressed", false, "stores the content of the charts once under blobs/sha256 of the target directory, the chart files being hard links to it")
+	rootCmd.Flags().StringVar(&credsFile, "credentials-file", "", "Docker or Helm registry config file (eg: `~/.config/helm/registry/config.json`) the repository and registry credentials are read from by host")
+	rootCmd.Flags().BoolVar(&deprecated, "include-deprecated", true, "mirrors the chart versions marked as deprecated, --include-deprecated=false skips them")
+	rootCmd.Flags().BoolVar(&urlFilename, "preserve-url-filename", false, "names the chart files after the base name of their URL instead of <name>-<version>.tgz")
+	rootCmd.Flags().StringVar(&layout, "layout", "", "how the charts are laid out in the target folder: urlPrefix (the subfolders of their URLs, the default), flat or byName (a subfolder per chart name)")
+	rootCmd.Flags().BoolVar(&fsync, "fsync", false, "syncs the charts and index files to disk once written, with their folders, so none is lost on a power failure")
+	rootCmd.Flags().StringVar(&afterCmd, "after-download", "", "shell command run after each chart is written (eg: a scanner or a signer), with the chart path as $1 and its name, version and digest in HELM_MIRROR_CHART_NAME, HELM_MIRROR_CHART_VERSION and HELM_MIRROR_CHART_DIGEST")
+	rootCmd.Flags().StringVar(&tarOutput, "tar-output", "", "write the charts and the index file to this tar archive instead of the destination folder, gzipped when it ends with .gz or .tgz")
+	rootCmd.Flags().StringVar(&stateFile, "state-file", "", "record the charts mirrored in this file of the destination folder (eg: `.mirror-state.json`), a run resumed from it skips them")
+	rootCmd.Flags().BoolVar(&condIndex, "conditional-index", false, "does nothing when the index file was not modified since the last complete run, from its ETag and Last-Modified headers")
+	rootCmd.Flags().BoolVar(&recheck, "force-recheck", false, "downloads the index file and checks the charts even when the index file was not modified, with --conditional-index")
+	rootCmd.Flags().IntVar(&indexRetries, "index-retries", 0, "number of times a failed index file download is retried, separately from the charts")
+	rootCmd.Flags().StringSliceVar(&blocklist, "blocklist", nil, "comma separated list of chart versions never mirrored whatever the other filters, as <name>-<version> (eg: `foo-1.2.3,bar-4.5.6`)")
+	rootCmd.Flags().StringVar(&blockFile, "blocklist-file", "", "file listing the chart versions never mirrored, one <name>-<version> per line")
+	rootCmd.Flags().BoolVar(&reproIndex, "reproducible-index", false, "set the generated time of the index file to the newest created time of its charts, so that mirrors of the same charts have the same index file")
+	rootCmd.Flags().StringVar(&indexTime, "index-timestamp", "", "RFC 3339 time set as the generated time of the index file (eg: `2020-01-02T15:04:05Z`)")
+	rootCmd.Flags().BoolVar(&indexOnly, "index-only", false, "only download and rewrite the index file, without downloading any chart")
+	rootCmd.Flags().IntVar(&idleConns, "max-idle-conns-per-host", 0, "number of idle connections kept open to each host between the downloads, 16 or the concurrency when it is higher by default")
+	rootCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "only log the totals of the run and the errors that stop it, the messages and warnings of the charts are dropped")
+	rootCmd.Flags().StringVar(&minTLS, "min-tls-version", "1.2", "oldest TLS version accepted from the servers: 1.0, 1.1, 1.2 or 1.3")
+	rootCmd.Flags().StringVar(&signKey, "sign-key", "", "sign each chart with the private key of this name in the keyring, writing its provenance (.prov) file, the passphrase of an encrypted key is read from HELM_KEY_PASSPHRASE")
+	rootCmd.Flags().StringVar(&keyring, "keyring", "", "keyring holding the signing key of --sign-key, $HOME/.gnupg/secring.gpg by default")
+	rootCmd.Flags().BoolVar(&keepRaw, "keep-raw-index", false, "keep the index file downloaded from the repository, before its URLs are rewritten, next to the index file of the mirror")
+	rootCmd.Flags().StringVar(&indexName, "index-file-name", "index.yaml", "name of the index file written to the destination folder")
+	rootCmd.Flags().StringVar(&rawIndexName, "raw-index-file-name", "downloaded-index.yaml", "name of the index file downloaded from the repository, kept with --keep-raw-index")
+	rootCmd.Flags().StringVar(&maintainer, "maintainer", "", "only mirrors the charts with a maintainer of this name or email, or with an email of this domain when it starts with @ (eg: `@example.com`)")
+	rootCmd.Flags().StringVar(&repoName, "repo-name", "", "name of the repository in the logs and the chart searches, the destination folder by default")
+	rootCmd.Flags().StringVar(&sourcePrefix, "source-url-prefix", "", "only mirrors the charts with a source URL starting with this prefix, or matching --maintainer (eg: `https://github.com/example/`)")
 	rootCmd.AddCommand(newVersionCmd())
 }
 
@@ -136,7 +309,7 @@ func validateRootArgs(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	if !strings.Contains(url.Scheme, "http") {
+	if !strings.Contains(url.Scheme, "http") && url.Scheme != "file" {
 		logger.Printf("error: not a valid URL protocol: `%s`", url.Scheme)
 		return errors.New("error: not a valid URL protocol")
 	}
@@ -154,10 +327,12 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		return err
 	}
 	folder = args[1]
-	err = os.MkdirAll(folder, 0744)
-	if err != nil {
-		logger.Printf("error: cannot create destination folder: %s", err)
-		return err
+	if !dryRun {
+		err = os.MkdirAll(folder, 0755)
+		if err != nil {
+			logger.Printf("error: cannot create destination folder: %s", err)
+			return err
+		}
 	}
 
 	rootURL := &url.URL{}
@@ -174,11 +349,80 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	if chartVersion != "" && chartName == "" {
+	if chartVersion != "" && chartName == "" && len(chartNames) == 0 {
 		logger.Printf("error: chart Version depends on a chart name, please specify one")
 		return errors.New("error: chart Version depends on a chart name, please specify one")
 	}
 
+	if quiet && Verbose {
+		logger.Printf("error: quiet and verbose cannot be used together")
+		return errors.New("error: quiet and verbose cannot be used together")
+	}
+
+	tlsVersion, ok := tlsVersions[minTLS]
+	if !ok {
+		logger.Printf("error: min-tls-version must be 1.0, 1.1, 1.2 or 1.3: `%s`", minTLS)
+		return errors.New("error: min-tls-version must be 1.0, 1.1, 1.2 or 1.3")
+	}
+
+	if keyring == "" {
+		keyring = os.ExpandEnv("$HOME/.gnupg/secring.gpg")
+	}
+
+	mode, err := strconv.ParseUint(fileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		logger.Printf("error: file-mode not a valid octal mode: `%s`", fileMode)
+		return errors.New("error: file-mode not a valid octal mode")
+	}
+
+	var eventLogger service.Logger
+	switch logFormat {
+	case "text":
+		eventLogger = service.NewTextLogger(logger, Verbose)
+	case "json":
+		eventLogger = service.NewJSONLogger(os.Stdout)
+	default:
+		logger.Printf("error: log-format must be text or json: `%s`", logFormat)
+		return errors.New("error: log-format must be text or json")
+	}
+
+	var modifiedSince time.Time
+	if since != "" {
+		modifiedSince, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			modifiedSince, err = time.Parse("2006-01-02", since)
+		}
+		if err != nil {
+			logger.Printf("error: since not a valid RFC 3339 or YYYY-MM-DD date: `%s`", since)
+			return errors.New("error: since not a valid date")
+		}
+	}
+
+	annotationFilter := map[string]string{}
+	for _, a := range annotations {
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			logger.Printf("error: annotation must be in the form key=value: `%s`", a)
+			return errors.New("error: annotation must be in the form key=value")
+		}
+		annotationFilter[parts[0]] = parts[1]
+	}
+
+	agent := userAgent
+	if agent == "" {
+		agent = "helm-mirror/" + version
+	}
+
+	rewrites := []service.URLRewrite{}
+	for _, r := range rewriteURLs {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			logger.Printf("error: rewrite-url must be in the form old=new: `%s`", r)
+			return errors.New("error: rewrite-url must be in the form old=new")
+		}
+		rewrites = append(rewrites, service.URLRewrite{From: parts[0], To: parts[1]})
+	}
+
 	config := repo.Entry{
 		Name:     folder,
 		URL:      repoURL.String(),
@@ -188,10 +432,202 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		CertFile: certFile,
 		KeyFile:  keyFile,
 	}
-	getService := service.NewGetService(config, AllVersions, Verbose, IgnoreErrors, logger, rootURL.String(), chartName, chartVersion)
-	err = getService.Get()
+	opts := []service.GetOption{
+		service.WithConcurrency(concurrency),
+		service.WithMaxConcurrentPerHost(perHost),
+		service.WithRetries(retries, retryDelay),
+		service.WithDigestVerification(verify),
+		service.WithVersionConstraint(versionRange),
+		service.WithProgress(logProgress),
+		service.WithSkipExisting(skipExisting),
+		service.WithDownloadTimeout(timeout),
+		service.WithOverallTimeout(runTimeout),
+		service.WithSummaryFile(summaryFile),
+		service.WithChartNames(chartNames),
+		service.WithProvenance(provenance),
+		service.WithURLRewrites(rewrites),
+		service.WithDryRun(dryRun),
+		service.WithFileMode(os.FileMode(mode)),
+		service.WithVersionInclude(include),
+		service.WithVersionExclude(exclude),
+		service.WithSkipPrereleases(skipPre),
+		service.WithMaxVersionsPerChart(maxVersions),
+		service.WithRateLimit(rateLimit),
+		service.WithFlatLayout(flatLayout),
+		service.WithRegeneratedIndex(regenerate),
+		service.WithDependencies(dependencies),
+		service.WithLogger(eventLogger),
+		service.WithChartValidation(validate),
+		service.WithModifiedSince(modifiedSince),
+		service.WithCompressedIndex(compress),
+		service.WithChecksums(checksums),
+		service.WithKeywords(keywords),
+		service.WithAnnotations(annotationFilter),
+		service.WithUserAgent(agent),
+		service.WithMergedIndex(mergeIndex),
+		service.WithFailOnMissing(failMissing),
+		service.WithLatestOnly(latestOnly),
+		service.WithExactMatch(exactMatch),
+		service.WithNamePattern(namePattern),
+		service.WithExtraArtifacts(extraArts, extraArtsKey),
+		service.WithMaxChartSize(maxSize, skipUnknown),
+		service.WithPrune(prune),
+		service.WithAppVersionConstraint(appRange),
+		service.WithContentAddressed(contentAddr),
+		service.WithCredentialsFile(credsFile),
+		service.WithIncludeDeprecated(deprecated),
+		service.WithPreserveURLFilename(urlFilename),
+		service.WithLayout(service.Layout(layout)),
+		service.WithFsync(fsync),
+		service.WithTarOutput(tarOutput),
+		service.WithStateFile(stateFile),
+		service.WithIndexRetries(indexRetries),
+		service.WithConditionalIndex(condIndex),
+		service.WithForcedRecheck(recheck),
+		service.WithBlocklist(blocklist),
+		service.WithReproducibleIndex(reproIndex),
+		service.WithIndexOnly(indexOnly),
+		service.WithMaxIdleConnsPerHost(idleConns),
+		service.WithQuiet(quiet),
+		service.WithMinTLSVersion(tlsVersion),
+		service.WithSigningKey(keyring, signKey, os.Getenv("HELM_KEY_PASSPHRASE")),
+		service.WithKeepRawIndex(keepRaw),
+		service.WithIndexFileNames(indexName, rawIndexName),
+		service.WithMaintainer(maintainer),
+		service.WithSourceURLPrefix(sourcePrefix),
+		// the registries of the oci:// chart URLs use them as well as the
+		// one of push-to
+		service.WithRegistryCredentials(regUsername, regPassword),
+		service.WithPlainHTTPRegistry(plainHTTP),
+	}
+	if repoName != "" {
+		// the mirror is still written to the destination folder, only the
+		// name of the repository in the searches and the logs is overridden
+		opts = append(opts, service.WithRepoName(repoName), service.WithOutputDir(folder))
+	}
+	if flatLayout && layout != "" && layout != string(service.LayoutFlat) {
+		logger.Printf("error: flat-layout and layout %s cannot be used together", layout)
+		return errors.New("error: flat-layout and layout cannot be used together")
+	}
+	if indexTime != "" {
+		t, err := time.Parse(time.RFC3339, indexTime)
+		if err != nil {
+			logger.Printf("error: index-timestamp not a valid RFC 3339 time: %s", err)
+			return err
+		}
+		opts = append(opts, service.WithIndexTimestamp(t))
+	}
+	if blockFile != "" {
+		opts = append(opts, service.WithBlocklistFile(blockFile))
+	}
+	if afterCmd != "" {
+		opts = append(opts, service.WithAfterDownload(afterDownloadCommand(afterCmd)))
+	}
+	var getService service.GetServiceInterface
+	if s3Target != "" {
+		u, err := url.Parse(s3Target)
+		if err != nil || u.Scheme != "s3" || u.Host == "" {
+			logger.Printf("error: s3 must be in the form s3://bucket/prefix: `%s`", s3Target)
+			return errors.New("error: s3 must be in the form s3://bucket/prefix")
+		}
+		if pushTo != "" {
+			logger.Printf("error: s3 and push-to cannot be used together")
+			return errors.New("error: s3 and push-to cannot be used together")
+		}
+		storage, err := service.NewS3Writer(u.Host, u.Path, s3Region, s3Endpoint)
+		if err != nil {
+			logger.Printf("error: %s", err)
+			return err
+		}
+		opts = append(opts, service.WithStorageWriter(storage))
+	}
+	if gcsTarget != "" {
+		u, err := url.Parse(gcsTarget)
+		if err != nil || u.Scheme != "gs" || u.Host == "" {
+			logger.Printf("error: gcs must be in the form gs://bucket/prefix: `%s`", gcsTarget)
+			return errors.New("error: gcs must be in the form gs://bucket/prefix")
+		}
+		if pushTo != "" || s3Target != "" {
+			logger.Printf("error: gcs cannot be used with push-to or s3")
+			return errors.New("error: gcs cannot be used with push-to or s3")
+		}
+		storage, err := service.NewGCSWriter(u.Host, u.Path)
+		if err != nil {
+			logger.Printf("error: %s", err)
+			return err
+		}
+		opts = append(opts, service.WithStorageWriter(storage))
+	}
+	if specFile != "" {
+		if pushTo != "" || chartName != "" || chartVersion != "" || len(chartNames) > 0 || repoName != "" {
+			logger.Printf("error: spec cannot be used with push-to, chart-name, chart-names, chart-version or repo-name")
+			return errors.New("error: spec cannot be used with push-to, chart-name, chart-names, chart-version or repo-name")
+		}
+		var specs []service.ChartSpec
+		if specs, err = service.LoadMirrorSpec(specFile); err != nil {
+			logger.Printf("error: %s", err)
+			return err
+		}
+		getService, err = service.NewSpecGetService(config, specs, Verbose, IgnoreErrors, logger, rootURL.String(), opts...)
+	} else if pushTo != "" {
+		getService, err = service.NewOCIGetService(config, pushTo, AllVersions, Verbose, IgnoreErrors, logger, chartName, chartVersion, opts...)
+	} else {
+		getService, err = service.NewGetService(config, AllVersions, Verbose, IgnoreErrors, logger, rootURL.String(), chartName, chartVersion, opts...)
+	}
+	if err != nil {
+		logger.Printf("error: %s", err)
+		return err
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	err = getService.Get(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// logProgress logs every downloaded chart in verbose mode, the JSON logs
+// have an event for each one instead
+func logProgress(chartName string, version string, current int, total int) {
+	if Verbose && logFormat != "json" {
+		logger.Printf("downloaded %s(%s) [%d/%d]", chartName, version, current, total)
+	}
+}
+
+// afterDownloadCommand returns the hook running command with sh after each
+// chart is written, the chart path is its first argument and the chart name,
+// version and digest are in the HELM_MIRROR_CHART_NAME, HELM_MIRROR_CHART_VERSION
+// and HELM_MIRROR_CHART_DIGEST environment variables
+func afterDownloadCommand(command string) service.AfterDownloadFunc {
+	return func(chartPath string, chart *service.ChartInfo) error {
+		c := exec.Command("sh", "-c", command, "sh", chartPath)
+		c.Env = append(os.Environ(),
+			"HELM_MIRROR_CHART_NAME="+chart.Name,
+			"HELM_MIRROR_CHART_VERSION="+chart.Version,
+			"HELM_MIRROR_CHART_DIGEST="+chart.Digest,
+		)
+		if out, err := c.CombinedOutput(); err != nil {
+			return fmt.Errorf("after download command: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+}
+
+// interruptContext returns a context that is cancelled when the process
+// receives an interrupt or termination signal.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case <-sigs:
+			logger.Printf("interrupted, stopping downloads")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -1,15 +1,22 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/openSUSE/helm-mirror/fixtures"
+	"github.com/openSUSE/helm-mirror/service"
 	"github.com/spf13/cobra"
+	"k8s.io/helm/pkg/repo"
 )
 
 func Test_validateRootArgs(t *testing.T) {
@@ -37,6 +44,7 @@ func Test_validateRootArgs(t *testing.T) {
 		{"6", args{c, []string{"ftps://url", "/target", "extra"}}, true},
 		{"7", args{c, []string{"help"}}, false},
 		{"8", args{c, []string{"%", "/target", "extra"}}, true},
+		{"9", args{c, []string{"file:///charts", "/target"}}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -54,7 +62,7 @@ func Test_runRoot(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 	svr := fixtures.StartHTTPServer()
-	defer svr.Shutdown(nil)
+	defer svr.Shutdown(context.Background())
 	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
 	type args struct {
 		cmd          *cobra.Command
@@ -97,3 +105,113 @@ func Test_runRoot(t *testing.T) {
 		})
 	}
 }
+
+func Test_runRootRepoName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirror")
+	if err != nil {
+		t.Errorf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name      string
+		repoName  string
+		chartName string
+		want      []string
+		wantRepo  string
+	}{
+		{"1", "stable", "chart1", []string{"chart1-2.11.0.tgz"}, "stable"},
+		{"2", "stable", "", []string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz", "chart3-0.0.1-rc1.tgz"}, "stable"},
+		{"3", "", "chart1", []string{"chart1-2.11.0.tgz"}, path.Join(dir, "chart-mirror-3")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folder := path.Join(dir, "chart-mirror-"+tt.name)
+			newRootURL = ""
+			IgnoreErrors = true
+			AllVersions = false
+			chartVersion = ""
+			repoName = tt.repoName
+			chartName = tt.chartName
+			logFormat = "json"
+			// the JSON logs are written to stdout
+			out, err := ioutil.TempFile(dir, "logs")
+			if err != nil {
+				t.Fatalf("creating logs file: %s", err)
+			}
+			stdout := os.Stdout
+			os.Stdout = out
+			defer func() {
+				os.Stdout = stdout
+				repoName = ""
+				chartName = ""
+				logFormat = "text"
+			}()
+			err = runRoot(&cobra.Command{}, []string{"http://127.0.0.1:1793", folder})
+			os.Stdout = stdout
+			if err != nil {
+				t.Fatalf("runRoot() error = %v", err)
+			}
+			logs, _ := ioutil.ReadFile(out.Name())
+			repos := map[string]string{}
+			for _, line := range strings.Split(strings.TrimSpace(string(logs)), "\n") {
+				var e service.Event
+				if err := json.Unmarshal([]byte(line), &e); err == nil && e.Repo != "" {
+					repos[e.Event] = e.Repo
+				}
+			}
+			for _, event := range []string{service.EventIndexDownloaded, service.EventRunCompleted} {
+				if repos[event] != tt.wantRepo {
+					t.Errorf("runRoot() logged %s event of repo %q, want %q", event, repos[event], tt.wantRepo)
+				}
+			}
+			// the mirror is still written to the destination folder
+			if _, err := repo.LoadIndexFile(path.Join(folder, "index.yaml")); err != nil {
+				t.Fatalf("loading index file: %s", err)
+			}
+			charts, _ := filepath.Glob(path.Join(folder, "*.tgz"))
+			got := []string{}
+			for _, c := range charts {
+				got = append(got, filepath.Base(c))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("runRoot() mirrored %v, want %v", got, tt.want)
+			}
+			if tt.repoName != "" {
+				if _, err := os.Stat(tt.repoName); !os.IsNotExist(err) {
+					t.Errorf("runRoot() wrote the mirror to %s", tt.repoName)
+				}
+			}
+		})
+	}
+}
+
+func Test_afterDownloadCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirror")
+	if err != nil {
+		t.Errorf("creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	chartPath := path.Join(dir, "chart1-2.11.0.tgz")
+	ioutil.WriteFile(chartPath, []byte("chart"), 0644)
+	chart := &service.ChartInfo{Name: "chart1", Version: "2.11.0", Digest: "abc"}
+	tests := []struct {
+		name    string
+		command string
+		wantErr bool
+	}{
+		{"1", `test -f "$1"`, false},
+		{"2", `[ "$HELM_MIRROR_CHART_NAME-$HELM_MIRROR_CHART_VERSION-$HELM_MIRROR_CHART_DIGEST" = chart1-2.11.0-abc ]`, false},
+		{"3", `echo vulnerable; exit 1`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := afterDownloadCommand(tt.command)(chartPath, chart); (err != nil) != tt.wantErr {
+				t.Errorf("afterDownloadCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
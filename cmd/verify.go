@@ -0,0 +1,81 @@
+// Copyright © 2018 openSUSE opensuse-project@opensuse.org
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/openSUSE/helm-mirror/service"
+	"github.com/spf13/cobra"
+)
+
+const verifyDesc = `Verify a mirror against its index file without downloading
+anything. Every chart of the index file has to be in the folder
+and its sha256 has to match the digest of the index file, the
+missing and corrupt charts are reported. Example:
+
+  - helm mirror verify /tmp/helm
+
+The [folder] has to be a full path.
+`
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [folder]",
+	Short: "Verify the charts of a mirror against its index file.",
+	Long:  verifyDesc,
+	Args:  validateVerifyArgs,
+	RunE:  runVerify,
+}
+
+var verifyIndexName string
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringVar(&verifyIndexName, "index-file-name", "index.yaml", "name of the index file of the mirror")
+}
+
+func validateVerifyArgs(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		logger.Print("error: requires at least one arg to execute")
+		return errors.New("error: requires at least one arg")
+	}
+	if !path.IsAbs(args[0]) {
+		logger.Printf("error: please provide a full path for [folder]: `%s`", args[0])
+		return errors.New("error: please provide a full path for [folder]")
+	}
+	return nil
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+	verifyService := service.NewVerifyService(args[0], Verbose, logger, service.WithVerifyIndexFileName(verifyIndexName))
+	report, err := verifyService.Verify()
+	if err != nil {
+		return err
+	}
+	for _, r := range report.Missing {
+		logger.Printf("missing: %s(%s) - %s", r.Name, r.Version, r.Error)
+	}
+	for _, r := range report.Corrupt {
+		logger.Printf("corrupt: %s(%s) %s - %s", r.Name, r.Version, r.Path, r.Error)
+	}
+	logger.Printf("verified %d charts, %d without digest, %d missing, %d corrupt", report.Verified, report.Unverified, len(report.Missing), len(report.Corrupt))
+	if !report.OK() {
+		return fmt.Errorf("error: %d charts are missing or corrupt", len(report.Missing)+len(report.Corrupt))
+	}
+	return nil
+}
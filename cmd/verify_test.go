@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func Test_validateVerifyArgs(t *testing.T) {
+	c := &cobra.Command{}
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"1", []string{}, true},
+		{"2", []string{"target"}, true},
+		{"3", []string{"/target"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateVerifyArgs(c, tt.args); (err != nil) != tt.wantErr {
+				t.Errorf("validateVerifyArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_runVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "empty"), 0755)
+	ioutil.WriteFile(path.Join(dir, "empty", "index.yaml"), []byte("apiVersion: v1\nentries: {}\n"), 0644)
+	os.MkdirAll(path.Join(dir, "missing"), 0755)
+	ioutil.WriteFile(path.Join(dir, "missing", "mirror-index.yaml"), []byte("apiVersion: v1\nentries: {}\n"), 0644)
+	ioutil.WriteFile(path.Join(dir, "missing", "index.yaml"), []byte("apiVersion: v1\nentries:\n  chart1:\n  - name: chart1\n    version: 1.0.0\n    urls:\n    - https://mirror.local.lan/chart1-1.0.0.tgz\n"), 0644)
+	tests := []struct {
+		name      string
+		dir       string
+		indexName string
+		wantErr   bool
+	}{
+		{"1", path.Join(dir, "empty"), "index.yaml", false},
+		{"2", path.Join(dir, "missing"), "index.yaml", true},
+		{"3", path.Join(dir, "none"), "index.yaml", true},
+		{"4", path.Join(dir, "missing"), "mirror-index.yaml", false},
+		{"5", path.Join(dir, "empty"), "mirror-index.yaml", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifyIndexName = tt.indexName
+			defer func() { verifyIndexName = "index.yaml" }()
+			if err := runVerify(&cobra.Command{}, []string{tt.dir}); (err != nil) != tt.wantErr {
+				t.Errorf("runVerify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,24 +2,38 @@ package fixtures
 
 import (
 	"log"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-// StartHTTPServer start http server for tests
+var registerHandlers sync.Once
+
+// StartHTTPServer start http server for tests, it can be started again
+// once the previous server has been shut down
 func StartHTTPServer() *http.Server {
 	srv := &http.Server{Addr: ":1793"}
-	http.HandleFunc("/alive", aliveTest)
-	http.HandleFunc("/index.yaml", indexFile)
-	http.HandleFunc("/chart1-2.11.0.tgz", chartTgz)
-	http.HandleFunc("/chart2-1.0.1.tgz", chartTgz)
-	http.HandleFunc("/chart2-0.0.0-rc1.tgz", chartTgz)
-	http.HandleFunc("/chart3-0.0.1-rc1.tgz", chartTgz)
+	registerHandlers.Do(func() {
+		http.HandleFunc("/alive", aliveTest)
+		http.HandleFunc("/index.yaml", indexFile)
+		http.HandleFunc("/chart1-2.11.0.tgz", chartTgz)
+		http.HandleFunc("/chart2-1.0.1.tgz", chartTgz)
+		http.HandleFunc("/chart2-0.0.0-rc1.tgz", chartTgz)
+		http.HandleFunc("/chart3-0.0.1-rc1.tgz", chartTgz)
+		http.HandleFunc("/chart1-2.11.0.tgz.prov", chartProv)
+	})
+	// Listen before returning so the server accepts requests right away
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Printf("Httpserver: Listen() error: %s", err)
+		return srv
+	}
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Printf("Httpserver: ListenAndServe() error: %s", err)
+		if err := srv.Serve(ln); err != nil {
+			log.Printf("Httpserver: Serve() error: %s", err)
 		}
 	}()
 	return srv
@@ -56,6 +70,21 @@ func chartTgz(w http.ResponseWriter, r *http.Request) {
 	w.Write(chartTGZ)
 }
 
+func chartProv(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(ChartProv))
+}
+
+// ChartProv test provenance file served for chart1
+var ChartProv = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+name: chart1
+version: 2.11.0
+-----BEGIN PGP SIGNATURE-----
+-----END PGP SIGNATURE-----
+`
+
 var chartTGZ = []byte{31, 139, 8, 0, 224, 223, 181, 91, 0, 3, 237, 193, 1, 13, 0, 0, 0, 194,
 	160, 247, 79, 109, 14, 55, 160, 0, 0, 0, 0, 0, 0, 0, 0, 0, 128, 55, 3, 154, 222, 29, 39, 0, 40, 0, 0}
 
@@ -42,7 +42,7 @@ func NewFormatter(t Type, fileName string, logger *log.Logger) Formatter {
 }
 
 func writeFile(name string, content []byte, log *log.Logger) error {
-	err := ioutil.WriteFile(name, content, 0666)
+	err := ioutil.WriteFile(name, content, 0644)
 	if err != nil {
 		log.Printf("cannot write files %s: %s", name, err)
 		return err
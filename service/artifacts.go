@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"k8s.io/helm/cmd/helm/search"
+	"k8s.io/helm/pkg/repo"
+)
+
+// DefaultExtraArtifactsAnnotation is the chart annotation listing the URLs of
+// the extra artifacts of a chart when no other one is set
+const DefaultExtraArtifactsAnnotation = "helm-mirror/extra-artifacts"
+
+// extraArtifactURLs returns the URLs listed in the extra artifacts annotation
+// of the chart, separated by commas or white space. Relative URLs are
+// resolved against chartURL.
+func (g *GetService) extraArtifactURLs(r *search.Result, chartURL *url.URL) ([]*url.URL, error) {
+	key := g.extraArtifactsAnnotation
+	if key == "" {
+		key = DefaultExtraArtifactsAnnotation
+	}
+	fields := strings.FieldsFunc(r.Chart.Annotations[key], func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\t' || c == '\n'
+	})
+	urls := make([]*url.URL, 0, len(fields))
+	for _, f := range fields {
+		u, err := url.Parse(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extra artifact URL %q: %s", f, err)
+		}
+		urls = append(urls, chartURL.ResolveReference(u))
+	}
+	return urls, nil
+}
+
+// extraArtifactPath returns the path the extra artifact of URL u is written
+// to, next to chartPath with the file name of u
+func extraArtifactPath(u *url.URL, chartPath string) (string, error) {
+	name := path.Base(u.Path)
+	if name == "." || name == "/" || name == ".." || name == path.Base(chartPath) || name == path.Base(chartPath)+provSuffix {
+		return "", fmt.Errorf("extra artifact %s has no usable file name", u)
+	}
+	return path.Join(path.Dir(chartPath), name), nil
+}
+
+// downloadExtraArtifacts downloads the extra artifacts listed in the
+// annotation of the chart next to chartPath, each one keeps the file name of
+// its URL
+func (g *GetService) downloadExtraArtifacts(ctx context.Context, chartRepo *repo.ChartRepository, r *search.Result, chartURL *url.URL, chartPath string) error {
+	urls, err := g.extraArtifactURLs(r, chartURL)
+	if err != nil {
+		return err
+	}
+	for _, u := range urls {
+		name, err := extraArtifactPath(u, chartPath)
+		if err != nil {
+			return err
+		}
+		b, err := g.fetch(ctx, chartRepo.Client, u.String())
+		if err != nil {
+			return err
+		}
+		if err := g.writeMirrorFile(ctx, name, b.Bytes()); err != nil {
+			return err
+		}
+		g.addBytes(b.Len())
+		g.summary.addArtifact(name)
+	}
+	return nil
+}
+
+// keepExtraArtifacts records the extra artifacts of the chart at chartPath,
+// found up to date, so that the ones of a previous run are not pruned
+func (g *GetService) keepExtraArtifacts(r *search.Result, chartURL *url.URL, chartPath string) {
+	if !g.fetchExtraArtifacts || chartURL.Scheme == ociScheme {
+		return
+	}
+	urls, err := g.extraArtifactURLs(r, chartURL)
+	if err != nil {
+		return
+	}
+	for _, u := range urls {
+		if name, err := extraArtifactPath(u, chartPath); err == nil {
+			g.summary.addArtifact(name)
+		}
+	}
+}
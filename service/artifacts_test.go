@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_GetExtraArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + indexFileName:
+			w.Write([]byte(index))
+		case "/charts/nginx-1.0.0.tgz", "/charts/keys/signing.asc", "/bundles/values.tgz":
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	entry := "apiVersion: v1\nentries:\n  nginx:\n  - name: nginx\n    version: 1.0.0\n    annotations:\n      %s: %q\n    urls:\n    - %s/charts/nginx-1.0.0.tgz\n"
+	tests := []struct {
+		name         string
+		fetch        bool
+		key          string
+		annotation   string
+		value        string
+		ignoreErrors bool
+		prune        bool
+		want         []string
+		wantErr      bool
+	}{
+		{"1", false, "", DefaultExtraArtifactsAnnotation, "keys/signing.asc", false, false, []string{"nginx-1.0.0.tgz"}, false},
+		{"2", true, "", DefaultExtraArtifactsAnnotation, "keys/signing.asc, SVR/bundles/values.tgz", false, false, []string{"nginx-1.0.0.tgz", "signing.asc", "values.tgz"}, false},
+		{"3", true, "example.com/artifacts", "example.com/artifacts", "keys/signing.asc", false, false, []string{"nginx-1.0.0.tgz", "signing.asc"}, false},
+		{"4", true, "example.com/artifacts", DefaultExtraArtifactsAnnotation, "keys/signing.asc", false, false, []string{"nginx-1.0.0.tgz"}, false},
+		{"5", true, "", DefaultExtraArtifactsAnnotation, "keys/missing.asc", false, false, nil, true},
+		{"6", true, "", DefaultExtraArtifactsAnnotation, "keys/missing.asc", true, false, []string{"nginx-1.0.0.tgz"}, false},
+		{"7", true, "", DefaultExtraArtifactsAnnotation, "nginx-1.0.0.tgz", false, false, nil, true},
+		{"8", true, "", DefaultExtraArtifactsAnnotation, "SVR/bundles/values.tgz", false, true, []string{"nginx-1.0.0.tgz", "values.tgz"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index = fmt.Sprintf(entry, tt.annotation, strings.Replace(tt.value, "SVR", svr.URL, -1), svr.URL)
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:                   repo.Entry{Name: workDir, URL: svr.URL},
+				logger:                   fakeLogger,
+				ignoreErrors:             tt.ignoreErrors,
+				allVersions:              true,
+				fetchExtraArtifacts:      tt.fetch,
+				extraArtifactsAnnotation: tt.key,
+				prune:                    tt.prune,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "charts", "*"))
+			got := []string{}
+			for _, f := range files {
+				got = append(got, filepath.Base(f))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetService.Get() files = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// blobsFolder is the folder of the chart contents of a content addressed
+// mirror, by sha256
+const blobsFolder = "blobs/sha256"
+
+// blobPath returns the path of the blob of the hex encoded sha256 sum
+func (g *GetService) blobPath(sum string) string {
+	return path.Join(g.dir(), blobsFolder, sum)
+}
+
+// storeBlob makes the chart written to chartPath a hard link to the blob of
+// its content sum, so identical chart versions are stored once. The blob is
+// created from the chart when it is the first with this content. When hard
+// links are not supported the chart and the blob are left as copies.
+// chartPath is never missing meanwhile.
+func (g *GetService) storeBlob(chartPath string, sum string) error {
+	blob := g.blobPath(sum)
+	if err := os.MkdirAll(path.Dir(blob), dirMode(g.mode())); err != nil {
+		return err
+	}
+	err := os.Link(chartPath, blob)
+	if err == nil {
+		return g.syncDir(path.Dir(blob))
+	}
+	if !os.IsExist(err) {
+		g.log().Printf("WARNING: cannot link %s to %s, copying it - %s", chartPath, blob, err)
+		content, err := ioutil.ReadFile(chartPath)
+		if err != nil {
+			return err
+		}
+		return writeAtomic(g.fileSystem(), blob, content, g.mode())
+	}
+	// the blob already exists, the chart is replaced by a link to it
+	tmp := chartPath + ".link"
+	os.Remove(tmp)
+	if err := os.Link(blob, tmp); err != nil {
+		g.log().Printf("WARNING: cannot link %s to %s, keeping a copy - %s", chartPath, blob, err)
+		return nil
+	}
+	if err := os.Rename(tmp, chartPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return g.syncDir(path.Dir(chartPath))
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_GetContentAddressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name             string
+		contentAddressed bool
+		// the charts of the fixtures all have the same content
+		wantBlobs int
+	}{
+		{"1", true, 1},
+		{"2", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:           repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:           fakeLogger,
+				ignoreErrors:     true,
+				allVersions:      true,
+				contentAddressed: tt.contentAddressed,
+			}
+			// run twice, the charts downloaded again are linked to the
+			// existing blob
+			for i := 0; i < 2; i++ {
+				if err := g.Get(context.Background()); err != nil {
+					t.Fatalf("GetService.Get() error = %v", err)
+				}
+			}
+			blobs, _ := filepath.Glob(path.Join(workDir, blobsFolder, "*"))
+			if len(blobs) != tt.wantBlobs {
+				t.Fatalf("GetService.Get() got %v blobs, want %v", len(blobs), tt.wantBlobs)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			if len(files) != fixtures.Expectedcharts-1 {
+				t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), fixtures.Expectedcharts-1)
+			}
+			if tt.wantBlobs == 0 {
+				return
+			}
+			blob, _ := os.Stat(blobs[0])
+			for _, f := range files {
+				if info, err := os.Stat(f); err != nil || !os.SameFile(info, blob) {
+					t.Errorf("GetService.Get() %s is not a link to the blob %s", f, blobs[0])
+				}
+			}
+			if leftover, _ := filepath.Glob(path.Join(workDir, "*.link")); len(leftover) > 0 {
+				t.Errorf("GetService.Get() left %v", leftover)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+const checksumsFileName = "SHA256SUMS"
+
+// writeChecksums writes the SHA256SUMS file of the folder with the sums of
+// the chart files and of the index files of the folder named indexFiles, one
+// "sum  path" line per file with the path relative to the folder, as
+// sha256sum does
+func writeChecksums(fs FileSystem, folder string, sums map[string]string, indexFiles []string, mode os.FileMode) error {
+	lines := map[string]string{}
+	for name, sum := range sums {
+		rel, err := filepath.Rel(folder, name)
+		if err != nil {
+			return err
+		}
+		lines[filepath.ToSlash(rel)] = sum
+	}
+	for _, name := range indexFiles {
+		content, err := fs.ReadFile(path.Join(folder, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		lines[name] = digest(content)
+	}
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s  %s\n", lines[name], name)
+	}
+	return writeAtomic(fs, path.Join(folder, checksumsFileName), buf.Bytes(), mode)
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_GetChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name         string
+		skipExisting bool
+		compress     bool
+	}{
+		{"1", false, false},
+		// the charts skipped because they are up to date are listed too
+		{"2", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GetService{
+				config:         repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+				logger:         fakeLogger,
+				ignoreErrors:   true,
+				allVersions:    true,
+				skipExisting:   tt.skipExisting,
+				compressIndex:  tt.compress,
+				writeChecksums: true,
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			content, err := ioutil.ReadFile(path.Join(dir, checksumsFileName))
+			if err != nil {
+				t.Fatalf("reading SHA256SUMS: %s", err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+			// every chart but chart4, and the index file
+			want := fixtures.Expectedcharts
+			if tt.compress {
+				want++
+			}
+			if len(lines) != want {
+				t.Errorf("GetService.Get() SHA256SUMS has %d lines, want %d:\n%s", len(lines), want, content)
+			}
+			for _, l := range lines {
+				parts := strings.SplitN(l, "  ", 2)
+				if len(parts) != 2 {
+					t.Errorf("GetService.Get() SHA256SUMS line %q is not in the sha256sum format", l)
+					continue
+				}
+				if err := verifyFileDigest(path.Join(dir, parts[1]), parts[0]); err != nil {
+					t.Errorf("GetService.Get() SHA256SUMS line %q: %s", l, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// UsernameEnvVar is the environment variable read for the repository username
+	UsernameEnvVar = "HELM_MIRROR_USERNAME"
+	// PasswordEnvVar is the environment variable read for the repository password
+	PasswordEnvVar = "HELM_MIRROR_PASSWORD"
+)
+
+// applyEnvCredentials fills the repository credentials from the environment
+// when they are not set in the repository entry.
+func (g *GetService) applyEnvCredentials() {
+	applied := false
+	if u := os.Getenv(UsernameEnvVar); u != "" && g.config.Username == "" {
+		g.config.Username = u
+		applied = true
+	}
+	if p := os.Getenv(PasswordEnvVar); p != "" && g.config.Password == "" {
+		g.config.Password = p
+		applied = true
+	}
+	if applied && g.verbose {
+		g.log().Printf("using repository credentials from %s and %s for user %q", UsernameEnvVar, PasswordEnvVar, g.config.Username)
+	}
+}
+
+// registryConfig is the part of a Docker or Helm registry config file (eg:
+// ~/.config/helm/registry/config.json) with the credentials by registry
+type registryConfig struct {
+	Auths map[string]registryAuth `json:"auths"`
+}
+
+// registryAuth are the credentials of a registry in a registryConfig, either
+// as a base64 encoded user:password auth or as a username and a password
+type registryAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loadRegistryConfig reads the registry config file name
+func loadRegistryConfig(name string) (*registryConfig, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &registryConfig{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %s", name, err)
+	}
+	return c, nil
+}
+
+// credentials returns the username and password of host, the registries of
+// the config file are either host names or URLs
+func (c *registryConfig) credentials(host string) (string, string, bool, error) {
+	for key, auth := range c.Auths {
+		if !strings.EqualFold(registryHost(key), host) {
+			continue
+		}
+		if auth.Auth == "" {
+			return auth.Username, auth.Password, true, nil
+		}
+		b, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", false, fmt.Errorf("invalid auth of %s: %s", key, err)
+		}
+		parts := strings.SplitN(string(b), ":", 2)
+		if len(parts) != 2 {
+			return "", "", false, fmt.Errorf("invalid auth of %s: expected user:password", key)
+		}
+		return parts[0], parts[1], true, nil
+	}
+	return "", "", false, nil
+}
+
+// registryHost returns the host of a registry of a config file
+func registryHost(key string) string {
+	if strings.Contains(key, "://") {
+		if u, err := url.Parse(key); err == nil {
+			return u.Host
+		}
+	}
+	return strings.SplitN(key, "/", 2)[0]
+}
+
+// applyFileCredentials fills the repository credentials, and the ones of the
+// OCI registry, from the credentials file by host when they are not set yet.
+func (g *GetService) applyFileCredentials() error {
+	if g.credentialsFile == "" {
+		return nil
+	}
+	c, err := loadRegistryConfig(g.credentialsFile)
+	if err != nil {
+		return err
+	}
+	if g.config.Username == "" && g.config.Password == "" {
+		u, err := url.Parse(g.config.URL)
+		if err != nil {
+			return err
+		}
+		username, password, ok, err := c.credentials(u.Host)
+		if err != nil {
+			return err
+		}
+		if ok {
+			g.config.Username, g.config.Password = username, password
+			if g.verbose {
+				g.log().Printf("using repository credentials from %s for user %q", g.credentialsFile, username)
+			}
+		}
+	}
+	if g.registry != nil && g.registry.username == "" && g.registry.password == "" {
+		username, password, ok, err := c.credentials(g.registry.host)
+		if err != nil {
+			return err
+		}
+		if ok {
+			g.registry.username, g.registry.password = username, password
+			if g.verbose {
+				g.log().Printf("using registry credentials from %s for user %q", g.credentialsFile, username)
+			}
+		}
+	}
+	return nil
+}
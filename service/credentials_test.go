@@ -0,0 +1,89 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_applyEnvCredentials(t *testing.T) {
+	defer os.Unsetenv(UsernameEnvVar)
+	defer os.Unsetenv(PasswordEnvVar)
+	tests := []struct {
+		name         string
+		config       repo.Entry
+		envUsername  string
+		envPassword  string
+		wantUsername string
+		wantPassword string
+	}{
+		{"1", repo.Entry{}, "", "", "", ""},
+		{"2", repo.Entry{}, "user", "pass", "user", "pass"},
+		{"3", repo.Entry{Username: "admin", Password: "secret"}, "user", "pass", "admin", "secret"},
+		{"4", repo.Entry{Username: "admin"}, "", "pass", "admin", "pass"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(UsernameEnvVar, tt.envUsername)
+			os.Setenv(PasswordEnvVar, tt.envPassword)
+			g := &GetService{config: tt.config, logger: fakeLogger, verbose: true}
+			g.applyEnvCredentials()
+			if g.config.Username != tt.wantUsername || g.config.Password != tt.wantPassword {
+				t.Errorf("applyEnvCredentials() = %q/%q, want %q/%q", g.config.Username, g.config.Password, tt.wantUsername, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestGetService_applyFileCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// the auth of charts.local is user:pass
+	config := `{"auths": {"https://charts.local/v1/": {"auth": "dXNlcjpwYXNz"}, "registry.local": {"username": "robot", "password": "token"}, "broken.local": {"auth": "dXNlcg=="}}}`
+	name := path.Join(dir, "config.json")
+	ioutil.WriteFile(name, []byte(config), 0600)
+	invalid := path.Join(dir, "invalid.json")
+	ioutil.WriteFile(invalid, []byte("{"), 0600)
+	tests := []struct {
+		name         string
+		file         string
+		config       repo.Entry
+		registry     string
+		wantUsername string
+		wantPassword string
+		wantRegistry string
+		wantErr      bool
+	}{
+		{"1", "", repo.Entry{URL: "https://charts.local/stable"}, "", "", "", "", false},
+		{"2", name, repo.Entry{URL: "https://charts.local/stable"}, "", "user", "pass", "", false},
+		{"3", name, repo.Entry{URL: "https://CHARTS.local/stable", Username: "admin"}, "", "admin", "", "", false},
+		{"4", name, repo.Entry{URL: "https://other.local/stable"}, "", "", "", "", false},
+		{"5", name, repo.Entry{URL: "https://charts.local/stable"}, "oci://registry.local/charts", "user", "pass", "robot", false},
+		{"6", name, repo.Entry{URL: "https://broken.local/stable"}, "", "", "", "", true},
+		{"7", invalid, repo.Entry{URL: "https://charts.local/stable"}, "", "", "", "", true},
+		{"8", path.Join(dir, "missing.json"), repo.Entry{URL: "https://charts.local/stable"}, "", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GetService{config: tt.config, logger: fakeLogger, verbose: true, credentialsFile: tt.file}
+			if tt.registry != "" {
+				g.registry, _ = newOCIPusher(tt.registry, "", "", false)
+			}
+			if err := g.applyFileCredentials(); (err != nil) != tt.wantErr {
+				t.Fatalf("applyFileCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if g.config.Username != tt.wantUsername || g.config.Password != tt.wantPassword {
+				t.Errorf("applyFileCredentials() = %q/%q, want %q/%q", g.config.Username, g.config.Password, tt.wantUsername, tt.wantPassword)
+			}
+			if g.registry != nil && g.registry.username != tt.wantRegistry {
+				t.Errorf("applyFileCredentials() registry username = %q, want %q", g.registry.username, tt.wantRegistry)
+			}
+		})
+	}
+}
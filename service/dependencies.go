@@ -0,0 +1,279 @@
+package service
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/cmd/helm/search"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/repo"
+	"k8s.io/helm/pkg/urlutil"
+)
+
+// dependencyRepo is a chart repository that dependencies are downloaded from
+type dependencyRepo struct {
+	chartRepo *repo.ChartRepository
+	index     *repo.IndexFile
+	main      bool
+	err       error
+}
+
+// downloadDependencies downloads the charts that the mirrored charts depend
+// on, then the ones those depend on in turn. The dependencies from other
+// repositories are written under the path of their URL and returned with a
+// URL relative to the destination folder, so they can be added to the index
+// file.
+func (g *GetService) downloadDependencies(ctx context.Context, chartRepo *repo.ChartRepository, charts []*search.Result) ([]*repo.ChartVersion, error) {
+	seen := map[string]bool{}
+	for _, r := range charts {
+		seen[chartFileName(r.Chart.Name, r.Chart.Version)] = true
+	}
+	repos := map[string]*dependencyRepo{}
+	var external []*repo.ChartVersion
+	for len(charts) > 0 {
+		batches := map[string][]*search.Result{}
+		var order []string
+		for _, r := range charts {
+			chartPath := g.writtenChart(r)
+			if chartPath == "" {
+				continue
+			}
+			deps, err := readDependencies(chartPath)
+			if err != nil {
+				if !g.ignoreErrors {
+					return external, err
+				}
+				g.log().Printf("WARNING: reading dependencies of chart %s(%s) - %s", r.Chart.Name, r.Chart.Version, err)
+				g.reportError(r.Chart.Name, r.Chart.Version, "", err)
+				continue
+			}
+			for _, d := range deps {
+				repoURL, ok := g.dependencyRepoURL(r, d)
+				if !ok {
+					continue
+				}
+				dr := g.dependencyRepo(ctx, repos, chartRepo, repoURL)
+				cv, skipped, err := dr.resolve(repoURL, d, g.blockedVersion)
+				for _, b := range skipped {
+					if !seen[chartFileName(b.Name, b.Version)] {
+						seen[chartFileName(b.Name, b.Version)] = true
+						g.log().Printf("skipped dependency %s(%s) of chart %s(%s), it is in the blocklist", b.Name, b.Version, r.Chart.Name, r.Chart.Version)
+						g.summary.addBlocked(1)
+					}
+				}
+				if err != nil && len(skipped) > 0 {
+					// every version matching the dependency is blocked
+					continue
+				}
+				if err != nil {
+					err = fmt.Errorf("dependency %s(%s) of chart %s(%s): %s", d.Name, d.Version, r.Chart.Name, r.Chart.Version, err)
+					if !g.ignoreErrors {
+						return external, err
+					}
+					g.log().Printf("WARNING: %s", err)
+					g.reportError(d.Name, d.Version, repoURL, err)
+					g.addResult(d.Name, d.Version, StatusFailed, err)
+					continue
+				}
+				if seen[chartFileName(cv.Name, cv.Version)] {
+					continue
+				}
+				seen[chartFileName(cv.Name, cv.Version)] = true
+				if g.verbose {
+					g.log().Printf("chart %s(%s) depends on %s(%s) from %s", r.Chart.Name, r.Chart.Version, cv.Name, cv.Version, repoURL)
+				}
+				if _, ok := batches[repoURL]; !ok {
+					order = append(order, repoURL)
+				}
+				batches[repoURL] = append(batches[repoURL], &search.Result{Name: cv.Name, Chart: cv})
+			}
+		}
+
+		charts = nil
+		for _, repoURL := range order {
+			dr := repos[repoURL]
+			if err := g.downloadCharts(ctx, dr.chartRepo, batches[repoURL]); err != nil {
+				return external, err
+			}
+			if !dr.main {
+				for _, r := range batches[repoURL] {
+					if e := g.externalEntry(r); e != nil {
+						external = append(external, e)
+					}
+				}
+			}
+			charts = append(charts, batches[repoURL]...)
+		}
+	}
+	return external, nil
+}
+
+// dependencyRepoURL returns the URL of the repository of the dependency d of
+// r. Bundled dependencies and the ones that cannot be resolved are skipped.
+func (g *GetService) dependencyRepoURL(r *search.Result, d *chartutil.Dependency) (string, bool) {
+	if d.Repository == "" || strings.HasPrefix(d.Repository, "file://") {
+		// bundled with the chart
+		return "", false
+	}
+	u, err := url.Parse(d.Repository)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		g.log().Printf("WARNING: dependency %s of chart %s(%s) uses the repository %s, only http and https repositories are supported", d.Name, r.Chart.Name, r.Chart.Version, d.Repository)
+		return "", false
+	}
+	return strings.TrimSuffix(d.Repository, "/"), true
+}
+
+// dependencyRepo returns the repository at repoURL, downloading its index
+// file the first time. The mirrored repository is reused.
+func (g *GetService) dependencyRepo(ctx context.Context, repos map[string]*dependencyRepo, chartRepo *repo.ChartRepository, repoURL string) *dependencyRepo {
+	if dr, ok := repos[repoURL]; ok {
+		return dr
+	}
+	dr := &dependencyRepo{}
+	repos[repoURL] = dr
+	if repoURL == strings.TrimSuffix(g.config.URL, "/") {
+		dr.chartRepo, dr.index, dr.main = chartRepo, chartRepo.IndexFile, true
+		return dr
+	}
+	// the credentials of the mirrored repository are not sent to other ones
+	dr.chartRepo, dr.err = repo.NewChartRepository(&repo.Entry{Name: g.config.Name, URL: repoURL}, g.providers("", ""))
+	if dr.err != nil {
+		return dr
+	}
+	b, err := g.fetch(ctx, dr.chartRepo.Client, repoURL+"/"+indexFileName)
+	if err != nil {
+		dr.err = err
+		return dr
+	}
+	dr.index = repo.NewIndexFile()
+	if dr.err = yaml.Unmarshal(b.Bytes(), dr.index); dr.err != nil {
+		return dr
+	}
+	dr.index.SortEntries()
+	return dr
+}
+
+// resolve returns the newest chart version of the repository matching the
+// dependency d that is not blocked, with absolute URLs. The versions matching
+// d that are blocked are returned too, even when no version is left.
+func (dr *dependencyRepo) resolve(repoURL string, d *chartutil.Dependency, blocked func(*repo.ChartVersion) bool) (*repo.ChartVersion, []*repo.ChartVersion, error) {
+	if dr.err != nil {
+		return nil, nil, dr.err
+	}
+	index := dr.index
+	var skipped []*repo.ChartVersion
+	cv, err := index.Get(d.Name, d.Version)
+	for err == nil && blocked(cv) {
+		skipped = append(skipped, cv)
+		// search again without the blocked version
+		left := repo.ChartVersions{}
+		for _, v := range index.Entries[d.Name] {
+			if v != cv {
+				left = append(left, v)
+			}
+		}
+		index = &repo.IndexFile{Entries: map[string]repo.ChartVersions{d.Name: left}}
+		cv, err = index.Get(d.Name, d.Version)
+	}
+	if err != nil {
+		return nil, skipped, err
+	}
+	resolved := *cv
+	resolved.URLs = make([]string, len(cv.URLs))
+	for i, u := range cv.URLs {
+		resolved.URLs[i] = u
+		if parsed, err := url.Parse(u); err == nil && !parsed.IsAbs() {
+			if joined, err := urlutil.URLJoin(repoURL, u); err == nil {
+				resolved.URLs[i] = joined
+			}
+		}
+	}
+	return &resolved, skipped, nil
+}
+
+// writtenChart returns the path of the file written for r, or an empty
+// string when none of its URLs was downloaded
+func (g *GetService) writtenChart(r *search.Result) string {
+	for _, u := range r.Chart.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		chartPath, err := g.chartPath(r, parsed)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(chartPath); err == nil {
+			return chartPath
+		}
+	}
+	return ""
+}
+
+// externalEntry returns the index file entry of the dependency r downloaded
+// from another repository, or nil when it was not downloaded
+func (g *GetService) externalEntry(r *search.Result) *repo.ChartVersion {
+	chartPath := g.writtenChart(r)
+	if chartPath == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(g.dir(), chartPath)
+	if err != nil {
+		return nil
+	}
+	entry := *r.Chart
+	entry.URLs = []string{filepath.ToSlash(rel)}
+	return &entry
+}
+
+// readDependencies returns the dependencies declared by the chart archive in
+// its requirements.yaml or, for apiVersion v2 charts, its Chart.yaml
+func readDependencies(name string) ([]*chartutil.Dependency, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var deps []*chartutil.Dependency
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return deps, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// only the files of the chart itself, not the ones of its subcharts
+		parts := strings.Split(strings.TrimPrefix(h.Name, "./"), "/")
+		if len(parts) != 2 || (parts[1] != "requirements.yaml" && parts[1] != "Chart.yaml") {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		var requirements struct {
+			Dependencies []*chartutil.Dependency `json:"dependencies"`
+		}
+		if err := yaml.Unmarshal(b, &requirements); err != nil {
+			return nil, fmt.Errorf("%s: %s", h.Name, err)
+		}
+		deps = append(deps, requirements.Dependencies...)
+	}
+}
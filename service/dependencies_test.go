@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/protobuf/ptypes/any"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+// packageChart returns the archive of a chart with the given requirements
+func packageChart(t *testing.T, dir string, name string, version string, requirements string) []byte {
+	c := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: name, Version: version}}
+	if requirements != "" {
+		c.Files = []*any.Any{{TypeUrl: "requirements.yaml", Value: []byte(requirements)}}
+	}
+	archive, err := chartutil.Save(c, dir)
+	if err != nil {
+		t.Fatalf("saving chart: %s", err)
+	}
+	b, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("reading chart: %s", err)
+	}
+	return b
+}
+
+func TestGetService_GetDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string][]byte{}
+	indexes := map[string]*repo.IndexFile{"/main": repo.NewIndexFile(), "/other": repo.NewIndexFile()}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if folder, name := path.Split(r.URL.Path); name == indexFileName {
+			b, _ := yaml.Marshal(indexes[strings.TrimSuffix(folder, "/")])
+			w.Write(b)
+			return
+		}
+		if b, ok := files[r.URL.Path]; ok {
+			w.Write(b)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer svr.Close()
+	charts := []struct {
+		repo, name, version, requirements string
+		relative                          bool
+	}{
+		{"/main", "umbrella", "1.0.0", `dependencies:
+- name: lib
+  version: ^1.0.0
+  repository: ` + svr.URL + `/main
+- name: dep1
+  version: ~1.0.0
+  repository: ` + svr.URL + `/other/
+- name: local
+  repository: file://../local
+- name: aliased
+  repository: "@stable"
+`, false},
+		{"/main", "lib", "1.0.0", "", false},
+		{"/other", "dep1", "1.0.0", "", false},
+		{"/other", "dep1", "1.0.5", `dependencies:
+- name: dep2
+  repository: ` + svr.URL + `/other
+`, false},
+		{"/other", "dep1", "2.0.0", "", false},
+		{"/other", "dep2", "0.1.0", "", true},
+	}
+	for _, c := range charts {
+		b := packageChart(t, dir, c.name, c.version, c.requirements)
+		name := chartFileName(c.name, c.version)
+		files[c.repo+"/"+name] = b
+		baseURL := svr.URL + c.repo
+		if c.relative {
+			baseURL = ""
+		}
+		indexes[c.repo].Add(&chart.Metadata{ApiVersion: "v1", Name: c.name, Version: c.version}, name, baseURL, digest(b))
+	}
+
+	tests := []struct {
+		name        string
+		resolve     bool
+		blocklist   []string
+		wantCharts  []string
+		wantEntries []string
+		wantBlocked int
+	}{
+		{"1", false, nil, []string{"main/umbrella-1.0.0.tgz"}, []string{"lib", "umbrella"}, 0},
+		{"2", true, nil, []string{"main/lib-1.0.0.tgz", "main/umbrella-1.0.0.tgz", "other/dep1-1.0.5.tgz", "other/dep2-0.1.0.tgz"}, []string{"dep1", "dep2", "lib", "umbrella"}, 0},
+		{"3", true, []string{"dep1-1.0.5", "lib-1.0.0.tgz"}, []string{"main/umbrella-1.0.0.tgz", "other/dep1-1.0.0.tgz"}, []string{"dep1", "lib", "umbrella"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:              repo.Entry{Name: workDir, URL: svr.URL + "/main"},
+				logger:              fakeLogger,
+				chartName:           "umbrella",
+				newRootURL:          "http://mirror.local.lan",
+				resolveDependencies: tt.resolve,
+			}
+			if err := WithBlocklist(tt.blocklist)(g); err != nil {
+				t.Fatalf("WithBlocklist() error = %v", err)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			if blocked := g.Stats().Blocked; blocked != tt.wantBlocked {
+				t.Errorf("GetService.Stats().Blocked = %d, want %d", blocked, tt.wantBlocked)
+			}
+			var got []string
+			filepath.Walk(workDir, func(p string, info os.FileInfo, err error) error {
+				if err == nil && strings.HasSuffix(p, ".tgz") {
+					rel, _ := filepath.Rel(workDir, p)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if !reflect.DeepEqual(got, tt.wantCharts) {
+				t.Errorf("GetService.Get() charts = %v, want %v", got, tt.wantCharts)
+			}
+			indexFile, err := repo.LoadIndexFile(path.Join(workDir, indexFileName))
+			if err != nil {
+				t.Fatalf("loading index.yaml: %s", err)
+			}
+			var entries []string
+			for name := range indexFile.Entries {
+				entries = append(entries, name)
+			}
+			sort.Strings(entries)
+			if !reflect.DeepEqual(entries, tt.wantEntries) {
+				t.Errorf("GetService.Get() index entries = %v, want %v", entries, tt.wantEntries)
+			}
+			if tt.resolve && len(tt.blocklist) == 0 {
+				cv, err := indexFile.Get("dep2", "0.1.0")
+				if err != nil || cv.URLs[0] != "http://mirror.local.lan/other/dep2-0.1.0.tgz" {
+					t.Errorf("GetService.Get() dep2 entry = %v, %v", cv, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_readDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	requirements := "dependencies:\n- name: dep1\n  version: ^1.0.0\n  repository: https://charts.local.lan\n"
+	withSubchart := &chart.Chart{
+		Metadata:     &chart.Metadata{ApiVersion: "v1", Name: "parent", Version: "1.0.0"},
+		Dependencies: []*chart.Chart{{Metadata: &chart.Metadata{ApiVersion: "v1", Name: "sub", Version: "1.0.0"}, Files: []*any.Any{{TypeUrl: "requirements.yaml", Value: []byte(requirements)}}}},
+	}
+	subchartArchive, err := chartutil.Save(withSubchart, dir)
+	if err != nil {
+		t.Fatalf("saving chart: %s", err)
+	}
+	write := func(name string, b []byte) string {
+		p := path.Join(dir, name)
+		ioutil.WriteFile(p, b, 0644)
+		return p
+	}
+	tests := []struct {
+		name    string
+		file    string
+		want    []string
+		wantErr bool
+	}{
+		{"1", write("1.tgz", packageChart(t, dir, "chart", "1.0.0", requirements)), []string{"dep1"}, false},
+		{"2", write("2.tgz", packageChart(t, dir, "chart", "1.0.1", "")), nil, false},
+		{"3", subchartArchive, nil, false},
+		{"4", write("4.tgz", []byte("not a chart")), nil, true},
+		{"5", path.Join(dir, "missing.tgz"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deps, err := readDependencies(tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readDependencies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, d := range deps {
+				got = append(got, d.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readDependencies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// digest returns the hex encoded sha256 of content, as used by the index file
+func digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyDigest checks content against the digest declared in the index file
+func verifyDigest(content []byte, expected string) error {
+	return checkDigest(digest(content), expected)
+}
+
+// verifyFileDigest checks that the sha256 of the file content matches expected
+func verifyFileDigest(name string, expected string) error {
+	actual, err := fileDigest(name)
+	if err != nil {
+		return err
+	}
+	return checkDigest(actual, expected)
+}
+
+// checkDigest compares the hex encoded sha256 actual with the digest declared
+// in the index file
+func checkDigest(actual string, expected string) error {
+	if !strings.EqualFold(actual, strings.TrimPrefix(expected, "sha256:")) {
+		return fmt.Errorf("digest mismatch: got %s, expected %s", actual, expected)
+	}
+	return nil
+}
+
+// fileDigest returns the hex encoded sha256 of the file content
+func fileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// upToDate reports whether the file exists and matches the expected digest,
+// files without a known digest are never up to date.
+func upToDate(name string, expected string) bool {
+	if expected == "" {
+		return false
+	}
+	return verifyFileDigest(name, expected) == nil
+}
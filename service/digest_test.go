@@ -0,0 +1,91 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_verifyDigest(t *testing.T) {
+	// sha256 of "test"
+	sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		name     string
+		content  []byte
+		expected string
+		wantErr  bool
+	}{
+		{"1", []byte("test"), sum, false},
+		{"2", []byte("test"), "sha256:" + sum, false},
+		{"3", []byte("test"), "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08", false},
+		{"4", []byte("tset"), sum, true},
+		{"5", []byte("test"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyDigest(tt.content, tt.expected); (err != nil) != tt.wantErr {
+				t.Errorf("verifyDigest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_verifyFileDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "chart-1.0.0.tgz.partial")
+	ioutil.WriteFile(name, []byte("test"), 0644)
+	sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		name     string
+		file     string
+		expected string
+		wantErr  bool
+	}{
+		{"1", name, sum, false},
+		{"2", name, "sha256:" + sum, false},
+		{"3", name, "0c76ee9b4b78cb60fcce8c00ec0f5048cbe626fcaabe48f2f8e84b029e894f49", true},
+		{"4", path.Join(dir, "missing.tgz"), sum, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyFileDigest(tt.file, tt.expected); (err != nil) != tt.wantErr {
+				t.Errorf("verifyFileDigest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_upToDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "chart-1.0.0.tgz")
+	ioutil.WriteFile(name, []byte("test"), 0644)
+	sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		name     string
+		file     string
+		expected string
+		want     bool
+	}{
+		{"1", name, sum, true},
+		{"2", name, "sha256:" + sum, true},
+		{"3", name, "", false},
+		{"4", name, "0c76ee9b4b78cb60fcce8c00ec0f5048cbe626fcaabe48f2f8e84b029e894f49", false},
+		{"5", path.Join(dir, "missing.tgz"), sum, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upToDate(tt.file, tt.expected); got != tt.want {
+				t.Errorf("upToDate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+
+	"k8s.io/helm/cmd/helm/search"
+	"k8s.io/helm/pkg/getter"
+)
+
+// sizeGetter is implemented by getters that can tell the size of a download
+// without fetching it
+type sizeGetter interface {
+	Size(ctx context.Context, href string) (int64, error)
+}
+
+// reportDryRun logs the charts that would be downloaded and their estimated
+// total size, the size of each chart is asked to the server when the getter
+// supports it.
+func (g *GetService) reportDryRun(ctx context.Context, client getter.Getter, charts []*search.Result) error {
+	sizer, _ := client.(sizeGetter)
+	var total int64
+	unknown := 0
+	for _, r := range charts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(r.Chart.URLs) == 0 {
+			continue
+		}
+		// the other URLs are only fallbacks
+		u := r.Chart.URLs[0]
+		g.log().Printf("dry run: would download chart %s(%s) from %s", r.Name, r.Chart.Version, u)
+		size := int64(-1)
+		if sizer != nil {
+			s, err := sizer.Size(ctx, u)
+			if err != nil && g.verbose {
+				g.log().Printf("dry run: cannot get the size of %s - %s", u, err)
+			}
+			if err == nil {
+				size = s
+			}
+		}
+		if size < 0 {
+			unknown++
+			continue
+		}
+		total += size
+	}
+	if unknown > 0 {
+		g.log().Printf("dry run: %d charts would be downloaded, about %d bytes (size unknown for %d downloads)", len(charts), total, unknown)
+	} else {
+		g.log().Printf("dry run: %d charts would be downloaded, about %d bytes", len(charts), total)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_GetDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name        string
+		allVersions bool
+		want        []string
+	}{
+		{"1", false, []string{"would download chart", "dry run: 4 charts would be downloaded", "(size unknown for 1 downloads)"}},
+		{"2", true, []string{"chart2-0.0.0-rc1.tgz", "dry run: 5 charts would be downloaded"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			g := &GetService{
+				config:       repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+				logger:       log.New(out, "", 0),
+				ignoreErrors: true,
+				allVersions:  tt.allVersions,
+				dryRun:       true,
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(out.String(), w) {
+					t.Errorf("GetService.Get() output = %q, want %q", out.String(), w)
+				}
+			}
+			files, _ := ioutil.ReadDir(dir)
+			if len(files) != 0 {
+				t.Errorf("GetService.Get() wrote %v files in dry run mode", len(files))
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The errors of a mirror run can be told apart with errors.Is against these
+var (
+	// ErrIndexDownload is matched by the errors downloading the index file
+	ErrIndexDownload = errors.New("cannot download the index file")
+	// ErrChartDownload is matched by the errors mirroring a chart, they are a
+	// *ChartError
+	ErrChartDownload = errors.New("cannot download the chart")
+	// ErrWriteFailed is matched by the errors writing to the destination
+	// folder or the file system of the service
+	ErrWriteFailed = errors.New("cannot write the mirror")
+	// ErrAuth is matched by the errors of requests the repository rejected
+	// as unauthenticated or forbidden
+	ErrAuth = errors.New("authentication failed")
+	// ErrRunTimeout is matched by the error of a run aborted when it exceeded
+	// its overall timeout
+	ErrRunTimeout = errors.New("run exceeded timeout")
+)
+
+// ChartError is the error of a chart version that could not be mirrored from
+// any of its URLs, URL is the last one tried
+type ChartError struct {
+	Chart   string
+	Version string
+	URL     string
+	Err     error
+}
+
+func (e *ChartError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of the last URL
+func (e *ChartError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrChartDownload
+func (e *ChartError) Is(target error) bool {
+	return target == ErrChartDownload
+}
+
+// kindError is err matching the sentinel error kind
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// writeFailed returns err matching ErrWriteFailed, nil when err is nil
+func writeFailed(err error) error {
+	if err == nil || errors.Is(err, ErrWriteFailed) {
+		return err
+	}
+	return &kindError{kind: ErrWriteFailed, err: err}
+}
+
+// runTimedOut returns the error matching ErrRunTimeout of a run aborted after
+// timeout, with the number of charts it completed
+func runTimedOut(timeout time.Duration, completed int) error {
+	return &kindError{kind: ErrRunTimeout, err: fmt.Errorf("%s of %s, %d charts completed", ErrRunTimeout, timeout, completed)}
+}
+
+// indexDownloadFailed returns err matching ErrIndexDownload
+func indexDownloadFailed(err error) error {
+	return &kindError{kind: ErrIndexDownload, err: err}
+}
+
+// Is matches ErrAuth when the request was rejected as unauthenticated or
+// forbidden
+func (e *statusError) Is(target error) bool {
+	return target == ErrAuth && (e.statusCode == http.StatusUnauthorized || e.statusCode == http.StatusForbidden)
+}
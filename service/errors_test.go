@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_GetErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index []byte
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/private/"):
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/charts/"+indexFileName:
+			w.Write(index)
+		case strings.HasPrefix(r.URL.Path, "/charts/chart1"):
+			w.Write([]byte("chart"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	index = []byte(strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", svr.URL+"/charts/", -1))
+	tests := []struct {
+		name      string
+		repo      string
+		chartName string
+		fs        FileSystem
+		wantIs    []error
+		wantNotIs []error
+		wantChart string
+	}{
+		{"1", "/private", "", nil, []error{ErrIndexDownload, ErrAuth}, []error{ErrChartDownload, ErrWriteFailed}, ""},
+		{"2", "/missing", "", nil, []error{ErrIndexDownload}, []error{ErrAuth, ErrChartDownload}, ""},
+		{"3", "/charts", "chart2", nil, []error{ErrChartDownload}, []error{ErrIndexDownload, ErrAuth, ErrWriteFailed}, "chart2"},
+		{"4", "/charts", "chart1", failingFileSystem{op: "TempFile", match: "chart1"}, []error{ErrChartDownload, ErrWriteFailed, errDiskFull}, []error{ErrIndexDownload}, "chart1"},
+		{"5", "/charts", "chart1", failingFileSystem{op: "TempFile", match: downloadedFileName}, []error{ErrWriteFailed, errDiskFull}, []error{ErrIndexDownload, ErrChartDownload}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:     repo.Entry{Name: workDir, URL: svr.URL + tt.repo},
+				logger:     fakeLogger,
+				exactMatch: true,
+				chartName:  tt.chartName,
+				fs:         tt.fs,
+			}
+			err := g.Get(context.Background())
+			if err == nil {
+				t.Fatalf("GetService.Get() error = nil, want an error")
+			}
+			for _, target := range tt.wantIs {
+				if !errors.Is(err, target) {
+					t.Errorf("GetService.Get() error %v is not %v", err, target)
+				}
+			}
+			for _, target := range tt.wantNotIs {
+				if errors.Is(err, target) {
+					t.Errorf("GetService.Get() error %v is %v", err, target)
+				}
+			}
+			var chartErr *ChartError
+			if errors.As(err, &chartErr) != (tt.wantChart != "") {
+				t.Fatalf("GetService.Get() error %v is a ChartError = %v, want %v", err, chartErr != nil, tt.wantChart != "")
+			}
+			if chartErr != nil && (chartErr.Chart != tt.wantChart || chartErr.Version == "" || !strings.HasPrefix(chartErr.URL, svr.URL+"/charts/"+tt.wantChart)) {
+				t.Errorf("GetService.Get() ChartError = %+v, want chart %s", chartErr, tt.wantChart)
+			}
+		})
+	}
+}
+
+func TestMultiGetError_Is(t *testing.T) {
+	chartErr := &ChartError{Chart: "chart1", Version: "1.0.0", Err: errDiskFull}
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		want   bool
+	}{
+		{"1", MultiGetError{{Repo: "stable", Err: indexDownloadFailed(errDiskFull)}}, ErrIndexDownload, true},
+		{"2", MultiGetError{{Repo: "stable", Err: indexDownloadFailed(errDiskFull)}}, ErrChartDownload, false},
+		{"3", MultiGetError{{Repo: "stable", Err: errDiskFull}, {Repo: "incubator", Err: chartErr}}, ErrChartDownload, true},
+		{"4", SpecGetError{{Chart: "chart1", Err: chartErr}}, errDiskFull, true},
+		{"5", SpecGetError{{Chart: "chart1", Err: chartErr}}, ErrWriteFailed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errors.Is(tt.err, tt.target); got != tt.want {
+				t.Errorf("errors.Is(%v, %v) = %v, want %v", tt.err, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiGetError_As(t *testing.T) {
+	chartErr := &ChartError{Chart: "chart1", Version: "1.0.0", Err: errDiskFull}
+	tests := []struct {
+		name string
+		err  error
+		want *ChartError
+	}{
+		{"1", MultiGetError{{Repo: "stable", Err: errDiskFull}, {Repo: "incubator", Err: chartErr}}, chartErr},
+		{"2", MultiGetError{{Repo: "stable", Err: indexDownloadFailed(errDiskFull)}}, nil},
+		{"3", SpecGetError{{Chart: "chart1", Err: writeFailed(chartErr)}}, chartErr},
+		{"4", SpecGetError{{Chart: "chart1", Err: errNoChartVersion}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *ChartError
+			if ok := errors.As(tt.err, &got); ok != (tt.want != nil) || got != tt.want {
+				t.Errorf("errors.As(%v) = %v, %v, want %v", tt.err, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+// the error of the first repository or folder that fails is matched when
+// errors are not ignored
+func TestGetErrorsFailFast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index []byte
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/private/"):
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/charts/"+indexFileName:
+			w.Write(index)
+		case strings.HasPrefix(r.URL.Path, "/charts/chart1"):
+			w.Write([]byte("chart"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	index = []byte(strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", svr.URL+"/charts/", -1))
+	multi := func(repos ...MirrorRepo) func(string) error {
+		return func(workDir string) error {
+			m, err := NewMultiGetService(workDir, repos, false, false, fakeLogger)
+			if err != nil {
+				return err
+			}
+			return m.Get(context.Background())
+		}
+	}
+	spec := func(specs ...ChartSpec) func(string) error {
+		return func(workDir string) error {
+			s, err := NewSpecGetService(repo.Entry{Name: workDir, URL: svr.URL + "/charts"}, specs, false, false, fakeLogger, "")
+			if err != nil {
+				return err
+			}
+			return s.Get(context.Background())
+		}
+	}
+	tests := []struct {
+		name      string
+		get       func(workDir string) error
+		wantIs    []error
+		wantNotIs []error
+		wantChart string
+	}{
+		{"1", multi(MirrorRepo{Entry: repo.Entry{Name: "private", URL: svr.URL + "/private"}}), []error{ErrIndexDownload, ErrAuth}, []error{ErrChartDownload}, ""},
+		{"2", multi(MirrorRepo{Entry: repo.Entry{Name: "charts", URL: svr.URL + "/charts"}, ChartName: "chart2"}), []error{ErrChartDownload}, []error{ErrIndexDownload, ErrAuth}, "chart2"},
+		{"3", multi(MirrorRepo{Entry: repo.Entry{Name: "charts", URL: svr.URL + "/charts"}, ChartName: "chart1", Options: []GetOption{WithFileSystem(failingFileSystem{op: "TempFile", match: "chart1"})}}), []error{ErrChartDownload, ErrWriteFailed, errDiskFull}, []error{ErrIndexDownload}, "chart1"},
+		{"4", spec(ChartSpec{Name: "chart1"}, ChartSpec{Name: "chart2", Version: "1.0.1", Dir: "two"}), []error{ErrChartDownload}, []error{ErrIndexDownload, ErrAuth}, "chart2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			err := tt.get(workDir)
+			if err == nil {
+				t.Fatalf("Get() error = nil, want an error")
+			}
+			for _, target := range tt.wantIs {
+				if !errors.Is(err, target) {
+					t.Errorf("Get() error %v is not %v", err, target)
+				}
+			}
+			for _, target := range tt.wantNotIs {
+				if errors.Is(err, target) {
+					t.Errorf("Get() error %v is %v", err, target)
+				}
+			}
+			var chartErr *ChartError
+			if errors.As(err, &chartErr) != (tt.wantChart != "") || chartErr != nil && chartErr.Chart != tt.wantChart {
+				t.Errorf("Get() error %v is a ChartError %+v, want chart %q", err, chartErr, tt.wantChart)
+			}
+		})
+	}
+}
+
+func TestGetService_GetOverallTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + indexFileName:
+			w.Write([]byte(index))
+		case "/chart1-1.0.0.tgz":
+			w.Write([]byte("chart1"))
+		case "/slow/chart2-1.0.0.tgz":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			w.Write([]byte("chart2"))
+		}
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name          string
+		chart2        string
+		timeout       time.Duration
+		parentTimeout time.Duration
+		wantErr       bool
+		wantTimeout   bool
+	}{
+		{"1", "/slow/chart2-1.0.0.tgz", 300 * time.Millisecond, 0, true, true},
+		{"2", "/slow/chart2-1.0.0.tgz", 0, 300 * time.Millisecond, true, false},
+		{"3", "/slow/chart2-1.0.0.tgz", 10 * time.Second, 300 * time.Millisecond, true, false},
+		{"4", "/chart2-1.0.0.tgz", 10 * time.Second, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index = "apiVersion: v1\nentries:\n" +
+				"  chart1:\n  - name: chart1\n    version: 1.0.0\n    urls:\n    - " + svr.URL + "/chart1-1.0.0.tgz\n" +
+				"  chart2:\n  - name: chart2\n    version: 1.0.0\n    urls:\n    - " + svr.URL + tt.chart2 + "\n"
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			var completionErr error
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, true, false, false, fakeLogger, "", "", "",
+				WithConcurrency(1), WithOverallTimeout(tt.timeout), WithCompletion(func(stats *GetStats, err error) { completionErr = err }))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			ctx := context.Background()
+			if tt.parentTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.parentTimeout)
+				defer cancel()
+			}
+			err = g.Get(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrRunTimeout) != tt.wantTimeout {
+				t.Errorf("GetService.Get() error = %v, want ErrRunTimeout %v", err, tt.wantTimeout)
+			}
+			if tt.wantTimeout && !strings.Contains(err.Error(), "1 charts completed") {
+				t.Errorf("GetService.Get() error = %v, want the number of charts completed", err)
+			}
+			if completionErr != err {
+				t.Errorf("GetService.Get() completion error = %v, want %v", completionErr, err)
+			}
+		})
+	}
+}
+
+func TestGetService_GetOverallTimeoutIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name        string
+		conditional bool
+	}{
+		{"1", false},
+		{"2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, true, false, false, fakeLogger, "", "", "",
+				WithOverallTimeout(300*time.Millisecond), WithConditionalIndex(tt.conditional))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			start := time.Now()
+			err = g.Get(context.Background())
+			if err == nil {
+				t.Fatalf("GetService.Get() error = nil, want an error")
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("GetService.Get() took %s, want the index download aborted by the overall timeout", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"k8s.io/helm/pkg/getter"
+)
+
+const (
+	// DefaultRetryBaseDelay is the delay before the first retry when no delay is set
+	DefaultRetryBaseDelay = time.Second
+	// DefaultDownloadTimeout is the deadline of each download when no timeout is set
+	DefaultDownloadTimeout = 5 * time.Minute
+)
+
+// contextGetter is implemented by getters that can abort a request when its
+// context is done
+type contextGetter interface {
+	GetContext(ctx context.Context, href string) (*bytes.Buffer, error)
+}
+
+// streamGetter is implemented by getters that can hand out the body of a
+// download as it arrives and resume it from an offset
+type streamGetter interface {
+	Open(ctx context.Context, href string, offset int64) (io.ReadCloser, bool, error)
+}
+
+// fetch downloads u with client, retrying transient failures with an
+// exponential backoff up to maxRetries times.
+func (g *GetService) fetch(ctx context.Context, client getter.Getter, u string) (*bytes.Buffer, error) {
+	var b *bytes.Buffer
+	err := g.retry(ctx, u, func() error {
+		var err error
+		b, err = g.getWithTimeout(ctx, client, u)
+		return err
+	})
+	return b, err
+}
+
+// fetchToFile downloads u into name with client, retrying transient failures
+// like fetch. The content already in name is resumed when the server supports
+// byte ranges, and name is kept on failure so a later attempt can resume it.
+// The body is copied to name as it arrives, so memory stays bounded whatever
+// the size of the chart. It returns the size of name and its hex encoded
+// sha256.
+func (g *GetService) fetchToFile(ctx context.Context, client streamGetter, u string, name string) (int64, string, error) {
+	var size int64
+	var sum string
+	err := g.retry(ctx, u, func() error {
+		var err error
+		size, sum, err = g.streamWithTimeout(ctx, client, u, name)
+		return err
+	})
+	return size, sum, err
+}
+
+// retry calls download until it succeeds, fails with an error that is not
+// transient or was retried maxRetries times.
+func (g *GetService) retry(ctx context.Context, u string, download func() error) error {
+	return g.retryTimes(ctx, u, g.maxRetries, download)
+}
+
+// retryTimes calls download until it succeeds, fails with an error that is
+// not transient or was retried maxRetries times. It waits as long as the
+// server asked with a Retry-After header, up to the download timeout so that
+// a server cannot hold a worker for hours, otherwise for a random delay up to
+// an exponential backoff so that concurrent workers do not retry all at once.
+func (g *GetService) retryTimes(ctx context.Context, u string, maxRetries int, download func() error) error {
+	backoff := g.retryBaseDelay
+	if backoff <= 0 {
+		backoff = DefaultRetryBaseDelay
+	}
+	for attempt := 1; ; attempt++ {
+		err := download()
+		if err == nil || attempt > maxRetries || !isRetryable(err) {
+			return err
+		}
+		delay := jitter(backoff)
+		if e, ok := err.(*statusError); ok && e.retryAfter > 0 {
+			delay = e.retryAfter
+			if max := g.timeout(); delay > max {
+				delay = max
+			}
+		}
+		g.log().Printf("WARNING: downloading %s failed, retry %d/%d in %s - %s", u, attempt, maxRetries, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// jitter returns a random delay between 0 and max, the full jitter of an
+// exponential backoff
+var jitter = func(max time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// parseRetryAfter returns the delay asked by the Retry-After header value h,
+// in seconds or as an HTTP date, or 0 when there is none
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	if seconds, err := strconv.ParseInt(h, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	t, err := http.ParseTime(h)
+	if err != nil || t.Before(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
+
+// timeout returns the deadline of each download
+func (g *GetService) timeout() time.Duration {
+	if g.downloadTimeout <= 0 {
+		return DefaultDownloadTimeout
+	}
+	return g.downloadTimeout
+}
+
+// getWithTimeout downloads u, giving up after the download timeout. Getters
+// that don't support a context are left running in the background.
+func (g *GetService) getWithTimeout(ctx context.Context, client getter.Getter, u string) (*bytes.Buffer, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout())
+	defer cancel()
+	if c, ok := client.(contextGetter); ok {
+		return c.GetContext(ctx, u)
+	}
+
+	type result struct {
+		b   *bytes.Buffer
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, err := client.Get(u)
+		done <- result{b, err}
+	}()
+	select {
+	case r := <-done:
+		return r.b, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// streamWithTimeout downloads u into name, appending to its content when the
+// server resumes from there and replacing it otherwise, giving up after the
+// download timeout. The sha256 is computed while the body is written.
+func (g *GetService) streamWithTimeout(ctx context.Context, client streamGetter, u string, name string) (int64, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout())
+	defer cancel()
+	var offset int64
+	if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+		offset = fi.Size()
+	}
+	body, resumed, err := client.Open(ctx, u, offset)
+	if err != nil {
+		return 0, "", err
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resumed {
+		if g.verbose {
+			g.log().Printf("resuming %s from byte %d", u, offset)
+		}
+		flag = os.O_RDWR
+	} else {
+		offset = 0
+	}
+	if err := os.MkdirAll(path.Dir(name), dirMode(g.mode())); err != nil {
+		return 0, "", writeFailed(err)
+	}
+	f, err := os.OpenFile(name, flag, g.mode())
+	if err != nil {
+		return 0, "", writeFailed(err)
+	}
+	defer f.Close()
+	if resumed {
+		// the content already there is part of the digest
+		if _, err := io.CopyN(h, f, offset); err != nil {
+			return 0, "", err
+		}
+	}
+	n, err := io.Copy(io.MultiWriter(f, h), body)
+	if err != nil {
+		return 0, "", err
+	}
+	if g.fsync {
+		if err := f.Sync(); err != nil {
+			return 0, "", writeFailed(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", writeFailed(err)
+	}
+	return offset + n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isRetryable reports whether err is a network error, a server error or a
+// rate limit that may go away on a new attempt, even when wrapped.
+func isRetryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.statusCode >= 500 || se.statusCode == http.StatusTooManyRequests
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
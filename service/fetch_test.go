@@ -0,0 +1,245 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/helm/pkg/getter"
+)
+
+type slowGetter struct {
+	delay time.Duration
+}
+
+func (s *slowGetter) Get(href string) (*bytes.Buffer, error) {
+	time.Sleep(s.delay)
+	return bytes.NewBufferString("chart"), nil
+}
+
+type mockGetter struct {
+	errs  []error
+	calls int
+}
+
+func (m *mockGetter) Get(href string) (*bytes.Buffer, error) {
+	m.calls++
+	if m.calls <= len(m.errs) {
+		return nil, m.errs[m.calls-1]
+	}
+	return bytes.NewBufferString("chart"), nil
+}
+
+func TestGetService_fetch(t *testing.T) {
+	unavailable := &statusError{url: "u", statusCode: http.StatusServiceUnavailable, status: "503 Service Unavailable"}
+	notFound := &statusError{url: "u", statusCode: http.StatusNotFound, status: "404 Not Found"}
+	netErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	tooMany := &statusError{url: "u", statusCode: http.StatusTooManyRequests, status: "429 Too Many Requests"}
+	tests := []struct {
+		name       string
+		maxRetries int
+		errs       []error
+		wantErr    bool
+		wantCalls  int
+	}{
+		{"1", 0, nil, false, 1},
+		{"2", 0, []error{unavailable}, true, 1},
+		{"3", 2, []error{unavailable}, false, 2},
+		{"4", 2, []error{unavailable, netErr, unavailable}, true, 3},
+		{"5", 3, []error{notFound}, true, 1},
+		{"6", 3, []error{io.ErrUnexpectedEOF, netErr}, false, 3},
+		{"7", 3, []error{errors.New("malformed")}, true, 1},
+		{"8", 1, []error{tooMany}, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GetService{logger: fakeLogger, maxRetries: tt.maxRetries, retryBaseDelay: time.Millisecond}
+			m := &mockGetter{errs: tt.errs}
+			if _, err := g.fetch(context.Background(), m, "u"); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if m.calls != tt.wantCalls {
+				t.Errorf("GetService.fetch() calls = %v, want %v", m.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestGetService_retryDelays(t *testing.T) {
+	defer func(j func(time.Duration) time.Duration) { jitter = j }(jitter)
+	var backoffs []time.Duration
+	jitter = func(max time.Duration) time.Duration {
+		backoffs = append(backoffs, max)
+		return 0
+	}
+	unavailable := &statusError{url: "u", statusCode: http.StatusServiceUnavailable, status: "503 Service Unavailable"}
+	limited := &statusError{url: "u", statusCode: http.StatusTooManyRequests, status: "429 Too Many Requests", retryAfter: 50 * time.Millisecond}
+	g := &GetService{logger: fakeLogger, maxRetries: 3, retryBaseDelay: time.Millisecond}
+	m := &mockGetter{errs: []error{unavailable, limited, unavailable}}
+	start := time.Now()
+	if _, err := g.fetch(context.Background(), m, "u"); err != nil {
+		t.Errorf("GetService.fetch() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("GetService.fetch() took %v, want at least the Retry-After delay", elapsed)
+	}
+	// the Retry-After delay replaces the backoff of the second retry
+	if want := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}; !reflect.DeepEqual(backoffs, want) {
+		t.Errorf("GetService.fetch() backoffs = %v, want %v", backoffs, want)
+	}
+}
+
+func TestGetService_retryAfterCapped(t *testing.T) {
+	limited := &statusError{url: "u", statusCode: http.StatusTooManyRequests, status: "429 Too Many Requests", retryAfter: time.Hour}
+	g := &GetService{logger: fakeLogger, maxRetries: 1, downloadTimeout: 50 * time.Millisecond}
+	m := &mockGetter{errs: []error{limited}}
+	start := time.Now()
+	if _, err := g.fetch(context.Background(), m, "u"); err != nil {
+		t.Errorf("GetService.fetch() error = %v", err)
+	}
+	// the Retry-After delay is bounded by the download timeout
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("GetService.fetch() took %v, want the download timeout", elapsed)
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		h    string
+		want time.Duration
+	}{
+		{"1", "", 0},
+		{"2", "120", 2 * time.Minute},
+		{"3", "-5", 0},
+		{"4", "Sat, 01 Jun 2019 12:00:30 GMT", 30 * time.Second},
+		{"5", "Sat, 01 Jun 2019 11:00:00 GMT", 0},
+		{"6", "soon", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.h, now); got != tt.want {
+				t.Errorf("parseRetryAfter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_getWithTimeout(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	client, _ := newHTTPGetter("", "", "", nil, nil, nil)(svr.URL, "", "", "")
+	tests := []struct {
+		name    string
+		client  getter.Getter
+		u       string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{"1", client, svr.URL + "/fast", 0, false},
+		{"2", client, svr.URL + "/slow", 20 * time.Millisecond, true},
+		{"3", client, svr.URL + "/slow", time.Second, false},
+		{"4", &slowGetter{200 * time.Millisecond}, "u", 20 * time.Millisecond, true},
+		{"5", &slowGetter{time.Millisecond}, "u", time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GetService{logger: fakeLogger, downloadTimeout: tt.timeout}
+			if _, err := g.getWithTimeout(context.Background(), tt.client, tt.u); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.getWithTimeout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetService_fetchToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	content := []byte("0123456789abcdef")
+	var mu sync.Mutex
+	var ranges []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		switch {
+		case r.URL.Path == "/full":
+			w.Write(content)
+		case r.URL.Path == "/cut" && r.Method == "GET" && r.Header.Get("Range") == "":
+			// the connection is closed in the middle of the body
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:8])
+		default:
+			http.ServeContent(w, r, "chart.tgz", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer svr.Close()
+	client, _ := newHTTPGetter("", "", "", nil, nil, nil)(svr.URL, "", "", "")
+	tests := []struct {
+		name       string
+		u          string
+		partial    string
+		maxRetries int
+		wantRanges []string
+	}{
+		{"1", "/full", "", 0, []string{""}},
+		{"2", "/ranges", "01234567", 0, []string{"bytes=8-"}},
+		{"3", "/full", "01234567", 0, []string{""}},
+		{"4", "/ranges", string(content) + "extra", 0, []string{"bytes=21-", ""}},
+		{"5", "/cut", "", 1, []string{"", "bytes=8-"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := path.Join(dir, tt.name, "chart.tgz.partial")
+			if tt.partial != "" {
+				os.MkdirAll(path.Dir(name), 0755)
+				ioutil.WriteFile(name, []byte(tt.partial), 0644)
+			}
+			mu.Lock()
+			ranges = nil
+			mu.Unlock()
+			g := &GetService{logger: fakeLogger, maxRetries: tt.maxRetries, retryBaseDelay: time.Millisecond}
+			size, sum, err := g.fetchToFile(context.Background(), client.(streamGetter), svr.URL+tt.u, name)
+			if err != nil {
+				t.Errorf("GetService.fetchToFile() error = %v", err)
+			}
+			if sum != digest(content) {
+				t.Errorf("GetService.fetchToFile() sum = %v, want %v", sum, digest(content))
+			}
+			if size != int64(len(content)) {
+				t.Errorf("GetService.fetchToFile() size = %v, want %v", size, len(content))
+			}
+			if got, _ := ioutil.ReadFile(name); !bytes.Equal(got, content) {
+				t.Errorf("GetService.fetchToFile() content = %q, want %q", got, content)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(ranges, tt.wantRanges) {
+				t.Errorf("GetService.fetchToFile() ranges = %q, want %q", ranges, tt.wantRanges)
+			}
+		})
+	}
+}
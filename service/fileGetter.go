@@ -0,0 +1,107 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/pkg/getter"
+	"k8s.io/helm/pkg/repo"
+)
+
+// fileGetter reads the files of a chart repository that is a local folder,
+// its URL being file:///path/to/folder. Relative chart URLs are resolved
+// against the folder and, when the folder has no index file, one is built
+// from the charts in it and in its first-level subfolders.
+type fileGetter struct {
+	base *url.URL
+}
+
+// newFileGetter is the getter.Constructor of the file:// getter
+func newFileGetter(repoURL, certFile, keyFile, caFile string) (getter.Getter, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &fileGetter{base: u}, nil
+}
+
+// Get returns the content of the file at href
+func (f *fileGetter) Get(href string) (*bytes.Buffer, error) {
+	name, err := f.path(href)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		if f.buildsIndex(name) {
+			return f.indexDirectory(filepath.Dir(name))
+		}
+		return nil, &statusError{url: href, statusCode: http.StatusNotFound, status: "404 Not Found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(b), nil
+}
+
+// Size returns the size of the file at href
+func (f *fileGetter) Size(ctx context.Context, href string) (int64, error) {
+	name, err := f.path(href)
+	if err != nil {
+		return -1, err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return -1, err
+	}
+	return info.Size(), nil
+}
+
+// path returns the local path of href
+func (f *fileGetter) path(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(f.base.ResolveReference(u).Path), nil
+}
+
+// buildsIndex tells if the missing file name is the index file of a folder
+// to build from its charts, a gzipped index file is used instead if any.
+func (f *fileGetter) buildsIndex(name string) bool {
+	if filepath.Base(name) != indexFileName {
+		return false
+	}
+	if _, err := os.Stat(name + gzSuffix); err == nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Dir(name))
+	return err == nil && info.IsDir()
+}
+
+// indexDirectory builds the index file of the charts in dir
+func (f *fileGetter) indexDirectory(dir string) (*bytes.Buffer, error) {
+	u := *f.base
+	u.Path = path.Clean(filepath.ToSlash(dir))
+	index, err := repo.IndexDirectory(dir, u.String())
+	if err != nil {
+		return nil, err
+	}
+	index.SortEntries()
+	b, err := yaml.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(b), nil
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_GetFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	source := path.Join(dir, "source")
+	os.MkdirAll(path.Join(source, "stable"), 0755)
+	for _, c := range []struct{ folder, name, version string }{
+		{"", "chart1", "2.11.0"},
+		{"", "chart1", "2.10.0"},
+		{"stable", "chart2", "1.0.1"},
+	} {
+		ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: c.name, Version: c.version}}
+		if _, err := chartutil.Save(ch, path.Join(source, c.folder)); err != nil {
+			t.Fatalf("Saving chart: %s", err)
+		}
+	}
+	withIndex := path.Join(dir, "withindex")
+	os.MkdirAll(withIndex, 0755)
+	ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart3", Version: "0.1.0"}}
+	if _, err := chartutil.Save(ch, withIndex); err != nil {
+		t.Fatalf("Saving chart: %s", err)
+	}
+	index := "apiVersion: v1\nentries:\n  chart3:\n  - name: chart3\n    version: 0.1.0\n    urls:\n    - chart3-0.1.0.tgz\n"
+	if err := ioutil.WriteFile(path.Join(withIndex, indexFileName), []byte(index), 0644); err != nil {
+		t.Fatalf("Writing index file: %s", err)
+	}
+	tests := []struct {
+		name        string
+		url         string
+		allVersions bool
+		want        []string
+		wantURLs    []string
+		wantErr     bool
+	}{
+		{"1", "file://" + source, false, []string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}, []string{"https://mirror.local.lan/charts/chart1-2.11.0.tgz", "https://mirror.local.lan/charts/chart2-1.0.1.tgz"}, false},
+		{"2", "file://" + source, true, []string{"chart1-2.10.0.tgz", "chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}, nil, false},
+		{"3", "file://" + withIndex, false, []string{"chart3-0.1.0.tgz"}, []string{"https://mirror.local.lan/charts/chart3-0.1.0.tgz"}, false},
+		{"4", "file://" + path.Join(dir, "missing"), false, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			config := repo.Entry{Name: workDir, URL: tt.url}
+			g, err := NewGetService(config, tt.allVersions, false, true, fakeLogger, "https://mirror.local.lan/charts", "", "", WithLayout(LayoutFlat))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			got := []string{}
+			for _, f := range files {
+				got = append(got, filepath.Base(f))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("GetService.Get() charts = %v, want %v", got, tt.want)
+			}
+			b, err := ioutil.ReadFile(path.Join(workDir, indexFileName))
+			if err != nil {
+				t.Fatalf("Reading index file: %s", err)
+			}
+			for _, u := range tt.wantURLs {
+				if !strings.Contains(string(b), u) {
+					t.Errorf("GetService.Get() index file has no %s:\n%s", u, b)
+				}
+			}
+			if strings.Contains(string(b), "file://") {
+				t.Errorf("GetService.Get() index file not rewritten:\n%s", b)
+			}
+		})
+	}
+}
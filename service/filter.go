@@ -0,0 +1,260 @@
+package service
+
+import (
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"k8s.io/helm/cmd/helm/search"
+	"k8s.io/helm/pkg/repo"
+)
+
+// keep reports whether the search result passes the chart filters of the
+// service. A chart must have all the keywords and annotations of the filters,
+// and one of the maintainers or sources of the filters.
+// An exact chart version takes precedence over the version constraint and
+// expressions.
+func (g *GetService) keep(r *search.Result) bool {
+	if len(g.specs) > 0 && !g.matchSpecs(r) {
+		return false
+	}
+	if !g.matchName(r.Chart.Name) {
+		return false
+	}
+	for _, k := range g.keywordFilter {
+		if !contains(r.Chart.Keywords, k) {
+			return false
+		}
+	}
+	for k, v := range g.annotationFilter {
+		if value, ok := r.Chart.Annotations[k]; !ok || value != v {
+			return false
+		}
+	}
+	if (g.maintainerFilter != "" || g.sourceURLPrefix != "") && !g.matchOrigin(r) {
+		return false
+	}
+	if g.appVersionConstraint != nil && !g.matchAppVersion(r) {
+		return false
+	}
+	if g.chartVersion != "" {
+		return r.Chart.Version == g.chartVersion
+	}
+	if g.versionConstraint != nil {
+		v, err := semver.NewVersion(r.Chart.Version)
+		if err != nil || !g.versionConstraint.Check(v) {
+			return false
+		}
+	}
+	if g.versionInclude != nil && !g.versionInclude.MatchString(r.Chart.Version) {
+		return false
+	}
+	if g.versionExclude != nil && g.versionExclude.MatchString(r.Chart.Version) {
+		return false
+	}
+	if !g.modifiedSince.IsZero() && !r.Chart.Created.IsZero() && !r.Chart.Created.After(g.modifiedSince) {
+		return false
+	}
+	if g.skipPrereleases {
+		v, err := semver.NewVersion(r.Chart.Version)
+		if err != nil {
+			if g.verbose {
+				g.log().Printf("chart %s(%s) is not a semver version, keeping it", r.Name, r.Chart.Version)
+			}
+			return true
+		}
+		return v.Prerelease() == ""
+	}
+	return true
+}
+
+// matchAppVersion reports whether the app version of the chart version of r
+// matches the app version constraint, an app version that is empty or not
+// semver never does
+func (g *GetService) matchAppVersion(r *search.Result) bool {
+	v, err := semver.NewVersion(r.Chart.AppVersion)
+	if err != nil {
+		if g.verbose {
+			g.log().Printf("chart %s(%s) app version %q is not a semver version, skipping it", r.Name, r.Chart.Version, r.Chart.AppVersion)
+		}
+		return false
+	}
+	return g.appVersionConstraint.Check(v)
+}
+
+// matchOrigin reports whether the chart version of r has a maintainer whose
+// name or email is the maintainer filter, ignoring case, or a source URL
+// starting with the source URL prefix. A maintainer filter starting with @
+// matches the emails of that domain, eg: @example.com.
+func (g *GetService) matchOrigin(r *search.Result) bool {
+	if f := g.maintainerFilter; f != "" {
+		for _, m := range r.Chart.Maintainers {
+			if strings.EqualFold(m.Name, f) || strings.EqualFold(m.Email, f) ||
+				strings.HasPrefix(f, "@") && strings.HasSuffix(strings.ToLower(m.Email), strings.ToLower(f)) {
+				return true
+			}
+		}
+	}
+	if g.sourceURLPrefix != "" {
+		for _, s := range r.Chart.Sources {
+			if strings.HasPrefix(s, g.sourceURLPrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blocked reports whether the chart version is in the blocklist
+func (g *GetService) blocked(r *search.Result) bool {
+	return g.blocklist[r.Chart.Name+"-"+r.Chart.Version]
+}
+
+// blockedVersion reports whether the chart version cv is in the blocklist
+func (g *GetService) blockedVersion(cv *repo.ChartVersion) bool {
+	return g.blocked(&search.Result{Chart: cv})
+}
+
+// blocklistKey returns the <name>-<version> of the blocklist entry e, which
+// can also be the file name of the chart
+func blocklistKey(e string) string {
+	return strings.TrimSuffix(strings.TrimSpace(e), ".tgz")
+}
+
+// newestOnly reports whether only the newest version of each chart is kept,
+// either because latest only was asked or because pre-releases are filtered
+// out or versions are blocked, as every version is then searched so that the
+// newest one that is left is still found when the newest of all is not.
+func (g *GetService) newestOnly() bool {
+	if g.latestOnly {
+		return true
+	}
+	return (g.skipPrereleases || len(g.blocklist) > 0) && !g.allVersions && g.chartVersion == "" && g.versionConstraint == nil &&
+		len(g.specs) == 0 && g.appVersionConstraint == nil && g.versionInclude == nil && g.versionExclude == nil
+}
+
+// newest returns the n newest versions of each chart of charts, the charts
+// come in order of first appearance and their versions in descending semver
+// order. Versions that are not semver are older than any other.
+func newest(charts []*search.Result, n int) []*search.Result {
+	groups := map[string][]*search.Result{}
+	names := []string{}
+	for _, r := range charts {
+		if _, ok := groups[r.Chart.Name]; !ok {
+			names = append(names, r.Chart.Name)
+		}
+		groups[r.Chart.Name] = append(groups[r.Chart.Name], r)
+	}
+	res := []*search.Result{}
+	for _, name := range names {
+		versions := groups[name]
+		sort.SliceStable(versions, func(i, j int) bool {
+			return newer(versions[i].Chart.Version, versions[j].Chart.Version)
+		})
+		if len(versions) > n {
+			versions = versions[:n]
+		}
+		res = append(res, versions...)
+	}
+	return res
+}
+
+// sortResults sorts the search results by chart name and then by version in
+// descending semver order, the search index returns them in map order
+func sortResults(charts []*search.Result) {
+	sort.SliceStable(charts, func(i, j int) bool {
+		if charts[i].Chart.Name != charts[j].Chart.Name {
+			return charts[i].Chart.Name < charts[j].Chart.Name
+		}
+		return newer(charts[i].Chart.Version, charts[j].Chart.Version)
+	})
+}
+
+// newer reports whether version is a greater semver version than than
+func newer(version string, than string) bool {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return false
+	}
+	t, err := semver.NewVersion(than)
+	if err != nil {
+		return true
+	}
+	return v.GreaterThan(t)
+}
+
+// allVersionsNeeded reports whether every version of the charts has to be
+// searched rather than only the latest one.
+func (g *GetService) allVersionsNeeded() bool {
+	return g.allVersions || g.latestOnly || g.chartVersion != "" || g.versionConstraint != nil ||
+		g.appVersionConstraint != nil || g.versionInclude != nil || g.versionExclude != nil || g.skipPrereleases ||
+		len(g.blocklist) > 0 || len(g.specs) > 0
+}
+
+// names returns the chart names to mirror, the single chart name is handled
+// as a list of one
+func (g *GetService) names() []string {
+	if g.chartName == "" {
+		return g.chartNames
+	}
+	return append([]string{g.chartName}, g.chartNames...)
+}
+
+// matchName reports whether the chart name is one of the chart names, or
+// contains one of them when names are not matched exactly, ignoring case
+// either way, and matches the name pattern
+func (g *GetService) matchName(name string) bool {
+	if names := g.names(); len(names) > 0 {
+		found := false
+		for _, n := range names {
+			if g.exactMatch && strings.EqualFold(name, n) ||
+				!g.exactMatch && strings.Contains(strings.ToLower(name), strings.ToLower(n)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return g.namePattern == nil || g.namePattern.MatchString(name)
+}
+
+// searchRegexp returns the expression used to search the index, the chart
+// name is a literal and the names are matched afterwards by keep
+func (g *GetService) searchRegexp() string {
+	if len(g.chartNames) > 0 {
+		return ".*"
+	}
+	return "(?i)^.*" + regexp.QuoteMeta(g.chartName)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readBlocklist reads the chart versions of the blocklist file name, one
+// <name>-<version> per line, the blank lines and the lines starting with #
+// are ignored
+func readBlocklist(name string) ([]string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, nil
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/cmd/helm/search"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func newResult(name string, version string) *search.Result {
+	return &search.Result{
+		Name:  "repo/" + name,
+		Chart: &repo.ChartVersion{Metadata: &chart.Metadata{Name: name, Version: version}},
+	}
+}
+
+// created sets the created timestamp of the chart version of r
+func created(r *search.Result, t time.Time) *search.Result {
+	r.Chart.Created = t
+	return r
+}
+
+// app sets the app version of the chart version of r
+func app(r *search.Result, appVersion string) *search.Result {
+	r.Chart.AppVersion = appVersion
+	return r
+}
+
+// tagged sets the keywords and annotations of the chart version of r
+func tagged(r *search.Result, keywords []string, annotations map[string]string) *search.Result {
+	r.Chart.Keywords = keywords
+	r.Chart.Annotations = annotations
+	return r
+}
+
+// maintained sets the maintainer emails and the sources of the chart version
+// of r, the maintainers are named after their emails
+func maintained(r *search.Result, emails []string, sources []string) *search.Result {
+	for _, e := range emails {
+		r.Chart.Maintainers = append(r.Chart.Maintainers, &chart.Maintainer{Name: strings.Split(e, "@")[0], Email: e})
+	}
+	r.Chart.Sources = sources
+	return r
+}
+
+func TestGetService_keep(t *testing.T) {
+	constraint, _ := semver.NewConstraint(">=1.2.0, <2.0.0")
+	prerelease := regexp.MustCompile(`-`)
+	stable := regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+	appConstraint, _ := semver.NewConstraint("~1.25.0")
+	since := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		g    *GetService
+		r    *search.Result
+		want bool
+	}{
+		{"1", &GetService{}, newResult("nginx", "1.0.0"), true},
+		{"2", &GetService{exactMatch: true, chartName: "nginx"}, newResult("nginx", "1.0.0"), true},
+		{"3", &GetService{exactMatch: true, chartName: "nginx"}, newResult("my-nginx", "1.0.0"), false},
+		{"4", &GetService{chartVersion: "1.0.0"}, newResult("nginx", "1.0.0"), true},
+		{"5", &GetService{chartVersion: "1.0.0"}, newResult("nginx", "1.0.1"), false},
+		{"6", &GetService{versionConstraint: constraint}, newResult("nginx", "1.2.0"), true},
+		{"7", &GetService{versionConstraint: constraint}, newResult("nginx", "1.9.9"), true},
+		{"8", &GetService{versionConstraint: constraint}, newResult("nginx", "2.0.0"), false},
+		{"9", &GetService{versionConstraint: constraint}, newResult("nginx", "1.1.0"), false},
+		{"10", &GetService{versionConstraint: constraint}, newResult("nginx", "latest"), false},
+		{"11", &GetService{versionConstraint: constraint, chartVersion: "1.0.0"}, newResult("nginx", "1.0.0"), true},
+		{"12", &GetService{versionConstraint: constraint, chartVersion: "1.0.0"}, newResult("nginx", "1.5.0"), false},
+		{"13", &GetService{exactMatch: true, chartNames: []string{"nginx", "redis"}}, newResult("redis", "1.0.0"), true},
+		{"14", &GetService{exactMatch: true, chartNames: []string{"nginx", "redis"}}, newResult("mysql", "1.0.0"), false},
+		{"15", &GetService{exactMatch: true, chartName: "mysql", chartNames: []string{"nginx", "redis"}}, newResult("mysql", "1.0.0"), true},
+		{"16", &GetService{versionExclude: prerelease}, newResult("nginx", "1.2.3-alpha.47+build99"), false},
+		{"17", &GetService{versionExclude: prerelease}, newResult("nginx", "1.2.3"), true},
+		{"18", &GetService{versionInclude: stable}, newResult("nginx", "1.2.3"), true},
+		{"19", &GetService{versionInclude: stable}, newResult("nginx", "1.2.3-rc1"), false},
+		{"20", &GetService{versionInclude: regexp.MustCompile(`^1\.`), versionExclude: prerelease}, newResult("nginx", "1.2.3-beta"), false},
+		{"21", &GetService{versionInclude: regexp.MustCompile(`^1\.`), versionExclude: prerelease}, newResult("nginx", "2.0.0"), false},
+		{"22", &GetService{versionExclude: prerelease, chartVersion: "1.2.3-rc1"}, newResult("nginx", "1.2.3-rc1"), true},
+		{"23", &GetService{skipPrereleases: true}, newResult("nginx", "1.2.3-rc1"), false},
+		{"24", &GetService{skipPrereleases: true}, newResult("nginx", "1.2.3+build99"), true},
+		{"25", &GetService{skipPrereleases: true}, newResult("nginx", "latest"), true},
+		{"26", &GetService{modifiedSince: since}, created(newResult("nginx", "1.0.0"), since.Add(time.Hour)), true},
+		{"27", &GetService{modifiedSince: since}, created(newResult("nginx", "1.0.0"), since), false},
+		{"28", &GetService{modifiedSince: since}, created(newResult("nginx", "1.0.0"), since.Add(-time.Hour)), false},
+		{"29", &GetService{modifiedSince: since}, newResult("nginx", "1.0.0"), true},
+		{"30", &GetService{}, created(newResult("nginx", "1.0.0"), since), true},
+		{"31", &GetService{modifiedSince: since, skipPrereleases: true}, created(newResult("nginx", "1.0.0"), since.Add(-time.Hour)), false},
+		{"32", &GetService{keywordFilter: []string{"database"}}, tagged(newResult("mysql", "1.0.0"), []string{"sql", "database"}, nil), true},
+		{"33", &GetService{keywordFilter: []string{"database", "cache"}}, tagged(newResult("mysql", "1.0.0"), []string{"sql", "database"}, nil), false},
+		{"34", &GetService{keywordFilter: []string{"database"}}, newResult("mysql", "1.0.0"), false},
+		{"35", &GetService{annotationFilter: map[string]string{"category": "database"}}, tagged(newResult("mysql", "1.0.0"), nil, map[string]string{"category": "database", "tier": "1"}), true},
+		{"36", &GetService{annotationFilter: map[string]string{"category": "database"}}, tagged(newResult("mysql", "1.0.0"), nil, map[string]string{"category": "web"}), false},
+		{"37", &GetService{annotationFilter: map[string]string{"category": ""}}, newResult("mysql", "1.0.0"), false},
+		{"38", &GetService{keywordFilter: []string{"database"}, annotationFilter: map[string]string{"tier": "1"}}, tagged(newResult("mysql", "1.0.0"), []string{"database"}, map[string]string{"tier": "1"}), true},
+		{"39", &GetService{keywordFilter: []string{"database"}, chartVersion: "1.0.0"}, newResult("mysql", "1.0.0"), false},
+		{"40", &GetService{exactMatch: true, chartName: "NGINX"}, newResult("nginx", "1.0.0"), true},
+		{"41", &GetService{chartName: "nginx"}, newResult("my-nginx-ingress", "1.0.0"), true},
+		{"42", &GetService{chartName: "Nginx"}, newResult("my-nginx-ingress", "1.0.0"), true},
+		{"43", &GetService{chartName: "nginx"}, newResult("redis", "1.0.0"), false},
+		{"44", &GetService{exactMatch: true, chartName: "c++"}, newResult("c++", "1.0.0"), true},
+		{"45", &GetService{exactMatch: true, chartName: "c.d"}, newResult("cod", "1.0.0"), false},
+		{"46", &GetService{namePattern: regexp.MustCompile(`^nginx-`)}, newResult("nginx-ingress", "1.0.0"), true},
+		{"47", &GetService{namePattern: regexp.MustCompile(`^nginx-`)}, newResult("my-nginx-ingress", "1.0.0"), false},
+		{"48", &GetService{exactMatch: true, chartNames: []string{"nginx", "redis"}, namePattern: regexp.MustCompile(`^r`)}, newResult("nginx", "1.0.0"), false},
+		{"49", &GetService{appVersionConstraint: appConstraint}, app(newResult("nginx", "1.0.0"), "1.25.3"), true},
+		{"50", &GetService{appVersionConstraint: appConstraint}, app(newResult("nginx", "1.0.0"), "1.24.0"), false},
+		{"51", &GetService{appVersionConstraint: appConstraint}, newResult("nginx", "1.0.0"), false},
+		{"52", &GetService{appVersionConstraint: appConstraint, verbose: true, logger: fakeLogger}, app(newResult("nginx", "1.0.0"), "stable"), false},
+		{"53", &GetService{appVersionConstraint: appConstraint, chartVersion: "1.0.0"}, app(newResult("nginx", "1.0.0"), "1.26.0"), false},
+		{"54", &GetService{maintainerFilter: "jane"}, maintained(newResult("nginx", "1.0.0"), []string{"bob@example.com", "Jane@example.com"}, nil), true},
+		{"55", &GetService{maintainerFilter: "JANE@example.com"}, maintained(newResult("nginx", "1.0.0"), []string{"jane@example.com"}, nil), true},
+		{"56", &GetService{maintainerFilter: "@example.com"}, maintained(newResult("nginx", "1.0.0"), []string{"jane@Example.com"}, nil), true},
+		{"57", &GetService{maintainerFilter: "@example.com"}, maintained(newResult("nginx", "1.0.0"), []string{"jane@example.com.evil.org"}, nil), false},
+		{"58", &GetService{maintainerFilter: "jan"}, maintained(newResult("nginx", "1.0.0"), []string{"jane@example.com"}, nil), false},
+		{"59", &GetService{maintainerFilter: "jane"}, newResult("nginx", "1.0.0"), false},
+		{"60", &GetService{sourceURLPrefix: "https://github.com/example/"}, maintained(newResult("nginx", "1.0.0"), nil, []string{"https://nginx.org", "https://github.com/example/nginx"}), true},
+		{"61", &GetService{sourceURLPrefix: "https://github.com/example/"}, maintained(newResult("nginx", "1.0.0"), nil, []string{"https://github.com/example-fork/nginx"}), false},
+		{"62", &GetService{maintainerFilter: "jane", sourceURLPrefix: "https://github.com/example/"}, maintained(newResult("nginx", "1.0.0"), []string{"bob@example.com"}, []string{"https://github.com/example/nginx"}), true},
+		{"63", &GetService{maintainerFilter: "jane", sourceURLPrefix: "https://github.com/example/"}, maintained(newResult("nginx", "1.0.0"), []string{"bob@example.com"}, []string{"https://github.com/other/nginx"}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.g.keep(tt.r); got != tt.want {
+				t.Errorf("GetService.keep() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newest(t *testing.T) {
+	tests := []struct {
+		name   string
+		charts []*search.Result
+		n      int
+		want   []string
+	}{
+		{"1", nil, 1, []string{}},
+		{"2", []*search.Result{newResult("nginx", "1.0.0"), newResult("redis", "1.0.0"), newResult("nginx", "1.10.0"), newResult("nginx", "1.9.0")}, 1, []string{"nginx-1.10.0", "redis-1.0.0"}},
+		{"3", []*search.Result{newResult("nginx", "latest"), newResult("nginx", "0.1.0")}, 1, []string{"nginx-0.1.0"}},
+		{"4", []*search.Result{newResult("nginx", "0.1.0"), newResult("nginx", "latest")}, 1, []string{"nginx-0.1.0"}},
+		{"5", []*search.Result{newResult("nginx", "1.9.0"), newResult("nginx", "1.10.0"), newResult("nginx", "1.2.0"), newResult("nginx", "1.10.0-rc1")}, 3, []string{"nginx-1.10.0", "nginx-1.10.0-rc1", "nginx-1.9.0"}},
+		{"6", []*search.Result{newResult("nginx", "1.9.0"), newResult("redis", "2.0.0"), newResult("nginx", "1.10.0")}, 5, []string{"nginx-1.10.0", "nginx-1.9.0", "redis-2.0.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, r := range newest(tt.charts, tt.n) {
+				got = append(got, r.Chart.Name+"-"+r.Chart.Version)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sortResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		charts []*search.Result
+		want   []string
+	}{
+		{"1", nil, []string{}},
+		{"2", []*search.Result{newResult("redis", "1.0.0"), newResult("nginx", "1.9.0"), newResult("nginx", "1.10.0")}, []string{"nginx-1.10.0", "nginx-1.9.0", "redis-1.0.0"}},
+		{"3", []*search.Result{newResult("nginx", "1.0.0-rc1"), newResult("nginx", "latest"), newResult("nginx", "1.0.0")}, []string{"nginx-1.0.0", "nginx-1.0.0-rc1", "nginx-latest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sortResults(tt.charts)
+			got := []string{}
+			for _, r := range tt.charts {
+				got = append(got, r.Chart.Name+"-"+r.Chart.Version)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sortResults() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// the charts are selected in the same order whatever the order of the index
+// file, so the runs over the same index download and report them alike
+func TestGetService_selectChartsOrder(t *testing.T) {
+	index := repo.NewIndexFile()
+	for _, name := range []string{"nginx", "redis", "mysql", "kafka", "etcd", "consul", "vault", "minio"} {
+		for _, v := range []string{"1.0.0", "1.10.0", "1.9.0"} {
+			index.Add(&chart.Metadata{Name: name, Version: v}, name+"-"+v+".tgz", "http://charts", "")
+		}
+	}
+	g := &GetService{logger: fakeLogger, allVersions: true}
+	var first []string
+	for i := 0; i < 10; i++ {
+		charts, err := g.selectCharts(index)
+		if err != nil {
+			t.Fatalf("GetService.selectCharts() error = %v", err)
+		}
+		got := []string{}
+		for _, r := range charts {
+			got = append(got, r.Chart.Name+"-"+r.Chart.Version)
+		}
+		if first == nil {
+			first = got
+			if got[0] != "consul-1.10.0" || got[2] != "consul-1.0.0" || len(got) != 24 {
+				t.Errorf("GetService.selectCharts() = %v, want the charts by name then newest version", got)
+			}
+		} else if !reflect.DeepEqual(got, first) {
+			t.Errorf("GetService.selectCharts() = %v, want %v as before", got, first)
+		}
+	}
+}
+
+func TestGetService_searchRegexp(t *testing.T) {
+	tests := []struct {
+		name string
+		g    *GetService
+		want string
+	}{
+		{"1", &GetService{}, "(?i)^.*"},
+		{"2", &GetService{chartName: "nginx"}, "(?i)^.*nginx"},
+		{"3", &GetService{chartNames: []string{"nginx", "redis"}}, ".*"},
+		{"4", &GetService{chartName: "mysql", chartNames: []string{"nginx"}}, ".*"},
+		{"5", &GetService{chartName: "c++"}, `(?i)^.*c\+\+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.g.searchRegexp(); got != tt.want {
+				t.Errorf("GetService.searchRegexp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "blocklist")
+	ioutil.WriteFile(name, []byte("# CVE advisory\nfoo-1.2.3.tgz\n\n  bar-4.5.6\n"), 0644)
+	tests := []struct {
+		name    string
+		file    string
+		want    []string
+		wantErr bool
+	}{
+		{"1", name, []string{"foo-1.2.3.tgz", "bar-4.5.6"}, false},
+		{"2", path.Join(dir, "missing"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readBlocklist(tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readBlocklist() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readBlocklist() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_GetBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name        string
+		allVersions bool
+		blocklist   []string
+		want        []string
+		wantBlocked int
+	}{
+		{"1", false, nil, []string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}, 0},
+		// the newest version that is not blocked is mirrored instead
+		{"2", false, []string{"chart2-1.0.1.tgz"}, []string{"chart1-2.11.0.tgz", "chart2-0.0.0-rc1.tgz"}, 1},
+		{"3", true, []string{"chart1-2.11.0", "chart2-0.0.0-rc1.tgz", "chart9-1.0.0"}, []string{"chart2-1.0.1.tgz"}, 2},
+		// only the newest version of chart2 is mirrored when none is blocked
+		{"4", false, []string{"chart9-1.0.0"}, []string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}, 0},
+		{"5", false, []string{"chart1-2.11.0"}, []string{"chart2-1.0.1.tgz"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			opts := []GetOption{WithChartNames([]string{"chart1", "chart2"}), WithBlocklist(tt.blocklist)}
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, tt.allVersions, false, true, fakeLogger, "", "", "", opts...)
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			got := []string{}
+			for _, f := range files {
+				got = append(got, filepath.Base(f))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetService.Get() charts = %v, want %v", got, tt.want)
+			}
+			if blocked := g.Stats().Blocked; blocked != tt.wantBlocked {
+				t.Errorf("GetService.Get() blocked = %v, want %v", blocked, tt.wantBlocked)
+			}
+		})
+	}
+}
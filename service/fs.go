@@ -0,0 +1,158 @@
+package service
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+// FileSystem is the file system the mirror is written to, the OS one by
+// default. Tests can use it to write to memory or to make writes fail.
+type FileSystem interface {
+	MkdirAll(path string, perm os.FileMode) error
+	TempFile(dir string, pattern string) (File, error)
+	ReadFile(name string) ([]byte, error)
+	Chmod(name string, mode os.FileMode) error
+	Rename(oldpath string, newpath string) error
+	Remove(name string) error
+}
+
+// File is a file of a FileSystem open for writing
+type File interface {
+	io.WriteCloser
+	Name() string
+}
+
+// osFileSystem is the FileSystem of the os package
+type osFileSystem struct{}
+
+func (osFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) TempFile(dir string, pattern string) (File, error) {
+	return ioutil.TempFile(dir, pattern)
+}
+
+func (osFileSystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (osFileSystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFileSystem) Rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// fileSystem returns the file system of the service, the OS one unless
+// another one was set. Its writes are synced to disk when asked.
+func (g *GetService) fileSystem() FileSystem {
+	var fs FileSystem = osFileSystem{}
+	if g.fs != nil {
+		fs = g.fs
+	}
+	if g.fsync {
+		return syncFileSystem{fs}
+	}
+	return fs
+}
+
+// syncFileSystem is a FileSystem whose files are synced to disk when they
+// are closed, and whose folders are synced once a file was moved into them,
+// so a write is not lost on a power failure after it returned. The folders
+// are only synced on the OS file system.
+type syncFileSystem struct {
+	FileSystem
+}
+
+func (s syncFileSystem) TempFile(dir string, pattern string) (File, error) {
+	f, err := s.FileSystem.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return syncFile{f}, nil
+}
+
+func (s syncFileSystem) Rename(oldpath string, newpath string) error {
+	if err := s.FileSystem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if _, ok := s.FileSystem.(osFileSystem); !ok {
+		return nil
+	}
+	return syncDir(path.Dir(newpath))
+}
+
+// syncFile is a File synced to disk before it is closed, when it supports it
+type syncFile struct {
+	File
+}
+
+func (f syncFile) Close() error {
+	if s, ok := f.File.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			f.File.Close()
+			return err
+		}
+	}
+	return f.File.Close()
+}
+
+// syncDir syncs the folder dir to disk, so the files moved into it are there
+// after a power failure
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir syncs the folder dir to disk when the service syncs its writes
+func (g *GetService) syncDir(dir string) error {
+	if !g.fsync {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// moveFile moves oldpath to newpath. When they are not on the same device
+// the content is copied to newpath before removing oldpath, so oldpath is
+// left in place if anything fails.
+func moveFile(fs FileSystem, oldpath string, newpath string, mode os.FileMode) error {
+	err := fs.Rename(oldpath, newpath)
+	if !crossDevice(err) {
+		return writeFailed(err)
+	}
+	content, err := fs.ReadFile(oldpath)
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(path.Dir(newpath), dirMode(mode)); err != nil {
+		return writeFailed(err)
+	}
+	if err := writeAtomic(fs, newpath, content, mode); err != nil {
+		return err
+	}
+	return writeFailed(fs.Remove(oldpath))
+}
+
+// crossDevice tells if err is the error of a rename across file systems
+func crossDevice(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	return err == syscall.EXDEV
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+// failingFileSystem is the OS file system where the operation op fails on
+// the files whose name contains match
+type failingFileSystem struct {
+	osFileSystem
+	op    string
+	match string
+}
+
+var errDiskFull = errors.New("no space left on device")
+
+func (f failingFileSystem) fails(op string, name string) bool {
+	return op == f.op && strings.Contains(name, f.match)
+}
+
+func (f failingFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	if f.fails("MkdirAll", path) {
+		return errDiskFull
+	}
+	return f.osFileSystem.MkdirAll(path, perm)
+}
+
+func (f failingFileSystem) TempFile(dir string, pattern string) (File, error) {
+	if f.fails("TempFile", pattern) {
+		return nil, errDiskFull
+	}
+	return f.osFileSystem.TempFile(dir, pattern)
+}
+
+func (f failingFileSystem) Rename(oldpath string, newpath string) error {
+	if f.fails("Rename", newpath) {
+		return errDiskFull
+	}
+	return f.osFileSystem.Rename(oldpath, newpath)
+}
+
+// crossDeviceFileSystem is a failingFileSystem where the files whose name
+// contains from cannot be renamed as if they were on another device
+type crossDeviceFileSystem struct {
+	failingFileSystem
+	from string
+}
+
+func (f crossDeviceFileSystem) Rename(oldpath string, newpath string) error {
+	if strings.Contains(oldpath, f.from) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return f.failingFileSystem.Rename(oldpath, newpath)
+}
+
+func Test_moveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		fs      FileSystem
+		wantErr bool
+	}{
+		{"1", osFileSystem{}, false},
+		{"2", crossDeviceFileSystem{from: downloadedFileName}, false},
+		{"3", crossDeviceFileSystem{failingFileSystem{op: "TempFile", match: indexFileName}, downloadedFileName}, true},
+		{"4", failingFileSystem{op: "Rename", match: indexFileName}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folder := path.Join(dir, tt.name)
+			os.MkdirAll(folder, 0755)
+			downloadedPath := path.Join(folder, downloadedFileName)
+			indexPath := path.Join(folder, indexFileName)
+			ioutil.WriteFile(downloadedPath, []byte(fixtures.IndexYaml), 0644)
+			if err := moveFile(tt.fs, downloadedPath, indexPath, DefaultFileMode); (err != nil) != tt.wantErr {
+				t.Errorf("moveFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Stat(downloadedPath); (err == nil) != tt.wantErr {
+				t.Errorf("moveFile() downloaded-index.yaml present = %v, want %v", err == nil, tt.wantErr)
+			}
+			content, err := ioutil.ReadFile(indexPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("moveFile() wrote index.yaml on failure")
+				}
+				return
+			}
+			if string(content) != fixtures.IndexYaml {
+				t.Errorf("moveFile() index.yaml does not match the moved file: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetService_GetFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name         string
+		fs           FileSystem
+		ignoreErrors bool
+		wantErr      bool
+		wantTgz      int
+		wantIndex    bool
+	}{
+		{"1", osFileSystem{}, true, false, fixtures.Expectedcharts - 1, true},
+		{"2", failingFileSystem{op: "TempFile", match: downloadedFileName}, true, true, 0, false},
+		{"3", failingFileSystem{op: "Rename", match: "/" + indexFileName}, true, true, fixtures.Expectedcharts - 1, false},
+		{"4", failingFileSystem{op: "TempFile", match: "chart1"}, true, false, fixtures.Expectedcharts - 2, true},
+		// the other charts may be written before the run stops
+		{"5", failingFileSystem{op: "TempFile", match: "chart1"}, false, true, -1, false},
+		{"6", failingFileSystem{op: "MkdirAll", match: "/"}, true, false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:       fakeLogger,
+				ignoreErrors: tt.ignoreErrors,
+				allVersions:  true,
+				fs:           tt.fs,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			if tt.wantTgz >= 0 && len(files) != tt.wantTgz {
+				t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), tt.wantTgz)
+			}
+			if _, err := os.Stat(path.Join(workDir, indexFileName)); (err == nil) != tt.wantIndex {
+				t.Errorf("GetService.Get() index.yaml present = %v, want %v", err == nil, tt.wantIndex)
+			}
+		})
+	}
+}
+
+// syncRecordingFileSystem is the OS file system recording the names of the
+// files synced
+type syncRecordingFileSystem struct {
+	osFileSystem
+	mu     *sync.Mutex
+	synced *[]string
+}
+
+func (s syncRecordingFileSystem) TempFile(dir string, pattern string) (File, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return syncRecordingFile{f, s}, nil
+}
+
+// syncRecordingFile is a file of a syncRecordingFileSystem
+type syncRecordingFile struct {
+	*os.File
+	fs syncRecordingFileSystem
+}
+
+func (f syncRecordingFile) Sync() error {
+	f.fs.mu.Lock()
+	*f.fs.synced = append(*f.fs.synced, f.Name())
+	f.fs.mu.Unlock()
+	return f.File.Sync()
+}
+
+func TestGetService_GetFsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name       string
+		fsync      bool
+		record     bool
+		wantCharts int
+		wantIndex  bool
+	}{
+		{"1", true, true, fixtures.Expectedcharts - 1, true},
+		{"2", false, true, 0, false},
+		// the charts are streamed to the OS file system
+		{"3", true, false, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			var synced []string
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:       fakeLogger,
+				ignoreErrors: true,
+				allVersions:  true,
+				fsync:        tt.fsync,
+			}
+			if tt.record {
+				g.fs = syncRecordingFileSystem{mu: &sync.Mutex{}, synced: &synced}
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			if files, _ := filepath.Glob(path.Join(workDir, "*.tgz")); len(files) != fixtures.Expectedcharts-1 {
+				t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), fixtures.Expectedcharts-1)
+			}
+			charts, index := 0, false
+			for _, name := range synced {
+				base := path.Base(name)
+				switch {
+				case strings.Contains(base, ".tgz"+partialSuffix):
+					charts++
+				// the downloaded index is moved into place unless rewritten
+				case strings.HasPrefix(base, "."+downloadedFileName+"."), strings.HasPrefix(base, "."+indexFileName+"."):
+					index = true
+				}
+			}
+			if charts != tt.wantCharts || index != tt.wantIndex {
+				t.Errorf("GetService.Get() synced %v charts and the index %v, want %v and %v", charts, index, tt.wantCharts, tt.wantIndex)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsEndpoint     = "https://storage.googleapis.com"
+	gcsScope        = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsTokenURL     = "https://oauth2.googleapis.com/token"
+	gcsMetadataHost = "metadata.google.internal"
+	// gcsTokenMargin is how long before its expiry an access token is renewed
+	gcsTokenMargin = time.Minute
+	// gcsTimeout bounds each upload and each access token request
+	gcsTimeout = 5 * time.Minute
+)
+
+// GCSWriter writes the mirror files as objects of a Google Cloud Storage
+// bucket, under a prefix. The requests are authenticated with the
+// application default credentials. It uploads through the JSON API itself
+// rather than with cloud.google.com/go/storage, which is not vendored, so
+// only the service account keys, the user credentials and the metadata
+// server are supported, not workload identity federation.
+type GCSWriter struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	// credentials is nil with the storage emulator, which needs none
+	credentials *gcsCredentials
+}
+
+// NewGCSWriter returns a writer to the bucket, the object names are the file
+// paths under prefix. The application default credentials are the file of
+// the GOOGLE_APPLICATION_CREDENTIALS environment variable, then the one
+// written by `gcloud auth application-default login`, then the service
+// account of the metadata server on Google Cloud (eg: a GKE workload). When
+// STORAGE_EMULATOR_HOST is set (eg: localhost:4443) the objects are written
+// to that emulator without credentials.
+func NewGCSWriter(bucket string, prefix string) (*GCSWriter, error) {
+	if bucket == "" {
+		return nil, errors.New("no GCS bucket given")
+	}
+	g := &GCSWriter{
+		client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}, Timeout: gcsTimeout},
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+	}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		u, err := url.Parse(host)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid STORAGE_EMULATOR_HOST %q", host)
+		}
+		g.endpoint = u
+		return g, nil
+	}
+	g.endpoint, _ = url.Parse(gcsEndpoint)
+	credentials, err := defaultGCSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	g.credentials = credentials
+	return g, nil
+}
+
+// Write uploads content as the object name under the prefix of the writer,
+// the upload is aborted when ctx is done
+func (g *GCSWriter) Write(ctx context.Context, name string, content []byte) error {
+	object := path.Join(g.prefix, name)
+	u := *g.endpoint
+	u.Path = path.Join("/", u.Path, "upload/storage/v1/b", g.bucket, "o")
+	u.RawQuery = url.Values{"uploadType": {"media"}, "name": {object}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(content))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if g.credentials != nil {
+		token, err := g.credentials.token(ctx, g.client)
+		if err != nil {
+			return fmt.Errorf("GCS credentials: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("uploading gs://%s/%s: %s %s", g.bucket, object, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// gcsCredentialsFile is the JSON file of a service account key or of the
+// user credentials written by gcloud
+type gcsCredentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcsCredentials fetches the OAuth2 access tokens of the requests and keeps
+// the current one until it is about to expire
+type gcsCredentials struct {
+	file *gcsCredentialsFile
+	key  *rsa.PrivateKey
+	// metadataHost is the metadata server asked for the tokens when there is
+	// no credentials file
+	metadataHost string
+	now          func() time.Time
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+// defaultGCSCredentials returns the application default credentials
+func defaultGCSCredentials() (*gcsCredentials, error) {
+	name := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if name == "" {
+		if wellKnown := gcloudCredentialsFile(); wellKnown != "" {
+			if _, err := os.Stat(wellKnown); err == nil {
+				name = wellKnown
+			}
+		}
+	}
+	if name == "" {
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = gcsMetadataHost
+		}
+		return &gcsCredentials{metadataHost: host, now: time.Now}, nil
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the GCS credentials: %s", err)
+	}
+	return parseGCSCredentials(b)
+}
+
+// gcloudCredentialsFile returns the path of the application default
+// credentials written by gcloud
+func gcloudCredentialsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", "application_default_credentials.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// parseGCSCredentials returns the credentials of a service account key or
+// user credentials file
+func parseGCSCredentials(b []byte) (*gcsCredentials, error) {
+	f := &gcsCredentialsFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("invalid GCS credentials: %s", err)
+	}
+	c := &gcsCredentials{file: f, now: time.Now}
+	switch f.Type {
+	case "service_account":
+		if f.ClientEmail == "" {
+			return nil, errors.New("invalid GCS credentials: no client_email")
+		}
+		key, err := parseRSAPrivateKey(f.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCS credentials: %s", err)
+		}
+		c.key = key
+	case "authorized_user":
+		if f.RefreshToken == "" {
+			return nil, errors.New("invalid GCS credentials: no refresh_token")
+		}
+	case "external_account":
+		return nil, errors.New("GCS credentials of workload identity federation (external_account) are not supported, use a service account key or the metadata server")
+	default:
+		return nil, fmt.Errorf("invalid GCS credentials: unsupported type %q", f.Type)
+	}
+	if f.TokenURI == "" {
+		f.TokenURI = gcsTokenURL
+	}
+	return c, nil
+}
+
+// parseRSAPrivateKey parses the PEM encoded PKCS #8 or PKCS #1 key
+func parseRSAPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// token returns a valid access token, fetching a new one with client when
+// the current one is about to expire, the request is aborted when ctx is done
+func (c *gcsCredentials) token(ctx context.Context, client *http.Client) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accessToken != "" && c.now().Add(gcsTokenMargin).Before(c.expiry) {
+		return c.accessToken, nil
+	}
+	var (
+		req *http.Request
+		err error
+	)
+	switch {
+	case c.file == nil:
+		u := &url.URL{Scheme: "http", Host: c.metadataHost, Path: "/computeMetadata/v1/instance/service-accounts/default/token", RawQuery: url.Values{"scopes": {gcsScope}}.Encode()}
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	case c.key != nil:
+		var assertion string
+		if assertion, err = c.assertion(); err == nil {
+			req, err = newFormRequest(ctx, c.file.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	default:
+		req, err = newFormRequest(ctx, c.file.TokenURI, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.file.ClientID},
+			"client_secret": {c.file.ClientSecret},
+			"refresh_token": {c.file.RefreshToken},
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching an access token from %s: %s %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &t); err != nil || t.AccessToken == "" {
+		return "", fmt.Errorf("fetching an access token from %s: invalid response", req.URL.Host)
+	}
+	c.accessToken = t.AccessToken
+	c.expiry = c.now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	return c.accessToken, nil
+}
+
+// assertion returns the JWT signed with the key of the service account that
+// is exchanged for an access token
+func (c *gcsCredentials) assertion() (string, error) {
+	now := c.now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   c.file.ClientEmail,
+		"scope": gcsScope,
+		"aud":   c.file.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func newFormRequest(ctx context.Context, u string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gcsServiceAccount returns the JSON key of a service account fetching its
+// tokens from tokenURI, and its private key
+func gcsServiceAccount(t *testing.T, tokenURI string) ([]byte, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	b, _ := json.Marshal(gcsCredentialsFile{
+		Type:        "service_account",
+		ClientEmail: "mirror@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    tokenURI,
+	})
+	return b, key
+}
+
+func TestNewGCSWriter(t *testing.T) {
+	for _, env := range []string{"GOOGLE_APPLICATION_CREDENTIALS", "STORAGE_EMULATOR_HOST", "GCE_METADATA_HOST", "HOME"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("HOME", dir)
+	serviceAccount, _ := gcsServiceAccount(t, "")
+	ioutil.WriteFile(path.Join(dir, "service-account.json"), serviceAccount, 0600)
+	ioutil.WriteFile(path.Join(dir, "user.json"), []byte(`{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"refresh"}`), 0600)
+	ioutil.WriteFile(path.Join(dir, "external.json"), []byte(`{"type":"external_account"}`), 0600)
+	ioutil.WriteFile(path.Join(dir, "invalid.json"), []byte(`{"type":"service_account","client_email":"mirror@project.iam.gserviceaccount.com","private_key":"none"}`), 0600)
+	tests := []struct {
+		name         string
+		bucket       string
+		credentials  string
+		emulator     string
+		wantEndpoint string
+		wantType     string
+		wantErr      bool
+	}{
+		{"1", "charts", path.Join(dir, "service-account.json"), "", gcsEndpoint, "service_account", false},
+		{"2", "charts", path.Join(dir, "user.json"), "", gcsEndpoint, "authorized_user", false},
+		{"3", "charts", "", "", gcsEndpoint, "", false},
+		{"4", "charts", path.Join(dir, "service-account.json"), "localhost:4443", "http://localhost:4443", "", false},
+		{"5", "", path.Join(dir, "service-account.json"), "", "", "", true},
+		{"6", "charts", path.Join(dir, "missing.json"), "", "", "", true},
+		{"7", "charts", path.Join(dir, "external.json"), "", "", "", true},
+		{"8", "charts", path.Join(dir, "invalid.json"), "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", tt.credentials)
+			os.Setenv("STORAGE_EMULATOR_HOST", tt.emulator)
+			g, err := NewGCSWriter(tt.bucket, "/mirror/")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewGCSWriter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if g.endpoint.String() != tt.wantEndpoint || g.prefix != "mirror" {
+				t.Errorf("NewGCSWriter() endpoint = %v, prefix = %v, want %v, mirror", g.endpoint, g.prefix, tt.wantEndpoint)
+			}
+			switch {
+			case tt.emulator != "":
+				if g.credentials != nil {
+					t.Errorf("NewGCSWriter() credentials = %v with the emulator, want none", g.credentials)
+				}
+			case tt.wantType == "":
+				if g.credentials == nil || g.credentials.metadataHost != gcsMetadataHost {
+					t.Errorf("NewGCSWriter() credentials = %v, want the metadata server", g.credentials)
+				}
+			case g.credentials == nil || g.credentials.file == nil || g.credentials.file.Type != tt.wantType:
+				t.Errorf("NewGCSWriter() credentials = %v, want %v", g.credentials, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestGCSWriter_Write(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		objects = map[string]string{}
+		tokens  int
+		key     *rsa.PrivateKey
+	)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			r.ParseForm()
+			parts := strings.Split(r.PostForm.Get("assertion"), ".")
+			if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			mu.Lock()
+			tokens++
+			mu.Unlock()
+			w.Write([]byte(`{"access_token":"token","expires_in":3600,"token_type":"Bearer"}`))
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/upload/storage/v1/b/charts/o" || r.URL.Query().Get("uploadType") != "media" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if strings.Contains(name, "denied") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"code":403,"message":"denied"}}`))
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		objects[name] = string(b)
+		mu.Unlock()
+	}))
+	defer svr.Close()
+	serviceAccount, privateKey := gcsServiceAccount(t, svr.URL+"/token")
+	key = privateKey
+	credentials, err := parseGCSCredentials(serviceAccount)
+	if err != nil {
+		t.Fatalf("parseGCSCredentials() error = %v", err)
+	}
+	g := &GCSWriter{
+		client:      svr.Client(),
+		bucket:      "charts",
+		prefix:      "mirror",
+		credentials: credentials,
+	}
+	g.endpoint, _ = url.Parse(svr.URL)
+	tests := []struct {
+		name      string
+		file      string
+		cancelled bool
+		wantKey   string
+		wantErr   bool
+	}{
+		{"1", "index.yaml", false, "mirror/index.yaml", false},
+		{"2", "stable/chart1-1.0.0+build.1.tgz", false, "mirror/stable/chart1-1.0.0+build.1.tgz", false},
+		{"3", "denied.tgz", false, "", true},
+		{"4", "index.yaml", true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.cancelled {
+				cancel()
+			}
+			defer cancel()
+			err := g.Write(ctx, tt.file, []byte("content "+tt.name))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GCSWriter.Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := objects[tt.wantKey]; got != "content "+tt.name {
+				t.Errorf("GCSWriter.Write() object %s = %q, objects %v", tt.wantKey, got, objects)
+			}
+		})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if tokens != 1 {
+		t.Errorf("GCSWriter.Write() fetched %d access tokens, want 1", tokens)
+	}
+}
+
+func Test_parseGCSCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"1", `{"type":"authorized_user","refresh_token":"refresh"}`, ""},
+		{"2", `{"type":"authorized_user"}`, "no refresh_token"},
+		{"3", `{"type":"external_account","audience":"//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider"}`, "workload identity federation"},
+		{"4", `{"type":"impersonated_service_account"}`, "unsupported type"},
+		{"5", `{`, "invalid GCS credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseGCSCredentials([]byte(tt.content))
+			if tt.wantErr == "" {
+				if err != nil || c.file.TokenURI != gcsTokenURL {
+					t.Errorf("parseGCSCredentials() = %v, %v, want the default token URI", c, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseGCSCredentials() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_gcsCredentials_token(t *testing.T) {
+	var requests []string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" && r.Header.Get("Metadata-Flavor") == "Google":
+			requests = append(requests, "metadata")
+		case r.URL.Path == "/token" && r.PostForm.Get("grant_type") == "refresh_token" && r.PostForm.Get("refresh_token") == "refresh":
+			requests = append(requests, "refresh")
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"access_token":"token","expires_in":120}`))
+	}))
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+	user, err := parseGCSCredentials([]byte(`{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"refresh","token_uri":"` + svr.URL + `/token"}`))
+	if err != nil {
+		t.Fatalf("parseGCSCredentials() error = %v", err)
+	}
+	denied, _ := parseGCSCredentials([]byte(`{"type":"authorized_user","refresh_token":"expired","token_uri":"` + svr.URL + `/token"}`))
+	now := time.Now()
+	tests := []struct {
+		name         string
+		credentials  *gcsCredentials
+		later        time.Duration
+		wantRequests []string
+		wantErr      bool
+	}{
+		{"1", &gcsCredentials{metadataHost: u.Host}, 0, []string{"metadata"}, false},
+		{"2", user, 0, []string{"refresh"}, false},
+		{"3", user, 30 * time.Second, []string{"refresh"}, false},
+		{"4", user, 90 * time.Second, []string{"refresh", "refresh"}, false},
+		{"5", denied, 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = nil
+			tt.credentials.accessToken = ""
+			tt.credentials.now = func() time.Time { return now }
+			if _, err := tt.credentials.token(context.Background(), svr.Client()); (err != nil) != tt.wantErr {
+				t.Fatalf("gcsCredentials.token() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.later > 0 {
+				tt.credentials.now = func() time.Time { return now.Add(tt.later) }
+				if got, err := tt.credentials.token(context.Background(), svr.Client()); err != nil || got != "token" {
+					t.Fatalf("gcsCredentials.token() = %v, %v, want token", got, err)
+				}
+			}
+			if strings.Join(requests, ",") != strings.Join(tt.wantRequests, ",") {
+				t.Errorf("gcsCredentials.token() requests = %v, want %v", requests, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -2,17 +2,31 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/url"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Masterminds/semver"
+	"github.com/ghodss/yaml"
+	"golang.org/x/time/rate"
 	"k8s.io/helm/cmd/helm/search"
+	"k8s.io/helm/pkg/chartutil"
 	"k8s.io/helm/pkg/getter"
-	"k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
 	"k8s.io/helm/pkg/repo"
+	"k8s.io/helm/pkg/urlutil"
 )
 
 const (
@@ -20,141 +34,1464 @@ const (
 	indexFileName      = "index.yaml"
 )
 
+// DefaultConcurrency is the number of charts downloaded in parallel when
+// no concurrency is set
+const DefaultConcurrency = 4
+
+// DefaultFileMode is the mode of the written files when no file mode is set,
+// folders get the same permissions plus the matching execute bits.
+const DefaultFileMode os.FileMode = 0644
+
+const (
+	partialSuffix = ".partial"
+	provSuffix    = ".prov"
+)
+
 // GetServiceInterface defines a Get service
 type GetServiceInterface interface {
-	Get() error
+	Get(ctx context.Context) error
+	Stats() *GetStats
+	Index() *repo.IndexFile
+	Fetch(ctx context.Context) (<-chan FetchedChart, error)
 }
 
 // GetService structure definition
 type GetService struct {
-	config       repo.Entry
-	verbose      bool
-	ignoreErrors bool
-	logger       *log.Logger
-	newRootURL   string
-	allVersions  bool
-	chartName    string
-	chartVersion string
+	config          repo.Entry
+	verbose         bool
+	ignoreErrors    bool
+	logger          *log.Logger
+	eventLogger     Logger
+	newRootURL      string
+	rewrites        []URLRewrite
+	allVersions     bool
+	chartName       string
+	chartVersion    string
+	chartNames      []string
+	specs           []ChartSpec
+	missingSpecs    []ChartSpec
+	concurrency     int
+	maxPerHost      int
+	maxRetries      int
+	retryBaseDelay  time.Duration
+	downloadTimeout time.Duration
+	overallTimeout  time.Duration
+	rateLimit       int64
+	verifyDigests   bool
+	validateCharts  bool
+	skipExisting    bool
+	withProvenance  bool
+	skipPrereleases bool
+	layout          Layout
+	regenerateIndex bool
+	dryRun          bool
+	fileMode        os.FileMode
+	registry        *ociPusher
+
+	versionConstraint        *semver.Constraints
+	appVersionConstraint     *semver.Constraints
+	versionInclude           *regexp.Regexp
+	versionExclude           *regexp.Regexp
+	maxVersionsPerChart      int
+	resolveDependencies      bool
+	modifiedSince            time.Time
+	onError                  ErrorFunc
+	errMu                    sync.Mutex
+	outputDir                string
+	repoNameOverride         string
+	compressIndex            bool
+	writeChecksums           bool
+	storage                  StorageWriter
+	fs                       FileSystem
+	keywordFilter            []string
+	annotationFilter         map[string]string
+	maintainerFilter         string
+	sourceURLPrefix          string
+	userAgent                string
+	mergeIndex               bool
+	failOnMissing            bool
+	latestOnly               bool
+	exactMatch               bool
+	namePattern              *regexp.Regexp
+	metricsHook              Metrics
+	fetchExtraArtifacts      bool
+	extraArtifactsAnnotation string
+	maxChartBytes            int64
+	skipUnknownSize          bool
+	prune                    bool
+	tracer                   Tracer
+	customGetters            getter.Providers
+	contentAddressed         bool
+	credentialsFile          string
+	includeDeprecated        bool
+	preserveURLFilename      bool
+	fsync                    bool
+	afterDownload            AfterDownloadFunc
+	indexTransform           IndexTransformFunc
+	indexConcurrency         int
+	tarOutput                string
+	stateFile                string
+	indexRetries             int
+	blocklist                map[string]bool
+	indexTimestamp           time.Time
+	reproducible             bool
+	indexOnly                bool
+	maxIdleConnsPerHost      int
+	quiet                    bool
+	minTLSVersion            uint16
+	signingKey               string
+	keyring                  string
+	passphrase               string
+	keepRawIndex             bool
+	indexName                string
+	rawIndexName             string
+	plainHTTPRegistry        bool
+	registryUsername         string
+	registryPassword         string
+	conditionalIndex         bool
+	forceRecheck             bool
+	versionRange             string
+	appVersionRange          string
+	progress                 ProgressFunc
+	completion               CompletionFunc
+	summaryFile              string
+	summary                  *summary
+	state                    *runState
+	stats                    *GetStats
+	index                    *repo.IndexFile
+	limiter                  *rate.Limiter
+	pool                     chan struct{}
+	indexPool                chan struct{}
+	sharedLimiter            *rate.Limiter
+	hosts                    *hostLimiter
+	sharedHosts              *hostLimiter
+	transports               *transportCache
+	sharedTransports         *transportCache
+	signer                   *provenance.Signatory
+	oci                      *ociGetter
+}
+
+// CompletionFunc is called once a run ended with err, with its statistics
+type CompletionFunc func(stats *GetStats, err error)
+
+// ProgressFunc is called after each chart is written, total is the number of
+// charts selected for download
+type ProgressFunc func(chartName string, version string, current int, total int)
+
+// ChartInfo describes a chart version written to the destination folder
+type ChartInfo struct {
+	Name    string
+	Version string
+	// Digest is the hex encoded sha256 of the chart file
+	Digest string
+	// URL is where the chart was downloaded from
+	URL      string
+	Metadata *chart.Metadata
+}
+
+// AfterDownloadFunc is called after each chart is written to chartPath, eg:
+// to scan or sign it. An error fails the chart unless errors are ignored.
+type AfterDownloadFunc func(chartPath string, chart *ChartInfo) error
+
+// IndexTransformFunc modifies the index file of the mirror before it is
+// written, after its chart URLs are rewritten or it is regenerated, eg: to
+// strip or add annotations. An error fails the run and leaves the index file
+// of the previous run in place.
+type IndexTransformFunc func(index *repo.IndexFile) error
+
+// ErrorFunc is called for each error ignored during a mirror run, url is the
+// URL that failed when there is one
+type ErrorFunc func(chartName string, version string, url string, err error)
+
+// reportError calls the error callback of the service, if any, one call at a
+// time
+func (g *GetService) reportError(chartName string, version string, u string, err error) {
+	if g.onError == nil {
+		return
+	}
+	g.errMu.Lock()
+	defer g.errMu.Unlock()
+	g.onError(chartName, version, u, err)
 }
 
-// NewGetService return a new instace of GetService
-func NewGetService(config repo.Entry, allVersions bool, verbose bool, ignoreErrors bool, logger *log.Logger, newRootURL string, chartName string, chartVersion string) GetServiceInterface {
-	return &GetService{
-		config:       config,
-		verbose:      verbose,
-		ignoreErrors: ignoreErrors,
-		logger:       logger,
-		newRootURL:   newRootURL,
-		allVersions:  allVersions,
-		chartName:    chartName,
-		chartVersion: chartVersion,
+// NewGetService return a new instace of GetService, it fails when one of the
+// options is not valid
+func NewGetService(config repo.Entry, allVersions bool, verbose bool, ignoreErrors bool, logger *log.Logger, newRootURL string, chartName string, chartVersion string, opts ...GetOption) (GetServiceInterface, error) {
+	g := &GetService{
+		config:            config,
+		verbose:           verbose,
+		ignoreErrors:      ignoreErrors,
+		logger:            logger,
+		newRootURL:        newRootURL,
+		allVersions:       allVersions,
+		chartName:         chartName,
+		chartVersion:      chartVersion,
+		exactMatch:        true,
+		includeDeprecated: true,
+	}
+	for _, opt := range opts {
+		if err := opt(g); err != nil {
+			return nil, err
+		}
 	}
+	return g, nil
 }
 
-//Get methods downloads the index file and the Helm charts to the working directory.
-func (g *GetService) Get() error {
-	chartRepo, err := repo.NewChartRepository(&g.config, getter.All(environment.EnvSettings{}))
+// NewOCIGetService return a new instance of GetService that pushes the charts
+// to the OCI registry reference registry (eg: oci://registry.local/charts)
+// instead of writing them to the destination folder, which still receives the
+// index file.
+func NewOCIGetService(config repo.Entry, registry string, allVersions bool, verbose bool, ignoreErrors bool, logger *log.Logger, chartName string, chartVersion string, opts ...GetOption) (GetServiceInterface, error) {
+	pusher, err := newOCIPusher(registry, "", "", false)
+	if err != nil {
+		return nil, err
+	}
+	g, err := NewGetService(config, allVersions, verbose, ignoreErrors, logger, "", chartName, chartVersion, append([]GetOption{withRegistry(pusher)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Get methods downloads the index file and the Helm charts to the working directory.
+// Cancelling ctx stops the remaining downloads, charts that were being written
+// are left with a .partial suffix.
+func (g *GetService) Get(ctx context.Context) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	parent := ctx
+	if g.overallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, g.overallTimeout)
+		defer cancel()
+	}
+	ctx, span := g.startSpan(ctx, "helm-mirror.get")
+	span.SetAttribute("repo.name", g.repoName())
+	span.SetAttribute("repo.url", g.config.URL)
+	defer func() {
+		endSpan(span, err)
+	}()
+	if g.storage != nil && g.regenerateIndex {
+		return errors.New("the index file cannot be regenerated from the charts of a storage writer")
+	}
+	if g.storage != nil && (g.skipExisting || g.resolveDependencies) {
+		return errors.New("the charts of a storage writer cannot be skipped when present nor their dependencies resolved")
+	}
+	if g.prune && g.mergeIndex {
+		return errors.New("the charts cannot be pruned when the index file is merged")
+	}
+	if g.indexOnly && (g.regenerateIndex || g.prune) {
+		return errors.New("the index file cannot be regenerated nor the charts pruned without downloading the charts")
+	}
+	if g.signingKey != "" && (g.registry != nil || g.withProvenance) {
+		return errors.New("the charts pushed to a registry or keeping their upstream provenance files cannot be signed")
+	}
+	if indexName, rawName := g.indexNames(); indexName == rawName || !validPathElement(indexName) || !validPathElement(rawName) {
+		return fmt.Errorf("invalid index file names %q and %q: they must be different file names", indexName, rawName)
+	}
+	if g.tarOutput != "" && g.stateFile != "" {
+		return errors.New("a run writing a tar archive cannot be resumed from a state file")
+	}
+	if g.tarOutput != "" && !g.dryRun {
+		if g.storage != nil || g.registry != nil || g.regenerateIndex {
+			return errors.New("the charts written to a tar archive cannot be pushed, stored elsewhere or indexed again")
+		}
+		archive, terr := newTarWriter(g.tarOutput, g.mode())
+		if terr != nil {
+			return writeFailed(terr)
+		}
+		g.storage = archive
+		defer func() {
+			g.storage = nil
+			if err != nil {
+				archive.abort()
+				return
+			}
+			err = writeFailed(archive.Close())
+		}()
+	}
+	start := time.Now()
+	g.summary = &summary{}
+	g.index = nil
+	defer func() {
+		g.stats = g.summary.stats(time.Since(start))
+		// the run was aborted by its own deadline, not by its caller
+		if err != nil && g.overallTimeout > 0 && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			err = runTimedOut(g.overallTimeout, g.stats.Downloaded+g.stats.Skipped)
+		}
+		g.reportCompletion(err)
+	}()
+	if err := g.prepareClients(); err != nil {
+		return err
+	}
+	g.signer = nil
+	if g.signingKey != "" {
+		signer, err := newSigner(g.keyring, g.signingKey, g.passphrase)
+		if err != nil {
+			return err
+		}
+		g.signer = signer
+	}
+	config := g.config
+	dir := g.dir()
+	if g.dryRun {
+		// nothing is written to the destination folder in dry run mode
+		tmp, err := ioutil.TempDir("", "helm-mirror")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		config.Name = tmp
+		dir = tmp
+	}
+	chartRepo, err := repo.NewChartRepository(&config, g.getters())
 	if err != nil {
 		return err
 	}
 
-	downloadedIndexPath := path.Join(g.config.Name, downloadedFileName)
-	err = chartRepo.DownloadIndexFile(downloadedIndexPath)
+	indexName, rawName := g.indexNames()
+	downloadedIndexPath := path.Join(dir, rawName)
+	// the index file of the last complete run is downloaded again only when
+	// it changed
+	var previous, validators *indexValidators
+	if g.conditionalIndex && !g.dryRun && !g.forceRecheck {
+		previous = loadIndexValidators(g.fileSystem(), path.Join(dir, indexCacheFileName), path.Join(dir, indexName), g.selection())
+	}
+	_, indexSpan := g.startSpan(ctx, "helm-mirror.index")
+	indexSpan.SetAttribute("index.url", config.URL)
+	release, err := g.acquireIndexSlot(ctx)
+	if err == nil {
+		// the index file is retried on its own, a run cannot go on without it
+		attempt := 0
+		err = g.retryTimes(ctx, config.URL, g.indexRetries, func() error {
+			attempt++
+			if g.verbose {
+				g.log().Printf("downloading index file of %s, attempt %d/%d", config.URL, attempt, g.indexRetries+1)
+			}
+			var derr error
+			validators, derr = downloadIndexFile(ctx, g.fileSystem(), chartRepo, downloadedIndexPath, previous, g.mode())
+			return derr
+		})
+		release()
+	}
+	if err == errNotModified {
+		endSpan(indexSpan, nil)
+		g.log().Printf("index file of %s not modified since the last run, nothing to do", config.URL)
+		g.index, _ = loadIndexFile(g.fileSystem(), path.Join(dir, indexName))
+		return nil
+	}
+	endSpan(indexSpan, err)
 	if err != nil {
 		return err
 	}
+	if g.conditionalIndex && !g.dryRun && !g.indexOnly {
+		// the validators are only kept once the run is complete, the index
+		// file is downloaded again after a failure, an ignored one included,
+		// and by a run writing the charts after an index only one
+		defer func() {
+			if err == nil && len(g.summary.failed()) == 0 && len(g.missingSpecs) == 0 {
+				if validators != nil {
+					validators.Selection = g.selection()
+				}
+				err = saveIndexValidators(g.fileSystem(), path.Join(dir, indexCacheFileName), validators, g.mode())
+			}
+		}()
+	}
+	g.log().Event(Event{Event: EventIndexDownloaded, Repo: g.repoName(), URL: config.URL})
 
-	err = chartRepo.Load()
+	chartRepo.IndexFile, err = loadIndexFile(g.fileSystem(), downloadedIndexPath)
 	if err != nil {
 		return err
 	}
+	if g.indexOnly {
+		// no chart is searched nor downloaded, only the index file is written
+		if g.dryRun {
+			return nil
+		}
+		if err := g.writeIndexFile(nil); err != nil {
+			return err
+		}
+		if g.storage != nil {
+			return g.storeIndexFiles(ctx)
+		}
+		return nil
+	}
 
-	chartPrefix := ""
-	chartPath := ""
-	index := search.NewIndex()
-	index.AddRepo(chartRepo.Config.Name, chartRepo.IndexFile, (g.allVersions || g.chartVersion != ""))
-	rexp := fmt.Sprintf("^.*%s.*", g.chartName)
-	res, err := index.Search(rexp, 1, true)
+	charts, err := g.selectCharts(chartRepo.IndexFile)
+	if err != nil {
+		return err
+	}
+
+	if g.dryRun {
+		return g.reportDryRun(ctx, chartRepo.Client, charts)
+	}
+
+	g.state = nil
+	if g.stateFile != "" {
+		if g.state, err = loadRunState(g.fileSystem(), dir, path.Join(dir, g.stateFile), g.mode()); err != nil {
+			return err
+		}
+		// the state is written once more when the run completes or is cancelled
+		defer func() {
+			if serr := g.state.save(); err == nil {
+				err = writeFailed(serr)
+			}
+		}()
+	}
+	err = g.downloadCharts(ctx, chartRepo, charts)
+	var dependencies []*repo.ChartVersion
+	if err == nil && g.resolveDependencies && g.registry == nil && g.storage == nil {
+		dependencies, err = g.downloadDependencies(ctx, chartRepo, charts)
+	}
+	if g.summaryFile != "" {
+		serr := writeSummary(g.fileSystem(), path.Join(g.dir(), g.summaryFile), g.summary.results, g.mode(), g.log(), g.ignoreErrors)
+		if err == nil {
+			err = serr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if g.prune && g.registry == nil && g.storage == nil && g.fs == nil {
+		if failed := g.summary.failed(); len(failed) > 0 {
+			g.log().Printf("WARNING: not pruning the charts, %d charts could not be downloaded", len(failed))
+		} else if err := g.pruneCharts(chartRepo.IndexFile); err != nil {
+			return err
+		}
+	}
+
+	if err := g.writeIndexFile(dependencies); err != nil {
+		return err
+	}
+	if g.writeChecksums && g.registry == nil {
+		if err := writeChecksums(g.fileSystem(), g.dir(), g.summary.checksums(), g.indexFiles(), g.mode()); err != nil {
+			return err
+		}
+	}
+	if g.storage != nil {
+		if err := g.storeIndexFiles(ctx); err != nil {
+			return err
+		}
+	}
+	if failed := g.summary.failed(); g.failOnMissing && len(failed) > 0 {
+		return missingChartsError(failed)
+	}
+	return nil
+}
+
+// writeIndexFile turns the downloaded index file into the index file of the
+// mirror: it is rewritten or regenerated, merged with the previous one,
+// its timestamps pinned and compressed as configured, then kept for Index.
+// The extra chart versions are added to a rewritten index file.
+func (g *GetService) writeIndexFile(extra []*repo.ChartVersion) (err error) {
+	indexName, rawName := g.indexNames()
+	indexPath, rawPath := path.Join(g.dir(), indexName), path.Join(g.dir(), rawName)
+	var previous *repo.IndexFile
+	if g.mergeIndex {
+		if previous, err = loadPreviousIndex(g.fileSystem(), indexPath); err != nil {
+			return err
+		}
+	}
+	edit := g.indexEdit(previous)
+	if g.regenerateIndex {
+		err = regenerateIndexFile(g.fileSystem(), g.dir(), rawPath, indexPath, g.newRootURL, edit, g.keepRawIndex, g.mode())
+	} else {
+		err = prepareIndexFile(g.fileSystem(), rawPath, indexPath, normalizeURL(g.config.URL), g.newRootURL, g.rewrites, g.layout, g.preserveURLFilename, extra, edit, g.keepRawIndex, g.mode())
+	}
+	if err != nil {
+		return err
+	}
+	if g.index, err = loadIndexFile(g.fileSystem(), indexPath); err != nil {
+		return err
+	}
+	if g.compressIndex {
+		return compressIndexFile(g.fileSystem(), indexPath, g.mode())
+	}
+	return nil
+}
+
+// prepareClients sets up the credentials, the rate limit, the bound per host
+// and the connections of a run
+func (g *GetService) prepareClients() error {
+	g.applyEnvCredentials()
+	if err := g.applyFileCredentials(); err != nil {
+		return err
+	}
+	g.limiter = g.sharedLimiter
+	if g.limiter == nil {
+		g.limiter = newRateLimiter(g.rateLimit)
+	}
+	g.hosts = g.sharedHosts
+	if g.hosts == nil {
+		g.hosts = newHostLimiter(g.maxPerHost)
+	}
+	// the getters of the index file, the charts and their dependencies
+	// reuse the connections of the same transports
+	g.transports = g.sharedTransports
+	if g.transports == nil {
+		g.transports = newTransportCache(g.idleConnsPerHost(), g.tlsMinVersion())
+	}
+	// the charts of oci:// URLs are pulled from their registries with the
+	// connections of the repository. The credentials of the registries are
+	// sent to all of them, the ones of the repository only to a registry of
+	// its host, the charts of the other ones are pulled anonymously.
+	ociTransport, err := g.transports.get(g.config.CertFile, g.config.KeyFile, g.config.CAFile)
 	if err != nil {
 		return err
 	}
+	username, password, host := g.config.Username, g.config.Password, urlHost(g.config.URL)
+	if host == "" {
+		// eg: a file:// repository, no registry is on its host
+		username, password = "", ""
+	}
+	if g.registryUsername != "" || g.registryPassword != "" {
+		username, password, host = g.registryUsername, g.registryPassword, ""
+	}
+	g.oci = newOCIGetter(ociTransport, username, password, host, g.userAgent, g.plainHTTPRegistry)
+	return nil
+}
 
+// selectCharts returns the chart versions of the index file selected by the
+// chart name, the filters and the blocklist
+func (g *GetService) selectCharts(indexFile *repo.IndexFile) ([]*search.Result, error) {
+	index := search.NewIndex()
+	index.AddRepo(g.repoName(), indexFile, g.allVersionsNeeded())
+	res, err := index.Search(g.searchRegexp(), 1, true)
+	if err != nil {
+		return nil, err
+	}
+	sortResults(res)
+
+	charts := []*search.Result{}
+	deprecated, blocked := 0, 0
 	for _, r := range res {
-		if g.chartName != "" && r.Chart.Name != g.chartName {
+		if !g.keep(r) {
 			continue
 		}
-		if g.chartVersion != "" && r.Chart.Version != g.chartVersion {
+		if r.Chart.Deprecated && !g.includeDeprecated {
+			deprecated++
 			continue
 		}
-		for _, u := range r.Chart.URLs {
-			urlParsed, _ := url.Parse(u)
-			chartPrefix, _ = path.Split(urlParsed.Path)
+		if g.blocked(r) {
+			blocked++
+			continue
+		}
+		charts = append(charts, r)
+	}
+	if deprecated > 0 {
+		g.log().Printf("skipped %d deprecated chart versions", deprecated)
+	}
+	if blocked > 0 {
+		g.log().Printf("skipped %d chart versions of the blocklist", blocked)
+		g.summary.addBlocked(blocked)
+	}
+	if g.newestOnly() {
+		charts = newest(charts, 1)
+	} else if g.maxVersionsPerChart > 0 {
+		charts = newest(charts, g.maxVersionsPerChart)
+	}
+	if len(g.specs) > 0 {
+		return g.selectSpecs(charts)
+	}
+	return charts, nil
+}
 
-			b, err := chartRepo.Client.Get(u)
-			if err != nil {
-				if g.ignoreErrors {
-					g.logger.Printf("WARNING: processing chart %s(%s) - %s", r.Name, r.Chart.Version, err)
-					continue
-				} else {
-					return err
-				}
+// Stats returns the statistics of the last run of Get, or nil when Get was
+// never run. It must not be called while Get is running.
+func (g *GetService) Stats() *GetStats {
+	return g.stats
+}
+
+// Index returns the index file written by the last run of Get, with its
+// chart URLs rewritten or regenerated, or nil when Get was never run, was a
+// dry run or failed before the index file was written. It must not be called
+// while Get is running.
+func (g *GetService) Index() *repo.IndexFile {
+	return g.index
+}
+
+// reportCompletion logs the totals of the run that ended with err, unless it
+// was a dry run, and calls the completion callback
+func (g *GetService) reportCompletion(err error) {
+	if !g.dryRun {
+		e := Event{Event: EventRunCompleted, Repo: g.repoName(), URL: g.config.URL, Message: fmt.Sprintf("mirror of %s done: %s", g.config.URL, g.stats)}
+		if err != nil {
+			e.Error = err.Error()
+			e.Message = fmt.Sprintf("mirror of %s stopped: %s - %s", g.config.URL, g.stats, err)
+		}
+		g.log().Event(e)
+	}
+	if g.completion != nil {
+		g.completion(g.stats, err)
+	}
+}
+
+// continueOnError reports whether the other charts are still downloaded
+// after one failed
+func (g *GetService) continueOnError() bool {
+	return g.ignoreErrors || g.failOnMissing
+}
+
+// missingChartsError returns the error of a run where the failed charts
+// could not be downloaded
+func missingChartsError(failed []ChartResult) error {
+	names := make([]string, len(failed))
+	for i, r := range failed {
+		names[i] = fmt.Sprintf("%s(%s)", r.Name, r.Version)
+	}
+	return fmt.Errorf("%d charts could not be downloaded: %s", len(failed), strings.Join(names, ", "))
+}
+
+// workers returns the number of charts downloaded in parallel
+func (g *GetService) workers() int {
+	if g.concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return g.concurrency
+}
+
+// idleConnsPerHost returns the number of idle connections kept open to each
+// host, at least one per worker unless it is set
+func (g *GetService) idleConnsPerHost() int {
+	if g.maxIdleConnsPerHost > 0 {
+		return g.maxIdleConnsPerHost
+	}
+	if g.workers() > DefaultMaxIdleConnsPerHost {
+		return g.workers()
+	}
+	return DefaultMaxIdleConnsPerHost
+}
+
+// indexNames returns the names of the index file of the mirror and of the
+// index file downloaded from the repository
+func (g *GetService) indexNames() (string, string) {
+	indexName, rawName := g.indexName, g.rawIndexName
+	if indexName == "" {
+		indexName = indexFileName
+	}
+	if rawName == "" {
+		rawName = downloadedFileName
+	}
+	return indexName, rawName
+}
+
+// indexFiles returns the names of the index files written to the
+// destination folder at the end of the run
+func (g *GetService) indexFiles() []string {
+	indexName, rawName := g.indexNames()
+	names := []string{indexName, indexName + gzSuffix}
+	if g.keepRawIndex {
+		names = append(names, rawName)
+	}
+	return names
+}
+
+// tlsMinVersion returns the oldest TLS version accepted from the servers
+func (g *GetService) tlsMinVersion() uint16 {
+	if g.minTLSVersion == 0 {
+		return DefaultMinTLSVersion
+	}
+	return g.minTLSVersion
+}
+
+// downloadCharts downloads the charts using a bounded pool of workers. When
+// errors are not ignored the first failure stops the remaining downloads.
+func (g *GetService) downloadCharts(parent context.Context, chartRepo *repo.ChartRepository, charts []*search.Result) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var (
+		once     sync.Once
+		firstErr error
+		mu       sync.Mutex
+		current  int
+	)
+	g.dispatch(ctx, charts, func(ctx context.Context, r *search.Result) {
+		start := time.Now()
+		spanCtx, span := g.startSpan(ctx, "helm-mirror.chart")
+		span.SetAttribute("chart.name", r.Chart.Name)
+		span.SetAttribute("chart.version", r.Chart.Version)
+		if len(r.Chart.URLs) > 0 {
+			span.SetAttribute("chart.url", r.Chart.URLs[0])
+		}
+		status, err := g.downloadChart(spanCtx, chartRepo, r)
+		span.SetAttribute("chart.status", string(status))
+		endSpan(span, err)
+		if status == StatusDownloaded {
+			g.metrics().ObserveDuration(time.Since(start))
+		}
+		g.addResult(r.Chart.Name, r.Chart.Version, status, err)
+		if err != nil && !g.continueOnError() {
+			once.Do(func() {
+				firstErr = err
+				cancel()
+			})
+		}
+		if status == StatusDownloaded && g.progress != nil {
+			mu.Lock()
+			current++
+			g.progress(r.Chart.Name, r.Chart.Version, current, len(charts))
+			mu.Unlock()
+		}
+	})
+	if firstErr == nil {
+		return parent.Err()
+	}
+	return firstErr
+}
+
+// acquireSlot waits for a free slot of the pool of workers sem, it returns
+// false without one when ctx is done first
+func acquireSlot(ctx context.Context, sem chan struct{}) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// downloadChart downloads and writes the chart from the first of its URLs
+// that works, the other ones are fallbacks tried in order when a download
+// fails. It returns the outcome for the chart and the error of the last URL
+// when all of them failed, or when there is none, which is logged when errors
+// are ignored.
+func (g *GetService) downloadChart(ctx context.Context, chartRepo *repo.ChartRepository, r *search.Result) (ChartStatus, error) {
+	if len(r.Chart.URLs) == 0 {
+		err := fmt.Errorf("chart %s(%s) has no URL in the index file", r.Chart.Name, r.Chart.Version)
+		if g.continueOnError() {
+			g.log().Event(Event{Event: EventChartFailed, Chart: r.Chart.Name, Version: r.Chart.Version, Error: err.Error()})
+			g.reportError(r.Chart.Name, r.Chart.Version, "", err)
+		}
+		return StatusFailed, &ChartError{Chart: r.Chart.Name, Version: r.Chart.Version, Err: err}
+	}
+	var (
+		lastErr error
+		lastURL string
+	)
+	for i, u := range r.Chart.URLs {
+		if err := ctx.Err(); err != nil {
+			return StatusFailed, err
+		}
+		s, err := g.downloadURL(ctx, chartRepo, r, u)
+		if err == nil {
+			if s == StatusDownloaded {
+				g.log().Event(Event{Event: EventChartDownloaded, Chart: r.Chart.Name, Version: r.Chart.Version, URL: u})
 			}
-			chartFileName := fmt.Sprintf("%s-%s.tgz", r.Chart.Name, r.Chart.Version)
-			if chartPrefix != "" {
-				chartPath = path.Join(g.config.Name, chartPrefix, chartFileName)
-			} else {
-				chartPath = path.Join(g.config.Name, chartFileName)
+			return s, nil
+		}
+		if ctx.Err() != nil {
+			return StatusFailed, err
+		}
+		lastErr, lastURL = err, u
+		if i < len(r.Chart.URLs)-1 {
+			g.log().Printf("WARNING: downloading chart %s(%s) from %s failed, trying the next URL - %s", r.Chart.Name, r.Chart.Version, u, err)
+		}
+	}
+	if lastErr != nil && g.continueOnError() {
+		g.log().Event(Event{Event: EventChartFailed, Chart: r.Chart.Name, Version: r.Chart.Version, URL: lastURL, Error: lastErr.Error()})
+		g.reportError(r.Chart.Name, r.Chart.Version, lastURL, lastErr)
+	}
+	if lastErr == nil {
+		return StatusFailed, nil
+	}
+	return StatusFailed, &ChartError{Chart: r.Chart.Name, Version: r.Chart.Version, URL: lastURL, Err: lastErr}
+}
+
+// downloadURL downloads the chart from u and writes it to the destination
+// folder, or pushes it to the registry
+func (g *GetService) downloadURL(ctx context.Context, chartRepo *repo.ChartRepository, r *search.Result, u string) (ChartStatus, error) {
+	u = normalizeURL(u)
+	urlParsed, err := url.Parse(u)
+	if err != nil {
+		return StatusFailed, err
+	}
+	// the chart is written to the path of its first URL, the one the index
+	// file of the mirror points to, whichever of its URLs it comes from
+	pathURL := urlParsed
+	if first, err := url.Parse(normalizeURL(r.Chart.URLs[0])); err == nil {
+		pathURL = first
+	}
+	chartPath, err := g.chartPath(r, pathURL)
+	if err != nil {
+		return StatusFailed, err
+	}
+	// a relative URL is downloaded from the repository, the chart keeps its
+	// path relative to it
+	u = g.absoluteChartURL(u, urlParsed)
+
+	if c, ok := g.state.done(r.Chart.Name, r.Chart.Version, chartPath); ok && g.stateChartValid(r, c, chartPath) {
+		g.log().Event(Event{Event: EventChartSkipped, Chart: r.Chart.Name, Version: r.Chart.Version, URL: u})
+		g.summary.addChart(chartPath)
+		g.keepExtraArtifacts(r, urlParsed, chartPath)
+		if g.writeChecksums && c.Digest != "" {
+			g.summary.addChecksum(chartPath, c.Digest)
+		}
+		return StatusSkipped, nil
+	}
+	if g.registry == nil && g.storage == nil && g.skipExisting && upToDate(chartPath, r.Chart.Digest) {
+		g.log().Event(Event{Event: EventChartSkipped, Chart: r.Chart.Name, Version: r.Chart.Version, URL: u})
+		g.summary.addChart(chartPath)
+		g.keepExtraArtifacts(r, urlParsed, chartPath)
+		if g.writeChecksums {
+			if sum, err := fileDigest(chartPath); err == nil {
+				g.summary.addChecksum(chartPath, sum)
 			}
-			err = writeFile(chartPath, b.Bytes(), g.logger, g.ignoreErrors)
-			if err != nil {
-				return err
+		}
+		return StatusSkipped, nil
+	}
+	client := g.chartGetter(chartRepo, urlParsed)
+	release, err := g.hosts.acquire(ctx, urlHost(u))
+	if err != nil {
+		return StatusFailed, err
+	}
+	defer release()
+	if g.maxChartBytes > 0 && g.oversized(ctx, client, r, u) {
+		// a chart mirrored before it was over the maximum size, or before its
+		// size was unknown, is not pruned
+		g.summary.addChart(chartPath)
+		g.keepExtraArtifacts(r, urlParsed, chartPath)
+		return StatusSkipped, nil
+	}
+	// the hex encoded sha256 of the chart written
+	var sum string
+	// the chart when it was not streamed to chartPath
+	var content []byte
+	// the size of the chart written
+	var size int64
+	if streamer, ok := client.(streamGetter); ok && g.registry == nil && g.storage == nil && g.fs == nil {
+		size, sum, err = g.downloadChartFile(ctx, streamer, r, u, chartPath)
+		if err != nil {
+			return StatusFailed, err
+		}
+		g.addBytes(int(size))
+		if g.writeChecksums {
+			g.summary.addChecksum(chartPath, sum)
+		}
+		if g.contentAddressed {
+			if err := g.storeBlob(chartPath, sum); err != nil {
+				return StatusFailed, writeFailed(err)
+			}
+		}
+	} else {
+		b, err := g.fetch(ctx, client, u)
+		if err != nil {
+			return StatusFailed, err
+		}
+		err = g.verify(r, u, func(expected string) error {
+			return verifyDigest(b.Bytes(), expected)
+		})
+		if err != nil {
+			return StatusFailed, err
+		}
+		if g.validateCharts {
+			if err := validateChart(bytes.NewReader(b.Bytes()), r.Chart.Name, r.Chart.Version); err != nil {
+				return StatusFailed, fmt.Errorf("%s: %s", u, err)
+			}
+		}
+		if g.registry != nil {
+			if err := g.registry.push(ctx, r.Chart.Metadata, b.Bytes()); err != nil {
+				return StatusFailed, err
+			}
+			g.addBytes(b.Len())
+			if err := g.state.add(r.Chart.Name, r.Chart.Version, chartPath, digest(b.Bytes()), int64(b.Len())); err != nil {
+				return StatusFailed, writeFailed(err)
+			}
+			return StatusDownloaded, nil
+		}
+		if err := g.writeMirrorFile(ctx, chartPath, b.Bytes()); err != nil {
+			return StatusFailed, err
+		}
+		g.addBytes(b.Len())
+		content = b.Bytes()
+		size = int64(len(content))
+		sum = digest(content)
+		if g.writeChecksums {
+			g.summary.addChecksum(chartPath, sum)
+		}
+		if g.contentAddressed && g.storage == nil && g.fs == nil {
+			if err := g.storeBlob(chartPath, sum); err != nil {
+				return StatusFailed, writeFailed(err)
+			}
+		}
+	}
+	g.summary.addChart(chartPath)
+	if g.signer != nil {
+		if err := g.signChart(ctx, chartPath, content); err != nil {
+			if !g.ignoreErrors {
+				return StatusFailed, err
+			}
+			// the chart itself was mirrored
+			g.log().Printf("WARNING: signing chart %s(%s) - %s", r.Name, r.Chart.Version, err)
+			g.reportError(r.Chart.Name, r.Chart.Version, u, err)
+		}
+	}
+	// the provenance file and the extra artifacts are next to the charts of
+	// HTTP(S) URLs only
+	if g.withProvenance && urlParsed.Scheme != ociScheme {
+		if err := g.downloadProvenance(ctx, chartRepo, *urlParsed, chartPath); err != nil {
+			if !g.ignoreErrors {
+				return StatusFailed, err
+			}
+			// the chart itself was mirrored
+			g.log().Printf("WARNING: processing provenance of chart %s(%s) - %s", r.Name, r.Chart.Version, err)
+			g.reportError(r.Chart.Name, r.Chart.Version, u, err)
+		}
+	}
+	if g.fetchExtraArtifacts && urlParsed.Scheme != ociScheme {
+		if err := g.downloadExtraArtifacts(ctx, chartRepo, r, urlParsed, chartPath); err != nil {
+			if !g.ignoreErrors {
+				return StatusFailed, err
 			}
+			// the chart itself was mirrored
+			g.log().Printf("WARNING: processing extra artifacts of chart %s(%s) - %s", r.Name, r.Chart.Version, err)
+			g.reportError(r.Chart.Name, r.Chart.Version, u, err)
 		}
 	}
+	if g.afterDownload != nil && g.storage == nil {
+		info := &ChartInfo{Name: r.Chart.Name, Version: r.Chart.Version, Digest: sum, URL: u, Metadata: r.Chart.Metadata}
+		if err := g.afterDownload(chartPath, info); err != nil {
+			if !g.ignoreErrors {
+				return StatusFailed, err
+			}
+			// the chart itself was mirrored
+			g.log().Printf("WARNING: after download hook of chart %s(%s) - %s", r.Name, r.Chart.Version, err)
+			g.reportError(r.Chart.Name, r.Chart.Version, u, err)
+		}
+	}
+	if err := g.state.add(r.Chart.Name, r.Chart.Version, chartPath, sum, size); err != nil {
+		return StatusFailed, writeFailed(err)
+	}
+	return StatusDownloaded, nil
+}
+
+// absoluteChartURL returns the chart URL u, parsed as parsed, resolved
+// against the repository URL when it is relative
+func (g *GetService) absoluteChartURL(u string, parsed *url.URL) string {
+	if parsed.IsAbs() {
+		return u
+	}
+	base, err := url.Parse(strings.TrimRight(g.config.URL, "/") + "/")
+	if err != nil {
+		return u
+	}
+	return base.ResolveReference(parsed).String()
+}
+
+// chartGetter returns the getter of the chart URL u, the charts of oci://
+// URLs are pulled from their registry
+func (g *GetService) chartGetter(chartRepo *repo.ChartRepository, u *url.URL) getter.Getter {
+	if u.Scheme == ociScheme {
+		return g.oci
+	}
+	return chartRepo.Client
+}
 
-	err = prepareIndexFile(g.config.Name, g.config.URL, g.newRootURL, g.logger, g.ignoreErrors)
+// urlHost returns the host of the absolute URL u
+func urlHost(u string) string {
+	parsed, err := url.Parse(u)
 	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// stateChartValid reports whether the chart c recorded by the state file can
+// be skipped: its file in the destination folder must still match the digest
+// of the index file, or the size recorded when the index has no digest, so a
+// chart truncated or removed since is downloaded again. The charts written
+// elsewhere, or recorded without a size, are trusted.
+func (g *GetService) stateChartValid(r *search.Result, c stateChart, chartPath string) bool {
+	if g.registry != nil || g.storage != nil || g.fs != nil || c.Size <= 0 {
+		return true
+	}
+	valid := false
+	if r.Chart.Digest != "" {
+		valid = upToDate(chartPath, r.Chart.Digest)
+	} else if info, err := os.Stat(chartPath); err == nil {
+		valid = info.Size() == c.Size
+	}
+	if !valid {
+		g.log().Printf("chart %s(%s) recorded by the state file does not match %s, downloading it again", r.Chart.Name, r.Chart.Version, chartPath)
+	}
+	return valid
+}
+
+// downloadChartFile streams the chart at u to chartPath with a .partial
+// suffix, resuming a previous partial download when possible, and moves it
+// into place once verified. A partial download that does not match the
+// digest or is not a valid chart is removed, the next attempt starts from
+// scratch.
+func (g *GetService) downloadChartFile(ctx context.Context, client streamGetter, r *search.Result, u string, chartPath string) (int64, string, error) {
+	partialName := chartPath + partialSuffix
+	size, sum, err := g.fetchToFile(ctx, client, u, partialName)
+	if err != nil {
+		return 0, "", err
+	}
+	err = g.verify(r, u, func(expected string) error {
+		return checkDigest(sum, expected)
+	})
+	if err == nil && g.validateCharts {
+		if verr := validateChartFile(partialName, r.Chart.Name, r.Chart.Version); verr != nil {
+			err = fmt.Errorf("%s: %s", u, verr)
+		}
+	}
+	if err != nil {
+		os.Remove(partialName)
+		return 0, "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(partialName, chartPath); err != nil {
+		return 0, "", writeFailed(err)
+	}
+	return size, sum, writeFailed(g.syncDir(path.Dir(chartPath)))
+}
+
+// verify checks the download of u against the digest of the chart with check
+// when digests are verified
+func (g *GetService) verify(r *search.Result, u string, check func(expected string) error) error {
+	if !g.verifyDigests {
+		return nil
+	}
+	if r.Chart.Digest == "" {
+		if g.verbose {
+			g.log().Printf("chart %s(%s) has no digest, skipping verification", r.Name, r.Chart.Version)
+		}
+		return nil
+	}
+	if err := check(r.Chart.Digest); err != nil {
+		return fmt.Errorf("%s: %s", u, err)
+	}
+	return nil
+}
+
+// oversized reports whether the chart at u is larger than the maximum chart
+// size, which is asked with a HEAD request. A chart whose size is not known
+// is only oversized when those are skipped.
+func (g *GetService) oversized(ctx context.Context, client interface{}, r *search.Result, u string) bool {
+	size := int64(-1)
+	if sizer, ok := client.(sizeGetter); ok {
+		s, err := sizer.Size(ctx, u)
+		if err != nil && g.verbose {
+			g.log().Printf("cannot get the size of %s - %s", u, err)
+		}
+		if err == nil {
+			size = s
+		}
+	}
+	switch {
+	case size < 0 && g.skipUnknownSize:
+		g.log().Printf("chart %s(%s) skipping, its size is unknown", r.Chart.Name, r.Chart.Version)
+		return true
+	case size > g.maxChartBytes:
+		g.log().Printf("chart %s(%s) skipping, %d bytes is over the maximum size of %d bytes", r.Chart.Name, r.Chart.Version, size, g.maxChartBytes)
+		return true
+	}
+	return false
+}
+
+// downloadProvenance downloads the provenance file of the chart at chartURL
+// next to chartPath. Charts without a provenance file are not an error.
+func (g *GetService) downloadProvenance(ctx context.Context, chartRepo *repo.ChartRepository, chartURL url.URL, chartPath string) error {
+	chartURL.Path += provSuffix
+	chartURL.RawPath = ""
+	b, err := g.fetch(ctx, chartRepo.Client, chartURL.String())
+	if err != nil {
+		if e, ok := err.(*statusError); ok && e.statusCode == http.StatusNotFound {
+			if g.verbose {
+				g.log().Printf("no provenance file found at %s", chartURL.String())
+			}
+			return nil
+		}
+		return err
+	}
+	if err := g.writeMirrorFile(ctx, chartPath+provSuffix, b.Bytes()); err != nil {
 		return err
 	}
+	g.addBytes(b.Len())
 	return nil
 }
 
-func writeFile(name string, content []byte, log *log.Logger, ignoreErrors bool) error {
+// chartPath returns where the chart downloaded from u is written. A chart
+// name or version with a path separator, or a URL path leading out of the
+// destination folder with its .. elements, is an error: nothing is ever
+// written outside of it.
+func (g *GetService) chartPath(r *search.Result, u *url.URL) (string, error) {
+	if !validPathElement(r.Chart.Name) || strings.ContainsAny(r.Chart.Version, `/\`) {
+		return "", fmt.Errorf("chart %s(%s) cannot be written, its name or version is not a valid file name", r.Chart.Name, r.Chart.Version)
+	}
+	// the reference of an oci:// URL is no file name
+	preserve := g.preserveURLFilename && u.Scheme != ociScheme
+	name := urlFileName(r.Chart.Name, r.Chart.Version, u.Path, preserve)
+	return containedPath(g.dir(), g.layout.chartPath(r.Chart.Name, name, u.Path))
+}
+
+// validPathElement reports whether s can be used as a single element of a
+// path, eg: a folder named after a chart
+func validPathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+// containedPath joins rel to dir, it is an error when the joined path is not
+// inside dir
+func containedPath(dir string, rel string) (string, error) {
+	joined := path.Join(dir, rel)
+	if !strings.HasPrefix(joined, strings.TrimRight(path.Clean(dir), "/")+"/") {
+		return "", fmt.Errorf("path %s is outside of the destination folder %s", rel, dir)
+	}
+	return joined, nil
+}
+
+// chartFileName returns the file name of a chart version, it is unique in a
+// chart repository
+func chartFileName(name string, version string) string {
+	return fmt.Sprintf("%s-%s.tgz", name, version)
+}
+
+// urlFileName returns the file name of the chart version downloaded from the
+// URL path p, the base name of p when preserved unless it has none
+func urlFileName(name string, version string, p string, preserve bool) string {
+	if base := path.Base(p); preserve && base != "." && base != "/" {
+		return base
+	}
+	return chartFileName(name, version)
+}
+
+// writeChart writes the chart next to its destination with a .partial suffix
+// and only moves it into place if ctx was not cancelled meanwhile. Errors are
+// always returned, the caller decides whether they are ignored.
+func writeChart(ctx context.Context, fs FileSystem, name string, content []byte, mode os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	partialName := name + partialSuffix
+	err := writeFile(fs, partialName, content, mode, nil, false)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return writeFailed(fs.Rename(partialName, name))
+}
+
+// writeFile writes content to name with the file mode mode, the missing
+// folders are created with the matching directory mode. When errors are
+// ignored a failure is logged and nothing is written.
+func writeFile(fs FileSystem, name string, content []byte, mode os.FileMode, log Printer, ignoreErrors bool) error {
 	// Create required subfolders structure
-	err := os.MkdirAll(path.Dir(name), 0744)
+	err := writeFailed(fs.MkdirAll(path.Dir(name), dirMode(mode)))
 	if err != nil {
-	  if ignoreErrors {
-		  log.Printf("cannot create destination folder: %s", name, err)
-	  } else {
-		  return err
-	  }
+		if ignoreErrors {
+			log.Printf("cannot create destination folder for %s: %s", name, err)
+			return nil
+		}
+		return err
 	}
 
 	// Write destination file
-	err = ioutil.WriteFile(name, content, 0666)
+	err = writeAtomic(fs, name, content, mode)
 	if err != nil {
-	  if ignoreErrors {
-		  log.Printf("cannot write files %s: %s", name, err)
-	  } else {
-		  return err
-	  }
+		if ignoreErrors {
+			log.Printf("cannot write files %s: %s", name, err)
+			return nil
+		}
+		return err
 	}
 	return nil
 }
 
-func prepareIndexFile(folder string, repoURL string, newRootURL string, log *log.Logger, ignoreErrors bool) error {
-	downloadedPath := path.Join(folder, downloadedFileName)
-	indexPath := path.Join(folder, indexFileName)
-	if newRootURL != "" {
-		indexContent, err := ioutil.ReadFile(downloadedPath)
+// writeAtomic writes content to a temporary file next to name and moves it
+// into place, so readers never see a partially written file
+func writeAtomic(fs FileSystem, name string, content []byte, mode os.FileMode) error {
+	tmp, err := fs.TempFile(path.Dir(name), "."+path.Base(name)+".*")
+	if err != nil {
+		return writeFailed(err)
+	}
+	// nothing is left to remove once the file was moved into place
+	defer fs.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return writeFailed(err)
+	}
+	if err := fs.Chmod(tmp.Name(), mode); err != nil {
+		return writeFailed(err)
+	}
+	return writeFailed(fs.Rename(tmp.Name(), name))
+}
+
+// downloadIndexFile downloads the index file of chartRepo to name through a
+// temporary file in the same folder, so name is never left truncated. It
+// returns errNotModified when previous is set and the index file did not
+// change, and the validators of the downloaded index file. The download is
+// aborted when ctx is done.
+func downloadIndexFile(ctx context.Context, fs FileSystem, chartRepo *repo.ChartRepository, name string, previous *indexValidators, mode os.FileMode) (*indexValidators, error) {
+	content, validators, err := fetchIndexFile(ctx, chartRepo, previous)
+	if err == errNotModified {
+		return nil, err
+	}
+	if err != nil {
+		return nil, indexDownloadFailed(err)
+	}
+	return validators, writeAtomic(fs, name, content, mode)
+}
+
+// dir returns the folder the mirror is written to, the output folder when
+// one is set or else the name of the repository
+func (g *GetService) dir() string {
+	if g.outputDir != "" {
+		return g.outputDir
+	}
+	return g.repoName()
+}
+
+// repoName returns the name of the repository, the override when one is set
+// or else the name of its entry
+func (g *GetService) repoName() string {
+	if g.repoNameOverride != "" {
+		return g.repoNameOverride
+	}
+	return g.config.Name
+}
+
+// mode returns the mode of the written files
+func (g *GetService) mode() os.FileMode {
+	if g.fileMode == 0 {
+		return DefaultFileMode
+	}
+	return g.fileMode
+}
+
+// dirMode returns the mode of the folders holding files with mode, every
+// read permission comes with the execute one (0644 gives 0755).
+func dirMode(mode os.FileMode) os.FileMode {
+	return mode | (mode&0444)>>2
+}
+
+// URLRewrite replaces the From URL with the To URL in the chart URLs of the
+// index file
+type URLRewrite struct {
+	From string
+	To   string
+}
+
+// prepareIndexFile rewrites the chart URLs of the index file downloaded to
+// rawPath and moves it to indexPath, or copies it there when keepRaw is set
+// so the file of the repository is kept as it was. The extra chart versions,
+// with URLs relative to the folder, are added to it, then edit modifies it
+// before it is written when it is not nil. With a flat or by name
+// layout the URLs are replaced by the chart paths, named after the base names
+// of the URLs when preserveFilename is set. The oci:// URLs are replaced by
+// the paths of the charts pulled from their registry.
+// The URLs of the repository repoURL are re-based under newRootURL, then the
+// rewrites are applied in order. The index file is required for the mirror
+// to be usable, so its errors are never ignored.
+func prepareIndexFile(fs FileSystem, rawPath string, indexPath string, repoURL string, newRootURL string, rewrites []URLRewrite, layout Layout, preserveFilename bool, extra []*repo.ChartVersion, edit IndexTransformFunc, keepRaw bool, mode os.FileMode) error {
+	if newRootURL != "" || len(rewrites) > 0 || layout.rewritesURLs() || len(extra) > 0 || edit != nil {
+		indexFile, err := loadIndexFile(fs, rawPath)
+		if err != nil {
+			return err
+		}
+		for _, cv := range extra {
+			if !hasVersion(indexFile, cv.Name, cv.Version) {
+				indexFile.Entries[cv.Name] = append(indexFile.Entries[cv.Name], cv)
+			}
+		}
+		if len(extra) > 0 {
+			indexFile.SortEntries()
+		}
+		for _, versions := range indexFile.Entries {
+			for _, v := range versions {
+				for i, u := range v.URLs {
+					u = normalizeURL(u)
+					if parsed, err := url.Parse(u); err == nil && parsed.Scheme == ociScheme {
+						u = strings.TrimLeft(layout.chartPath(v.Name, chartFileName(v.Name, v.Version), parsed.Path), "/")
+					} else if layout.rewritesURLs() {
+						p := u
+						if parsed, err := url.Parse(u); err == nil {
+							p = parsed.Path
+						}
+						u = layout.chartPath(v.Name, urlFileName(v.Name, v.Version, p, preserveFilename), p)
+					}
+					v.URLs[i] = rewriteURL(u, repoURL, newRootURL, rewrites)
+				}
+			}
+		}
+		if edit != nil {
+			if err := edit(indexFile); err != nil {
+				return err
+			}
+		}
+		content, err := yaml.Marshal(indexFile)
+		if err != nil {
+			return err
+		}
+		// the downloaded index is only removed once index.yaml is written,
+		// so a retry can start over from it
+		err = writeFile(fs, indexPath, content, mode, nil, false)
+		if err != nil || keepRaw {
+			return err
+		}
+		return fs.Remove(rawPath)
+	}
+	if keepRaw {
+		content, err := fs.ReadFile(rawPath)
+		if err != nil {
+			return err
+		}
+		return writeFile(fs, indexPath, content, mode, nil, false)
+	}
+	return moveFile(fs, rawPath, indexPath, mode)
+}
+
+// regenerateIndexFile builds the index file at indexPath from the charts
+// present in the folder and all its subfolders, with newRootURL as the base of
+// the chart URLs, and replaces the one downloaded to rawPath with it unless
+// keepRaw is set. edit modifies it before it is written when it is not nil.
+func regenerateIndexFile(fs FileSystem, folder string, rawPath string, indexPath string, newRootURL string, edit IndexTransformFunc, keepRaw bool, mode os.FileMode) error {
+	indexFile, err := indexTree(folder, newRootURL)
+	if err != nil {
+		return err
+	}
+	indexFile.SortEntries()
+	if edit != nil {
+		if err := edit(indexFile); err != nil {
+			return err
+		}
+	}
+	content, err := yaml.Marshal(indexFile)
+	if err != nil {
+		return err
+	}
+	err = writeFile(fs, indexPath, content, mode, nil, false)
+	if err != nil || keepRaw {
+		return err
+	}
+	return fs.Remove(rawPath)
+}
+
+// indexTree returns the index file of the chart archives of the folder at any
+// depth, like repo.IndexDirectory which only reads the first level of
+// subfolders. The files that are not charts are skipped.
+func indexTree(folder string, baseURL string) (*repo.IndexFile, error) {
+	indexFile := repo.NewIndexFile()
+	err := filepath.Walk(folder, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(name, ".tgz") {
+			return err
+		}
+		rel, err := filepath.Rel(folder, name)
 		if err != nil {
 			return err
 		}
-		content := bytes.Replace(indexContent, []byte(repoURL), []byte(newRootURL), -1)
-		err = writeFile(downloadedPath, []byte(content), log, ignoreErrors)
+		parentDir, fileName := path.Split(filepath.ToSlash(rel))
+		parentURL := strings.TrimSuffix(parentDir, "/")
+		if baseURL != "" {
+			if parentURL, err = urlutil.URLJoin(baseURL, parentURL); err != nil {
+				parentURL = path.Join(baseURL, parentDir)
+			}
+		}
+		c, err := chartutil.Load(name)
 		if err != nil {
+			// not a chart
 			return nil
 		}
+		hash, err := provenance.DigestFile(name)
+		if err != nil {
+			return err
+		}
+		indexFile.Add(c.Metadata, fileName, parentURL, hash)
+		return nil
+	})
+	return indexFile, err
+}
+
+// rewriteURL re-bases u under newRootURL when it is a URL of the repository
+// repoURL and applies the rewrites. The query and fragment of a rewritten URL
+// are dropped, as signed parameters (eg: presigned S3 URLs) of the upstream
+// repository are not valid for the mirror.
+func rewriteURL(u string, repoURL string, newRootURL string, rewrites []URLRewrite) string {
+	rewritten := u
+	if newRootURL != "" {
+		if rebased, ok := rebaseURL(u, repoURL, newRootURL); ok {
+			rewritten = rebased
+		}
+	}
+	for _, r := range rewrites {
+		if r.From != "" {
+			rewritten = strings.Replace(rewritten, r.From, r.To, -1)
+		}
+	}
+	if rewritten == u {
+		return u
+	}
+	return stripQuery(rewritten)
+}
+
+// rebaseURL resolves u against the repository URL repoURL and joins its path
+// relative to the repository to newRootURL, so
+// https://charts.example.com/stable/nginx/nginx-1.2.3.tgz of the repository
+// https://charts.example.com/stable is re-based as
+// https://mirror.example.com/helm/stable/nginx/nginx-1.2.3.tgz under
+// https://mirror.example.com/helm/stable, with or without trailing slashes.
+// ok is false when u is not a URL of the repository, eg: a chart served by
+// a CDN or a relative URL going up from the repository folder.
+func rebaseURL(u string, repoURL string, newRootURL string) (rebased string, ok bool) {
+	ref, err := url.Parse(u)
+	if err != nil {
+		return "", false
+	}
+	base, err := url.Parse(strings.TrimRight(repoURL, "/") + "/")
+	if err != nil {
+		return "", false
+	}
+	abs := base.ResolveReference(ref)
+	if !strings.EqualFold(abs.Scheme, base.Scheme) || !strings.EqualFold(abs.Host, base.Host) {
+		return "", false
+	}
+	if !strings.HasPrefix(abs.EscapedPath(), base.EscapedPath()) {
+		return "", false
+	}
+	rel := strings.TrimPrefix(abs.EscapedPath(), base.EscapedPath())
+	return strings.TrimRight(newRootURL, "/") + "/" + rel, true
+}
+
+// normalizeURL lowercases the host of u and collapses the duplicate slashes
+// of its path, so https://Repo/charts//nginx-1.2.3.tgz is downloaded, written
+// and rewritten like https://repo/charts/nginx-1.2.3.tgz. A URL that needs no
+// change, or cannot be parsed, is returned as is.
+func normalizeURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	host := strings.ToLower(parsed.Host)
+	if host == parsed.Host && !strings.Contains(parsed.Path, "//") && !strings.Contains(parsed.RawPath, "//") {
+		return u
+	}
+	parsed.Host = host
+	parsed.Path = collapseSlashes(parsed.Path)
+	parsed.RawPath = collapseSlashes(parsed.RawPath)
+	return parsed.String()
+}
+
+// collapseSlashes replaces the runs of slashes of p by a single one
+func collapseSlashes(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.Replace(p, "//", "/", -1)
+	}
+	return p
+}
+
+// stripQuery returns u without its query and fragment
+func stripQuery(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		return u[:i]
 	}
-	return os.Rename(downloadedPath, indexPath)
+	return u
 }
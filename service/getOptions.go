@@ -0,0 +1,882 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"k8s.io/helm/pkg/getter"
+)
+
+// GetOption configures optional behavior of a GetService
+type GetOption func(*GetService) error
+
+// WithConcurrency sets how many charts are downloaded in parallel,
+// DefaultConcurrency is used when n is 0 or lower
+func WithConcurrency(n int) GetOption {
+	return func(g *GetService) error {
+		g.concurrency = n
+		return nil
+	}
+}
+
+// WithMaxConcurrentPerHost bounds the charts downloaded at once from each
+// host to n, within the concurrency, eg: when the charts of an index file or
+// of their dependencies are on several hosts. The charts wait in a queue per
+// host before they take a worker, so a busy host leaves the workers to the
+// others. There is no bound per host when n is 0 or lower.
+func WithMaxConcurrentPerHost(n int) GetOption {
+	return func(g *GetService) error {
+		g.maxPerHost = n
+		return nil
+	}
+}
+
+// WithRetries retries failed chart downloads up to maxRetries times, waiting
+// for a random delay up to baseDelay before the first retry and doubling it
+// on each attempt, or as long as a Retry-After header asks up to the download
+// timeout. Only network errors, server errors (5xx) and rate limits (429) are
+// retried.
+func WithRetries(maxRetries int, baseDelay time.Duration) GetOption {
+	return func(g *GetService) error {
+		g.maxRetries = maxRetries
+		g.retryBaseDelay = baseDelay
+		return nil
+	}
+}
+
+// WithDigestVerification checks every downloaded chart against the digest of
+// its index entry, a mismatch is handled like a download error.
+func WithDigestVerification(verify bool) GetOption {
+	return func(g *GetService) error {
+		g.verifyDigests = verify
+		return nil
+	}
+}
+
+// WithVersionConstraint only mirrors the chart versions matching the semver
+// constraint (eg: `>=1.2.0, <2.0.0`). An exact chart version takes precedence.
+func WithVersionConstraint(constraint string) GetOption {
+	return func(g *GetService) error {
+		g.versionRange = constraint
+		if constraint == "" {
+			g.versionConstraint = nil
+			return nil
+		}
+		c, err := semver.NewConstraint(constraint)
+		if err != nil {
+			return fmt.Errorf("invalid version constraint %q: %s", constraint, err)
+		}
+		g.versionConstraint = c
+		return nil
+	}
+}
+
+// WithVersionInclude only mirrors the chart versions matching the regular
+// expression pattern, it fails when pattern is not valid.
+func WithVersionInclude(pattern string) GetOption {
+	return func(g *GetService) error {
+		re, err := compileVersionRegexp(pattern)
+		g.versionInclude = re
+		return err
+	}
+}
+
+// WithVersionExclude does not mirror the chart versions matching the regular
+// expression pattern, it fails when pattern is not valid.
+func WithVersionExclude(pattern string) GetOption {
+	return func(g *GetService) error {
+		re, err := compileVersionRegexp(pattern)
+		g.versionExclude = re
+		return err
+	}
+}
+
+func compileVersionRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version expression %q: %s", pattern, err)
+	}
+	return re, nil
+}
+
+// WithProgress calls fn after each chart is written to the destination folder,
+// calls are never concurrent.
+func WithProgress(fn ProgressFunc) GetOption {
+	return func(g *GetService) error {
+		g.progress = fn
+		return nil
+	}
+}
+
+// WithSkipExisting does not download the charts already present in the
+// destination folder when they match the digest of their index entry.
+func WithSkipExisting(skip bool) GetOption {
+	return func(g *GetService) error {
+		g.skipExisting = skip
+		return nil
+	}
+}
+
+// WithDownloadTimeout aborts a chart download that takes longer than timeout,
+// DefaultDownloadTimeout is used when timeout is 0 or lower
+func WithDownloadTimeout(timeout time.Duration) GetOption {
+	return func(g *GetService) error {
+		g.downloadTimeout = timeout
+		return nil
+	}
+}
+
+// WithSummaryFile writes a JSON summary of the downloaded, skipped and failed
+// charts to name in the destination folder. No summary is written when name
+// is empty.
+func WithSummaryFile(name string) GetOption {
+	return func(g *GetService) error {
+		g.summaryFile = name
+		return nil
+	}
+}
+
+// WithChartNames only mirrors the charts named in names, on top of the chart
+// name given to NewGetService
+func WithChartNames(names []string) GetOption {
+	return func(g *GetService) error {
+		g.chartNames = names
+		return nil
+	}
+}
+
+// WithProvenance also downloads the provenance file (.prov) of each chart,
+// charts without one are not an error.
+func WithProvenance(withProvenance bool) GetOption {
+	return func(g *GetService) error {
+		g.withProvenance = withProvenance
+		return nil
+	}
+}
+
+// withRegistry pushes the charts to an OCI registry, see NewOCIGetService
+func withRegistry(pusher *ociPusher) GetOption {
+	return func(g *GetService) error {
+		g.registry = pusher
+		return nil
+	}
+}
+
+// withSpecs only mirrors the charts of specs, see NewSpecGetService
+func withSpecs(specs []ChartSpec) GetOption {
+	return func(g *GetService) error {
+		g.specs = specs
+		return nil
+	}
+}
+
+// WithRegistryCredentials authenticates to the OCI registry of a service
+// created by NewOCIGetService, and to all the registries of the oci:// chart
+// URLs of an index file. Without them the credentials of the repository are
+// only sent to a registry of its host.
+func WithRegistryCredentials(username string, password string) GetOption {
+	return func(g *GetService) error {
+		g.registryUsername = username
+		g.registryPassword = password
+		if g.registry != nil {
+			g.registry.username = username
+			g.registry.password = password
+		}
+		return nil
+	}
+}
+
+// WithPlainHTTPRegistry talks to the OCI registry of a service created by
+// NewOCIGetService, and to the registries of the oci:// chart URLs of an
+// index file, over plain HTTP instead of HTTPS
+func WithPlainHTTPRegistry(plainHTTP bool) GetOption {
+	return func(g *GetService) error {
+		g.plainHTTPRegistry = plainHTTP
+		if g.registry != nil && plainHTTP {
+			g.registry.scheme = "http"
+		}
+		return nil
+	}
+}
+
+// WithURLRewrites rewrites more URLs of the index file, in order, after the
+// repository URL was rewritten to the new root URL
+func WithURLRewrites(rewrites []URLRewrite) GetOption {
+	return func(g *GetService) error {
+		g.rewrites = rewrites
+		return nil
+	}
+}
+
+// WithDryRun only logs the charts that would be downloaded and their
+// estimated size, nothing is written to the destination folder.
+func WithDryRun(dryRun bool) GetOption {
+	return func(g *GetService) error {
+		g.dryRun = dryRun
+		return nil
+	}
+}
+
+// WithFileMode sets the mode of the written files, DefaultFileMode when mode
+// is 0. Folders get the same permissions plus the matching execute bits.
+func WithFileMode(mode os.FileMode) GetOption {
+	return func(g *GetService) error {
+		g.fileMode = mode
+		return nil
+	}
+}
+
+// WithSkipPrereleases does not mirror the chart versions with a semver
+// pre-release, like 1.0.0-rc1. Without all versions the latest stable version
+// of each chart is mirrored, versions that are not semver are kept.
+func WithSkipPrereleases(skip bool) GetOption {
+	return func(g *GetService) error {
+		g.skipPrereleases = skip
+		return nil
+	}
+}
+
+// WithMaxVersionsPerChart only mirrors the max newest versions of each chart,
+// in semver order. There is no limit when max is 0 or less.
+func WithMaxVersionsPerChart(max int) GetOption {
+	return func(g *GetService) error {
+		g.maxVersionsPerChart = max
+		return nil
+	}
+}
+
+// WithRateLimit throttles the downloads to bytesPerSec bytes per second, the
+// limit is shared by all the concurrent downloads. There is no limit when
+// bytesPerSec is 0 or less.
+func WithRateLimit(bytesPerSec int64) GetOption {
+	return func(g *GetService) error {
+		g.rateLimit = bytesPerSec
+		return nil
+	}
+}
+
+// WithFlatLayout writes all the charts directly in the destination folder
+// instead of the subfolders of their URL paths, the chart URLs of the index
+// file are rewritten to match. It is the same as WithLayout(LayoutFlat).
+func WithFlatLayout(flat bool) GetOption {
+	return func(g *GetService) error {
+		if flat {
+			g.layout = LayoutFlat
+		} else if g.layout == LayoutFlat {
+			g.layout = LayoutURLPrefix
+		}
+		return nil
+	}
+}
+
+// WithRegeneratedIndex builds the index file from the charts written to the
+// destination folder instead of rewriting the upstream one, so it only lists
+// the charts that were actually mirrored.
+func WithRegeneratedIndex(regenerate bool) GetOption {
+	return func(g *GetService) error {
+		g.regenerateIndex = regenerate
+		return nil
+	}
+}
+
+// WithDependencies also mirrors the charts that the mirrored charts depend on,
+// read from their requirements.yaml or Chart.yaml, and their own dependencies.
+// The ones from other repositories are added to the index file.
+func WithDependencies(resolve bool) GetOption {
+	return func(g *GetService) error {
+		g.resolveDependencies = resolve
+		return nil
+	}
+}
+
+// WithLogger logs with l instead of the text logger of the *log.Logger given
+// to the constructor, eg: NewJSONLogger for structured logs
+func WithLogger(l Logger) GetOption {
+	return func(g *GetService) error {
+		g.eventLogger = l
+		return nil
+	}
+}
+
+// WithChartValidation checks that each downloaded chart is a well formed
+// archive whose Chart.yaml matches the name and version of the index file, a
+// chart that does not is a failed download
+func WithChartValidation(validate bool) GetOption {
+	return func(g *GetService) error {
+		g.validateCharts = validate
+		return nil
+	}
+}
+
+// WithModifiedSince only mirrors the chart versions created after since,
+// according to the created timestamps of the index file. The versions without
+// a timestamp are always mirrored. There is no filter when since is zero.
+func WithModifiedSince(since time.Time) GetOption {
+	return func(g *GetService) error {
+		g.modifiedSince = since
+		return nil
+	}
+}
+
+// WithErrorHandler calls fn for each chart error that is logged and ignored
+// when errors are ignored, calls are never concurrent. The errors are still
+// logged.
+func WithErrorHandler(fn ErrorFunc) GetOption {
+	return func(g *GetService) error {
+		g.onError = fn
+		return nil
+	}
+}
+
+// WithOutputDir writes the mirror to dir instead of the folder named after
+// the repository
+func WithOutputDir(dir string) GetOption {
+	return func(g *GetService) error {
+		g.outputDir = dir
+		return nil
+	}
+}
+
+// WithRepoName uses name as the name of the repository instead of the name
+// of its entry, eg: when that one is awkward as a folder name. It is the
+// folder the mirror is written to, unless an output folder is set, the
+// repository of the searched charts and the Repo of the logged events. The
+// charts are still downloaded from the URL of the entry.
+func WithRepoName(name string) GetOption {
+	return func(g *GetService) error {
+		g.repoNameOverride = name
+		return nil
+	}
+}
+
+// WithCompressedIndex also writes the index file gzip compressed as
+// index.yaml.gz, for the clients that fetch the smaller form
+func WithCompressedIndex(compress bool) GetOption {
+	return func(g *GetService) error {
+		g.compressIndex = compress
+		return nil
+	}
+}
+
+// WithChecksums writes a SHA256SUMS file in the destination folder with the
+// sha256 sums of the mirrored charts and of the index file, in the format of
+// sha256sum so that it can be checked with sha256sum -c
+func WithChecksums(write bool) GetOption {
+	return func(g *GetService) error {
+		g.writeChecksums = write
+		return nil
+	}
+}
+
+// WithStorageWriter writes the charts to w instead of the destination folder,
+// which only holds the index file and the other files written at the end of
+// the run until they are copied to w too. It is an error to also skip the
+// charts already present or resolve the dependencies, as both read the charts
+// back from the destination folder.
+func WithStorageWriter(w StorageWriter) GetOption {
+	return func(g *GetService) error {
+		g.storage = w
+		return nil
+	}
+}
+
+// WithFileSystem writes the mirror through fs instead of the OS file system.
+// The charts are then downloaded in memory instead of streamed to disk, and
+// the features that read the mirrored charts back, like skipping the charts
+// already present, still use the OS file system.
+func WithFileSystem(fs FileSystem) GetOption {
+	return func(g *GetService) error {
+		g.fs = fs
+		return nil
+	}
+}
+
+// WithKeywords only mirrors the chart versions that have all the keywords
+func WithKeywords(keywords []string) GetOption {
+	return func(g *GetService) error {
+		g.keywordFilter = keywords
+		return nil
+	}
+}
+
+// WithAnnotations only mirrors the chart versions that have all the
+// annotations with the same values
+func WithAnnotations(annotations map[string]string) GetOption {
+	return func(g *GetService) error {
+		g.annotationFilter = annotations
+		return nil
+	}
+}
+
+// WithMaintainer only mirrors the chart versions with a maintainer whose
+// name or email is maintainer, ignoring case, or with an email of its domain
+// when it starts with @ (eg: @example.com). With WithSourceURLPrefix too, a
+// chart version matching either of them is mirrored.
+func WithMaintainer(maintainer string) GetOption {
+	return func(g *GetService) error {
+		g.maintainerFilter = maintainer
+		return nil
+	}
+}
+
+// WithSourceURLPrefix only mirrors the chart versions with a source URL
+// starting with prefix, eg: https://github.com/example/. With WithMaintainer
+// too, a chart version matching either of them is mirrored.
+func WithSourceURLPrefix(prefix string) GetOption {
+	return func(g *GetService) error {
+		g.sourceURLPrefix = prefix
+		return nil
+	}
+}
+
+// WithUserAgent sets the User-Agent header of the requests to the chart
+// repository and to the OCI registry, DefaultUserAgent when it is empty
+func WithUserAgent(userAgent string) GetOption {
+	return func(g *GetService) error {
+		g.userAgent = userAgent
+		if g.registry != nil {
+			g.registry.userAgent = userAgent
+		}
+		return nil
+	}
+}
+
+// WithMergedIndex keeps the chart versions of the index file left in the
+// destination folder by a previous run that are no longer in the repository
+// index, so the index file of an append-only mirror lists all its charts
+func WithMergedIndex(mergeIndex bool) GetOption {
+	return func(g *GetService) error {
+		g.mergeIndex = mergeIndex
+		return nil
+	}
+}
+
+// WithFailOnMissing downloads all the charts it can, like when errors are
+// ignored, then fails Get when some of them could not be downloaded
+func WithFailOnMissing(failOnMissing bool) GetOption {
+	return func(g *GetService) error {
+		g.failOnMissing = failOnMissing
+		return nil
+	}
+}
+
+// WithLatestOnly only mirrors the newest version of each chart in semver
+// order, among the versions that pass the other filters, whether all the
+// versions were asked for or not
+func WithLatestOnly(latestOnly bool) GetOption {
+	return func(g *GetService) error {
+		g.latestOnly = latestOnly
+		return nil
+	}
+}
+
+// WithExactMatch matches the chart names exactly, the default, otherwise the
+// charts whose name contains one of the chart names are mirrored. Names are
+// compared ignoring case either way.
+func WithExactMatch(exactMatch bool) GetOption {
+	return func(g *GetService) error {
+		g.exactMatch = exactMatch
+		return nil
+	}
+}
+
+// WithNamePattern only mirrors the charts whose name matches the regular
+// expression pattern, it fails when pattern is not valid.
+func WithNamePattern(pattern string) GetOption {
+	return func(g *GetService) error {
+		if pattern == "" {
+			g.namePattern = nil
+			return nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid name pattern %q: %s", pattern, err)
+		}
+		g.namePattern = re
+		return nil
+	}
+}
+
+// WithMetrics notifies m of the outcome of each chart, eg: a
+// PrometheusMetrics shared by the runs of a mirror daemon
+func WithMetrics(m Metrics) GetOption {
+	return func(g *GetService) error {
+		g.metricsHook = m
+		return nil
+	}
+}
+
+// WithExtraArtifacts downloads next to each chart the extra artifacts (eg:
+// signing keys or values bundles) listed by URL in the annotation of the
+// chart, DefaultExtraArtifactsAnnotation when annotation is empty
+func WithExtraArtifacts(fetch bool, annotation string) GetOption {
+	return func(g *GetService) error {
+		g.fetchExtraArtifacts = fetch
+		g.extraArtifactsAnnotation = annotation
+		return nil
+	}
+}
+
+// WithMaxChartSize skips the charts larger than max bytes, their size is
+// asked with a HEAD request before the download. The charts whose size is
+// not known are downloaded, or skipped when skipUnknown is set. There is no
+// limit when max is 0 or less.
+func WithMaxChartSize(max int64, skipUnknown bool) GetOption {
+	return func(g *GetService) error {
+		g.maxChartBytes = max
+		g.skipUnknownSize = skipUnknown
+		return nil
+	}
+}
+
+// WithPrune deletes the charts of the destination folder that are no longer
+// in the filtered repository index at the end of a run where every chart
+// was downloaded. It is not supported with a storage writer, a file system
+// or a registry, and cannot be used with a merged index.
+func WithPrune(prune bool) GetOption {
+	return func(g *GetService) error {
+		g.prune = prune
+		return nil
+	}
+}
+
+// WithTracer starts the spans of the mirror runs of the service with tracer,
+// eg: an adapter of an OpenTelemetry tracer
+func WithTracer(tracer Tracer) GetOption {
+	return func(g *GetService) error {
+		g.tracer = tracer
+		return nil
+	}
+}
+
+// WithAppVersionConstraint only mirrors the chart versions whose app version
+// matches the semver constraint (eg: `~1.25.0`), the ones with an empty or
+// non-semver app version are skipped.
+func WithAppVersionConstraint(constraint string) GetOption {
+	return func(g *GetService) error {
+		g.appVersionRange = constraint
+		if constraint == "" {
+			g.appVersionConstraint = nil
+			return nil
+		}
+		c, err := semver.NewConstraint(constraint)
+		if err != nil {
+			return fmt.Errorf("invalid app version constraint %q: %s", constraint, err)
+		}
+		g.appVersionConstraint = c
+		return nil
+	}
+}
+
+// WithGetters registers custom getters, eg: for a scheme of an internal
+// artifact store. They download the index file and the charts of the URLs of
+// their schemes, before the built-in getters.
+func WithGetters(providers getter.Providers) GetOption {
+	return func(g *GetService) error {
+		g.customGetters = append(g.customGetters, providers...)
+		return nil
+	}
+}
+
+// WithContentAddressed stores the content of the charts once under
+// blobs/sha256/<digest> of the destination folder, the chart files being hard
+// links to them. Charts are copied when hard links are not supported. It has
+// no effect with a storage writer, a file system or a registry.
+func WithContentAddressed(contentAddressed bool) GetOption {
+	return func(g *GetService) error {
+		g.contentAddressed = contentAddressed
+		return nil
+	}
+}
+
+// WithCredentialsFile reads the credentials of the repository, and of the OCI
+// registry, from a Docker or Helm registry config file by host when they are
+// not given otherwise
+func WithCredentialsFile(name string) GetOption {
+	return func(g *GetService) error {
+		g.credentialsFile = name
+		return nil
+	}
+}
+
+// WithIncludeDeprecated mirrors the chart versions marked as deprecated in
+// the index file, the default, otherwise they are skipped
+func WithIncludeDeprecated(include bool) GetOption {
+	return func(g *GetService) error {
+		g.includeDeprecated = include
+		return nil
+	}
+}
+
+// WithPreserveURLFilename names the chart files after the base name of their
+// URL instead of <name>-<version>.tgz, so they match the file names the
+// index file references
+func WithPreserveURLFilename(preserve bool) GetOption {
+	return func(g *GetService) error {
+		g.preserveURLFilename = preserve
+		return nil
+	}
+}
+
+// WithLayout sets how the charts are laid out in the destination folder,
+// LayoutURLPrefix by default, the chart URLs of the index file are rewritten
+// to match. An empty layout leaves it unchanged.
+func WithLayout(layout Layout) GetOption {
+	return func(g *GetService) error {
+		if layout == "" {
+			return nil
+		}
+		if err := layout.validate(); err != nil {
+			return err
+		}
+		g.layout = layout
+		return nil
+	}
+}
+
+// WithFsync syncs the charts and the index files to disk once written, with
+// the folders they are in, so a mirror copied right after the run is not
+// missing writes lost on a power failure. It slows down the writes.
+func WithFsync(fsync bool) GetOption {
+	return func(g *GetService) error {
+		g.fsync = fsync
+		return nil
+	}
+}
+
+// WithAfterDownload calls fn after each chart is written to the destination
+// folder, it is not called for the charts pushed to a registry or a storage
+// writer
+func WithAfterDownload(fn AfterDownloadFunc) GetOption {
+	return func(g *GetService) error {
+		g.afterDownload = fn
+		return nil
+	}
+}
+
+// WithIndexConcurrency sets how many repositories of a MultiGetService
+// download their index file at once, separately from the chart downloads.
+// They are not bounded when n is 0 or lower, a single GetService ignores it.
+func WithIndexConcurrency(n int) GetOption {
+	return func(g *GetService) error {
+		g.indexConcurrency = n
+		return nil
+	}
+}
+
+// WithTarOutput writes the charts and the index files to the tar archive
+// name instead of the destination folder, gzipped when name ends with .gz or
+// .tgz. The paths in the archive follow the layout of the mirror, and the
+// destination folder only holds the index files the same as with a storage
+// writer. It cannot be used by a MultiGetService, nor by a SpecGetService
+// with charts in folders.
+func WithTarOutput(name string) GetOption {
+	return func(g *GetService) error {
+		g.tarOutput = name
+		return nil
+	}
+}
+
+// WithStateFile records each chart version mirrored in the state file name
+// of the destination folder, like .mirror-state.json. A run resumed from it
+// skips the chart versions it records, even when the index file has no
+// digests, unless its file no longer matches the digest of the index file or
+// the recorded size (eg: it was truncated). The state file is written every
+// few seconds at most while the charts are mirrored, and again when the run
+// completes or is cancelled.
+func WithStateFile(name string) GetOption {
+	return func(g *GetService) error {
+		g.stateFile = name
+		return nil
+	}
+}
+
+// WithIndexRetries retries a failed download of the index file up to
+// maxRetries times, separately from the charts since a run cannot go on
+// without it. The delays are the ones of WithRetries.
+func WithIndexRetries(maxRetries int) GetOption {
+	return func(g *GetService) error {
+		g.indexRetries = maxRetries
+		return nil
+	}
+}
+
+// WithBlocklist leaves out the chart versions given as <name>-<version>, like
+// the file name of their chart with or without the .tgz suffix, whatever the
+// other filters. The newest version of a chart that is not in the blocklist
+// is mirrored instead of a blocked one, also for the resolved dependencies.
+func WithBlocklist(entries []string) GetOption {
+	return func(g *GetService) error {
+		if g.blocklist == nil {
+			g.blocklist = map[string]bool{}
+		}
+		for _, e := range entries {
+			g.blocklist[blocklistKey(e)] = true
+		}
+		return nil
+	}
+}
+
+// WithBlocklistFile leaves out the chart versions of the blocklist file name,
+// one per line as for WithBlocklist. The blank lines and the lines starting
+// with # are ignored.
+func WithBlocklistFile(name string) GetOption {
+	return func(g *GetService) error {
+		entries, err := readBlocklist(name)
+		if err != nil {
+			return fmt.Errorf("cannot read the blocklist file: %s", err)
+		}
+		return WithBlocklist(entries)(g)
+	}
+}
+
+// WithCompletion calls fn once each run ended, with its statistics and its
+// error if any, after the totals were logged
+func WithCompletion(fn CompletionFunc) GetOption {
+	return func(g *GetService) error {
+		g.completion = fn
+		return nil
+	}
+}
+
+// WithIndexTimestamp sets the generated time of the index file, and the
+// created time of the charts of a regenerated one, to t so that mirrors of
+// the same charts have the same index file
+func WithIndexTimestamp(t time.Time) GetOption {
+	return func(g *GetService) error {
+		g.indexTimestamp = t
+		return nil
+	}
+}
+
+// WithReproducibleIndex sets the generated time of the index file to the
+// newest created time of its charts, unless WithIndexTimestamp gives one, so
+// that mirrors of the same charts have the same index file
+func WithReproducibleIndex(reproducible bool) GetOption {
+	return func(g *GetService) error {
+		g.reproducible = reproducible
+		return nil
+	}
+}
+
+// WithIndexOnly downloads and rewrites the index file of the repository
+// without searching or downloading any of its charts
+func WithIndexOnly(indexOnly bool) GetOption {
+	return func(g *GetService) error {
+		g.indexOnly = indexOnly
+		return nil
+	}
+}
+
+// WithMaxIdleConnsPerHost sets the number of idle connections kept open to
+// each host between the downloads, DefaultMaxIdleConnsPerHost or the
+// concurrency when it is higher when n is 0
+func WithMaxIdleConnsPerHost(n int) GetOption {
+	return func(g *GetService) error {
+		g.maxIdleConnsPerHost = n
+		return nil
+	}
+}
+
+// WithQuiet only logs the totals of each run, the messages and warnings of
+// the charts are dropped. The errors that stop a run are still returned.
+func WithQuiet(quiet bool) GetOption {
+	return func(g *GetService) error {
+		g.quiet = quiet
+		return nil
+	}
+}
+
+// WithMinTLSVersion refuses the servers only speaking TLS versions older
+// than version (eg: tls.VersionTLS13), DefaultMinTLSVersion when it is 0
+func WithMinTLSVersion(version uint16) GetOption {
+	return func(g *GetService) error {
+		g.minTLSVersion = version
+		return nil
+	}
+}
+
+// WithSigningKey signs each mirrored chart with the private key named name
+// in the keyring file, writing its provenance file (.prov) next to it. The
+// key is decrypted with passphrase when it is encrypted. The upstream
+// provenance files are not downloaded then, and the charts pushed to a
+// registry cannot be signed.
+func WithSigningKey(keyring string, name string, passphrase string) GetOption {
+	return func(g *GetService) error {
+		g.keyring = keyring
+		g.signingKey = name
+		g.passphrase = passphrase
+		return nil
+	}
+}
+
+// WithKeepRawIndex keeps the index file downloaded from the repository, as it
+// was before its chart URLs were rewritten, next to the index file of the
+// mirror instead of replacing it (eg: for auditing)
+func WithKeepRawIndex(keep bool) GetOption {
+	return func(g *GetService) error {
+		g.keepRawIndex = keep
+		return nil
+	}
+}
+
+// WithIndexFileNames names the index file of the mirror, index.yaml by
+// default, and the index file downloaded from the repository,
+// downloaded-index.yaml by default. An empty name keeps the default one.
+func WithIndexFileNames(index string, raw string) GetOption {
+	return func(g *GetService) error {
+		g.indexName = index
+		g.rawIndexName = raw
+		return nil
+	}
+}
+
+// WithOverallTimeout aborts a run that takes longer than timeout, whatever
+// is left of it, with an error matching ErrRunTimeout that tells how many
+// charts it completed, sent last on the channel of Fetch. It is separate from
+// the timeout of each download, a run has no overall timeout when timeout is
+// 0 or lower.
+func WithOverallTimeout(timeout time.Duration) GetOption {
+	return func(g *GetService) error {
+		g.overallTimeout = timeout
+		return nil
+	}
+}
+
+// WithIndexTransform modifies the index file of the mirror with fn before it
+// is written, its chart URLs are still rewritten first. It is also called in
+// index only runs.
+func WithIndexTransform(fn IndexTransformFunc) GetOption {
+	return func(g *GetService) error {
+		g.indexTransform = fn
+		return nil
+	}
+}
+
+// WithConditionalIndex keeps the ETag and Last-Modified headers of the index
+// file of a complete run in the destination folder, and sends them back on
+// the next run: when the index file was not modified since, nothing is done.
+// The index file is downloaded again when the one of the mirror is missing,
+// or by a run of other filters. A run with failed charts, their errors
+// ignored or not, or an index only run does not keep them.
+func WithConditionalIndex(conditional bool) GetOption {
+	return func(g *GetService) error {
+		g.conditionalIndex = conditional
+		return nil
+	}
+}
+
+// WithForcedRecheck downloads the index file and checks the charts even when
+// the index file was not modified since the last run
+func WithForcedRecheck(force bool) GetOption {
+	return func(g *GetService) error {
+		g.forceRecheck = force
+		return nil
+	}
+}
@@ -1,16 +1,31 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/Masterminds/semver"
+	"github.com/ghodss/yaml"
 	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/cmd/helm/search"
 
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/repo"
 )
 
@@ -29,7 +44,8 @@ func TestNewGetService(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 	config := repo.Entry{Name: dir, URL: "http://helmrepo"}
-	gService := &GetService{config: config, logger: fakeLogger, newRootURL: "https://newchartserver.com", allVersions: false}
+	gService := &GetService{config: config, logger: fakeLogger, newRootURL: "https://newchartserver.com", allVersions: false, exactMatch: true, includeDeprecated: true}
+	gServiceConcurrency := &GetService{config: config, logger: fakeLogger, newRootURL: "https://newchartserver.com", allVersions: false, concurrency: 8, exactMatch: true, includeDeprecated: true}
 	type args struct {
 		helmRepo     string
 		workspace    string
@@ -40,17 +56,32 @@ func TestNewGetService(t *testing.T) {
 		allVersions  bool
 		chartName    string
 		chartVersion string
+		opts         []GetOption
 	}
 	tests := []struct {
-		name string
-		args args
-		want GetServiceInterface
+		name    string
+		args    args
+		want    GetServiceInterface
+		wantErr bool
 	}{
-		{"1", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", ""}, gService},
+		{"1", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", nil}, gService, false},
+		{"2", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithConcurrency(8)}}, gServiceConcurrency, false},
+		{"3", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithVersionConstraint("")}}, gService, false},
+		{"4", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithVersionConstraint(">=1.x.y")}}, nil, true},
+		{"5", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithVersionInclude(""), WithVersionExclude("")}}, gService, false},
+		{"6", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithVersionExclude("-alpha(")}}, nil, true},
+		{"7", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithAppVersionConstraint("")}}, gService, false},
+		{"8", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithAppVersionConstraint("~1.x.y")}}, nil, true},
+		{"9", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithFlatLayout(false), WithLayout("")}}, gService, false},
+		{"10", args{"http://helmrepo", dir, false, false, fakeLogger, "https://newchartserver.com", false, "", "", []GetOption{WithLayout("nested")}}, nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := NewGetService(config, tt.args.verbose, tt.args.allVersions, tt.args.ignoreErrors, tt.args.logger, tt.args.newRootURL, tt.args.chartName, tt.args.chartVersion); !reflect.DeepEqual(got, tt.want) {
+			got, err := NewGetService(config, tt.args.verbose, tt.args.allVersions, tt.args.ignoreErrors, tt.args.logger, tt.args.newRootURL, tt.args.chartName, tt.args.chartVersion, tt.args.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewGetService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NewGetService() = %v, want %v", got, tt.want)
 			}
 		})
@@ -64,7 +95,7 @@ func TestGetService_Get(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 	svr := fixtures.StartHTTPServer()
-	defer svr.Shutdown(nil)
+	defer svr.Shutdown(context.Background())
 	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
 	type fields struct {
 		repoURL      string
@@ -90,7 +121,7 @@ func TestGetService_Get(t *testing.T) {
 		{"7", fields{"http://127.0.0.1:1793", path.Join(dir, "get"), true, true, false, "", ""}, false, 3},
 		{"8", fields{"http://127.0.0.1:1793", path.Join(dir, "get"), true, true, false, "chart2", ""}, false, 1},
 		{"9", fields{"http://127.0.0.1:1793", path.Join(dir, "get"), true, true, false, "chart", ""}, false, 0},
-		{"10", fields{"http://127.0.0.1:1793", path.Join(dir, "get"), true, true, false, `^(?:(?:aa)|.$`, ""}, true, 0},
+		{"10", fields{"http://127.0.0.1:1793", path.Join(dir, "get"), true, true, false, `^(?:(?:aa)|.$`, ""}, false, 0},
 		{"11", fields{"http://127.0.0.1:1793", path.Join(dir, "get"), true, true, false, "chart2", "7.0.0"}, false, 0},
 		{"12", fields{"http://127.0.0.1:1793", path.Join(dir, "get"), true, true, false, "chart2", "0.0.0-rc1"}, false, 1},
 		{"13", fields{"http://127.0.0.1:1793", path.Join(dir, "get"), true, true, true, "chart2", ""}, false, 2},
@@ -106,8 +137,9 @@ func TestGetService_Get(t *testing.T) {
 				allVersions:  tt.fields.allVersions,
 				chartName:    tt.fields.chartName,
 				chartVersion: tt.fields.chartVersion,
+				exactMatch:   true,
 			}
-			if err := g.Get(); (err != nil) != tt.wantErr {
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
 			}
 			if !tt.wantErr {
@@ -131,75 +163,1883 @@ func TestGetService_Get(t *testing.T) {
 	os.RemoveAll("downloaded-index.yaml")
 }
 
-func Test_writeFile(t *testing.T) {
-	type args struct {
+func TestGetService_GetConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
 		name         string
-		content      []byte
-		log          *log.Logger
+		concurrency  int
 		ignoreErrors bool
+		wantErr      bool
+		wantTgz      int
+	}{
+		{"1", 0, true, false, 4},
+		{"2", 1, true, false, 4},
+		{"3", 16, true, false, 4},
+		{"4", 2, false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:       fakeLogger,
+				ignoreErrors: tt.ignoreErrors,
+				allVersions:  true,
+				concurrency:  tt.concurrency,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				files, err := filepath.Glob(path.Join(workDir, "*.tgz"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(files) != tt.wantTgz {
+					t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), tt.wantTgz)
+				}
+			}
+		})
 	}
+}
+
+func TestGetService_GetVerifyDigests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	// digests in the fixtures index do not match the served charts
 	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
+		name          string
+		verifyDigests bool
+		ignoreErrors  bool
+		wantErr       bool
+		wantTgz       int
 	}{
-		{"1", args{"tmp.txt", []byte("test"), fakeLogger, false}, false},
-		{"2", args{"", []byte("test"), fakeLogger, false}, true},
-		{"2", args{"", []byte("test"), fakeLogger, true}, false},
+		{"1", false, true, false, 4},
+		{"2", true, true, false, 0},
+		{"3", true, false, true, 0},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := writeFile(tt.args.name, tt.args.content, tt.args.log, tt.args.ignoreErrors); (err != nil) != tt.wantErr {
-				t.Errorf("writeFile() error = %v, wantErr %v", err, tt.wantErr)
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:        repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:        fakeLogger,
+				ignoreErrors:  tt.ignoreErrors,
+				allVersions:   true,
+				verifyDigests: tt.verifyDigests,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			if len(files) != tt.wantTgz {
+				t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), tt.wantTgz)
 			}
 		})
 	}
-	os.RemoveAll("tmp.txt")
 }
 
-func Test_prepareIndexFile(t *testing.T) {
-	dir, err := prepareTmp()
+func TestGetService_GetProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
 	if err != nil {
-		t.Errorf("loading testdata: %s", err)
+		t.Errorf("Creating tmp directory: %s", err)
 	}
 	defer os.RemoveAll(dir)
-	type args struct {
-		folder       string
-		URL          string
-		newRootURL   string
-		log          *log.Logger
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	calls := 0
+	lastCurrent := 0
+	g := &GetService{
+		config:       repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+		logger:       fakeLogger,
+		ignoreErrors: true,
+		allVersions:  true,
+		progress: func(chartName string, version string, current int, total int) {
+			calls++
+			if current != lastCurrent+1 {
+				t.Errorf("progress current = %v, want %v", current, lastCurrent+1)
+			}
+			lastCurrent = current
+			// chart4 is in the index but cannot be downloaded
+			if total != 5 {
+				t.Errorf("progress total = %v, want 5", total)
+			}
+		},
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Errorf("GetService.Get() error = %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("progress calls = %v, want 4", calls)
+	}
+}
+
+func TestGetService_GetErrorHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name         string
 		ignoreErrors bool
+		wantErr      bool
+		wantCalls    []string
+	}{
+		{"1", true, false, []string{"chart3(0.0.1-rc1) http://127.0.0.1:1793/chart4-0.0.1.tgz"}},
+		{"2", false, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			g := &GetService{
+				config:       repo.Entry{Name: path.Join(dir, tt.name), URL: "http://127.0.0.1:1793"},
+				logger:       fakeLogger,
+				ignoreErrors: tt.ignoreErrors,
+				allVersions:  true,
+				onError: func(chartName string, version string, url string, err error) {
+					if err == nil {
+						t.Errorf("error callback called without error")
+					}
+					calls = append(calls, fmt.Sprintf("%s(%s) %s", chartName, version, url))
+				},
+			}
+			os.MkdirAll(g.config.Name, 0755)
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("error callback calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestGetService_GetFailOnMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name          string
+		ignoreErrors  bool
+		failOnMissing bool
+		wantErr       bool
+	}{
+		{"1", true, false, false},
+		{"2", true, true, true},
+		{"3", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GetService{
+				config:        repo.Entry{Name: path.Join(dir, tt.name), URL: "http://127.0.0.1:1793"},
+				logger:        fakeLogger,
+				ignoreErrors:  tt.ignoreErrors,
+				failOnMissing: tt.failOnMissing,
+				allVersions:   true,
+			}
+			os.MkdirAll(g.config.Name, 0755)
+			err := g.Get(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "chart3(0.0.1-rc1)") {
+				t.Errorf("GetService.Get() error = %v, want the missing chart", err)
+			}
+			files, _ := filepath.Glob(path.Join(g.config.Name, "*.tgz"))
+			if len(files) != fixtures.Expectedcharts-1 {
+				t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), fixtures.Expectedcharts-1)
+			}
+			if _, err := os.Stat(path.Join(g.config.Name, indexFileName)); err != nil {
+				t.Errorf("GetService.Get() index.yaml not written: %s", err)
+			}
+		})
+	}
+}
+
+func TestGetService_GetFallbackURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
 	}
+	defer os.RemoveAll(dir)
+	var (
+		mu        sync.Mutex
+		requested []string
+		working   map[string]bool
+		index     []byte
+	)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+indexFileName {
+			w.Write(index)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		ok := working[r.URL.Path]
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	indexFile := repo.NewIndexFile()
+	indexFile.Entries["chart1"] = repo.ChartVersions{{
+		Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart1", Version: "1.0.0"},
+		URLs:     []string{svr.URL + "/first/chart1-1.0.0.tgz", svr.URL + "/second/chart1-1.0.0.tgz"},
+	}}
+	index, _ = yaml.Marshal(indexFile)
 	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
+		name          string
+		working       []string
+		ignoreErrors  bool
+		wantErr       bool
+		wantRequested []string
+		wantFile      string
 	}{
-		{"1", args{path.Join(dir, "processfolder"), "http://127.0.0.1:1793", "http://newchart.server.com", fakeLogger, false}, false},
-		{"2", args{path.Join(dir, "processerrorfolder"), "http://127.0.0.1:1793", "http://newchart.server.com", fakeLogger, false}, true},
-		{"3", args{path.Join(dir, "processfolder"), "http://127.0.0.1:1793", "", fakeLogger, false}, false},
+		{"1", []string{"/first/chart1-1.0.0.tgz", "/second/chart1-1.0.0.tgz"}, false, false, []string{"/first/chart1-1.0.0.tgz"}, "first/chart1-1.0.0.tgz"},
+		{"2", []string{"/second/chart1-1.0.0.tgz"}, false, false, []string{"/first/chart1-1.0.0.tgz", "/second/chart1-1.0.0.tgz"}, "first/chart1-1.0.0.tgz"},
+		{"3", nil, false, true, []string{"/first/chart1-1.0.0.tgz", "/second/chart1-1.0.0.tgz"}, ""},
+		{"4", nil, true, false, []string{"/first/chart1-1.0.0.tgz", "/second/chart1-1.0.0.tgz"}, ""},
 	}
 	for _, tt := range tests {
-		ioutil.WriteFile(path.Join(dir, "processfolder", "downloaded-index.yaml"), []byte(fixtures.IndexYaml), 0666)
 		t.Run(tt.name, func(t *testing.T) {
-			if err := prepareIndexFile(tt.args.folder, tt.args.URL, tt.args.newRootURL, tt.args.log, tt.args.ignoreErrors); (err != nil) != tt.wantErr {
-				t.Errorf("prepareIndexFile() error = %v, wantErr %v", err, tt.wantErr)
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			mu.Lock()
+			requested = nil
+			working = map[string]bool{}
+			for _, p := range tt.working {
+				working[p] = true
 			}
-			if tt.name == "1" {
-				contentBytes, err := ioutil.ReadFile(path.Join(dir, "processfolder", "index.yaml"))
-				if err != nil {
-					t.Log("Error reading index.yaml")
+			mu.Unlock()
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: svr.URL},
+				logger:       fakeLogger,
+				ignoreErrors: tt.ignoreErrors,
+				allVersions:  true,
+				newRootURL:   "https://mirror.local.lan",
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(requested, tt.wantRequested) {
+				t.Errorf("GetService.Get() requested = %v, want %v", requested, tt.wantRequested)
+			}
+			var files []string
+			filepath.Walk(workDir, func(p string, info os.FileInfo, err error) error {
+				if err == nil && strings.HasSuffix(p, ".tgz") {
+					rel, _ := filepath.Rel(workDir, p)
+					files = append(files, filepath.ToSlash(rel))
 				}
-				content := string(contentBytes)
-				count := strings.Count(content, tt.args.newRootURL)
-				if count != fixtures.Expectedcharts {
-					t.Errorf("prepareIndexFile() replacedCount = %v, want replacedCount %v", count, fixtures.Expectedcharts)
+				return nil
+			})
+			if tt.wantFile == "" && len(files) > 0 || tt.wantFile != "" && !reflect.DeepEqual(files, []string{tt.wantFile}) {
+				t.Errorf("GetService.Get() files = %v, want %v", files, tt.wantFile)
+			}
+			if tt.wantFile == "" {
+				return
+			}
+			// the index file points to the written chart
+			mirrored, err := repo.LoadIndexFile(path.Join(workDir, indexFileName))
+			if err != nil {
+				t.Fatalf("loading index file: %s", err)
+			}
+			if cv, err := mirrored.Get("chart1", "1.0.0"); err != nil || cv.URLs[0] != "https://mirror.local.lan/"+tt.wantFile {
+				t.Errorf("GetService.Get() index file URLs = %v, want https://mirror.local.lan/%s first", cv.URLs, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestGetService_GetSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	g := &GetService{
+		config:       repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+		logger:       fakeLogger,
+		ignoreErrors: true,
+		allVersions:  true,
+		summaryFile:  "mirror-summary.json",
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Errorf("GetService.Get() error = %v", err)
+	}
+	content, err := ioutil.ReadFile(path.Join(dir, "mirror-summary.json"))
+	if err != nil {
+		t.Fatalf("reading summary: %s", err)
+	}
+	if got := strings.Count(string(content), `"downloaded"`); got != 4 {
+		t.Errorf("summary downloaded count = %v, want 4", got)
+	}
+	if got := strings.Count(string(content), `"failed"`); got != 1 {
+		t.Errorf("summary failed count = %v, want 1", got)
+	}
+}
+
+func TestGetService_GetSkipPrereleases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	// chart2 has a stable and a pre-release version, chart3 only a
+	// pre-release one and chart4 is missing
+	tests := []struct {
+		name        string
+		allVersions bool
+		want        []string
+	}{
+		{"1", false, []string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}},
+		{"2", true, []string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:          repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:          fakeLogger,
+				ignoreErrors:    true,
+				allVersions:     tt.allVersions,
+				skipPrereleases: true,
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			got := []string{}
+			for _, f := range files {
+				got = append(got, filepath.Base(f))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetService.Get() charts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_GetLatestOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name              string
+		allVersions       bool
+		versionConstraint string
+		want              []string
+	}{
+		{"1", true, "", []string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}},
+		{"2", false, "", []string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}},
+		{"3", true, "< 1.0.0-0", []string{"chart2-0.0.0-rc1.tgz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:       fakeLogger,
+				ignoreErrors: true,
+				allVersions:  tt.allVersions,
+				latestOnly:   true,
+				// both versions of chart3 are 0.0.1-rc1
+				chartNames: []string{"chart1", "chart2"},
+			}
+			if tt.versionConstraint != "" {
+				g.versionConstraint, _ = semver.NewConstraint(tt.versionConstraint)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			got := []string{}
+			for _, f := range files {
+				got = append(got, filepath.Base(f))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetService.Get() charts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_GetStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	g := &GetService{
+		config:       repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+		logger:       fakeLogger,
+		ignoreErrors: true,
+		allVersions:  true,
+	}
+	if g.Stats() != nil {
+		t.Errorf("GetService.Stats() = %+v before Get, want nil", g.Stats())
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Errorf("GetService.Get() error = %v", err)
+	}
+	files, _ := filepath.Glob(path.Join(dir, "*.tgz"))
+	var size int64
+	for _, f := range files {
+		fi, _ := os.Stat(f)
+		size += fi.Size()
+	}
+	stats := g.Stats()
+	if stats == nil {
+		t.Fatalf("GetService.Stats() = nil after Get")
+	}
+	if stats.Downloaded != 4 || stats.Skipped != 0 || stats.Failed != 1 {
+		t.Errorf("GetService.Stats() = %+v, want 4 downloaded and 1 failed", stats)
+	}
+	if stats.BytesWritten != size || size == 0 {
+		t.Errorf("GetService.Stats() BytesWritten = %v, want %v", stats.BytesWritten, size)
+	}
+	if stats.Duration <= 0 {
+		t.Errorf("GetService.Stats() Duration = %v, want > 0", stats.Duration)
+	}
+}
+
+func TestGetService_GetWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	// chart4 is missing from the chart repository
+	tests := []struct {
+		name           string
+		ignoreErrors   bool
+		wantDownloaded int
+		wantFailed     int
+		wantIndex      bool
+		wantErr        bool
+	}{
+		{"1", true, 3, 2, true, false},
+		{"2", false, 0, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			// a folder in place of the partial file makes the chart write fail
+			os.MkdirAll(path.Join(workDir, "chart1-2.11.0.tgz.partial"), 0755)
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:       fakeLogger,
+				ignoreErrors: tt.ignoreErrors,
+				allVersions:  true,
+				concurrency:  1,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			downloaded, failed := 0, 0
+			for _, r := range g.summary.results {
+				switch r.Status {
+				case StatusDownloaded:
+					downloaded++
+				case StatusFailed:
+					failed++
 				}
-				_, err = os.Stat(path.Join(dir, "processfolder", "downloaded-index.yaml"))
-				if err == nil {
-					t.Errorf("prepareIndexFile() dowloaded-index.yaml not deleted")
+			}
+			if tt.ignoreErrors && (downloaded != tt.wantDownloaded || failed != tt.wantFailed) {
+				t.Errorf("GetService.Get() downloaded/failed = %v/%v, want %v/%v", downloaded, failed, tt.wantDownloaded, tt.wantFailed)
+			}
+			if _, err := os.Stat(path.Join(workDir, "chart1-2.11.0.tgz")); err == nil {
+				t.Errorf("GetService.Get() chart1 written")
+			}
+			if _, err := os.Stat(path.Join(workDir, "index.yaml")); (err == nil) != tt.wantIndex {
+				t.Errorf("GetService.Get() index present = %v, want %v", err == nil, tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestGetService_GetProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	// only chart1 has a provenance file
+	tests := []struct {
+		name           string
+		withProvenance bool
+		wantProv       int
+	}{
+		{"1", false, 0},
+		{"2", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:         repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:         fakeLogger,
+				ignoreErrors:   true,
+				allVersions:    true,
+				withProvenance: tt.withProvenance,
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.prov"))
+			if len(files) != tt.wantProv {
+				t.Errorf("GetService.Get() got count of = %v prov files, want count of %v", len(files), tt.wantProv)
+			}
+			if tt.wantProv > 0 {
+				content, _ := ioutil.ReadFile(path.Join(workDir, "chart1-2.11.0.tgz.prov"))
+				if string(content) != fixtures.ChartProv {
+					t.Errorf("GetService.Get() provenance content = %q, want %q", content, fixtures.ChartProv)
 				}
 			}
 		})
 	}
 }
+
+func TestGetService_GetFlatLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/index.yaml":
+			w.Write([]byte(index))
+		case strings.HasPrefix(r.URL.Path, "/charts/stable/chart4"):
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasPrefix(r.URL.Path, "/charts/stable/"):
+			w.Write([]byte("chart"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	index = strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", svr.URL+"/charts/stable/", -1)
+	tests := []struct {
+		name       string
+		layout     Layout
+		wantFolder string
+		wantURL    string
+	}{
+		{"1", "", "charts/stable", "http://mirror.local.lan/charts/stable/chart1-2.11.0.tgz"},
+		{"2", LayoutFlat, "", "http://mirror.local.lan/chart1-2.11.0.tgz"},
+		{"3", LayoutURLPrefix, "charts/stable", "http://mirror.local.lan/charts/stable/chart1-2.11.0.tgz"},
+		{"4", LayoutByName, "*", "http://mirror.local.lan/chart1/chart1-2.11.0.tgz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: svr.URL},
+				logger:       fakeLogger,
+				ignoreErrors: true,
+				allVersions:  true,
+				newRootURL:   "http://mirror.local.lan",
+				layout:       tt.layout,
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, tt.wantFolder, "*.tgz"))
+			if len(files) != fixtures.Expectedcharts-1 {
+				t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), fixtures.Expectedcharts-1)
+			}
+			content, _ := ioutil.ReadFile(path.Join(workDir, "index.yaml"))
+			if !strings.Contains(string(content), tt.wantURL) {
+				t.Errorf("GetService.Get() index.yaml does not contain %s", tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestGetService_GetOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	outputDir := path.Join(dir, "mystable")
+	os.MkdirAll(outputDir, 0755)
+	g := &GetService{
+		config:       repo.Entry{Name: path.Join(dir, "stable"), URL: "http://127.0.0.1:1793"},
+		logger:       fakeLogger,
+		ignoreErrors: true,
+		allVersions:  true,
+		outputDir:    outputDir,
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Errorf("GetService.Get() error = %v", err)
+	}
+	files, _ := filepath.Glob(path.Join(outputDir, "*.tgz"))
+	if len(files) != 4 {
+		t.Errorf("GetService.Get() charts in the output folder = %v, want 4", len(files))
+	}
+	if _, err := os.Stat(path.Join(outputDir, indexFileName)); err != nil {
+		t.Errorf("GetService.Get() index file in the output folder: %s", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "stable")); !os.IsNotExist(err) {
+		t.Errorf("GetService.Get() wrote to the repository folder: %v", err)
+	}
+}
+
+func TestGetService_GetRepoName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name      string
+		repoName  string
+		outputDir string
+		wantDir   string
+	}{
+		{"1", path.Join(dir, "mirror1"), "", path.Join(dir, "mirror1")},
+		{"2", path.Join(dir, "mirror2"), path.Join(dir, "output2"), path.Join(dir, "output2")},
+		{"3", "", "", path.Join(dir, "stable:charts")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.MkdirAll(tt.wantDir, 0755)
+			g, err := NewGetService(repo.Entry{Name: path.Join(dir, "stable:charts"), URL: "http://127.0.0.1:1793"}, true, false, true, fakeLogger, "", "chart2", "",
+				WithRepoName(tt.repoName), WithOutputDir(tt.outputDir))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			files, _ := filepath.Glob(path.Join(tt.wantDir, "chart2-*.tgz"))
+			if len(files) == 0 {
+				t.Errorf("GetService.Get() no chart2 in %v", tt.wantDir)
+			}
+			if _, err := os.Stat(path.Join(tt.wantDir, indexFileName)); err != nil {
+				t.Errorf("GetService.Get() index file in %v: %s", tt.wantDir, err)
+			}
+			if tt.repoName != "" {
+				if _, err := os.Stat(path.Join(dir, "stable:charts")); !os.IsNotExist(err) {
+					t.Errorf("GetService.Get() wrote to the folder of the repository entry: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetService_GetCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g := &GetService{
+		config:       repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+		logger:       fakeLogger,
+		ignoreErrors: true,
+		allVersions:  true,
+	}
+	if err := g.Get(ctx); err != context.Canceled {
+		t.Errorf("GetService.Get() error = %v, want %v", err, context.Canceled)
+	}
+	files, _ := filepath.Glob(path.Join(dir, "*.tgz"))
+	if len(files) != 0 {
+		t.Errorf("GetService.Get() got count of = %v TGZ files, want count of 0", len(files))
+	}
+}
+
+func TestGetService_GetIndexInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the connection is closed in the middle of the index file
+		w.Header().Set("Content-Length", strconv.Itoa(len(fixtures.IndexYaml)))
+		w.Write([]byte(fixtures.IndexYaml[:len(fixtures.IndexYaml)/2]))
+	}))
+	defer svr.Close()
+	ioutil.WriteFile(path.Join(dir, indexFileName), []byte("previous"), 0644)
+	g := &GetService{
+		config: repo.Entry{Name: dir, URL: svr.URL},
+		logger: fakeLogger,
+	}
+	if err := g.Get(context.Background()); err == nil {
+		t.Errorf("GetService.Get() error = %v, wantErr true", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != indexFileName {
+		t.Errorf("GetService.Get() left %v files, want only %s", len(files), indexFileName)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(dir, indexFileName)); string(content) != "previous" {
+		t.Errorf("GetService.Get() index.yaml = %q, want %q", content, "previous")
+	}
+}
+
+func TestGetService_GetStaleIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	// left by an interrupted run, it must not be used instead of the
+	// downloaded index file
+	os.MkdirAll(path.Join(dir, "stale"), 0755)
+	ioutil.WriteFile(path.Join(dir, "stale", downloadedFileName), []byte("apiVersion: v1\nentries: {}\n"), 0644)
+	g := &GetService{
+		config:       repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+		logger:       fakeLogger,
+		ignoreErrors: true,
+		allVersions:  true,
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Errorf("GetService.Get() error = %v", err)
+	}
+	files, _ := filepath.Glob(path.Join(dir, "*.tgz"))
+	if len(files) != fixtures.Expectedcharts-1 {
+		t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), fixtures.Expectedcharts-1)
+	}
+}
+
+func Test_writeAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "2", "folder"), 0755)
+	os.MkdirAll(path.Join(dir, "3"), 0755)
+	ioutil.WriteFile(path.Join(dir, "3", "file"), []byte("previous"), 0600)
+	tests := []struct {
+		name        string
+		file        string
+		want        string
+		wantErr     bool
+		wantEntries int
+	}{
+		{"1", path.Join(dir, "1", "file"), "", true, 0},
+		{"2", path.Join(dir, "2", "folder"), "", true, 1},
+		{"3", path.Join(dir, "3", "file"), "test", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := writeAtomic(osFileSystem{}, tt.file, []byte("test"), 0640); (err != nil) != tt.wantErr {
+				t.Errorf("writeAtomic() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// the temporary file is removed whatever happens
+			files, _ := ioutil.ReadDir(path.Dir(tt.file))
+			if len(files) != tt.wantEntries {
+				t.Errorf("writeAtomic() left %v entries, want %v", len(files), tt.wantEntries)
+			}
+			if tt.wantErr {
+				return
+			}
+			content, _ := ioutil.ReadFile(tt.file)
+			if string(content) != tt.want {
+				t.Errorf("writeAtomic() content = %q, want %q", content, tt.want)
+			}
+			if fi, err := os.Stat(tt.file); err != nil || fi.Mode().Perm() != 0640 {
+				t.Errorf("writeAtomic() mode = %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+			}
+		})
+	}
+}
+
+func Test_writeChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		wantErr     bool
+		wantChart   bool
+		wantPartial bool
+	}{
+		{"1", context.Background(), false, true, false},
+		{"2", cancelled, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := path.Join(dir, tt.name, "chart-1.0.0.tgz")
+			if err := writeChart(tt.ctx, osFileSystem{}, name, []byte("test"), DefaultFileMode); (err != nil) != tt.wantErr {
+				t.Errorf("writeChart() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Stat(name); (err == nil) != tt.wantChart {
+				t.Errorf("writeChart() chart present = %v, want %v", err == nil, tt.wantChart)
+			}
+			if _, err := os.Stat(name + partialSuffix); (err == nil) != tt.wantPartial {
+				t.Errorf("writeChart() partial present = %v, want %v", err == nil, tt.wantPartial)
+			}
+		})
+	}
+}
+
+func Test_writeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	type args struct {
+		name         string
+		content      []byte
+		mode         os.FileMode
+		log          *log.Logger
+		ignoreErrors bool
+	}
+	ioutil.WriteFile(path.Join(dir, "file"), []byte("test"), 0644)
+	out := &bytes.Buffer{}
+	outLogger := log.New(out, "", 0)
+	tests := []struct {
+		name        string
+		args        args
+		wantDirMode os.FileMode
+		wantLog     []string
+		wantErr     bool
+	}{
+		{"1", args{path.Join(dir, "1", "tmp.txt"), []byte("test"), DefaultFileMode, fakeLogger, false}, 0755, nil, false},
+		{"2", args{"", []byte("test"), DefaultFileMode, fakeLogger, false}, 0, nil, true},
+		{"3", args{"", []byte("test"), DefaultFileMode, outLogger, true}, 0, []string{"cannot write files : rename "}, false},
+		{"4", args{path.Join(dir, "4", "tmp.txt"), []byte("test"), 0640, fakeLogger, false}, 0750, nil, false},
+		{"5", args{path.Join(dir, "file", "5", "tmp.txt"), []byte("test"), DefaultFileMode, outLogger, true}, 0, []string{
+			"cannot create destination folder for " + path.Join(dir, "file", "5", "tmp.txt") + ": mkdir " + path.Join(dir, "file") + ": not a directory",
+		}, false},
+		{"6", args{path.Join(dir, "file", "6", "tmp.txt"), []byte("test"), DefaultFileMode, outLogger, false}, 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out.Reset()
+			if err := writeFile(osFileSystem{}, tt.args.name, tt.args.content, tt.args.mode, tt.args.log, tt.args.ignoreErrors); (err != nil) != tt.wantErr {
+				t.Errorf("writeFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if lines := strings.Count(out.String(), "\n"); lines != len(tt.wantLog) {
+				t.Errorf("writeFile() logged %v lines, want %v", lines, len(tt.wantLog))
+			}
+			for _, w := range tt.wantLog {
+				if !strings.Contains(out.String(), w) {
+					t.Errorf("writeFile() log = %q, want %q", out.String(), w)
+				}
+			}
+			if tt.wantDirMode == 0 {
+				return
+			}
+			fi, err := os.Stat(tt.args.name)
+			if err != nil || fi.Mode().Perm() != tt.args.mode {
+				t.Errorf("writeFile() file = %v, %v, want mode %v", fi, err, tt.args.mode)
+			}
+			fi, err = os.Stat(path.Dir(tt.args.name))
+			if err != nil || fi.Mode().Perm() != tt.wantDirMode {
+				t.Errorf("writeFile() folder = %v, %v, want mode %v", fi, err, tt.wantDirMode)
+			}
+		})
+	}
+}
+
+func Test_prepareIndexFile(t *testing.T) {
+	dir, err := prepareTmp()
+	if err != nil {
+		t.Errorf("loading testdata: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	type args struct {
+		folder     string
+		newRootURL string
+		rewrites   []URLRewrite
+		layout     Layout
+		preserve   bool
+	}
+	newRootURL := "http://newchart.server.com"
+	rootRewrite := []URLRewrite{{"http://127.0.0.1:1793", newRootURL}}
+	relativeIndex := strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", "", -1)
+	nestedIndex := strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", "http://127.0.0.1:1793/charts/stable/", -1)
+	signedIndex := strings.Replace(fixtures.IndexYaml, ".tgz\n", ".tgz?X-Amz-Expires=300&X-Amz-Signature=abc\n", -1)
+	renamedIndex := strings.Replace(nestedIndex, ".tgz\n", "+build.1.tgz\n", -1)
+	doubleSlashIndex := strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", "http://127.0.0.1:1793//charts//", -1)
+	mixedCaseIndex := strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", "http://Charts.Server.COM/", -1)
+	tests := []struct {
+		name      string
+		index     string
+		args      args
+		wantURL   string
+		wantCount int
+		wantErr   bool
+	}{
+		{"1", fixtures.IndexYaml, args{path.Join(dir, "processfolder"), newRootURL, rootRewrite, LayoutURLPrefix, false}, newRootURL, fixtures.Expectedcharts, false},
+		{"2", fixtures.IndexYaml, args{path.Join(dir, "processerrorfolder"), newRootURL, rootRewrite, LayoutURLPrefix, false}, "", 0, true},
+		{"3", fixtures.IndexYaml, args{path.Join(dir, "processfolder"), "", nil, LayoutURLPrefix, false}, "http://127.0.0.1:1793", fixtures.Expectedcharts, false},
+		{"4", fixtures.IndexYaml, args{path.Join(dir, "processfolder"), newRootURL, append(rootRewrite, URLRewrite{newRootURL + "/chart2", "http://cdn.server.com/chart2"}), LayoutURLPrefix, false}, "http://cdn.server.com", 2, false},
+		{"5", relativeIndex, args{path.Join(dir, "processfolder"), newRootURL, rootRewrite, LayoutURLPrefix, false}, newRootURL + "/chart", fixtures.Expectedcharts, false},
+		{"6", relativeIndex, args{path.Join(dir, "processfolder"), newRootURL + "/charts/", nil, LayoutURLPrefix, false}, newRootURL + "/charts/chart", fixtures.Expectedcharts, false},
+		{"7", nestedIndex, args{path.Join(dir, "processfolder"), newRootURL, rootRewrite, LayoutFlat, false}, newRootURL + "/chart", fixtures.Expectedcharts, false},
+		{"8", nestedIndex, args{path.Join(dir, "processfolder"), "", nil, LayoutFlat, false}, "- chart", fixtures.Expectedcharts, false},
+		{"9", nestedIndex, args{path.Join(dir, "processfolder"), newRootURL, rootRewrite, LayoutURLPrefix, false}, newRootURL + "/charts/stable/chart", fixtures.Expectedcharts, false},
+		{"10", signedIndex, args{path.Join(dir, "processfolder"), newRootURL, rootRewrite, LayoutURLPrefix, false}, ".tgz\n", fixtures.Expectedcharts, false},
+		{"11", signedIndex, args{path.Join(dir, "processfolder"), "", nil, LayoutURLPrefix, false}, ".tgz?X-Amz-Expires=300&X-Amz-Signature=abc", fixtures.Expectedcharts, false},
+		{"12", renamedIndex, args{path.Join(dir, "processfolder"), "", nil, LayoutFlat, true}, "\n    - chart", fixtures.Expectedcharts, false},
+		{"13", renamedIndex, args{path.Join(dir, "processfolder"), "", nil, LayoutFlat, true}, "+build.1.tgz", fixtures.Expectedcharts, false},
+		{"14", renamedIndex, args{path.Join(dir, "processfolder"), "", nil, LayoutFlat, false}, "+build.1.tgz", 0, false},
+		{"15", nestedIndex, args{path.Join(dir, "processfolder"), newRootURL, rootRewrite, LayoutByName, false}, newRootURL + "/chart2/chart2-", 2, false},
+		{"16", renamedIndex, args{path.Join(dir, "processfolder"), "", nil, LayoutByName, true}, "- chart2/chart2-", 2, false},
+		{"17", doubleSlashIndex, args{path.Join(dir, "processfolder"), newRootURL, rootRewrite, LayoutURLPrefix, false}, newRootURL + "/charts/chart", fixtures.Expectedcharts, false},
+		{"18", doubleSlashIndex, args{path.Join(dir, "processfolder"), newRootURL, rootRewrite, LayoutFlat, false}, newRootURL + "/chart", fixtures.Expectedcharts, false},
+		{"19", mixedCaseIndex, args{path.Join(dir, "processfolder"), newRootURL, []URLRewrite{{"http://charts.server.com", newRootURL}}, LayoutURLPrefix, false}, newRootURL + "/chart", fixtures.Expectedcharts, false},
+	}
+	for _, tt := range tests {
+		ioutil.WriteFile(path.Join(dir, "processfolder", "downloaded-index.yaml"), []byte(tt.index), 0666)
+		t.Run(tt.name, func(t *testing.T) {
+			if err := prepareIndexFile(osFileSystem{}, path.Join(tt.args.folder, downloadedFileName), path.Join(tt.args.folder, indexFileName), "http://127.0.0.1:1793", tt.args.newRootURL, tt.args.rewrites, tt.args.layout, tt.args.preserve, nil, nil, false, DefaultFileMode); (err != nil) != tt.wantErr {
+				t.Errorf("prepareIndexFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			contentBytes, err := ioutil.ReadFile(path.Join(dir, "processfolder", "index.yaml"))
+			if err != nil {
+				t.Log("Error reading index.yaml")
+			}
+			content := string(contentBytes)
+			count := strings.Count(content, tt.wantURL)
+			if count != tt.wantCount {
+				t.Errorf("prepareIndexFile() replacedCount = %v, want replacedCount %v", count, tt.wantCount)
+			}
+			_, err = os.Stat(path.Join(dir, "processfolder", "downloaded-index.yaml"))
+			if err == nil {
+				t.Errorf("prepareIndexFile() dowloaded-index.yaml not deleted")
+			}
+		})
+	}
+}
+
+func Test_prepareIndexFileExtra(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	raw := "apiVersion: v1\nentries:\n  chart1:\n  - name: chart1\n    version: 1.0.0+build.1\n    urls:\n    - chart1-1.0.0+build.1.tgz\n"
+	tests := []struct {
+		name         string
+		version      string
+		wantVersions int
+	}{
+		{"1", "1.0.0+build.1", 1},
+		// the build metadata makes it another version
+		{"2", "1.0.0", 2},
+		{"3", "1.1.0", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rawPath, indexPath := path.Join(dir, downloadedFileName), path.Join(dir, indexFileName)
+			ioutil.WriteFile(rawPath, []byte(raw), 0644)
+			extra := []*repo.ChartVersion{{Metadata: &chart.Metadata{Name: "chart1", Version: tt.version}, URLs: []string{"chart1-" + tt.version + ".tgz"}}}
+			if err := prepareIndexFile(osFileSystem{}, rawPath, indexPath, "http://127.0.0.1:1793", "", nil, LayoutURLPrefix, false, extra, nil, false, DefaultFileMode); err != nil {
+				t.Fatalf("prepareIndexFile() error = %v", err)
+			}
+			index, err := repo.LoadIndexFile(indexPath)
+			if err != nil {
+				t.Fatalf("Loading index file: %s", err)
+			}
+			if got := len(index.Entries["chart1"]); got != tt.wantVersions {
+				t.Errorf("prepareIndexFile() chart1 versions = %v, want %v", got, tt.wantVersions)
+			}
+		})
+	}
+}
+
+func Test_regenerateIndexFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "stable", "charts", "rc"), 0755)
+	for _, c := range []struct{ folder, name, version string }{
+		{"", "chart1", "2.11.0"},
+		{"stable", "chart2", "1.0.1"},
+		{"stable/charts/rc", "chart3", "0.0.1-rc1"},
+	} {
+		ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: c.name, Version: c.version}}
+		if _, err := chartutil.Save(ch, path.Join(dir, c.folder)); err != nil {
+			t.Fatalf("saving chart: %s", err)
+		}
+	}
+	tests := []struct {
+		name       string
+		newRootURL string
+		wantURLs   []string
+	}{
+		{"1", "http://mirror.local.lan", []string{"http://mirror.local.lan/chart1-2.11.0.tgz", "http://mirror.local.lan/stable/chart2-1.0.1.tgz", "http://mirror.local.lan/stable/charts/rc/chart3-0.0.1-rc1.tgz"}},
+		{"2", "", []string{"chart1-2.11.0.tgz", "stable/chart2-1.0.1.tgz", "stable/charts/rc/chart3-0.0.1-rc1.tgz"}},
+	}
+	for _, tt := range tests {
+		ioutil.WriteFile(path.Join(dir, downloadedFileName), []byte(fixtures.IndexYaml), 0666)
+		t.Run(tt.name, func(t *testing.T) {
+			if err := regenerateIndexFile(osFileSystem{}, dir, path.Join(dir, downloadedFileName), path.Join(dir, indexFileName), tt.newRootURL, nil, false, DefaultFileMode); err != nil {
+				t.Errorf("regenerateIndexFile() error = %v", err)
+			}
+			indexFile, err := repo.LoadIndexFile(path.Join(dir, indexFileName))
+			if err != nil {
+				t.Fatalf("loading index.yaml: %s", err)
+			}
+			if len(indexFile.Entries) != len(tt.wantURLs) {
+				t.Errorf("regenerateIndexFile() got %v charts, want %v", len(indexFile.Entries), len(tt.wantURLs))
+			}
+			var urls []string
+			for _, name := range []string{"chart1", "chart2", "chart3"} {
+				for _, v := range indexFile.Entries[name] {
+					urls = append(urls, v.URLs...)
+				}
+			}
+			if !reflect.DeepEqual(urls, tt.wantURLs) {
+				t.Errorf("regenerateIndexFile() URLs = %v, want %v", urls, tt.wantURLs)
+			}
+			if _, err := os.Stat(path.Join(dir, downloadedFileName)); err == nil {
+				t.Errorf("regenerateIndexFile() downloaded-index.yaml not deleted")
+			}
+		})
+	}
+}
+
+func Test_rewriteURL(t *testing.T) {
+	newRootURL := "http://newchart.server.com"
+	rootRewrite := []URLRewrite{{"http://127.0.0.1:1793", newRootURL}}
+	tests := []struct {
+		name       string
+		u          string
+		newRootURL string
+		rewrites   []URLRewrite
+		want       string
+	}{
+		{"1", "http://127.0.0.1:1793/chart1-2.11.0.tgz", newRootURL, rootRewrite, newRootURL + "/chart1-2.11.0.tgz"},
+		{"2", "http://127.0.0.1:1793/chart1-2.11.0.tgz?X-Amz-Signature=abc&X-Amz-Expires=300", newRootURL, rootRewrite, newRootURL + "/chart1-2.11.0.tgz"},
+		{"3", "chart1-2.11.0.tgz?sv=2019-02-02&sig=abc", newRootURL, nil, newRootURL + "/chart1-2.11.0.tgz"},
+		{"4", "http://127.0.0.1:1793/chart1-2.11.0.tgz?sig=abc#top", newRootURL, rootRewrite, newRootURL + "/chart1-2.11.0.tgz"},
+		{"5", "https://cdn.server.com/chart1-2.11.0.tgz?sig=abc", newRootURL, rootRewrite, "https://cdn.server.com/chart1-2.11.0.tgz?sig=abc"},
+		{"6", "chart1-2.11.0.tgz?sig=abc", "", nil, "chart1-2.11.0.tgz?sig=abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteURL(tt.u, "http://127.0.0.1:1793", tt.newRootURL, tt.rewrites); got != tt.want {
+				t.Errorf("rewriteURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_rebaseURL(t *testing.T) {
+	chartURL := "http://127.0.0.1:1793/charts/chart1-2.11.0.tgz"
+	tests := []struct {
+		name       string
+		u          string
+		repoURL    string
+		newRootURL string
+		want       string
+		wantOK     bool
+	}{
+		{"1", chartURL, "http://127.0.0.1:1793/charts", "http://newchart.server.com", "http://newchart.server.com/chart1-2.11.0.tgz", true},
+		{"2", chartURL, "http://127.0.0.1:1793/charts/", "http://newchart.server.com", "http://newchart.server.com/chart1-2.11.0.tgz", true},
+		{"3", chartURL, "http://127.0.0.1:1793/charts", "http://newchart.server.com/", "http://newchart.server.com/chart1-2.11.0.tgz", true},
+		{"4", chartURL, "http://127.0.0.1:1793/charts/", "http://newchart.server.com/", "http://newchart.server.com/chart1-2.11.0.tgz", true},
+		{"5", chartURL, "http://127.0.0.1:1793/charts//", "http://newchart.server.com/mirror//", "http://newchart.server.com/mirror/chart1-2.11.0.tgz", true},
+		{"6", chartURL, "http://127.0.0.1:1793/chart", "http://newchart.server.com", "", false},
+		{"7", "http://127.0.0.1:1793/charts/stable/nginx/nginx-1.2.3.tgz", "http://127.0.0.1:1793/charts/stable", "https://mirror.example.com/helm/stable/", "https://mirror.example.com/helm/stable/nginx/nginx-1.2.3.tgz", true},
+		{"8", "nginx/nginx-1.2.3.tgz", "http://127.0.0.1:1793/charts/stable", "https://mirror.example.com/helm/stable", "https://mirror.example.com/helm/stable/nginx/nginx-1.2.3.tgz", true},
+		{"9", "/charts/stable/nginx-1.2.3.tgz", "http://127.0.0.1:1793/charts/stable", "https://mirror.example.com/helm/stable", "https://mirror.example.com/helm/stable/nginx-1.2.3.tgz", true},
+		{"10", "nginx-1.2.3.tgz?sig=abc", "http://127.0.0.1:1793/charts/stable/", "https://mirror.example.com/helm/stable", "https://mirror.example.com/helm/stable/nginx-1.2.3.tgz", true},
+		{"11", "../incubator/nginx-1.2.3.tgz", "http://127.0.0.1:1793/charts/stable", "https://mirror.example.com/helm/stable", "", false},
+		{"12", "https://cdn.server.com/charts/stable/nginx-1.2.3.tgz", "http://127.0.0.1:1793/charts/stable", "https://mirror.example.com/helm/stable", "", false},
+		{"13", "nginx-1.2.3.tgz", "", "https://mirror.example.com/helm/stable", "https://mirror.example.com/helm/stable/nginx-1.2.3.tgz", true},
+		{"14", "https://127.0.0.1:1793/charts/stable/nginx-1.2.3.tgz", "http://127.0.0.1:1793/charts/stable", "https://mirror.example.com/helm/stable", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rebaseURL(tt.u, tt.repoURL, tt.newRootURL)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("rebaseURL() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_normalizeURL(t *testing.T) {
+	tests := []struct {
+		name string
+		u    string
+		want string
+	}{
+		{"1", "https://repo/charts/nginx-1.2.3.tgz", "https://repo/charts/nginx-1.2.3.tgz"},
+		{"2", "https://repo/charts//nginx-1.2.3.tgz", "https://repo/charts/nginx-1.2.3.tgz"},
+		{"3", "https://repo//charts///nginx-1.2.3.tgz?sig=a//b", "https://repo/charts/nginx-1.2.3.tgz?sig=a//b"},
+		{"4", "https://Repo.Example.COM:8443/charts/nginx-1.2.3.tgz", "https://repo.example.com:8443/charts/nginx-1.2.3.tgz"},
+		{"5", "charts//nginx-1.2.3.tgz", "charts/nginx-1.2.3.tgz"},
+		{"6", "https://repo/charts/nginx%2B1.2.3.tgz", "https://repo/charts/nginx%2B1.2.3.tgz"},
+		{"7", "%", "%"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeURL(tt.u); got != tt.want {
+				t.Errorf("normalizeURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_GetNormalizedURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + indexFileName:
+			w.Write([]byte(index))
+		case "/charts/nginx-1.0.0.tgz":
+			w.Write([]byte("chart"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	// the same server with a mixed case host
+	repoURL := strings.Replace(svr.URL, "127.0.0.1", "LocalHost", 1)
+	index = "apiVersion: v1\nentries:\n  nginx:\n  - name: nginx\n    version: 1.0.0\n    urls:\n    - " + repoURL + "//charts//nginx-1.0.0.tgz\n"
+	g := &GetService{
+		config:     repo.Entry{Name: dir, URL: repoURL},
+		logger:     fakeLogger,
+		newRootURL: "http://mirror.local.lan",
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Fatalf("GetService.Get() error = %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "charts", "nginx-1.0.0.tgz")); err != nil {
+		t.Errorf("GetService.Get() chart not downloaded: %s", err)
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, indexFileName))
+	if want := "- http://mirror.local.lan/charts/nginx-1.0.0.tgz\n"; !strings.Contains(string(content), want) {
+		t.Errorf("GetService.Get() index = %s, want %q", content, want)
+	}
+}
+
+func TestGetService_GetSignedURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/"+indexFileName:
+			w.Write([]byte(index))
+		case r.URL.Query().Get("X-Amz-Signature") != "abc":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.Write([]byte("chart"))
+		}
+	}))
+	defer svr.Close()
+	index = "apiVersion: v1\nentries:\n  nginx:\n  - name: nginx\n    version: 1.0.0\n    urls:\n    - " + svr.URL + "/charts/nginx-1.0.0.tgz?X-Amz-Expires=300&X-Amz-Signature=abc\n"
+	g := &GetService{
+		config:     repo.Entry{Name: dir, URL: svr.URL},
+		logger:     fakeLogger,
+		newRootURL: "http://mirror.local.lan",
+		rewrites:   []URLRewrite{{svr.URL, "http://mirror.local.lan"}},
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Fatalf("GetService.Get() error = %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "charts", "nginx-1.0.0.tgz")); err != nil {
+		t.Errorf("GetService.Get() chart not downloaded: %s", err)
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, indexFileName))
+	if want := "- http://mirror.local.lan/charts/nginx-1.0.0.tgz\n"; !strings.Contains(string(content), want) {
+		t.Errorf("GetService.Get() index = %s, want %q", content, want)
+	}
+}
+
+func TestGetService_GetMaxChartSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + indexFileName:
+			w.Write([]byte(index))
+		case "/small-1.0.0.tgz":
+			w.Write([]byte("chart"))
+		case "/big-1.0.0.tgz":
+			w.Write(bytes.Repeat([]byte("chart"), 20))
+		case "/nohead-1.0.0.tgz":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte("chart"))
+		}
+	}))
+	defer svr.Close()
+	index = "apiVersion: v1\nentries:\n"
+	for _, name := range []string{"big", "nohead", "small"} {
+		index += fmt.Sprintf("  %s:\n  - name: %s\n    version: 1.0.0\n    urls:\n    - %s/%s-1.0.0.tgz\n", name, name, svr.URL, name)
+	}
+	tests := []struct {
+		name        string
+		max         int64
+		skipUnknown bool
+		want        []string
+		wantSkipped int
+	}{
+		{"1", 0, false, []string{"big-1.0.0.tgz", "nohead-1.0.0.tgz", "small-1.0.0.tgz"}, 0},
+		{"2", 50, false, []string{"nohead-1.0.0.tgz", "small-1.0.0.tgz"}, 1},
+		{"3", 50, true, []string{"small-1.0.0.tgz"}, 2},
+		{"4", 100, false, []string{"big-1.0.0.tgz", "nohead-1.0.0.tgz", "small-1.0.0.tgz"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:          repo.Entry{Name: workDir, URL: svr.URL},
+				logger:          fakeLogger,
+				allVersions:     true,
+				maxChartBytes:   tt.max,
+				skipUnknownSize: tt.skipUnknown,
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			got := []string{}
+			for _, f := range files {
+				got = append(got, filepath.Base(f))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetService.Get() charts = %v, want %v", got, tt.want)
+			}
+			if g.Stats().Skipped != tt.wantSkipped {
+				t.Errorf("GetService.Stats() skipped = %d, want %d", g.Stats().Skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestGetService_GetDeprecated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+indexFileName {
+			w.Write([]byte(index))
+			return
+		}
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	// chart1 is deprecated
+	index = strings.Replace(fixtures.IndexYaml, "    name: chart1\n", "    deprecated: true\n    name: chart1\n", 1)
+	index = strings.Replace(index, "http://127.0.0.1:1793/", svr.URL+"/", -1)
+	tests := []struct {
+		name              string
+		includeDeprecated bool
+		want              []string
+	}{
+		{"1", true, []string{"chart1-2.11.0.tgz", "chart2-0.0.0-rc1.tgz", "chart2-1.0.1.tgz"}},
+		{"2", false, []string{"chart2-0.0.0-rc1.tgz", "chart2-1.0.1.tgz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:            repo.Entry{Name: workDir, URL: svr.URL},
+				logger:            fakeLogger,
+				allVersions:       true,
+				exactMatch:        true,
+				chartNames:        []string{"chart1", "chart2"},
+				includeDeprecated: tt.includeDeprecated,
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			got := []string{}
+			for _, f := range files {
+				got = append(got, filepath.Base(f))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetService.Get() charts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_urlFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		p        string
+		preserve bool
+		want     string
+	}{
+		{"1", "/charts/Nginx-1.0.0+build.1.tgz", false, "nginx-1.0.0.tgz"},
+		{"2", "/charts/Nginx-1.0.0+build.1.tgz", true, "Nginx-1.0.0+build.1.tgz"},
+		{"3", "Nginx-1.0.0.tgz", true, "Nginx-1.0.0.tgz"},
+		{"4", "/", true, "nginx-1.0.0.tgz"},
+		{"5", "", true, "nginx-1.0.0.tgz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := urlFileName("nginx", "1.0.0", tt.p, tt.preserve); got != tt.want {
+				t.Errorf("urlFileName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_chartPath(t *testing.T) {
+	g := &GetService{config: repo.Entry{Name: "/tmp/mirror"}}
+	byName := &GetService{config: repo.Entry{Name: "/tmp/mirror"}, layout: LayoutByName}
+	tests := []struct {
+		name    string
+		g       *GetService
+		chart   string
+		version string
+		u       string
+		want    string
+		wantErr bool
+	}{
+		{"1", g, "chart1", "1.0.0", "https://charts.local.lan/stable/chart1-1.0.0.tgz", "/tmp/mirror/stable/chart1-1.0.0.tgz", false},
+		{"2", g, "chart1", "1.0.0", "https://charts.local.lan/stable/../chart1-1.0.0.tgz", "/tmp/mirror/chart1-1.0.0.tgz", false},
+		{"3", g, "chart1", "1.0.0", "https://charts.local.lan/../../etc/cron.d/chart1-1.0.0.tgz", "/tmp/mirror/etc/cron.d/chart1-1.0.0.tgz", false},
+		{"4", g, "chart1", "1.0.0", "../../etc/cron.d/chart1-1.0.0.tgz", "", true},
+		{"5", g, "../../etc/cron.d/evil", "1.0.0", "https://charts.local.lan/evil-1.0.0.tgz", "", true},
+		{"6", g, "chart1", "1.0.0/../../../evil", "https://charts.local.lan/chart1-1.0.0.tgz", "", true},
+		{"7", byName, "..", "1.0.0", "https://charts.local.lan/chart1-1.0.0.tgz", "", true},
+		{"8", byName, `..\evil`, "1.0.0", "https://charts.local.lan/chart1-1.0.0.tgz", "", true},
+		{"9", byName, "chart1", "1.0.0", "https://charts.local.lan/../../chart1-1.0.0.tgz", "/tmp/mirror/chart1/chart1-1.0.0.tgz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(tt.u)
+			r := &search.Result{Name: tt.chart, Chart: &repo.ChartVersion{Metadata: &chart.Metadata{Name: tt.chart, Version: tt.version}}}
+			got, err := tt.g.chartPath(r, u)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.chartPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("GetService.chartPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_containedPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     string
+		rel     string
+		want    string
+		wantErr bool
+	}{
+		{"1", "/tmp/mirror", "stable/chart1-1.0.0.tgz", "/tmp/mirror/stable/chart1-1.0.0.tgz", false},
+		{"2", "/tmp/mirror/", "/stable/chart1-1.0.0.tgz", "/tmp/mirror/stable/chart1-1.0.0.tgz", false},
+		{"3", "/tmp/mirror", "../mirror2/chart1-1.0.0.tgz", "", true},
+		{"4", "/tmp/mirror", "/../../etc/passwd", "", true},
+		{"5", "/tmp/mirror", "..", "", true},
+		{"6", "/tmp/mirror", "", "", true},
+		{"7", "/", "chart1-1.0.0.tgz", "/chart1-1.0.0.tgz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := containedPath(tt.dir, tt.rel)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("containedPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("containedPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_GetPathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+indexFileName {
+			w.Write([]byte(index))
+			return
+		}
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	index = "apiVersion: v1\nentries:\n" +
+		"  chart1:\n  - name: chart1\n    version: 1.0.0\n    urls:\n    - " + svr.URL + "/chart1-1.0.0.tgz\n" +
+		"  evil:\n  - name: ../../cron.d/evil\n    version: 1.0.0\n    urls:\n    - " + svr.URL + "/evil-1.0.0.tgz\n" +
+		"  chart2:\n  - name: chart2\n    version: 1.0.0\n    urls:\n    - ../../cron.d/chart2-1.0.0.tgz\n"
+	tests := []struct {
+		name         string
+		layout       Layout
+		ignoreErrors bool
+		wantErr      bool
+	}{
+		{"1", LayoutURLPrefix, true, false},
+		{"2", LayoutByName, true, false},
+		{"3", LayoutURLPrefix, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := path.Join(dir, tt.name)
+			workDir := path.Join(root, "a", "mirror")
+			os.MkdirAll(workDir, 0755)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, true, false, tt.ignoreErrors, fakeLogger, "https://mirror.local.lan", "", "", WithLayout(tt.layout), WithConcurrency(1))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && !strings.HasPrefix(name, workDir+"/") {
+					t.Errorf("GetService.Get() wrote %s outside of the destination folder", name)
+				}
+				return nil
+			})
+			if !tt.wantErr {
+				if _, err := os.Stat(path.Join(workDir, tt.layout.chartPath("chart1", "chart1-1.0.0.tgz", "/chart1-1.0.0.tgz"))); err != nil {
+					t.Errorf("GetService.Get() chart not downloaded: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetService_GetEmptyURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index []byte
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+indexFileName {
+			w.Write(index)
+			return
+		}
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	indexFile := repo.NewIndexFile()
+	indexFile.Entries["chart1"] = repo.ChartVersions{{
+		Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart1", Version: "1.0.0"},
+	}}
+	indexFile.Entries["chart2"] = repo.ChartVersions{{
+		Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart2", Version: "1.0.0"},
+		URLs:     []string{svr.URL + "/chart2-1.0.0.tgz"},
+	}}
+	index, _ = yaml.Marshal(indexFile)
+	tests := []struct {
+		name         string
+		ignoreErrors bool
+		wantErr      bool
+	}{
+		{"1", true, false},
+		{"2", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			var reported []string
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: svr.URL},
+				logger:       fakeLogger,
+				ignoreErrors: tt.ignoreErrors,
+				allVersions:  true,
+				concurrency:  1,
+				onError: func(name string, version string, u string, err error) {
+					reported = append(reported, name)
+				},
+			}
+			err := g.Get(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), "chart1(1.0.0)") {
+					t.Errorf("GetService.Get() error = %v, want the chart named", err)
+				}
+				return
+			}
+			if stats := g.Stats(); stats.Failed != 1 || stats.Downloaded != 1 {
+				t.Errorf("GetService.Get() stats = %+v, want 1 failed and 1 downloaded", stats)
+			}
+			if !reflect.DeepEqual(reported, []string{"chart1"}) {
+				t.Errorf("GetService.Get() reported = %v, want [chart1]", reported)
+			}
+		})
+	}
+}
+
+func TestGetService_GetAfterDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	errScan := errors.New("vulnerable chart")
+	tests := []struct {
+		name         string
+		hookErr      error
+		ignoreErrors bool
+		wantErr      bool
+		wantReported int
+	}{
+		{"1", nil, false, false, 0},
+		{"2", errScan, false, true, 0},
+		{"3", errScan, true, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			var (
+				called   []string
+				reported int
+			)
+			g := &GetService{
+				config:       repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:       fakeLogger,
+				ignoreErrors: tt.ignoreErrors,
+				exactMatch:   true,
+				chartName:    "chart1",
+				afterDownload: func(chartPath string, info *ChartInfo) error {
+					content, err := ioutil.ReadFile(chartPath)
+					if err != nil || digest(content) != info.Digest {
+						t.Errorf("afterDownload() digest %s does not match %s: %v", info.Digest, chartPath, err)
+					}
+					called = append(called, info.Name+" "+info.Version+" "+info.URL)
+					return tt.hookErr
+				},
+				onError: func(chartName string, version string, u string, err error) {
+					reported++
+				},
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			want := []string{"chart1 2.11.0 http://127.0.0.1:1793/chart1-2.11.0.tgz"}
+			if !reflect.DeepEqual(called, want) {
+				t.Errorf("GetService.Get() afterDownload called with %v, want %v", called, want)
+			}
+			if reported != tt.wantReported {
+				t.Errorf("GetService.Get() reported %v errors, want %v", reported, tt.wantReported)
+			}
+		})
+	}
+}
+
+func TestGetService_GetIndexOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name       string
+		newRootURL string
+		opts       []GetOption
+		wantIndex  bool
+		wantURL    string
+		wantErr    bool
+	}{
+		{"1", "", nil, true, "http://127.0.0.1:1793/chart1-2.11.0.tgz", false},
+		{"2", "https://mirror.local.lan", nil, true, "https://mirror.local.lan/chart1-2.11.0.tgz", false},
+		{"3", "", []GetOption{WithLayout(LayoutFlat)}, true, "- chart1-2.11.0.tgz", false},
+		{"4", "", []GetOption{WithDryRun(true)}, false, "", false},
+		{"5", "", []GetOption{WithRegeneratedIndex(true)}, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			opts := append([]GetOption{WithIndexOnly(true)}, tt.opts...)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, true, false, false, fakeLogger, tt.newRootURL, "", "", opts...)
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if charts, _ := filepath.Glob(path.Join(workDir, "*.tgz")); len(charts) > 0 {
+				t.Errorf("GetService.Get() downloaded charts %v", charts)
+			}
+			b, err := ioutil.ReadFile(path.Join(workDir, indexFileName))
+			if (err == nil) != tt.wantIndex {
+				t.Fatalf("GetService.Get() index file read error = %v, want index %v", err, tt.wantIndex)
+			}
+			if tt.wantIndex && !strings.Contains(string(b), tt.wantURL) {
+				t.Errorf("GetService.Get() index file does not contain %s:\n%s", tt.wantURL, b)
+			}
+			if st := g.(*GetService).Stats(); st.Downloaded != 0 {
+				t.Errorf("GetService.Get() downloaded = %v, want 0", st.Downloaded)
+			}
+		})
+	}
+}
+
+func TestGetService_GetSubpathRootURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/charts/stable/" + indexFileName:
+			w.Write([]byte(index))
+		case "/charts/stable/chart1-1.0.0.tgz", "/charts/stable/nginx/chart2-1.0.0.tgz", "/charts/stable/chart3-1.0.0.tgz":
+			w.Write([]byte("chart"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	index = "apiVersion: v1\nentries:\n" +
+		"  chart1:\n  - name: chart1\n    version: 1.0.0\n    urls:\n    - " + svr.URL + "/charts/stable/chart1-1.0.0.tgz\n" +
+		"  chart2:\n  - name: chart2\n    version: 1.0.0\n    urls:\n    - nginx/chart2-1.0.0.tgz\n" +
+		"  chart3:\n  - name: chart3\n    version: 1.0.0\n    urls:\n    - /charts/stable/chart3-1.0.0.tgz\n"
+	g, err := NewGetService(repo.Entry{Name: dir, URL: svr.URL + "/charts/stable/"}, true, false, false, fakeLogger, "https://mirror.example.com/helm/stable", "", "")
+	if err != nil {
+		t.Fatalf("NewGetService() error = %v", err)
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Fatalf("GetService.Get() error = %v", err)
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, indexFileName))
+	for _, want := range []string{
+		"- https://mirror.example.com/helm/stable/chart1-1.0.0.tgz\n",
+		"- https://mirror.example.com/helm/stable/nginx/chart2-1.0.0.tgz\n",
+		"- https://mirror.example.com/helm/stable/chart3-1.0.0.tgz\n",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("GetService.Get() index = %s, want %q", content, want)
+		}
+	}
+	for _, chartPath := range []string{"charts/stable/chart1-1.0.0.tgz", "nginx/chart2-1.0.0.tgz", "charts/stable/chart3-1.0.0.tgz"} {
+		if _, err := os.Stat(path.Join(dir, chartPath)); err != nil {
+			t.Errorf("GetService.Get() chart not downloaded: %s", err)
+		}
+	}
+}
+
+func TestGetService_Index(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name      string
+		opts      []GetOption
+		wantIndex bool
+		wantURL   string
+	}{
+		{"1", nil, true, "https://mirror.local.lan/chart1-2.11.0.tgz"},
+		{"2", []GetOption{WithIndexOnly(true)}, true, "https://mirror.local.lan/chart1-2.11.0.tgz"},
+		{"3", []GetOption{WithDryRun(true)}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			opts := append([]GetOption{WithChartNames([]string{"chart1", "chart2"})}, tt.opts...)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, true, false, false, fakeLogger, "https://mirror.local.lan", "", "", opts...)
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if got := g.Index(); got != nil {
+				t.Errorf("GetService.Index() = %v before Get, want nil", got)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			got := g.Index()
+			if (got != nil) != tt.wantIndex {
+				t.Fatalf("GetService.Index() = %v, want index %v", got, tt.wantIndex)
+			}
+			if !tt.wantIndex {
+				return
+			}
+			cv, err := got.Get("chart1", "2.11.0")
+			if err != nil || len(cv.URLs) == 0 || cv.URLs[0] != tt.wantURL {
+				t.Errorf("GetService.Index() chart1(2.11.0) = %v, %v, want URL %v", cv, err, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestGetService_GetKeepRawIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name       string
+		newRootURL string
+		opts       []GetOption
+		wantFiles  []string
+		wantRaw    string
+		wantErr    bool
+	}{
+		{"1", "https://mirror.local.lan", nil, []string{"index.yaml"}, "", false},
+		{"2", "https://mirror.local.lan", []GetOption{WithKeepRawIndex(true)}, []string{"downloaded-index.yaml", "index.yaml"}, "downloaded-index.yaml", false},
+		{"3", "", []GetOption{WithKeepRawIndex(true)}, []string{"downloaded-index.yaml", "index.yaml"}, "downloaded-index.yaml", false},
+		{"4", "https://mirror.local.lan", []GetOption{WithKeepRawIndex(true), WithIndexFileNames("charts.yaml", "upstream.yaml"), WithCompressedIndex(true), WithChecksums(true)}, []string{"SHA256SUMS", "charts.yaml", "charts.yaml.gz", "upstream.yaml"}, "upstream.yaml", false},
+		{"5", "https://mirror.local.lan", []GetOption{WithIndexFileNames("charts.yaml", "")}, []string{"charts.yaml"}, "", false},
+		{"6", "https://mirror.local.lan", []GetOption{WithIndexFileNames("index.yaml", "index.yaml")}, nil, "", true},
+		{"7", "https://mirror.local.lan", []GetOption{WithIndexFileNames("../index.yaml", "")}, nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			opts := append([]GetOption{WithChartNames([]string{"chart1", "chart2"})}, tt.opts...)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, true, false, false, fakeLogger, tt.newRootURL, "", "", opts...)
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got []string
+			for _, name := range []string{"SHA256SUMS", "charts.yaml", "charts.yaml.gz", "downloaded-index.yaml", "index.yaml", "upstream.yaml"} {
+				if _, err := os.Stat(path.Join(workDir, name)); err == nil {
+					got = append(got, name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantFiles) {
+				t.Errorf("GetService.Get() index files = %v, want %v", got, tt.wantFiles)
+			}
+			if tt.wantRaw == "" {
+				return
+			}
+			if raw, _ := ioutil.ReadFile(path.Join(workDir, tt.wantRaw)); string(raw) != fixtures.IndexYaml {
+				t.Errorf("GetService.Get() raw index file = %s, want the index file of the repository", raw)
+			}
+			if sums, _ := ioutil.ReadFile(path.Join(workDir, "SHA256SUMS")); len(sums) > 0 && !strings.Contains(string(sums), "  "+tt.wantRaw+"\n") {
+				t.Errorf("GetService.Get() checksums = %s, want %s", sums, tt.wantRaw)
+			}
+		})
+	}
+}
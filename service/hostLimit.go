@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"k8s.io/helm/cmd/helm/search"
+)
+
+// hostLimiter bounds the charts downloaded at once from each host, so one
+// host of an index file is not overloaded while the others are idle. The
+// total number of downloads is still bounded by the pool of workers.
+type hostLimiter struct {
+	max int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+// newHostLimiter returns a limiter of max downloads per host, or nil when max
+// is 0 or less
+func newHostLimiter(max int) *hostLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &hostLimiter{max: max, hosts: map[string]chan struct{}{}}
+}
+
+// hostSlotKey is the context key of the host whose slot is held by the
+// caller
+type hostSlotKey struct{}
+
+// withHostSlot returns ctx holding a slot of host, acquire does not wait for
+// another one of this host
+func withHostSlot(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, hostSlotKey{}, host)
+}
+
+// acquire waits for a free slot to download from host, release frees the
+// slot. A nil limiter never waits, nor does a ctx already holding a slot of
+// host.
+func (h *hostLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	if held, ok := ctx.Value(hostSlotKey{}).(string); h == nil || ok && held == host {
+		return func() {}, nil
+	}
+	h.mu.Lock()
+	sem, ok := h.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, h.max)
+		h.hosts[host] = sem
+	}
+	h.mu.Unlock()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatch runs work for each chart in the pool of workers and returns once
+// all of them are done, no chart is started once ctx is done. With a bound
+// per host the charts are queued per host, a chart takes a slot of its host
+// before one of the pool: the charts of a busy host don't hold the workers
+// while the ones of the other hosts wait.
+func (g *GetService) dispatch(ctx context.Context, charts []*search.Result, work func(ctx context.Context, r *search.Result)) {
+	// the pool is shared with other services when one is set
+	sem := g.pool
+	if sem == nil {
+		sem = make(chan struct{}, g.workers())
+	}
+	queues := [][]*search.Result{charts}
+	if g.hosts != nil {
+		queues = g.hostQueues(charts)
+	}
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		wg.Add(1)
+		go func(queue []*search.Result) {
+			defer wg.Done()
+			for _, r := range queue {
+				workCtx, host := ctx, ""
+				if g.hosts != nil {
+					host = g.chartHost(r)
+					workCtx = withHostSlot(ctx, host)
+				}
+				release, err := g.hosts.acquire(ctx, host)
+				if err != nil {
+					return
+				}
+				// a shared pool can be busy with the charts of other services
+				if ctx.Err() != nil || !acquireSlot(ctx, sem) {
+					release()
+					return
+				}
+				wg.Add(1)
+				go func(r *search.Result) {
+					defer func() {
+						<-sem
+						release()
+						wg.Done()
+					}()
+					if ctx.Err() != nil {
+						return
+					}
+					work(workCtx, r)
+				}(r)
+			}
+		}(queue)
+	}
+	wg.Wait()
+}
+
+// hostQueues returns the charts by host of their first URL, in the order of
+// the chart of each host that comes first
+func (g *GetService) hostQueues(charts []*search.Result) [][]*search.Result {
+	queues := [][]*search.Result{}
+	hosts := map[string]int{}
+	for _, r := range charts {
+		host := g.chartHost(r)
+		i, ok := hosts[host]
+		if !ok {
+			i = len(queues)
+			hosts[host] = i
+			queues = append(queues, nil)
+		}
+		queues[i] = append(queues[i], r)
+	}
+	return queues
+}
+
+// chartHost returns the host the chart is downloaded from, the one of its
+// first URL resolved against the repository URL
+func (g *GetService) chartHost(r *search.Result) string {
+	if len(r.Chart.URLs) == 0 {
+		return ""
+	}
+	u := normalizeURL(r.Chart.URLs[0])
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return urlHost(g.absoluteChartURL(u, parsed))
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func Test_hostLimiter_acquire(t *testing.T) {
+	h := newHostLimiter(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tests := []struct {
+		name    string
+		host    string
+		wantErr bool
+	}{
+		{"1", "charts.local", false},
+		{"2", "charts.local", false},
+		{"3", "cdn.local", false},
+		{"4", "charts.local", true},
+	}
+	var releases []func()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release, err := h.acquire(ctx, tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hostLimiter.acquire() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				releases = append(releases, release)
+			}
+		})
+	}
+	releases[0]()
+	if _, err := h.acquire(context.Background(), "charts.local"); err != nil {
+		t.Errorf("hostLimiter.acquire() error = %v after a release", err)
+	}
+	var none *hostLimiter
+	if _, err := none.acquire(ctx, "charts.local"); err != nil {
+		t.Errorf("nil hostLimiter.acquire() error = %v", err)
+	}
+}
+
+func TestGetService_GetMaxConcurrentPerHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		mu       sync.Mutex
+		inflight = map[string]int{}
+		peak     = map[string]int{}
+		index    []byte
+	)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.yaml" {
+			w.Write(index)
+			return
+		}
+		host := strings.Split(r.Host, ":")[0]
+		mu.Lock()
+		inflight[host]++
+		if inflight[host] > peak[host] {
+			peak[host] = inflight[host]
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inflight[host]--
+		mu.Unlock()
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	port := svr.URL[strings.LastIndex(svr.URL, ":")+1:]
+	indexFile := repo.NewIndexFile()
+	for i := 0; i < 4; i++ {
+		for _, host := range []string{"127.0.0.1", "localhost"} {
+			name := fmt.Sprintf("%s%d", strings.Replace(host, ".", "", -1), i)
+			indexFile.Add(&chart.Metadata{Name: name, Version: "1.0.0"}, name+"-1.0.0.tgz", "http://"+host+":"+port, "")
+		}
+	}
+	if index, err = yaml.Marshal(indexFile); err != nil {
+		t.Fatalf("Marshalling index file: %s", err)
+	}
+	tests := []struct {
+		name       string
+		maxPerHost int
+		wantPeak   int
+	}{
+		{"1", 1, 1},
+		{"2", 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			peak = map[string]int{}
+			mu.Unlock()
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, true, false, false, fakeLogger, "", "", "",
+				WithConcurrency(8), WithMaxConcurrentPerHost(tt.maxPerHost))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, host := range []string{"127.0.0.1", "localhost"} {
+				if peak[host] > tt.wantPeak || peak[host] == 0 {
+					t.Errorf("GetService.Get() downloads at once from %s = %d, want at most %d", host, peak[host], tt.wantPeak)
+				}
+			}
+		})
+	}
+}
+
+func TestGetService_GetMaxConcurrentPerHostQueued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		mu      sync.Mutex
+		started []string
+		index   []byte
+	)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.yaml" {
+			w.Write(index)
+			return
+		}
+		mu.Lock()
+		started = append(started, strings.Split(r.Host, ":")[0])
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	port := svr.URL[strings.LastIndex(svr.URL, ":")+1:]
+	// all the charts of 127.0.0.1 come first in the order of the names
+	indexFile := repo.NewIndexFile()
+	for i := 0; i < 4; i++ {
+		for prefix, host := range map[string]string{"a": "127.0.0.1", "b": "localhost"} {
+			name := fmt.Sprintf("%s%d", prefix, i)
+			indexFile.Add(&chart.Metadata{Name: name, Version: "1.0.0"}, name+"-1.0.0.tgz", "http://"+host+":"+port, "")
+		}
+	}
+	if index, err = yaml.Marshal(indexFile); err != nil {
+		t.Fatalf("Marshalling index file: %s", err)
+	}
+	tests := []struct {
+		name  string
+		fetch bool
+	}{
+		{"1", false},
+		{"2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			started = nil
+			mu.Unlock()
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, true, false, false, fakeLogger, "", "", "",
+				WithConcurrency(2), WithMaxConcurrentPerHost(1))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if tt.fetch {
+				fetched, ferr := g.Fetch(context.Background())
+				if ferr == nil {
+					for range fetched {
+					}
+				}
+				err = ferr
+			} else {
+				err = g.Get(context.Background())
+			}
+			if err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// the second worker downloads from localhost while the first
+			// one is busy with 127.0.0.1
+			if len(started) != 8 || started[0] == started[1] {
+				t.Errorf("GetService.Get() downloads started from %v, want both hosts first", started)
+			}
+		})
+	}
+}
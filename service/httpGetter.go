@@ -0,0 +1,388 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/helm/pkg/getter"
+	"k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/tlsutil"
+)
+
+// DefaultUserAgent is the User-Agent header of the requests when none is set
+const DefaultUserAgent = "helm-mirror"
+
+// DefaultMaxIdleConnsPerHost is the number of idle connections kept open to
+// each host when none is set, enough for the default concurrency to reuse
+// its connections instead of opening new ones for each chart
+const DefaultMaxIdleConnsPerHost = 16
+
+// DefaultMinTLSVersion is the oldest TLS version accepted from the servers
+// when none is set
+const DefaultMinTLSVersion = tls.VersionTLS12
+
+// statusError is returned when the server answers a request with a status
+// other than 200 OK. retryAfter is the delay of its Retry-After header, 0
+// when there is none.
+type statusError struct {
+	url        string
+	statusCode int
+	status     string
+	retryAfter time.Duration
+}
+
+func newStatusError(href string, resp *http.Response) *statusError {
+	return &statusError{url: href, statusCode: resp.StatusCode, status: resp.Status, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("failed to fetch %s : %s", e.url, e.status)
+}
+
+// httpGetter is the HTTP(S) getter used for the index file and the charts.
+// Unlike helm's getter it keeps the status code of failed requests.
+type httpGetter struct {
+	client    *http.Client
+	username  string
+	password  string
+	userAgent string
+	limiter   *rate.Limiter
+}
+
+// Get performs a GET request and returns the body
+func (h *httpGetter) Get(href string) (*bytes.Buffer, error) {
+	return h.GetContext(context.Background(), href)
+}
+
+// GetContext performs a GET request that is aborted when ctx is done
+func (h *httpGetter) GetContext(ctx context.Context, href string) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer(nil)
+	body, _, err := h.Open(ctx, href, 0)
+	if err != nil {
+		return buf, err
+	}
+	defer body.Close()
+	_, err = io.Copy(buf, body)
+	return buf, err
+}
+
+// Open performs a GET request and returns the body, which must be closed.
+// When offset is positive and the server advertises byte ranges, only the
+// content from offset is asked for; resumed reports whether the body starts
+// at offset, otherwise it holds the whole content.
+func (h *httpGetter) Open(ctx context.Context, href string, offset int64) (body io.ReadCloser, resumed bool, err error) {
+	if offset > 0 && !h.acceptsRanges(ctx, href) {
+		offset = 0
+	}
+	req, err := h.newRequest(ctx, "GET", href)
+	if err != nil {
+		return nil, false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			return nil, false, fmt.Errorf("failed to fetch %s : unexpected content range %q", href, resp.Header.Get("Content-Range"))
+		}
+		resumed = true
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial content is not a prefix of the current one
+		resp.Body.Close()
+		return h.Open(ctx, href, 0)
+	default:
+		resp.Body.Close()
+		return nil, false, newStatusError(href, resp)
+	}
+
+	body = resp.Body
+	if h.limiter != nil {
+		body = struct {
+			io.Reader
+			io.Closer
+		}{&rateLimitedReader{ctx: ctx, r: resp.Body, limiter: h.limiter}, resp.Body}
+	}
+	return body, resumed, nil
+}
+
+// GetIfModified performs a GET request sending the validators of the previous
+// download of href, it returns errNotModified when the content did not change
+// since. The validators of the new content are returned with it. The request
+// is aborted when ctx is done.
+func (h *httpGetter) GetIfModified(ctx context.Context, href string, previous indexValidators) (*bytes.Buffer, indexValidators, error) {
+	req, err := h.newRequest(ctx, "GET", href)
+	if err != nil {
+		return nil, indexValidators{}, err
+	}
+	if previous.ETag != "" {
+		req.Header.Set("If-None-Match", previous.ETag)
+	}
+	if previous.LastModified != "" {
+		req.Header.Set("If-Modified-Since", previous.LastModified)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, indexValidators{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, previous, errNotModified
+	default:
+		return nil, indexValidators{}, newStatusError(href, resp)
+	}
+	var body io.Reader = resp.Body
+	if h.limiter != nil {
+		body = &rateLimitedReader{ctx: ctx, r: resp.Body, limiter: h.limiter}
+	}
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buf, body); err != nil {
+		return nil, indexValidators{}, err
+	}
+	return buf, indexValidators{URL: href, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+// acceptsRanges reports whether the server advertises byte ranges for href
+func (h *httpGetter) acceptsRanges(ctx context.Context, href string) bool {
+	req, err := h.newRequest(ctx, "HEAD", href)
+	if err != nil {
+		return false
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && resp.Header.Get("Accept-Ranges") == "bytes"
+}
+
+// Size performs a HEAD request and returns the size of the content at href,
+// or -1 when the server does not tell it
+func (h *httpGetter) Size(ctx context.Context, href string) (int64, error) {
+	req, err := h.newRequest(ctx, "HEAD", href)
+	if err != nil {
+		return -1, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1, newStatusError(href, resp)
+	}
+	return resp.ContentLength, nil
+}
+
+func (h *httpGetter) newRequest(ctx context.Context, method string, href string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, href, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", h.userAgent)
+	if h.username != "" && h.password != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+	return req, nil
+}
+
+// loggingTransport logs the URL, status, content length and elapsed time of
+// each request. The body of a response is logged when it is closed, with the
+// number of bytes read and the time taken by the whole download.
+type loggingTransport struct {
+	next http.RoundTripper
+	log  Printer
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.log.Printf("http: %s %s failed after %s - %s", req.Method, req.URL, time.Since(start).Round(time.Millisecond), err)
+		return nil, err
+	}
+	t.log.Printf("http: %s %s %s, content length %d, %s", req.Method, req.URL, resp.Status, resp.ContentLength, time.Since(start).Round(time.Millisecond))
+	if req.Method != http.MethodHead {
+		resp.Body = &loggingBody{ReadCloser: resp.Body, req: req, start: start, log: t.log}
+	}
+	return resp, nil
+}
+
+// loggingBody counts the bytes read from a response body
+type loggingBody struct {
+	io.ReadCloser
+	req   *http.Request
+	start time.Time
+	log   Printer
+	n     int64
+}
+
+func (b *loggingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *loggingBody) Close() error {
+	b.log.Printf("http: %s %s read %d bytes in %s", b.req.Method, b.req.URL, b.n, time.Since(b.start).Round(time.Millisecond))
+	return b.ReadCloser.Close()
+}
+
+// transportCache shares the HTTP transports, and so their idle connections,
+// between the getters of a run. There is one transport per client
+// certificate and CA bundle, as their TLS configuration differs.
+type transportCache struct {
+	mu                  sync.Mutex
+	maxIdleConnsPerHost int
+	minTLSVersion       uint16
+	transports          map[[3]string]*http.Transport
+}
+
+func newTransportCache(maxIdleConnsPerHost int, minTLSVersion uint16) *transportCache {
+	return &transportCache{maxIdleConnsPerHost: maxIdleConnsPerHost, minTLSVersion: minTLSVersion, transports: map[[3]string]*http.Transport{}}
+}
+
+// get returns the transport of the TLS files, creating it on first use. A
+// nil cache returns a new transport each time.
+func (c *transportCache) get(certFile string, keyFile string, caFile string) (*http.Transport, error) {
+	if c == nil {
+		return newTransport(certFile, keyFile, caFile, DefaultMaxIdleConnsPerHost, DefaultMinTLSVersion)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := [3]string{certFile, keyFile, caFile}
+	if tr, ok := c.transports[key]; ok {
+		return tr, nil
+	}
+	tr, err := newTransport(certFile, keyFile, caFile, c.maxIdleConnsPerHost, c.minTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+	c.transports[key] = tr
+	return tr, nil
+}
+
+// newTransport returns a transport keeping maxIdleConnsPerHost idle
+// connections open to each host, with the TLS configuration of the files.
+// It refuses the TLS versions older than minTLSVersion and speaks HTTP/2
+// with the servers supporting it.
+func newTransport(certFile string, keyFile string, caFile string, maxIdleConnsPerHost int, minTLSVersion uint16) (*http.Transport, error) {
+	tr := &http.Transport{
+		DisableCompression:  true,
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		// a custom TLS configuration disables HTTP/2 unless it is forced
+		ForceAttemptHTTP2: true,
+	}
+	tlsConf, err := newTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't create TLS config: %s", err)
+	}
+	tlsConf.MinVersion = minTLSVersion
+	tr.TLSClientConfig = tlsConf
+	return tr, nil
+}
+
+// newHTTPGetter returns a getter constructor that authenticates with the
+// given credentials and sends userAgent, DefaultUserAgent when it is empty.
+// The downloads are throttled by limiter when it is set, the requests are
+// logged with verbose when it is set. The getters share the transports of
+// transports, a nil one gives each getter its own.
+func newHTTPGetter(username string, password string, userAgent string, limiter *rate.Limiter, verbose Printer, transports *transportCache) getter.Constructor {
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	return func(URL, CertFile, KeyFile, CAFile string) (getter.Getter, error) {
+		tr, err := transports.get(CertFile, KeyFile, CAFile)
+		if err != nil {
+			return nil, err
+		}
+		var rt http.RoundTripper = tr
+		if verbose != nil {
+			rt = &loggingTransport{next: tr, log: verbose}
+		}
+		return &httpGetter{
+			client:    &http.Client{Transport: rt},
+			username:  username,
+			password:  password,
+			userAgent: userAgent,
+			limiter:   limiter,
+		}, nil
+	}
+}
+
+// newTLSConfig returns the TLS configuration of the client certificate and
+// the CA bundle. Unlike helm's, the CA bundle is added to the system pool and
+// the server name is not pinned to the repository host, so charts served by
+// other hosts (eg: a CDN) can still be downloaded.
+func newTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" && keyFile != "" {
+		cert, err := tlsutil.CertFromFilePair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA file: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("failed to append certificates from file: %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// getters returns the providers used to download from the chart repository,
+// the HTTP(S) getter of this package takes precedence over helm's.
+func (g *GetService) getters() getter.Providers {
+	return g.providers(g.config.Username, g.config.Password)
+}
+
+// providers returns the getters authenticating with the given credentials,
+// their requests are logged in verbose mode. The HTTP(S) getters of a run
+// share their connections. The custom getters come first
+// so they can also replace the built-in ones of a scheme.
+func (g *GetService) providers(username string, password string) getter.Providers {
+	var verbose Printer
+	if g.verbose {
+		verbose = g.log()
+	}
+	providers := append(getter.Providers{}, g.customGetters...)
+	providers = append(providers, getter.Provider{
+		Schemes: []string{"http", "https"},
+		New:     newHTTPGetter(username, password, g.userAgent, g.limiter, verbose, g.transports),
+	}, getter.Provider{
+		Schemes: []string{"file"},
+		New:     newFileGetter,
+	})
+	return append(providers, getter.All(environment.EnvSettings{})...)
+}
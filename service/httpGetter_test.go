@@ -0,0 +1,480 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/getter"
+	"k8s.io/helm/pkg/repo"
+)
+
+func Test_httpGetter_Get(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth":
+			if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case "/limited":
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name           string
+		path           string
+		username       string
+		password       string
+		wantStatus     int
+		wantRetryAfter time.Duration
+	}{
+		{"1", "/chart.tgz", "", "", http.StatusOK, 0},
+		{"2", "/missing", "", "", http.StatusNotFound, 0},
+		{"3", "/unavailable", "", "", http.StatusServiceUnavailable, 0},
+		{"4", "/auth", "", "", http.StatusUnauthorized, 0},
+		{"5", "/auth", "user", "pass", http.StatusOK, 0},
+		{"6", "/limited", "", "", http.StatusTooManyRequests, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newHTTPGetter(tt.username, tt.password, "", nil, nil, nil)(svr.URL, "", "", "")
+			if err != nil {
+				t.Fatalf("newHTTPGetter() error = %v", err)
+			}
+			b, err := c.Get(svr.URL + tt.path)
+			status := http.StatusOK
+			if e, ok := err.(*statusError); ok {
+				status = e.statusCode
+				if e.retryAfter != tt.wantRetryAfter {
+					t.Errorf("httpGetter.Get() retry after = %v, want %v", e.retryAfter, tt.wantRetryAfter)
+				}
+			} else if err != nil {
+				t.Fatalf("httpGetter.Get() error = %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("httpGetter.Get() status = %v, want %v", status, tt.wantStatus)
+			}
+			if status == http.StatusOK && b.String() != "chart" {
+				t.Errorf("httpGetter.Get() body = %q, want %q", b.String(), "chart")
+			}
+		})
+	}
+}
+
+func Test_httpGetter_GetIfModified(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/etag" {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		http.ServeContent(w, r, "index.yaml", modified, strings.NewReader("index"))
+	}))
+	defer svr.Close()
+	lastModified := modified.Format(http.TimeFormat)
+	tests := []struct {
+		name          string
+		path          string
+		previous      indexValidators
+		wantModified  bool
+		wantValidator indexValidators
+	}{
+		{"1", "/etag", indexValidators{}, true, indexValidators{URL: svr.URL + "/etag", ETag: `"v1"`, LastModified: lastModified}},
+		{"2", "/etag", indexValidators{ETag: `"v1"`}, false, indexValidators{ETag: `"v1"`}},
+		{"3", "/etag", indexValidators{ETag: `"v0"`}, true, indexValidators{URL: svr.URL + "/etag", ETag: `"v1"`, LastModified: lastModified}},
+		{"4", "/date", indexValidators{LastModified: lastModified}, false, indexValidators{LastModified: lastModified}},
+		{"5", "/date", indexValidators{LastModified: modified.Add(-time.Hour).Format(http.TimeFormat)}, true, indexValidators{URL: svr.URL + "/date", LastModified: lastModified}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newHTTPGetter("", "", "", nil, nil, nil)(svr.URL, "", "", "")
+			if err != nil {
+				t.Fatalf("newHTTPGetter() error = %v", err)
+			}
+			b, v, err := c.(conditionalGetter).GetIfModified(context.Background(), svr.URL+tt.path, tt.previous)
+			if tt.wantModified && (err != nil || b.String() != "index") {
+				t.Errorf("httpGetter.GetIfModified() = %v, %v, want index", b, err)
+			}
+			if !tt.wantModified && err != errNotModified {
+				t.Errorf("httpGetter.GetIfModified() error = %v, want %v", err, errNotModified)
+			}
+			if v != tt.wantValidator {
+				t.Errorf("httpGetter.GetIfModified() validators = %+v, want %+v", v, tt.wantValidator)
+			}
+		})
+	}
+}
+
+// writeClientCert writes a self-signed client certificate and its key to dir
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "helm-mirror"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := path.Join(dir, "client.crt")
+	keyFile := path.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, certFile, keyFile
+}
+
+func Test_httpGetter_GetTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/client" && len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("chart"))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	svr.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	svr.StartTLS()
+	defer svr.Close()
+	caFile := path.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svr.Certificate().Raw}), 0644)
+	tests := []struct {
+		name     string
+		repoURL  string
+		path     string
+		certFile string
+		keyFile  string
+		caFile   string
+		wantErr  bool
+	}{
+		{"1", svr.URL, "/chart.tgz", "", "", "", true},
+		{"2", svr.URL, "/chart.tgz", "", "", caFile, false},
+		// the charts may be served by another host than the repository
+		{"3", "https://charts.example.org", "/chart.tgz", "", "", caFile, false},
+		{"4", svr.URL, "/client", "", "", caFile, true},
+		{"5", svr.URL, "/client", certFile, keyFile, caFile, false},
+		{"6", svr.URL, "/chart.tgz", "", "", path.Join(dir, "missing.crt"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newHTTPGetter("", "", "", nil, nil, nil)(tt.repoURL, tt.certFile, tt.keyFile, tt.caFile)
+			if err == nil {
+				_, err = c.Get(svr.URL + tt.path)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("httpGetter.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// proxyTestEnv is set when the test binary runs Test_httpGetter_GetProxy in a
+// child process, as the proxy variables are only read once per process
+const proxyTestEnv = "HELM_MIRROR_PROXY_TEST"
+
+func Test_httpGetter_GetProxy(t *testing.T) {
+	if os.Getenv(proxyTestEnv) != "" {
+		c, _ := newHTTPGetter("", "", "", nil, nil, nil)("http://charts.example.org", "", "", "")
+		for _, u := range []string{"http://charts.example.org/chart.tgz", "http://direct.example.org/chart.tgz"} {
+			b, err := c.Get(u)
+			if err != nil {
+				fmt.Printf("%s: %s\n", u, err)
+				continue
+			}
+			fmt.Printf("%s: %s\n", u, b.String())
+		}
+		return
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a proxied request has the absolute URL of the target
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+	cmd := exec.Command(os.Args[0], "-test.run=^Test_httpGetter_GetProxy$")
+	cmd.Env = append(os.Environ(),
+		proxyTestEnv+"=1",
+		"HTTP_PROXY="+proxy.URL,
+		"http_proxy="+proxy.URL,
+		"NO_PROXY=direct.example.org",
+		"no_proxy=direct.example.org",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("running the proxy test: %s\n%s", err, out)
+	}
+	if want := "http://charts.example.org/chart.tgz: proxied http://charts.example.org/chart.tgz"; !strings.Contains(string(out), want) {
+		t.Errorf("httpGetter.Get() output = %q, want %q", out, want)
+	}
+	// direct.example.org does not resolve, the request must not reach the proxy
+	if strings.Contains(string(out), "proxied http://direct.example.org") {
+		t.Errorf("httpGetter.Get() output = %q, want direct.example.org not proxied", out)
+	}
+}
+
+func Test_httpGetter_GetVerbose(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("chart"))
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{"1", "/chart.tgz", []string{"GET " + svr.URL + "/chart.tgz 200 OK, content length 5", "read 5 bytes"}},
+		{"2", "/missing", []string{"GET " + svr.URL + "/missing 404 Not Found"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			c, _ := newHTTPGetter("", "", "", nil, log.New(out, "", 0), nil)(svr.URL, "", "", "")
+			c.Get(svr.URL + tt.path)
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("httpGetter.Get() logged %q, want %q", out.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func Test_httpGetter_UserAgent(t *testing.T) {
+	var got string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{"1", "", DefaultUserAgent},
+		{"2", "mirror-bot/1.0", "mirror-bot/1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newHTTPGetter("", "", tt.userAgent, nil, nil, nil)(svr.URL, "", "", "")
+			if _, err := c.Get(svr.URL + "/index.yaml"); err != nil {
+				t.Fatalf("httpGetter.Get() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("httpGetter.Get() User-Agent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// memoryGetter serves the content of files by URL
+type memoryGetter struct {
+	files map[string][]byte
+}
+
+func (m memoryGetter) Get(u string) (*bytes.Buffer, error) {
+	if b, ok := m.files[u]; ok {
+		return bytes.NewBuffer(b), nil
+	}
+	return nil, fmt.Errorf("%s not found", u)
+}
+
+func TestGetService_GetCustomGetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	store := memoryGetter{files: map[string][]byte{
+		"artifact://store/charts/index.yaml":           []byte(strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", "artifact://store/charts/", -1)),
+		"artifact://store/charts/chart1-2.11.0.tgz":    []byte("chart"),
+		"artifact://store/charts/chart2-1.0.1.tgz":     []byte("chart"),
+		"artifact://store/charts/chart2-0.0.0-rc1.tgz": []byte("chart"),
+	}}
+	providers := getter.Providers{{
+		Schemes: []string{"artifact"},
+		New: func(u, certFile, keyFile, caFile string) (getter.Getter, error) {
+			return store, nil
+		},
+	}}
+	tests := []struct {
+		name    string
+		opts    []GetOption
+		want    []string
+		wantErr bool
+	}{
+		{"1", []GetOption{WithGetters(providers)}, []string{"chart1-2.11.0.tgz", "chart2-0.0.0-rc1.tgz", "chart2-1.0.1.tgz"}, false},
+		{"2", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			config := repo.Entry{Name: workDir, URL: "artifact://store/charts"}
+			opts := append([]GetOption{WithChartNames([]string{"chart1", "chart2"})}, tt.opts...)
+			g, err := NewGetService(config, true, false, true, fakeLogger, "", "", "", opts...)
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "charts", "*.tgz"))
+			got := []string{}
+			for _, f := range files {
+				got = append(got, filepath.Base(f))
+			}
+			if !tt.wantErr && strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("GetService.Get() charts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_transportCache_get(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	_, certFile, keyFile := writeClientCert(t, dir)
+	c := newTransportCache(8, tls.VersionTLS13)
+	tr, err := c.get("", "", "")
+	if err != nil {
+		t.Fatalf("transportCache.get() error = %v", err)
+	}
+	if tr.MaxIdleConnsPerHost != 8 || tr.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("transportCache.get() MaxIdleConnsPerHost = %v, MinVersion = %v, want 8 and TLS 1.3", tr.MaxIdleConnsPerHost, tr.TLSClientConfig.MinVersion)
+	}
+	if again, _ := c.get("", "", ""); again != tr {
+		t.Errorf("transportCache.get() returned a new transport for the same files")
+	}
+	if other, _ := c.get(certFile, keyFile, certFile); other == tr || other.TLSClientConfig.RootCAs == nil {
+		t.Errorf("transportCache.get() = %v, want a transport with the TLS configuration of the files", other)
+	}
+	if _, err := c.get("", "", path.Join(dir, "missing.crt")); err == nil {
+		t.Errorf("transportCache.get() error = nil for a missing CA file")
+	}
+	var none *transportCache
+	first, _ := none.get("", "", "")
+	if second, _ := none.get("", "", ""); first == second || first.TLSClientConfig.MinVersion != DefaultMinTLSVersion {
+		t.Errorf("nil transportCache.get() = %v and %v, want two new transports", first, second)
+	}
+}
+
+func Test_httpGetter_GetTLSVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	svr.EnableHTTP2 = true
+	svr.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	svr.StartTLS()
+	defer svr.Close()
+	caFile := path.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svr.Certificate().Raw}), 0644)
+	tests := []struct {
+		name          string
+		minTLSVersion uint16
+		want          string
+		wantErr       bool
+	}{
+		{"1", DefaultMinTLSVersion, "HTTP/2.0", false},
+		{"2", tls.VersionTLS13, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newHTTPGetter("", "", "", nil, nil, newTransportCache(DefaultMaxIdleConnsPerHost, tt.minTLSVersion))(svr.URL, "", "", caFile)
+			if err != nil {
+				t.Fatalf("newHTTPGetter() error = %v", err)
+			}
+			got, err := c.Get(svr.URL + "/chart.tgz")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("httpGetter.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("httpGetter.Get() protocol = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+// Benchmark_httpGetter compares downloads sharing the transport of a run
+// with downloads each using a getter of its own
+func Benchmark_httpGetter(b *testing.B) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("c"), 4096))
+	}))
+	defer svr.Close()
+	for _, bb := range []struct {
+		name       string
+		transports func() *transportCache
+	}{
+		{"shared", func() *transportCache { return newTransportCache(DefaultMaxIdleConnsPerHost, DefaultMinTLSVersion) }},
+		{"per-request", func() *transportCache { return nil }},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			transports := bb.transports()
+			b.SetParallelism(DefaultConcurrency)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, _ := newHTTPGetter("", "", "", nil, nil, transports)(svr.URL, "", "", "")
+					if _, err := c.Get(svr.URL + "/chart-1.0.0.tgz"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
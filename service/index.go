@@ -0,0 +1,311 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/pkg/repo"
+)
+
+const gzSuffix = ".gz"
+
+// indexCacheFileName is the file of the destination folder keeping the
+// validators of the index file downloaded by the last complete run
+const indexCacheFileName = ".index-cache.json"
+
+// errNotModified is returned when the index file did not change since the
+// download of its validators
+var errNotModified = errors.New("index file not modified")
+
+// indexValidators are the ETag and Last-Modified headers of the index file
+// downloaded from URL, by a run of the options digested in Selection
+type indexValidators struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Selection    string `json:"selection,omitempty"`
+}
+
+// conditionalGetter is implemented by getters that can skip a download when
+// the content did not change since the previous one, they return
+// errNotModified then
+type conditionalGetter interface {
+	GetIfModified(ctx context.Context, href string, previous indexValidators) (*bytes.Buffer, indexValidators, error)
+}
+
+// fetchIndexFile downloads the index file of the repository, index.yaml.gz is
+// used when there is no index.yaml. A gzip compressed index file is
+// decompressed whatever its name. When previous is set the download is
+// conditional and errNotModified is returned when the index file did not
+// change. The validators of the downloaded index file are returned when the
+// getter supports them. The download is aborted when ctx is done.
+func fetchIndexFile(ctx context.Context, chartRepo *repo.ChartRepository, previous *indexValidators) ([]byte, *indexValidators, error) {
+	b, validators, err := getIndexFile(ctx, chartRepo, indexFileName, previous)
+	if e, ok := err.(*statusError); ok && e.statusCode == http.StatusNotFound {
+		if gz, gzValidators, gzErr := getIndexFile(ctx, chartRepo, indexFileName+gzSuffix, previous); gzErr == nil || gzErr == errNotModified {
+			b, validators, err = gz, gzValidators, gzErr
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if isGzip(b) {
+		if b, err = gunzip(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	if _, err := parseIndexFile(b); err != nil {
+		return nil, nil, err
+	}
+	return b, validators, nil
+}
+
+// getIndexFile downloads the file name from the folder of the repository,
+// conditionally when previous holds the validators of the same URL
+func getIndexFile(ctx context.Context, chartRepo *repo.ChartRepository, name string, previous *indexValidators) ([]byte, *indexValidators, error) {
+	u, err := url.Parse(chartRepo.Config.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.RawPath = path.Join(u.RawPath, name)
+	u.Path = path.Join(u.Path, name)
+	if c, ok := chartRepo.Client.(conditionalGetter); ok {
+		v := indexValidators{}
+		if previous != nil && previous.URL == u.String() {
+			v = *previous
+		}
+		b, validators, err := c.GetIfModified(ctx, u.String(), v)
+		if err != nil {
+			return nil, nil, err
+		}
+		return b.Bytes(), &validators, nil
+	}
+	var b *bytes.Buffer
+	if c, ok := chartRepo.Client.(contextGetter); ok {
+		b, err = c.GetContext(ctx, u.String())
+	} else {
+		b, err = chartRepo.Client.Get(u.String())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return b.Bytes(), nil, nil
+}
+
+// loadIndexValidators returns the validators of the last complete run kept
+// in cachePath, or nil when there are none or when the index file of the
+// mirror at indexPath is missing, as it must then be written again
+func loadIndexValidators(fs FileSystem, cachePath string, indexPath string, selection string) *indexValidators {
+	if _, err := fs.ReadFile(indexPath); err != nil {
+		return nil
+	}
+	b, err := fs.ReadFile(cachePath)
+	if err != nil {
+		return nil
+	}
+	v := &indexValidators{}
+	if err := json.Unmarshal(b, v); err != nil || (v.ETag == "" && v.LastModified == "") || v.Selection != selection {
+		return nil
+	}
+	return v
+}
+
+// selection returns the digest of the options selecting the charts and
+// where they are written, the validators of a run are only used by a run of
+// the same options
+func (g *GetService) selection() string {
+	regexpString := func(r *regexp.Regexp) string {
+		if r == nil {
+			return ""
+		}
+		return r.String()
+	}
+	blocklist := make([]string, 0, len(g.blocklist))
+	for b := range g.blocklist {
+		blocklist = append(blocklist, b)
+	}
+	sort.Strings(blocklist)
+	b, _ := json.Marshal([]interface{}{
+		g.allVersions, g.chartName, g.chartVersion, g.chartNames, g.specs,
+		g.versionRange, g.appVersionRange, regexpString(g.versionInclude), regexpString(g.versionExclude),
+		g.maxVersionsPerChart, g.resolveDependencies, g.modifiedSince, g.keywordFilter, g.annotationFilter,
+		g.maintainerFilter, g.sourceURLPrefix, g.latestOnly, g.exactMatch, regexpString(g.namePattern),
+		g.skipPrereleases, g.includeDeprecated, blocklist, g.maxChartBytes, g.skipUnknownSize,
+		g.newRootURL, g.rewrites, g.layout, g.preserveURLFilename, g.withProvenance, g.fetchExtraArtifacts,
+	})
+	return digest(b)
+}
+
+// saveIndexValidators keeps the validators v in cachePath for the next run,
+// an empty file is written when there are none
+func saveIndexValidators(fs FileSystem, cachePath string, v *indexValidators, mode os.FileMode) error {
+	if v == nil {
+		v = &indexValidators{}
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(fs, cachePath, content, mode)
+}
+
+// isGzip reports whether b starts with the gzip magic bytes
+func isGzip(b []byte) bool {
+	return len(b) > 1 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// compressIndexFile writes the gzip compressed copy of the index file at
+// indexPath next to it, eg: index.yaml.gz
+func compressIndexFile(fs FileSystem, indexPath string, mode os.FileMode) error {
+	content, err := fs.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(content); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return writeAtomic(fs, indexPath+gzSuffix, buf.Bytes(), mode)
+}
+
+// loadPreviousIndex loads the index file left at indexPath by a previous
+// run, or returns nil when there is none
+func loadPreviousIndex(fs FileSystem, indexPath string) (*repo.IndexFile, error) {
+	index, err := loadIndexFile(fs, indexPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading the previous index file: %s", err)
+	}
+	return index, nil
+}
+
+// indexEdit returns the changes made to the index file of the mirror before
+// it is written: the chart versions of previous are merged, then it is
+// transformed and its timestamps are pinned as configured. It is nil when
+// there is nothing to change.
+func (g *GetService) indexEdit(previous *repo.IndexFile) IndexTransformFunc {
+	pin := g.reproducible || !g.indexTimestamp.IsZero()
+	if previous == nil && g.indexTransform == nil && !pin {
+		return nil
+	}
+	return func(indexFile *repo.IndexFile) error {
+		mergeIndex(indexFile, previous)
+		if g.indexTransform != nil {
+			if err := g.indexTransform(indexFile); err != nil {
+				return fmt.Errorf("transforming the index file: %s", err)
+			}
+		}
+		if pin {
+			pinIndexTimestamps(indexFile, g.indexTimestamp, g.regenerateIndex)
+		}
+		return nil
+	}
+}
+
+// mergeIndex adds the chart versions of previous that are missing from the
+// index file, the entries of the index file win when both have the same
+// chart version
+func mergeIndex(indexFile *repo.IndexFile, previous *repo.IndexFile) {
+	if previous == nil {
+		return
+	}
+	for name, versions := range previous.Entries {
+		for _, cv := range versions {
+			if !hasVersion(indexFile, name, cv.Version) {
+				indexFile.Entries[name] = append(indexFile.Entries[name], cv)
+			}
+		}
+	}
+	indexFile.SortEntries()
+}
+
+// pinIndexTimestamps sets the generated time of the index file to t, or to
+// the newest created time of its charts when t is zero, so the same charts
+// always give the same index file. The created times of a regenerated index
+// file are the time of the run, they are set to t or else to the Unix epoch.
+func pinIndexTimestamps(indexFile *repo.IndexFile, t time.Time, regenerated bool) {
+	if regenerated {
+		created := t
+		if created.IsZero() {
+			created = time.Unix(0, 0).UTC()
+		}
+		for _, versions := range indexFile.Entries {
+			for _, cv := range versions {
+				cv.Created = created
+			}
+		}
+	}
+	if t.IsZero() {
+		t = time.Unix(0, 0).UTC()
+		for _, versions := range indexFile.Entries {
+			for _, cv := range versions {
+				if cv.Created.After(t) {
+					t = cv.Created
+				}
+			}
+		}
+	}
+	indexFile.Generated = t
+}
+
+// hasVersion reports whether the index file has exactly this chart version,
+// unlike IndexFile.Has which matches version as a constraint
+func hasVersion(index *repo.IndexFile, name string, version string) bool {
+	for _, cv := range index.Entries[name] {
+		if cv.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// loadIndexFile loads the index file name of fs like repo.LoadIndexFile
+func loadIndexFile(fs FileSystem, name string) (*repo.IndexFile, error) {
+	b, err := fs.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseIndexFile(b)
+}
+
+// parseIndexFile parses an index file with its entries sorted, the legacy
+// index files without apiVersion are not supported
+func parseIndexFile(b []byte) (*repo.IndexFile, error) {
+	index := &repo.IndexFile{}
+	if err := yaml.Unmarshal(b, index); err != nil {
+		return nil, err
+	}
+	if index.APIVersion == "" {
+		return nil, repo.ErrNoAPIVersion
+	}
+	index.SortEntries()
+	return index, nil
+}
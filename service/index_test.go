@@ -0,0 +1,479 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(b); err != nil {
+		t.Fatalf("compressing: %s", err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestGetService_GetGzipIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index []byte
+	files := map[string]map[string][]byte{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		switch {
+		case len(parts) != 2:
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(parts[1], ".tgz") && !strings.HasPrefix(parts[1], "chart4"):
+			w.Write([]byte("chart"))
+		default:
+			if b, ok := files[parts[0]][parts[1]]; ok {
+				w.Write(b)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	index = []byte(strings.Replace(fixtures.IndexYaml, "http://127.0.0.1:1793/", svr.URL+"/charts/", -1))
+	files["1"] = map[string][]byte{indexFileName: index}
+	files["2"] = map[string][]byte{indexFileName + gzSuffix: gzipBytes(t, index)}
+	files["3"] = map[string][]byte{indexFileName: gzipBytes(t, index)}
+	files["4"] = map[string][]byte{indexFileName: index, indexFileName + gzSuffix: []byte("not gzip")}
+	files["5"] = map[string][]byte{indexFileName + gzSuffix: []byte("not gzip")}
+	files["6"] = map[string][]byte{}
+	tests := []struct {
+		name     string
+		compress bool
+		wantErr  bool
+	}{
+		{"1", true, false},
+		{"2", false, false},
+		{"3", false, false},
+		{"4", false, false},
+		{"5", false, true},
+		{"6", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:        repo.Entry{Name: workDir, URL: svr.URL + "/" + tt.name},
+				logger:        fakeLogger,
+				ignoreErrors:  true,
+				allVersions:   true,
+				compressIndex: tt.compress,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "charts", "*.tgz"))
+			if len(files) != fixtures.Expectedcharts-1 {
+				t.Errorf("GetService.Get() got count of = %v TGZ files, want count of %v", len(files), fixtures.Expectedcharts-1)
+			}
+			content, err := ioutil.ReadFile(path.Join(workDir, indexFileName))
+			if err != nil {
+				t.Fatalf("reading index.yaml: %s", err)
+			}
+			compressed, err := ioutil.ReadFile(path.Join(workDir, indexFileName+gzSuffix))
+			if !tt.compress {
+				if err == nil {
+					t.Errorf("GetService.Get() wrote index.yaml.gz without compression")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading index.yaml.gz: %s", err)
+			}
+			if b, err := gunzip(compressed); err != nil || !bytes.Equal(b, content) {
+				t.Errorf("GetService.Get() index.yaml.gz does not match index.yaml: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetService_GetIndexRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name         string
+		indexRetries int
+		failures     int
+		status       int
+		wantErr      bool
+		wantCalls    int
+	}{
+		{"1", 0, 1, http.StatusServiceUnavailable, true, 1},
+		{"2", 2, 2, http.StatusServiceUnavailable, false, 3},
+		{"3", 2, 3, http.StatusBadGateway, true, 3},
+		{"4", 2, 1, http.StatusForbidden, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if path.Base(r.URL.Path) != indexFileName {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				calls++
+				if calls <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Write([]byte("apiVersion: v1\nentries: {}\n"))
+			}))
+			defer svr.Close()
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:         repo.Entry{Name: workDir, URL: svr.URL},
+				logger:         fakeLogger,
+				indexRetries:   tt.indexRetries,
+				retryBaseDelay: time.Millisecond,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("GetService.Get() index requests = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_mergeIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	index := "apiVersion: v1\nentries:\n  chart1:\n  - name: chart1\n    version: 1.0.0\n    urls:\n    - http://new/chart1-1.0.0.tgz\n"
+	tests := []struct {
+		name     string
+		index    string
+		previous string
+		want     []string
+		wantErr  bool
+	}{
+		{"1", index, "", []string{"chart1 1.0.0 http://new/chart1-1.0.0.tgz"}, false},
+		{"2", index, "apiVersion: v1\nentries:\n  chart1:\n  - name: chart1\n    version: 0.9.0\n    urls:\n    - http://old/chart1-0.9.0.tgz\n  chart2:\n  - name: chart2\n    version: 2.0.0\n    urls:\n    - http://old/chart2-2.0.0.tgz\n",
+			[]string{"chart1 1.0.0 http://new/chart1-1.0.0.tgz", "chart1 0.9.0 http://old/chart1-0.9.0.tgz", "chart2 2.0.0 http://old/chart2-2.0.0.tgz"}, false},
+		{"3", index, "apiVersion: v1\nentries:\n  chart1:\n  - name: chart1\n    version: 1.0.0\n    urls:\n    - http://old/chart1-1.0.0.tgz\n", []string{"chart1 1.0.0 http://new/chart1-1.0.0.tgz"}, false},
+		{"4", index, "not an index", nil, true},
+		{"5", "", "apiVersion: v1\nentries: {}\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folder := path.Join(dir, tt.name)
+			os.MkdirAll(folder, 0755)
+			indexPath := path.Join(folder, indexFileName)
+			if tt.previous != "" {
+				ioutil.WriteFile(indexPath, []byte(tt.previous), 0644)
+			}
+			previous, err := loadPreviousIndex(osFileSystem{}, path.Join(folder, indexFileName))
+			var merged *repo.IndexFile
+			if err == nil {
+				os.Remove(indexPath)
+				if tt.index != "" {
+					ioutil.WriteFile(indexPath, []byte(tt.index), 0644)
+				}
+				if merged, err = loadIndexFile(osFileSystem{}, indexPath); err == nil {
+					mergeIndex(merged, previous)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeIndex() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := []string{}
+			for _, name := range []string{"chart1", "chart2"} {
+				for _, cv := range merged.Entries[name] {
+					got = append(got, strings.Join([]string{cv.Name, cv.Version, cv.URLs[0]}, " "))
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("mergeIndex() entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pinIndexTimestamps(t *testing.T) {
+	older := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	newer := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	pinned := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	epoch := time.Unix(0, 0).UTC()
+	tests := []struct {
+		name          string
+		t             time.Time
+		regenerated   bool
+		wantGenerated time.Time
+		wantCreated   time.Time
+	}{
+		{"1", pinned, false, pinned, newer},
+		{"2", time.Time{}, false, newer, newer},
+		{"3", pinned, true, pinned, pinned},
+		{"4", time.Time{}, true, epoch, epoch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index := repo.NewIndexFile()
+			index.Add(&chart.Metadata{ApiVersion: "v1", Name: "chart1", Version: "1.0.0"}, "chart1-1.0.0.tgz", "http://charts", "")
+			index.Add(&chart.Metadata{ApiVersion: "v1", Name: "chart2", Version: "1.0.0"}, "chart2-1.0.0.tgz", "http://charts", "")
+			index.Entries["chart1"][0].Created = older
+			index.Entries["chart2"][0].Created = newer
+			pinIndexTimestamps(index, tt.t, tt.regenerated)
+			if !index.Generated.Equal(tt.wantGenerated) {
+				t.Errorf("pinIndexTimestamps() generated = %v, want %v", index.Generated, tt.wantGenerated)
+			}
+			if created := index.Entries["chart2"][0].Created; !created.Equal(tt.wantCreated) {
+				t.Errorf("pinIndexTimestamps() created = %v, want %v", created, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func TestGetService_GetReproducibleIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	var indexes []string
+	for _, name := range []string{"1", "2"} {
+		workDir := path.Join(dir, name)
+		os.MkdirAll(workDir, 0755)
+		opts := []GetOption{WithChartNames([]string{"chart1", "chart2"}), WithRegeneratedIndex(true), WithReproducibleIndex(true)}
+		g, err := NewGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, true, false, true, fakeLogger, "https://mirror.local.lan", "", "", opts...)
+		if err != nil {
+			t.Fatalf("NewGetService() error = %v", err)
+		}
+		if err := g.Get(context.Background()); err != nil {
+			t.Fatalf("GetService.Get() error = %v", err)
+		}
+		b, err := ioutil.ReadFile(path.Join(workDir, indexFileName))
+		if err != nil {
+			t.Fatalf("Reading index file: %s", err)
+		}
+		indexes = append(indexes, string(b))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if indexes[0] != indexes[1] {
+		t.Errorf("GetService.Get() index files differ:\n%s\n%s", indexes[0], indexes[1])
+	}
+}
+
+func TestGetService_GetIndexTransform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	annotate := func(index *repo.IndexFile) error {
+		for _, versions := range index.Entries {
+			for _, cv := range versions {
+				cv.Annotations = map[string]string{"mirror": "mirror.local.lan"}
+			}
+		}
+		return nil
+	}
+	tests := []struct {
+		name      string
+		transform IndexTransformFunc
+		indexOnly bool
+		want      func(index *repo.IndexFile) bool
+		wantErr   bool
+	}{
+		{"1", annotate, false, func(index *repo.IndexFile) bool {
+			for _, versions := range index.Entries {
+				for _, cv := range versions {
+					if cv.Annotations["mirror"] != "mirror.local.lan" || !strings.HasPrefix(cv.URLs[0], "https://mirror.local.lan/") {
+						return false
+					}
+				}
+			}
+			return len(index.Entries) > 0
+		}, false},
+		{"2", func(index *repo.IndexFile) error {
+			delete(index.Entries, "chart1")
+			return nil
+		}, false, func(index *repo.IndexFile) bool {
+			_, ok := index.Entries["chart1"]
+			return !ok && len(index.Entries) > 0
+		}, false},
+		{"3", annotate, true, func(index *repo.IndexFile) bool {
+			return index.Entries["chart1"][0].Annotations["mirror"] == "mirror.local.lan"
+		}, false},
+		{"4", func(index *repo.IndexFile) error {
+			return errors.New("rejected")
+		}, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			// the index file of the previous run
+			previous := "apiVersion: v1\nentries: {}\n"
+			ioutil.WriteFile(path.Join(workDir, indexFileName), []byte(previous), 0644)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, true, false, true, fakeLogger, "https://mirror.local.lan", "", "",
+				WithIndexTransform(tt.transform), WithIndexOnly(tt.indexOnly))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// a rejected index file is never written
+				if b, _ := ioutil.ReadFile(path.Join(workDir, indexFileName)); string(b) != previous {
+					t.Errorf("GetService.Get() index file = %s, want the previous one", b)
+				}
+				return
+			}
+			index, err := repo.LoadIndexFile(path.Join(workDir, indexFileName))
+			if err != nil {
+				t.Fatalf("Loading index file: %s", err)
+			}
+			if !tt.want(index) {
+				t.Errorf("GetService.Get() index file not transformed: %+v", index.Entries)
+			}
+		})
+	}
+}
+
+func TestGetService_GetConditionalIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := path.Join(dir, "upstream")
+	os.MkdirAll(upstream, 0755)
+	workDir := path.Join(dir, "mirror")
+	os.MkdirAll(workDir, 0755)
+	// chart4 is not found
+	for _, name := range []string{"chart1", "chart2", "chart3"} {
+		ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: name, Version: "1.0.0"}}
+		if _, err := chartutil.Save(ch, upstream); err != nil {
+			t.Fatalf("Saving chart: %s", err)
+		}
+	}
+	var (
+		index       []byte
+		notModified int
+		charts      int
+	)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/index.yaml" {
+			charts++
+			http.ServeFile(w, r, path.Join(upstream, path.Base(r.URL.Path)))
+			return
+		}
+		etag := `"` + digest(index) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "index.yaml", time.Time{}, bytes.NewReader(index))
+	}))
+	defer svr.Close()
+	writeIndex := func(names ...string) {
+		indexFile := repo.NewIndexFile()
+		// the same charts always give the same index file
+		indexFile.Generated = time.Unix(0, 0).UTC()
+		for _, name := range names {
+			indexFile.Add(&chart.Metadata{Name: name, Version: "1.0.0"}, name+"-1.0.0.tgz", svr.URL, "")
+			indexFile.Entries[name][0].Created = indexFile.Generated
+		}
+		index, _ = yaml.Marshal(indexFile)
+	}
+	writeIndex("chart1")
+	tests := []struct {
+		name            string
+		charts          []string
+		force           bool
+		removeIndex     bool
+		indexOnly       bool
+		chartName       string
+		ignoreErrors    bool
+		wantNotModified bool
+		wantDownloaded  int
+	}{
+		{"1", []string{"chart1"}, false, false, false, "", false, false, 1},
+		{"2", []string{"chart1"}, false, false, false, "", false, true, 0},
+		{"3", []string{"chart1"}, true, false, false, "", false, false, 1},
+		{"4", []string{"chart1", "chart2"}, false, false, false, "", false, false, 2},
+		{"5", []string{"chart1", "chart2"}, false, true, false, "", false, false, 2},
+		{"6", []string{"chart1", "chart2"}, false, false, false, "", false, true, 0},
+		// an index only run does not keep the validators for the next one
+		{"7", []string{"chart1", "chart2", "chart3"}, false, false, true, "", false, false, 0},
+		{"8", []string{"chart1", "chart2", "chart3"}, false, false, false, "", false, false, 3},
+		// the charts selected by other options are downloaded again
+		{"9", []string{"chart1", "chart2", "chart3"}, false, false, false, "chart1", false, false, 1},
+		{"10", []string{"chart1", "chart2", "chart3"}, false, false, false, "chart1", false, true, 0},
+		{"11", []string{"chart1", "chart2", "chart3"}, false, false, false, "", false, false, 3},
+		// the run of an ignored failure does not keep the validators
+		{"12", []string{"chart1", "chart2", "chart3", "chart4"}, false, false, false, "", true, false, 4},
+		{"13", []string{"chart1", "chart2", "chart3", "chart4"}, false, false, false, "", true, false, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeIndex(tt.charts...)
+			if tt.removeIndex {
+				os.Remove(path.Join(workDir, indexFileName))
+			}
+			notModified, charts = 0, 0
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, true, false, tt.ignoreErrors, fakeLogger, "", tt.chartName, "",
+				WithConditionalIndex(true), WithForcedRecheck(tt.force), WithIndexOnly(tt.indexOnly))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			if (notModified > 0) != tt.wantNotModified || charts != tt.wantDownloaded {
+				t.Errorf("GetService.Get() index not modified = %v, charts downloaded %d, want %v, %d", notModified > 0, charts, tt.wantNotModified, tt.wantDownloaded)
+			}
+			if got := g.Index(); got == nil || len(got.Entries) != len(tt.charts) {
+				t.Errorf("GetService.Index() = %v, want %v charts", got, len(tt.charts))
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"fmt"
+	"path"
+)
+
+// Layout is how the charts are laid out in the destination folder
+type Layout string
+
+const (
+	// LayoutURLPrefix writes the charts in the subfolders of their URL paths,
+	// the default
+	LayoutURLPrefix Layout = "urlPrefix"
+	// LayoutFlat writes all the charts directly in the destination folder
+	LayoutFlat Layout = "flat"
+	// LayoutByName writes each chart in a subfolder named after it, eg:
+	// nginx/nginx-1.0.0.tgz
+	LayoutByName Layout = "byName"
+)
+
+// validate checks that l is a known layout
+func (l Layout) validate() error {
+	switch l {
+	case LayoutURLPrefix, LayoutFlat, LayoutByName:
+		return nil
+	}
+	return fmt.Errorf("invalid layout %q: expected %s, %s or %s", l, LayoutURLPrefix, LayoutFlat, LayoutByName)
+}
+
+// rewritesURLs reports whether the chart URLs of the index file have to be
+// rewritten to match where the charts are written with the layout l
+func (l Layout) rewritesURLs() bool {
+	return l == LayoutFlat || l == LayoutByName
+}
+
+// chartPath returns the path of the chart file name downloaded from the URL
+// path p, relative to the destination folder
+func (l Layout) chartPath(chartName string, name string, p string) string {
+	switch l {
+	case LayoutFlat:
+		return name
+	case LayoutByName:
+		return path.Join(chartName, name)
+	}
+	chartPrefix, _ := path.Split(p)
+	return path.Join(chartPrefix, name)
+}
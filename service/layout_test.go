@@ -0,0 +1,28 @@
+package service
+
+import "testing"
+
+func TestLayout_chartPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  Layout
+		want    string
+		wantErr bool
+	}{
+		{"1", "", "/charts/stable/nginx-1.0.0.tgz", true},
+		{"2", LayoutURLPrefix, "/charts/stable/nginx-1.0.0.tgz", false},
+		{"3", LayoutFlat, "nginx-1.0.0.tgz", false},
+		{"4", LayoutByName, "nginx/nginx-1.0.0.tgz", false},
+		{"5", Layout("nested"), "/charts/stable/nginx-1.0.0.tgz", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.layout.chartPath("nginx", "nginx-1.0.0.tgz", "/charts/stable/nginx-1.0.0.tgz"); got != tt.want {
+				t.Errorf("Layout.chartPath() = %v, want %v", got, tt.want)
+			}
+			if err := tt.layout.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Layout.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
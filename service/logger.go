@@ -0,0 +1,143 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Key events of a mirror run
+const (
+	EventIndexDownloaded = "index_downloaded"
+	EventChartDownloaded = "chart_downloaded"
+	EventChartSkipped    = "chart_skipped"
+	EventChartFailed     = "chart_failed"
+	// EventRunCompleted ends a run, its message has the totals of the run
+	EventRunCompleted = "run_completed"
+	// EventMessage is a free-form message logged with Printf
+	EventMessage = "message"
+)
+
+// Event is a key event of a mirror run
+type Event struct {
+	Time  string `json:"time"`
+	Event string `json:"event"`
+	// Repo is the name of the repository of the run, on the index and run
+	// events
+	Repo    string `json:"repo,omitempty"`
+	Chart   string `json:"chart,omitempty"`
+	Version string `json:"version,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Printer logs free-form messages, *log.Logger implements it
+type Printer interface {
+	Printf(format string, v ...interface{})
+}
+
+// Logger is the logging interface of GetService, it logs the key events of
+// a mirror run on top of free-form messages
+type Logger interface {
+	Printer
+	Event(e Event)
+}
+
+// textLogger logs the events as sentences with a *log.Logger
+type textLogger struct {
+	*log.Logger
+	verbose bool
+}
+
+// NewTextLogger returns a Logger that writes text lines with l, the default
+// one. The index download is only logged when verbose is set, the chart
+// downloads are left to the progress callback.
+func NewTextLogger(l *log.Logger, verbose bool) Logger {
+	return &textLogger{Logger: l, verbose: verbose}
+}
+
+func (t *textLogger) Event(e Event) {
+	switch e.Event {
+	case EventIndexDownloaded:
+		if t.verbose && e.Repo != "" {
+			t.Printf("index file of %s downloaded from %s", e.Repo, e.URL)
+		} else if t.verbose {
+			t.Printf("index file downloaded from %s", e.URL)
+		}
+	case EventChartDownloaded:
+		// reported by the progress callback
+	case EventChartSkipped:
+		t.Printf("chart %s(%s) skipping, up to date", e.Chart, e.Version)
+	case EventChartFailed:
+		t.Printf("WARNING: processing chart %s(%s) - %s", e.Chart, e.Version, e.Error)
+	default:
+		t.Printf("%s", e.Message)
+	}
+}
+
+// jsonLogger writes each event as a JSON object on its own line
+type jsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLogger returns a Logger that writes one JSON object per line to w,
+// with the fields of Event. The free-form messages are message events.
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+func (j *jsonLogger) Printf(format string, v ...interface{}) {
+	j.Event(Event{Event: EventMessage, Message: fmt.Sprintf(format, v...)})
+}
+
+func (j *jsonLogger) Event(e Event) {
+	if e.Time == "" {
+		e.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.w.Write(append(b, '\n'))
+}
+
+// quietLogger only passes the end of the runs to the logger it wraps
+type quietLogger struct {
+	next Logger
+}
+
+// NewQuietLogger returns a Logger that drops the free-form messages, and the
+// events of l but the end of the runs, so a run only logs its totals. The
+// errors that stop a run are returned by it and are not affected.
+func NewQuietLogger(l Logger) Logger {
+	return &quietLogger{next: l}
+}
+
+func (q *quietLogger) Printf(format string, v ...interface{}) {}
+
+func (q *quietLogger) Event(e Event) {
+	if e.Event == EventRunCompleted {
+		q.next.Event(e)
+	}
+}
+
+// log returns the logger of the service, a text logger writing with its
+// *log.Logger unless another one was set, that only logs the end of the runs
+// in quiet mode
+func (g *GetService) log() Logger {
+	l := g.eventLogger
+	if l == nil {
+		l = NewTextLogger(g.logger, g.verbose)
+	}
+	if g.quiet {
+		return NewQuietLogger(l)
+	}
+	return l
+}
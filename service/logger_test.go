@@ -0,0 +1,161 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func Test_textLogger_Event(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   Event
+		verbose bool
+		want    string
+	}{
+		{"1", Event{Event: EventIndexDownloaded, URL: "http://charts"}, false, ""},
+		{"2", Event{Event: EventIndexDownloaded, URL: "http://charts"}, true, "index file downloaded from http://charts\n"},
+		{"2.1", Event{Event: EventIndexDownloaded, Repo: "stable", URL: "http://charts"}, true, "index file of stable downloaded from http://charts\n"},
+		{"3", Event{Event: EventChartDownloaded, Chart: "chart1", Version: "1.0.0", URL: "http://charts/chart1-1.0.0.tgz"}, false, ""},
+		{"4", Event{Event: EventChartDownloaded, Chart: "chart1", Version: "1.0.0", URL: "http://charts/chart1-1.0.0.tgz"}, true, ""},
+		{"5", Event{Event: EventChartSkipped, Chart: "chart1", Version: "1.0.0"}, false, "chart chart1(1.0.0) skipping, up to date\n"},
+		{"6", Event{Event: EventChartFailed, Chart: "chart1", Version: "1.0.0", Error: "not found"}, false, "WARNING: processing chart chart1(1.0.0) - not found\n"},
+		{"7", Event{Event: EventMessage, Message: "hello"}, false, "hello\n"},
+		{"8", Event{Event: EventRunCompleted, Message: "mirror of http://charts done: 1 charts downloaded"}, false, "mirror of http://charts done: 1 charts downloaded\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			NewTextLogger(log.New(out, "", 0), tt.verbose).Event(tt.event)
+			if out.String() != tt.want {
+				t.Errorf("textLogger.Event() = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_jsonLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := NewJSONLogger(out)
+	l.Event(Event{Event: EventChartFailed, Chart: "chart1", Version: "1.0.0", URL: "http://charts/chart1-1.0.0.tgz", Error: "not found"})
+	l.Printf("hello %s", "world")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("jsonLogger logged %v lines, want 2", len(lines))
+	}
+	want := []Event{
+		{Event: EventChartFailed, Chart: "chart1", Version: "1.0.0", URL: "http://charts/chart1-1.0.0.tgz", Error: "not found"},
+		{Event: EventMessage, Message: "hello world"},
+	}
+	for i, line := range lines {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("jsonLogger line %q: %s", line, err)
+		}
+		if e.Time == "" {
+			t.Errorf("jsonLogger line %q has no time", line)
+		}
+		e.Time = ""
+		if e != want[i] {
+			t.Errorf("jsonLogger event = %+v, want %+v", e, want[i])
+		}
+	}
+}
+
+func TestGetService_GetJSONLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	out := &bytes.Buffer{}
+	g := &GetService{
+		config:           repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+		logger:           fakeLogger,
+		eventLogger:      NewJSONLogger(out),
+		ignoreErrors:     true,
+		allVersions:      true,
+		repoNameOverride: "stable",
+		outputDir:        dir,
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Errorf("GetService.Get() error = %v", err)
+	}
+	events := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("GetService.Get() logged %q: %s", line, err)
+		}
+		if (e.Event == EventIndexDownloaded || e.Event == EventRunCompleted) && e.Repo != "stable" {
+			t.Errorf("GetService.Get() logged %s event of repo %q, want stable", e.Event, e.Repo)
+		}
+		events[e.Event]++
+	}
+	want := map[string]int{EventIndexDownloaded: 1, EventChartDownloaded: fixtures.Expectedcharts - 1, EventChartFailed: 1, EventRunCompleted: 1}
+	for event, count := range want {
+		if events[event] != count {
+			t.Errorf("GetService.Get() logged %v %s events, want %v", events[event], event, count)
+		}
+	}
+}
+
+func Test_quietLogger(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{"1", Event{Event: EventIndexDownloaded, URL: "http://charts"}, ""},
+		{"2", Event{Event: EventChartSkipped, Chart: "chart1", Version: "1.0.0"}, ""},
+		{"3", Event{Event: EventChartFailed, Chart: "chart1", Version: "1.0.0", Error: "not found"}, ""},
+		{"4", Event{Event: EventMessage, Message: "hello"}, ""},
+		{"5", Event{Event: EventRunCompleted, Message: "mirror of http://charts done: 1 charts downloaded"}, "mirror of http://charts done: 1 charts downloaded\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			l := NewQuietLogger(NewTextLogger(log.New(out, "", 0), true))
+			l.Printf("hello %s", "world")
+			l.Event(tt.event)
+			if out.String() != tt.want {
+				t.Errorf("quietLogger.Event() = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_GetQuiet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	out := &bytes.Buffer{}
+	g, err := NewGetService(repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"}, true, true, true, log.New(out, "", 0), "", "", "", WithQuiet(true))
+	if err != nil {
+		t.Fatalf("NewGetService() error = %v", err)
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Errorf("GetService.Get() error = %v", err)
+	}
+	// the failed chart is only counted in the totals
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "mirror of http://127.0.0.1:1793 done: ") {
+		t.Errorf("GetService.Get() logged %q, want the totals only", out.String())
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics is notified of the outcome of each chart of a mirror run, eg: to
+// export them to Prometheus with PrometheusMetrics. Its methods are called
+// concurrently by the download workers.
+type Metrics interface {
+	IncDownloaded()
+	IncSkipped()
+	IncFailed()
+	// ObserveDuration records the time taken to download a chart
+	ObserveDuration(d time.Duration)
+	// AddBytes records n more bytes written to the mirror or pushed
+	AddBytes(n int64)
+}
+
+// nopMetrics is the Metrics of a service without a metrics hook
+type nopMetrics struct{}
+
+func (nopMetrics) IncDownloaded()                {}
+func (nopMetrics) IncSkipped()                   {}
+func (nopMetrics) IncFailed()                    {}
+func (nopMetrics) ObserveDuration(time.Duration) {}
+func (nopMetrics) AddBytes(int64)                {}
+
+// metrics returns the metrics hook of the service, a no-op one when none
+// was set
+func (g *GetService) metrics() Metrics {
+	if g.metricsHook == nil {
+		return nopMetrics{}
+	}
+	return g.metricsHook
+}
+
+// addResult records the outcome of a chart in the summary and the metrics
+func (g *GetService) addResult(name string, version string, status ChartStatus, err error) {
+	g.summary.add(name, version, status, err)
+	switch status {
+	case StatusDownloaded:
+		g.metrics().IncDownloaded()
+	case StatusSkipped:
+		g.metrics().IncSkipped()
+	case StatusFailed:
+		g.metrics().IncFailed()
+	}
+}
+
+// addBytes records n more bytes in the summary and the metrics
+func (g *GetService) addBytes(n int) {
+	g.summary.addBytes(n)
+	g.metrics().AddBytes(int64(n))
+}
+
+// DefaultDurationBuckets are the upper bounds in seconds of the download
+// duration histogram of PrometheusMetrics
+var DefaultDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// PrometheusMetrics counts the charts downloaded, skipped and failed, keeps a
+// histogram of the download durations and a counter of the bytes transferred,
+// over all the runs of the services it is set on. It serves them in the
+// Prometheus text format, eg: on the /metrics path of a mirror daemon.
+type PrometheusMetrics struct {
+	mu         sync.Mutex
+	downloaded uint64
+	skipped    uint64
+	failed     uint64
+	bytes      int64
+	buckets    []float64
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+// NewPrometheusMetrics returns metrics whose duration histogram has the
+// buckets upper bounds in seconds, DefaultDurationBuckets when there are none
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultDurationBuckets
+	}
+	return &PrometheusMetrics{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// IncDownloaded counts a downloaded chart
+func (p *PrometheusMetrics) IncDownloaded() {
+	p.mu.Lock()
+	p.downloaded++
+	p.mu.Unlock()
+}
+
+// IncSkipped counts a chart skipped as up to date
+func (p *PrometheusMetrics) IncSkipped() {
+	p.mu.Lock()
+	p.skipped++
+	p.mu.Unlock()
+}
+
+// IncFailed counts a chart that could not be mirrored
+func (p *PrometheusMetrics) IncFailed() {
+	p.mu.Lock()
+	p.failed++
+	p.mu.Unlock()
+}
+
+// ObserveDuration adds the download duration d to the histogram
+func (p *PrometheusMetrics) ObserveDuration(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := d.Seconds()
+	for i, b := range p.buckets {
+		if s <= b {
+			p.counts[i]++
+		}
+	}
+	p.sum += s
+	p.count++
+}
+
+// AddBytes adds n bytes to the transferred bytes counter
+func (p *PrometheusMetrics) AddBytes(n int64) {
+	p.mu.Lock()
+	p.bytes += n
+	p.mu.Unlock()
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cw := &countingWriter{w: w}
+	fmt.Fprintln(cw, "# HELP helm_mirror_charts_total Charts processed by the mirror, by outcome.")
+	fmt.Fprintln(cw, "# TYPE helm_mirror_charts_total counter")
+	fmt.Fprintf(cw, "helm_mirror_charts_total{status=%q} %d\n", StatusDownloaded, p.downloaded)
+	fmt.Fprintf(cw, "helm_mirror_charts_total{status=%q} %d\n", StatusSkipped, p.skipped)
+	fmt.Fprintf(cw, "helm_mirror_charts_total{status=%q} %d\n", StatusFailed, p.failed)
+	fmt.Fprintln(cw, "# HELP helm_mirror_download_duration_seconds Time taken to download a chart.")
+	fmt.Fprintln(cw, "# TYPE helm_mirror_download_duration_seconds histogram")
+	for i, b := range p.buckets {
+		fmt.Fprintf(cw, "helm_mirror_download_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(b, 'g', -1, 64), p.counts[i])
+	}
+	fmt.Fprintf(cw, "helm_mirror_download_duration_seconds_bucket{le=\"+Inf\"} %d\n", p.count)
+	fmt.Fprintf(cw, "helm_mirror_download_duration_seconds_sum %s\n", strconv.FormatFloat(p.sum, 'g', -1, 64))
+	fmt.Fprintf(cw, "helm_mirror_download_duration_seconds_count %d\n", p.count)
+	fmt.Fprintln(cw, "# HELP helm_mirror_bytes_transferred_total Bytes written to the mirror or pushed to the registry.")
+	fmt.Fprintln(cw, "# TYPE helm_mirror_bytes_transferred_total counter")
+	fmt.Fprintf(cw, "helm_mirror_bytes_transferred_total %d\n", p.bytes)
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.WriteTo(w)
+}
+
+// countingWriter counts the bytes written to w and keeps the first error
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	p := NewPrometheusMetrics(1, 10)
+	p.IncDownloaded()
+	p.IncDownloaded()
+	p.IncSkipped()
+	p.IncFailed()
+	p.ObserveDuration(500 * time.Millisecond)
+	p.ObserveDuration(5 * time.Second)
+	p.ObserveDuration(time.Minute)
+	p.AddBytes(42)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("PrometheusMetrics.ServeHTTP() Content-Type = %q", ct)
+	}
+	for _, want := range []string{
+		`helm_mirror_charts_total{status="downloaded"} 2`,
+		`helm_mirror_charts_total{status="skipped"} 1`,
+		`helm_mirror_charts_total{status="failed"} 1`,
+		`helm_mirror_download_duration_seconds_bucket{le="1"} 1`,
+		`helm_mirror_download_duration_seconds_bucket{le="10"} 2`,
+		`helm_mirror_download_duration_seconds_bucket{le="+Inf"} 3`,
+		`helm_mirror_download_duration_seconds_sum 65.5`,
+		`helm_mirror_download_duration_seconds_count 3`,
+		`helm_mirror_bytes_transferred_total 42`,
+		`# TYPE helm_mirror_bytes_transferred_total counter`,
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("PrometheusMetrics.ServeHTTP() = %s, want a line %q", rec.Body.String(), want)
+		}
+	}
+}
+
+func TestGetService_GetMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	p := NewPrometheusMetrics()
+	g := &GetService{
+		config:       repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+		logger:       fakeLogger,
+		ignoreErrors: true,
+		allVersions:  true,
+		metricsHook:  p,
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Fatalf("GetService.Get() error = %v", err)
+	}
+	if p.downloaded != uint64(fixtures.Expectedcharts-1) || p.skipped != 0 || p.failed != 1 {
+		t.Errorf("metrics downloaded = %d, skipped = %d, failed = %d, want %d, 0, 1", p.downloaded, p.skipped, p.failed, fixtures.Expectedcharts-1)
+	}
+	if p.count != p.downloaded || p.bytes == 0 {
+		t.Errorf("metrics observed %d durations and %d bytes", p.count, p.bytes)
+	}
+	if _, err := os.Stat(path.Join(dir, indexFileName)); err != nil {
+		t.Errorf("GetService.Get() index.yaml not written: %s", err)
+	}
+}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -32,3 +34,24 @@ kube:
 image: "opensuse"
 version: "42"
 `
+
+// mockStorage keeps the files written to it in memory, writing the file
+// named fail fails
+type mockStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	fail  string
+}
+
+func (m *mockStorage) Write(ctx context.Context, name string, content []byte) error {
+	if name == m.fail {
+		return errors.New("storage full")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = map[string][]byte{}
+	}
+	m.files[name] = content
+	return nil
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/helm/pkg/repo"
+)
+
+// MirrorRepo is a chart repository mirrored by a MultiGetService
+type MirrorRepo struct {
+	// Entry of the repository, its Name is the folder of the mirror under
+	// the common root
+	Entry        repo.Entry
+	NewRootURL   string
+	AllVersions  bool
+	ChartName    string
+	ChartVersion string
+	// Options of the repository, applied after the common ones
+	Options []GetOption
+}
+
+// RepoError is the error of one of the repositories of a MultiGetService
+type RepoError struct {
+	Repo string
+	Err  error
+}
+
+// MultiGetError is returned by MultiGetService when repositories failed and
+// errors are ignored, it holds the error of each one
+type MultiGetError []RepoError
+
+func (e MultiGetError) Error() string {
+	msgs := make([]string, len(e))
+	for i, r := range e {
+		msgs[i] = fmt.Sprintf("%s: %s", r.Repo, r.Err)
+	}
+	return fmt.Sprintf("%d repositories failed - %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Is matches target when the error of one of the repositories does
+func (e MultiGetError) Is(target error) bool {
+	for _, r := range e {
+		if errors.Is(r.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of the repositories that matches target, eg: a
+// *ChartError
+func (e MultiGetError) As(target interface{}) bool {
+	for _, r := range e {
+		if errors.As(r.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// MultiGetService mirrors several chart repositories at once, each one in
+// its own folder under a common root. The download workers, the rate limit,
+// the bound per host and the HTTP connections are shared by all the
+// repositories, as well as the bound on the index files downloaded at once.
+type MultiGetService struct {
+	names            []string
+	services         []*GetService
+	ignoreErrors     bool
+	logger           Logger
+	concurrency      int
+	indexConcurrency int
+	rateLimit        int64
+	maxPerHost       int
+	idleConns        int
+	minTLSVersion    uint16
+	stats            *GetStats
+}
+
+// NewMultiGetService returns a new instance of MultiGetService that mirrors
+// repos under root. The options apply to every repository, the concurrency
+// and the rate limit they set are shared by all of them. When errors are
+// ignored a repository that fails does not stop the other ones.
+func NewMultiGetService(root string, repos []MirrorRepo, verbose bool, ignoreErrors bool, logger *log.Logger, opts ...GetOption) (*MultiGetService, error) {
+	shared := &GetService{logger: logger, verbose: verbose}
+	for _, opt := range opts {
+		if err := opt(shared); err != nil {
+			return nil, err
+		}
+	}
+	m := &MultiGetService{
+		ignoreErrors:     ignoreErrors,
+		logger:           shared.log(),
+		concurrency:      shared.workers(),
+		indexConcurrency: shared.indexConcurrency,
+		rateLimit:        shared.rateLimit,
+		maxPerHost:       shared.maxPerHost,
+		idleConns:        shared.idleConnsPerHost(),
+		minTLSVersion:    shared.tlsMinVersion(),
+	}
+	seen := map[string]bool{}
+	for _, r := range repos {
+		name := r.Entry.Name
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("invalid repository name %q, it must be a folder name", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("repository %q is mirrored twice", name)
+		}
+		seen[name] = true
+		config := r.Entry
+		config.Name = path.Join(root, name)
+		g, err := NewGetService(config, r.AllVersions, verbose, ignoreErrors, logger, r.NewRootURL, r.ChartName, r.ChartVersion, append(append([]GetOption{}, opts...), r.Options...)...)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %w", name, err)
+		}
+		// each repository would write the archive over the one of the others
+		if g.(*GetService).tarOutput != "" {
+			return nil, fmt.Errorf("repository %s: a tar output cannot be used with several repositories", name)
+		}
+		m.names = append(m.names, name)
+		m.services = append(m.services, g.(*GetService))
+	}
+	return m, nil
+}
+
+// Get mirrors all the repositories. When errors are not ignored the first
+// repository that fails stops the other ones and its error is returned,
+// otherwise the errors of all the failed repositories are returned in a
+// MultiGetError.
+func (m *MultiGetService) Get(parent context.Context) error {
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	pool := make(chan struct{}, m.concurrency)
+	var indexPool chan struct{}
+	if m.indexConcurrency > 0 {
+		indexPool = make(chan struct{}, m.indexConcurrency)
+	}
+	limiter := newRateLimiter(m.rateLimit)
+	hosts := newHostLimiter(m.maxPerHost)
+	transports := newTransportCache(m.idleConns, m.minTLSVersion)
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	errs := make([]error, len(m.services))
+	for i, g := range m.services {
+		g.pool = pool
+		g.indexPool = indexPool
+		g.sharedLimiter = limiter
+		g.sharedHosts = hosts
+		g.sharedTransports = transports
+		wg.Add(1)
+		go func(i int, g *GetService) {
+			defer wg.Done()
+			err := os.MkdirAll(g.dir(), dirMode(g.mode()))
+			if err == nil {
+				err = g.Get(ctx)
+			}
+			if err == nil {
+				return
+			}
+			if !m.ignoreErrors {
+				once.Do(func() {
+					firstErr = fmt.Errorf("repository %s: %w", m.names[i], err)
+					cancel()
+				})
+				return
+			}
+			m.logger.Printf("WARNING: mirroring repository %s - %s", m.names[i], err)
+			errs[i] = err
+		}(i, g)
+	}
+	wg.Wait()
+	m.stats = sumStats(m.services, time.Since(start))
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := parent.Err(); err != nil {
+		return err
+	}
+
+	var failed MultiGetError
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, RepoError{Repo: m.names[i], Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// Stats returns the statistics of the last run of Get summed over all the
+// repositories, or nil when Get was never run
+func (m *MultiGetService) Stats() *GetStats {
+	return m.stats
+}
+
+// RepoStats returns the statistics of the last run of Get for the repository
+// name, or nil when it was not run
+func (m *MultiGetService) RepoStats(name string) *GetStats {
+	for i, n := range m.names {
+		if n == name {
+			return m.services[i].Stats()
+		}
+	}
+	return nil
+}
+
+// acquireIndexSlot waits for a free slot to download the index file when the
+// index downloads of a MultiGetService are bounded, release frees the slot
+func (g *GetService) acquireIndexSlot(ctx context.Context) (release func(), err error) {
+	if g.indexPool == nil {
+		return func() {}, nil
+	}
+	select {
+	case g.indexPool <- struct{}{}:
+		return func() { <-g.indexPool }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sumStats sums the statistics of the last run of the services, which lasted d
+func sumStats(services []*GetService, d time.Duration) *GetStats {
+	total := &GetStats{Duration: d}
+	for _, g := range services {
+		st := g.Stats()
+		if st == nil {
+			continue
+		}
+		total.Downloaded += st.Downloaded
+		total.Skipped += st.Skipped
+		total.Failed += st.Failed
+		total.Blocked += st.Blocked
+		total.BytesWritten += st.BytesWritten
+	}
+	return total
+}
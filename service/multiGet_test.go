@@ -0,0 +1,319 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestNewMultiGetService(t *testing.T) {
+	tests := []struct {
+		name    string
+		repos   []string
+		opts    []GetOption
+		wantErr bool
+	}{
+		{"1", []string{"a", "b"}, nil, false},
+		{"2", []string{"a", "a"}, nil, true},
+		{"3", []string{""}, nil, true},
+		{"4", []string{"a/b"}, nil, true},
+		{"5", []string{".."}, nil, true},
+		{"6", []string{"a", "b"}, []GetOption{WithTarOutput("/tmp/mirror.tar")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var repos []MirrorRepo
+			for _, name := range tt.repos {
+				repos = append(repos, MirrorRepo{Entry: repo.Entry{Name: name, URL: "http://127.0.0.1:1793"}})
+			}
+			if _, err := NewMultiGetService("/tmp", repos, false, false, fakeLogger, tt.opts...); (err != nil) != tt.wantErr {
+				t.Errorf("NewMultiGetService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMultiGetService_Get(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+	)
+	var svr *httptest.Server
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folder, name := path.Split(r.URL.Path)
+		switch {
+		case folder == "/broken/":
+			w.WriteHeader(http.StatusInternalServerError)
+		case name == indexFileName:
+			index := repo.NewIndexFile()
+			for _, c := range []string{"chart1", "chart2"} {
+				index.Add(&chart.Metadata{ApiVersion: "v1", Name: c, Version: "1.0.0"}, chartFileName(c, "1.0.0"), svr.URL+folder, "")
+			}
+			b, _ := yaml.Marshal(index)
+			w.Write(b)
+		default:
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("chart"))
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name           string
+		repos          []string
+		ignoreErrors   bool
+		wantErr        bool
+		wantFailed     []string
+		wantMirrored   []string
+		wantDownloaded int
+	}{
+		{"1", []string{"a", "b"}, false, false, nil, []string{"a", "b"}, 4},
+		{"2", []string{"a", "broken"}, true, true, []string{"broken"}, []string{"a"}, 2},
+		{"3", []string{"broken", "a"}, false, true, nil, nil, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := path.Join(dir, tt.name)
+			var repos []MirrorRepo
+			for _, name := range tt.repos {
+				repos = append(repos, MirrorRepo{Entry: repo.Entry{Name: name, URL: svr.URL + "/" + name}, AllVersions: true})
+			}
+			mu.Lock()
+			maxInFlight = 0
+			mu.Unlock()
+			m, err := NewMultiGetService(root, repos, false, tt.ignoreErrors, fakeLogger, WithConcurrency(1))
+			if err != nil {
+				t.Fatalf("NewMultiGetService() error = %v", err)
+			}
+			err = m.Get(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("MultiGetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantFailed != nil {
+				failed, ok := err.(MultiGetError)
+				if !ok || len(failed) != len(tt.wantFailed) || failed[0].Repo != tt.wantFailed[0] {
+					t.Errorf("MultiGetService.Get() error = %v, want failed repositories %v", err, tt.wantFailed)
+				}
+			} else if _, ok := err.(MultiGetError); ok {
+				t.Errorf("MultiGetService.Get() error = %v, want the first error", err)
+			}
+			for _, name := range tt.wantMirrored {
+				// the charts keep the path of their URL
+				files, _ := filepath.Glob(path.Join(root, name, name, "*.tgz"))
+				if len(files) != 2 {
+					t.Errorf("MultiGetService.Get() got count of = %v TGZ files in %s, want count of 2", len(files), name)
+				}
+				if _, err := os.Stat(path.Join(root, name, indexFileName)); err != nil {
+					t.Errorf("MultiGetService.Get() no index file in %s", name)
+				}
+			}
+			if tt.wantDownloaded >= 0 && m.Stats().Downloaded != tt.wantDownloaded {
+				t.Errorf("MultiGetService.Get() downloaded = %v, want %v", m.Stats().Downloaded, tt.wantDownloaded)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if maxInFlight > 1 {
+				t.Errorf("MultiGetService.Get() downloaded %v charts at once, want at most 1", maxInFlight)
+			}
+		})
+	}
+}
+
+func TestGetService_GetSharedPoolCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name  string
+		fetch bool
+	}{
+		{"1", false},
+		{"2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the only worker of the shared pool is busy with another service
+			pool := make(chan struct{}, 1)
+			pool <- struct{}{}
+			os.MkdirAll(path.Join(dir, tt.name), 0755)
+			g := &GetService{
+				config:      repo.Entry{Name: path.Join(dir, tt.name), URL: "http://127.0.0.1:1793"},
+				logger:      fakeLogger,
+				allVersions: true,
+				pool:        pool,
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				if !tt.fetch {
+					done <- g.Get(ctx)
+					return
+				}
+				fetched, err := g.Fetch(ctx)
+				if err == nil {
+					for range fetched {
+					}
+				}
+				done <- err
+			}()
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+			select {
+			case err := <-done:
+				if !tt.fetch && err == nil {
+					t.Errorf("GetService.Get() error = nil, want the cancellation")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("GetService.Get() still waiting for the shared pool after the cancellation")
+			}
+		})
+	}
+}
+
+func TestMultiGetService_GetIndexConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+	)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) != indexFileName {
+			w.Write([]byte("chart"))
+			return
+		}
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		b, _ := yaml.Marshal(repo.NewIndexFile())
+		w.Write(b)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name             string
+		indexConcurrency int
+	}{
+		{"1", 1},
+		{"2", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var repos []MirrorRepo
+			for _, name := range []string{"a", "b", "c", "d"} {
+				repos = append(repos, MirrorRepo{Entry: repo.Entry{Name: name, URL: svr.URL + "/" + name}})
+			}
+			mu.Lock()
+			maxInFlight = 0
+			mu.Unlock()
+			m, err := NewMultiGetService(path.Join(dir, tt.name), repos, false, false, fakeLogger, WithConcurrency(4), WithIndexConcurrency(tt.indexConcurrency))
+			if err != nil {
+				t.Fatalf("NewMultiGetService() error = %v", err)
+			}
+			if err := m.Get(context.Background()); err != nil {
+				t.Fatalf("MultiGetService.Get() error = %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if maxInFlight > tt.indexConcurrency {
+				t.Errorf("MultiGetService.Get() downloaded %v index files at once, want at most %v", maxInFlight, tt.indexConcurrency)
+			}
+		})
+	}
+}
+
+func TestMultiGetService_GetReusesConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) != indexFileName {
+			w.Write([]byte("chart"))
+			return
+		}
+		index := repo.NewIndexFile()
+		for _, name := range []string{"chart1", "chart2", "chart3"} {
+			index.Add(&chart.Metadata{Name: name, Version: "1.0.0"}, name+"-1.0.0.tgz", "http://"+r.Host+path.Dir(r.URL.Path), "")
+		}
+		b, _ := yaml.Marshal(index)
+		w.Write(b)
+	}))
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	svr.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	svr.Start()
+	defer svr.Close()
+	var repos []MirrorRepo
+	for _, name := range []string{"a", "b", "c", "d"} {
+		repos = append(repos, MirrorRepo{Entry: repo.Entry{Name: name, URL: svr.URL + "/" + name}, AllVersions: true})
+	}
+	m, err := NewMultiGetService(dir, repos, false, false, fakeLogger, WithConcurrency(1), WithIndexConcurrency(1))
+	if err != nil {
+		t.Fatalf("NewMultiGetService() error = %v", err)
+	}
+	if err := m.Get(context.Background()); err != nil {
+		t.Fatalf("MultiGetService.Get() error = %v", err)
+	}
+	if st := m.Stats(); st.Downloaded != 12 {
+		t.Errorf("MultiGetService.Get() downloaded = %v, want 12", st.Downloaded)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// an index file and a chart are downloaded at once at most, the other
+	// requests reuse their connections
+	if conns > 2 {
+		t.Errorf("MultiGetService.Get() opened %d connections, want at most 2", conns)
+	}
+}
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"k8s.io/helm/pkg/proto/hapi/chart"
+)
+
+// Media types of Helm charts stored in OCI registries
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	helmConfigMediaType  = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType   = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// ociDescriptor describes a blob referenced by an OCI manifest
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int    `json:"size"`
+}
+
+// ociManifest is an OCI image manifest holding a Helm chart
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociPusher pushes charts to a repository of an OCI registry, each chart is
+// stored as <repository>/<chart name>:<chart version>. It also pulls the
+// charts of the oci:// URLs of an index file.
+type ociPusher struct {
+	client     *http.Client
+	scheme     string
+	host       string
+	repository string
+	username   string
+	password   string
+	userAgent  string
+
+	mu    sync.Mutex
+	token string
+}
+
+// newOCIPusher parses a registry reference like oci://registry.local/charts
+func newOCIPusher(ref string, username string, password string, plainHTTP bool) (*ociPusher, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry reference %q: %s", ref, err)
+	}
+	if u.Scheme != "oci" || u.Host == "" {
+		return nil, fmt.Errorf("invalid registry reference %q: expected oci://host/repository", ref)
+	}
+	scheme := "https"
+	if plainHTTP {
+		scheme = "http"
+	}
+	return &ociPusher{
+		client:     &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+		scheme:     scheme,
+		host:       u.Host,
+		repository: strings.Trim(u.Path, "/"),
+		username:   username,
+		password:   password,
+	}, nil
+}
+
+// agent returns the User-Agent header of the requests to the registry
+func (o *ociPusher) agent() string {
+	if o.userAgent == "" {
+		return DefaultUserAgent
+	}
+	return o.userAgent
+}
+
+// push uploads the chart archive and its metadata, then tags the manifest
+// with the chart version
+func (o *ociPusher) push(ctx context.Context, metadata *chart.Metadata, content []byte) error {
+	name := metadata.Name
+	if o.repository != "" {
+		name = o.repository + "/" + metadata.Name
+	}
+	config, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        ociDescriptor{MediaType: helmConfigMediaType, Digest: "sha256:" + digest(config), Size: len(config)},
+		Layers: []ociDescriptor{
+			{MediaType: helmChartMediaType, Digest: "sha256:" + digest(content), Size: len(content)},
+		},
+	}
+	if err := o.pushBlob(ctx, name, manifest.Config.Digest, config); err != nil {
+		return err
+	}
+	if err := o.pushBlob(ctx, name, manifest.Layers[0].Digest, content); err != nil {
+		return err
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	// OCI tags don't allow '+', helm uses '_' for semver build metadata
+	tag := strings.Replace(metadata.Version, "+", "_", -1)
+	resp, err := o.do(ctx, "PUT", o.endpoint("/v2/%s/manifests/%s", name, tag), ociManifestMediaType, "", body)
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusCreated, http.StatusOK)
+}
+
+// pushBlob uploads content unless the registry already has it
+func (o *ociPusher) pushBlob(ctx context.Context, name string, dgst string, content []byte) error {
+	resp, err := o.do(ctx, "HEAD", o.endpoint("/v2/%s/blobs/%s", name, dgst), "", "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = o.do(ctx, "POST", o.endpoint("/v2/%s/blobs/uploads/", name), "", "", nil)
+	if err != nil {
+		return err
+	}
+	location := resp.Header.Get("Location")
+	if err := expectStatus(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+	uploadURL, err := url.Parse(location)
+	if err != nil || location == "" {
+		return fmt.Errorf("registry returned an invalid upload location %q", location)
+	}
+	uploadURL = (&url.URL{Scheme: o.scheme, Host: o.host}).ResolveReference(uploadURL)
+	q := uploadURL.Query()
+	q.Set("digest", dgst)
+	uploadURL.RawQuery = q.Encode()
+
+	resp, err = o.do(ctx, "PUT", uploadURL.String(), "application/octet-stream", "", content)
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusCreated)
+}
+
+// pull downloads the chart archive of the manifest ref, a tag or a digest, of
+// the repository name and checks it against the digest of the manifest
+func (o *ociPusher) pull(ctx context.Context, name string, ref string) ([]byte, error) {
+	u := o.endpoint("/v2/%s/manifests/%s", name, ref)
+	resp, err := o.do(ctx, "GET", u, "", ociManifestMediaType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, newStatusError(u, resp)
+	}
+	manifest := ociManifest{}
+	err = json.NewDecoder(resp.Body).Decode(&manifest)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("registry %s: invalid manifest of %s:%s: %s", o.host, name, ref, err)
+	}
+	var layer *ociDescriptor
+	for i, l := range manifest.Layers {
+		if l.MediaType == helmChartMediaType {
+			layer = &manifest.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return nil, fmt.Errorf("registry %s: %s:%s is not a helm chart", o.host, name, ref)
+	}
+	u = o.endpoint("/v2/%s/blobs/%s", name, layer.Digest)
+	resp, err = o.do(ctx, "GET", u, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(u, resp)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if "sha256:"+digest(content) != layer.Digest {
+		return nil, fmt.Errorf("registry %s: the chart of %s:%s does not match its digest %s", o.host, name, ref, layer.Digest)
+	}
+	return content, nil
+}
+
+func (o *ociPusher) endpoint(format string, args ...interface{}) string {
+	return fmt.Sprintf("%s://%s%s", o.scheme, o.host, fmt.Sprintf(format, args...))
+}
+
+// do sends the request, accepting the media type accept when it is set,
+// authenticating and retrying once when the registry answers with a challenge
+func (o *ociPusher) do(ctx context.Context, method string, u string, contentType string, accept string, body []byte) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("User-Agent", o.agent())
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		o.mu.Lock()
+		token := o.token
+		o.mu.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if o.username != "" || o.password != "" {
+			req.SetBasicAuth(o.username, o.password)
+		}
+		return o.client.Do(req)
+	}
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return nil, fmt.Errorf("registry %s: unauthorized", o.host)
+	}
+	if err := o.authenticate(ctx, challenge); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate gets a bearer token from the authorization server of the
+// challenge
+func (o *ociPusher) authenticate(ctx context.Context, challenge string) error {
+	params := map[string]string{}
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("registry %s: invalid authentication challenge %q", o.host, challenge)
+	}
+	q := realm.Query()
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			q.Set(k, params[k])
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", o.agent())
+	if o.username != "" || o.password != "" {
+		req.SetBasicAuth(o.username, o.password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry %s: authentication failed: %s", o.host, resp.Status)
+	}
+	t := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return fmt.Errorf("registry %s: invalid token response: %s", o.host, err)
+	}
+	o.mu.Lock()
+	o.token = t.Token
+	if o.token == "" {
+		o.token = t.AccessToken
+	}
+	o.mu.Unlock()
+	return nil
+}
+
+// expectStatus closes the response and fails when its status is not one of
+// the expected ones
+func expectStatus(resp *http.Response, expected ...int) error {
+	defer resp.Body.Close()
+	for _, s := range expected {
+		if resp.StatusCode == s {
+			io.Copy(ioutil.Discard, resp.Body)
+			return nil
+		}
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
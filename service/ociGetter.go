@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ociScheme is the scheme of the chart URLs pulled from an OCI registry
+const ociScheme = "oci"
+
+// ociGetter downloads the charts of the oci:// URLs of an index file, like
+// oci://registry.local/charts/nginx:1.0.0, from their registry. The index
+// file can mix them with HTTP(S) URLs. The requests to a registry host share
+// its bearer token.
+type ociGetter struct {
+	client   *http.Client
+	scheme   string
+	username string
+	password string
+	// credentialsHost is the only registry host the credentials are sent
+	// to, all of them when it is empty
+	credentialsHost string
+	userAgent       string
+
+	mu         sync.Mutex
+	registries map[string]*ociPusher
+}
+
+// newOCIGetter returns a getter authenticating with the credentials on the
+// registry host credentialsHost, or on all of them when it is empty, and
+// anonymously on the other ones. It uses plain HTTP instead of HTTPS when
+// plainHTTP is set.
+func newOCIGetter(transport http.RoundTripper, username string, password string, credentialsHost string, userAgent string, plainHTTP bool) *ociGetter {
+	scheme := "https"
+	if plainHTTP {
+		scheme = "http"
+	}
+	return &ociGetter{
+		client:          &http.Client{Transport: transport},
+		scheme:          scheme,
+		username:        username,
+		password:        password,
+		credentialsHost: credentialsHost,
+		userAgent:       userAgent,
+		registries:      map[string]*ociPusher{},
+	}
+}
+
+// Get pulls the chart of the oci:// URL href
+func (o *ociGetter) Get(href string) (*bytes.Buffer, error) {
+	return o.GetContext(context.Background(), href)
+}
+
+// GetContext pulls the chart of the oci:// URL href, aborting when ctx is
+// done
+func (o *ociGetter) GetContext(ctx context.Context, href string) (*bytes.Buffer, error) {
+	host, name, ref, err := parseOCIChartURL(href)
+	if err != nil {
+		return nil, err
+	}
+	content, err := o.registry(host).pull(ctx, name, ref)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(content), nil
+}
+
+// registry returns the client of the registry host
+func (o *ociGetter) registry(host string) *ociPusher {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r, ok := o.registries[host]
+	if !ok {
+		r = &ociPusher{client: o.client, scheme: o.scheme, host: host, userAgent: o.userAgent}
+		if o.credentialsHost == "" || o.credentialsHost == host {
+			r.username, r.password = o.username, o.password
+		}
+		o.registries[host] = r
+	}
+	return r
+}
+
+// parseOCIChartURL returns the registry host, the repository name and the
+// reference of the manifest of the chart URL href, a tag or a digest (eg:
+// oci://registry.local/charts/nginx@sha256:...). As OCI tags don't allow
+// '+', helm writes the semver build metadata of a tag with '_'.
+func parseOCIChartURL(href string) (string, string, string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.Scheme != ociScheme || u.Host == "" {
+		return "", "", "", fmt.Errorf("invalid OCI chart URL %q: expected oci://host/repository:version", href)
+	}
+	name, ref := strings.Trim(u.Path, "/"), ""
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name, ref = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref = name[:i], strings.Replace(name[i+1:], "+", "_", -1)
+	}
+	if name == "" || ref == "" {
+		return "", "", "", fmt.Errorf("invalid OCI chart URL %q: expected oci://host/repository:version", href)
+	}
+	return u.Host, name, ref, nil
+}
@@ -0,0 +1,334 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+// fakeRegistry is a minimal OCI registry keeping blobs and manifests in memory
+type fakeRegistry struct {
+	token     bool
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]ociManifest
+}
+
+func newFakeRegistry(token bool) (*fakeRegistry, *httptest.Server) {
+	f := &fakeRegistry{token: token, blobs: map[string][]byte{}, manifests: map[string]ociManifest{}}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token":"secret"}`))
+		return
+	}
+	if f.token && r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.Method == "HEAD" && strings.Contains(p, "/blobs/"):
+		if _, ok := f.blobs[p[strings.LastIndex(p, "/")+1:]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == "POST" && strings.HasSuffix(p, "/blobs/uploads/"):
+		w.Header().Set("Location", "/upload/1")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT" && r.URL.Path == "/upload/1":
+		b, _ := ioutil.ReadAll(r.Body)
+		d := r.URL.Query().Get("digest")
+		if d != "sha256:"+digest(b) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[d] = b
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && strings.Contains(p, "/manifests/"):
+		m := ociManifest{}
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.manifests[strings.Replace(p, "/manifests/", ":", 1)] = m
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "GET" && strings.Contains(p, "/manifests/"):
+		m, ok := f.manifests[strings.Replace(p, "/manifests/", ":", 1)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ociManifestMediaType)
+		json.NewEncoder(w).Encode(m)
+	case r.Method == "GET" && strings.Contains(p, "/blobs/"):
+		b, ok := f.blobs[p[strings.LastIndex(p, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func Test_newOCIPusher(t *testing.T) {
+	tests := []struct {
+		name           string
+		ref            string
+		wantHost       string
+		wantRepository string
+		wantErr        bool
+	}{
+		{"1", "oci://registry.local/charts", "registry.local", "charts", false},
+		{"2", "oci://registry.local:5000/org/charts/", "registry.local:5000", "org/charts", false},
+		{"3", "oci://registry.local", "registry.local", "", false},
+		{"4", "https://registry.local/charts", "", "", true},
+		{"5", "registry.local/charts", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := newOCIPusher(tt.ref, "", "", false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newOCIPusher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if o.host != tt.wantHost || o.repository != tt.wantRepository {
+				t.Errorf("newOCIPusher() = %v/%v, want %v/%v", o.host, o.repository, tt.wantHost, tt.wantRepository)
+			}
+		})
+	}
+}
+
+func Test_ociPusher_push(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    bool
+		username string
+		password string
+		wantErr  bool
+	}{
+		{"1", false, "", "", false},
+		{"2", true, "user", "pass", false},
+		{"3", true, "user", "wrong", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, svr := newFakeRegistry(tt.token)
+			defer svr.Close()
+			o, _ := newOCIPusher("oci://"+strings.TrimPrefix(svr.URL, "http://")+"/charts", tt.username, tt.password, true)
+			content := []byte("chart content")
+			err := o.push(context.Background(), &chart.Metadata{Name: "nginx", Version: "1.0.0+build1"}, content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ociPusher.push() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			m, ok := f.manifests["charts/nginx:1.0.0_build1"]
+			if !ok {
+				t.Fatalf("ociPusher.push() manifests = %v, want charts/nginx:1.0.0_build1", f.manifests)
+			}
+			if m.Config.MediaType != helmConfigMediaType || len(m.Layers) != 1 || m.Layers[0].MediaType != helmChartMediaType {
+				t.Errorf("ociPusher.push() manifest = %+v", m)
+			}
+			if string(f.blobs[m.Layers[0].Digest]) != string(content) {
+				t.Errorf("ociPusher.push() layer = %q, want %q", f.blobs[m.Layers[0].Digest], content)
+			}
+		})
+	}
+}
+
+func TestGetService_GetOCI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	f, registry := newFakeRegistry(false)
+	defer registry.Close()
+
+	g, err := NewOCIGetService(repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"}, "oci://"+strings.TrimPrefix(registry.URL, "http://")+"/charts",
+		true, false, true, fakeLogger, "", "", WithPlainHTTPRegistry(true))
+	if err != nil {
+		t.Fatalf("NewOCIGetService() error = %v", err)
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Errorf("GetService.Get() error = %v", err)
+	}
+	// chart4 is missing from the chart repository
+	if len(f.manifests) != 4 {
+		t.Errorf("GetService.Get() pushed %v charts, want 4", len(f.manifests))
+	}
+	if _, ok := f.manifests["charts/chart2:0.0.0-rc1"]; !ok {
+		t.Errorf("GetService.Get() manifests = %v, want charts/chart2:0.0.0-rc1", f.manifests)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tgz") {
+			t.Errorf("GetService.Get() wrote %v to the destination folder", file.Name())
+		}
+	}
+}
+
+func Test_parseOCIChartURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		href     string
+		wantHost string
+		wantName string
+		wantRef  string
+		wantErr  bool
+	}{
+		{"1", "oci://registry.local/charts/nginx:1.0.0", "registry.local", "charts/nginx", "1.0.0", false},
+		{"2", "oci://registry.local:5000/nginx:1.0.0+build1", "registry.local:5000", "nginx", "1.0.0_build1", false},
+		{"3", "oci://registry.local/charts/nginx@sha256:abc", "registry.local", "charts/nginx", "sha256:abc", false},
+		{"4", "oci://registry.local:5000/charts/nginx", "", "", "", true},
+		{"5", "https://registry.local/charts/nginx:1.0.0", "", "", "", true},
+		{"6", "oci:///nginx:1.0.0", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, name, ref, err := parseOCIChartURL(tt.href)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOCIChartURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost || name != tt.wantName || ref != tt.wantRef {
+				t.Errorf("parseOCIChartURL() = %v, %v, %v, want %v, %v, %v", host, name, ref, tt.wantHost, tt.wantName, tt.wantRef)
+			}
+		})
+	}
+}
+
+func TestGetService_GetOCIURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := path.Join(dir, "upstream")
+	os.MkdirAll(upstream, 0755)
+	ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart1", Version: "1.0.0"}}
+	if _, err := chartutil.Save(ch, upstream); err != nil {
+		t.Fatalf("Saving chart: %s", err)
+	}
+	chart2 := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart2", Version: "1.0.0"}}
+	chart2Path, err := chartutil.Save(chart2, dir)
+	if err != nil {
+		t.Fatalf("Saving chart: %s", err)
+	}
+	content, _ := ioutil.ReadFile(chart2Path)
+	os.Remove(chart2Path)
+	files := http.FileServer(http.Dir(upstream))
+	svr := httptest.NewServer(files)
+	defer svr.Close()
+	tests := []struct {
+		name         string
+		token        bool
+		username     string
+		registryUser string
+		ref          string
+		sameHost     bool
+		wantErr      bool
+	}{
+		{"1", false, "", "", "1.0.0", false, false},
+		// the credentials of the repository are not sent to another host
+		{"2", true, "user", "", "1.0.0", false, true},
+		{"3", false, "", "", "2.0.0", false, true},
+		// the registry credentials replace the ones of the repository
+		{"4", true, "", "user", "1.0.0", false, false},
+		{"5", true, "user", "other", "1.0.0", false, true},
+		{"6", true, "user", "", "1.0.0", true, false},
+		{"7", true, "", "", "1.0.0", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, registry := newFakeRegistry(tt.token)
+			defer registry.Close()
+			host := strings.TrimPrefix(registry.URL, "http://")
+			repoURL := svr.URL
+			if tt.sameHost {
+				// the repository is served under /repo by the registry
+				registry.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if strings.HasPrefix(r.URL.Path, "/repo/") {
+						http.StripPrefix("/repo", files).ServeHTTP(w, r)
+						return
+					}
+					f.ServeHTTP(w, r)
+				})
+				repoURL = registry.URL + "/repo"
+			}
+			o, _ := newOCIPusher("oci://"+host+"/charts", "user", "pass", true)
+			if err := o.push(context.Background(), chart2.Metadata, content); err != nil {
+				t.Fatalf("ociPusher.push() error = %v", err)
+			}
+			index, err := repo.IndexDirectory(upstream, repoURL)
+			if err != nil {
+				t.Fatalf("Indexing charts: %s", err)
+			}
+			index.Add(chart2.Metadata, "chart2-1.0.0.tgz", "", digest(content))
+			index.Entries["chart2"][0].URLs = []string{"oci://" + host + "/charts/chart2:" + tt.ref}
+			index.WriteFile(path.Join(upstream, indexFileName), 0644)
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			config := repo.Entry{Name: workDir, URL: repoURL, Username: tt.username, Password: "pass"}
+			registryPass := ""
+			if tt.registryUser != "" {
+				registryPass = "pass"
+			}
+			g, err := NewGetService(config, true, false, false, fakeLogger, "https://mirror.local.lan", "", "", WithPlainHTTPRegistry(true), WithRegistryCredentials(tt.registryUser, registryPass))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if b, err := ioutil.ReadFile(path.Join(workDir, "charts", "chart2-1.0.0.tgz")); err != nil || string(b) != string(content) {
+				t.Errorf("GetService.Get() chart2 not pulled to charts/chart2-1.0.0.tgz: %v", err)
+			}
+			chart1Path := "chart1-1.0.0.tgz"
+			if tt.sameHost {
+				chart1Path = path.Join("repo", chart1Path)
+			}
+			if _, err := os.Stat(path.Join(workDir, chart1Path)); err != nil {
+				t.Errorf("GetService.Get() chart1 not downloaded: %v", err)
+			}
+			mirrored, err := repo.LoadIndexFile(path.Join(workDir, indexFileName))
+			if err != nil {
+				t.Fatalf("Loading index file: %s", err)
+			}
+			if got := mirrored.Entries["chart2"][0].URLs[0]; got != "https://mirror.local.lan/charts/chart2-1.0.0.tgz" {
+				t.Errorf("GetService.Get() chart2 URL = %v, want https://mirror.local.lan/charts/chart2-1.0.0.tgz", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/helm/pkg/repo"
+)
+
+// pruneCharts deletes the charts of the destination folder, with their
+// provenance files, that were neither written nor found up to date by the
+// run, as they are no longer in the filtered repository index. Only the
+// files at a path the layout gives to charts are pruned, the other files and
+// folders of the destination folder are left alone.
+func (g *GetService) pruneCharts(indexFile *repo.IndexFile) error {
+	g.summary.mu.Lock()
+	kept := g.summary.charts
+	g.summary.mu.Unlock()
+	folders := g.chartFolders(indexFile)
+	orphans := []string{}
+	err := filepath.Walk(g.dir(), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(name, ".tgz") && !kept[name] && g.layoutChartPath(name, folders) {
+			orphans = append(orphans, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range orphans {
+		g.log().Printf("pruning chart %s, it is no longer in the repository index", name)
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		if err := os.Remove(name + provSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// chartFolders returns the folders, relative to the destination folder, the
+// URL prefix layout writes the charts of indexFile to
+func (g *GetService) chartFolders(indexFile *repo.IndexFile) map[string]bool {
+	folders := map[string]bool{".": true}
+	for _, versions := range indexFile.Entries {
+		for _, cv := range versions {
+			for _, u := range cv.URLs {
+				if parsed, err := url.Parse(normalizeURL(u)); err == nil {
+					rel := LayoutURLPrefix.chartPath(cv.Name, chartFileName(cv.Name, cv.Version), parsed.Path)
+					folders[path.Clean(strings.TrimLeft(path.Dir(rel), "/"))] = true
+				}
+			}
+		}
+	}
+	return folders
+}
+
+// layoutChartPath reports whether the file name of the destination folder
+// is at a path the layout gives to charts: the destination folder itself
+// when flat, a folder named after the chart when by name, or one of the
+// folders of the chart URLs of the index file otherwise
+func (g *GetService) layoutChartPath(name string, folders map[string]bool) bool {
+	rel, err := filepath.Rel(g.dir(), name)
+	if err != nil {
+		return false
+	}
+	folder, file := path.Split(filepath.ToSlash(rel))
+	folder = path.Clean(folder)
+	switch g.layout {
+	case LayoutFlat:
+		return folder == "."
+	case LayoutByName:
+		return validPathElement(folder) && (g.preserveURLFilename || strings.HasPrefix(file, folder+"-"))
+	}
+	return folders[folder]
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_GetPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name       string
+		prune      bool
+		mergeIndex bool
+		chartNames []string
+		maxBytes   int64
+		wantOrphan bool
+		wantErr    bool
+	}{
+		{"1", true, false, []string{"chart1", "chart2"}, 0, false, false},
+		{"2", false, false, []string{"chart1", "chart2"}, 0, true, false},
+		// chart4 cannot be downloaded
+		{"3", true, false, nil, 0, true, false},
+		{"4", true, true, []string{"chart1", "chart2"}, 0, true, true},
+		// the charts mirrored before they were over the maximum size are kept
+		{"5", true, false, []string{"chart1", "chart2"}, 1, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			orphan := path.Join(workDir, "old-1.0.0.tgz")
+			ioutil.WriteFile(orphan, []byte("chart"), 0644)
+			ioutil.WriteFile(orphan+provSuffix, []byte("prov"), 0644)
+			// not at a path of the layout, it is never pruned
+			unrelated := path.Join(workDir, "backup", "old-1.0.0.tgz")
+			os.MkdirAll(path.Dir(unrelated), 0755)
+			ioutil.WriteFile(unrelated, []byte("chart"), 0644)
+			if tt.maxBytes > 0 {
+				ioutil.WriteFile(path.Join(workDir, "chart1-2.11.0.tgz"), []byte("chart"), 0644)
+			}
+			g := &GetService{
+				config:        repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:        fakeLogger,
+				ignoreErrors:  true,
+				allVersions:   true,
+				exactMatch:    true,
+				chartNames:    tt.chartNames,
+				prune:         tt.prune,
+				mergeIndex:    tt.mergeIndex,
+				maxChartBytes: tt.maxBytes,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, name := range []string{orphan, orphan + provSuffix} {
+				if _, err := os.Stat(name); (err == nil) != tt.wantOrphan {
+					t.Errorf("GetService.Get() %s exists = %v, want %v", path.Base(name), err == nil, tt.wantOrphan)
+				}
+			}
+			if _, err := os.Stat(unrelated); err != nil {
+				t.Errorf("GetService.Get() pruned a file outside of the layout: %s", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if _, err := os.Stat(path.Join(workDir, "chart1-2.11.0.tgz")); err != nil {
+				t.Errorf("GetService.Get() pruned a mirrored chart: %s", err)
+			}
+		})
+	}
+}
+
+func TestGetService_layoutChartPath(t *testing.T) {
+	folders := map[string]bool{".": true, "charts": true}
+	tests := []struct {
+		name     string
+		layout   Layout
+		preserve bool
+		file     string
+		want     bool
+	}{
+		{"1", "", false, "nginx-1.0.0.tgz", true},
+		{"2", "", false, "charts/nginx-1.0.0.tgz", true},
+		{"3", "", false, "backup/nginx-1.0.0.tgz", false},
+		{"4", LayoutFlat, false, "nginx-1.0.0.tgz", true},
+		{"5", LayoutFlat, false, "charts/nginx-1.0.0.tgz", false},
+		{"6", LayoutByName, false, "nginx/nginx-1.0.0.tgz", true},
+		{"7", LayoutByName, false, "nginx-1.0.0.tgz", false},
+		{"8", LayoutByName, false, "nginx/bundle.tgz", false},
+		{"9", LayoutByName, true, "nginx/bundle.tgz", true},
+		{"10", LayoutByName, false, "backup/nginx/nginx-1.0.0.tgz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GetService{config: repo.Entry{Name: "mirror"}, layout: tt.layout, preserveURLFilename: tt.preserve}
+			if got := g.layoutChartPath(path.Join("mirror", tt.file), folders); got != tt.want {
+				t.Errorf("GetService.layoutChartPath(%s) = %v, want %v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_chartFolders(t *testing.T) {
+	indexFile := &repo.IndexFile{Entries: map[string]repo.ChartVersions{
+		"nginx": {{Metadata: &chart.Metadata{Name: "nginx", Version: "1.0.0"}, URLs: []string{"http://charts.local/charts/nginx-1.0.0.tgz"}}},
+		"redis": {{Metadata: &chart.Metadata{Name: "redis", Version: "1.0.0"}, URLs: []string{"redis-1.0.0.tgz", "http://charts.local/stable/redis/redis-1.0.0.tgz"}}},
+	}}
+	g := &GetService{}
+	want := map[string]bool{".": true, "charts": true, "stable/redis": true}
+	if got := g.chartFolders(indexFile); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetService.chartFolders() = %v, want %v", got, want)
+	}
+}
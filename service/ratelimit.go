@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// minRateBurst is the largest read done at once by a rate limited reader, it
+// keeps reads efficient when the limit is high
+const minRateBurst = 32 * 1024
+
+// newRateLimiter returns a limiter of bytesPerSec shared by every download,
+// or nil when bytesPerSec is 0 or less
+func newRateLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := minRateBurst
+	if bytesPerSec < minRateBurst {
+		burst = int(bytesPerSec)
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// rateLimitedReader waits for the limiter before handing out the bytes read
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.limiter.Burst() {
+		p = p[:l.limiter.Burst()]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.limiter.WaitN(l.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
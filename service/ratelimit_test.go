@@ -0,0 +1,67 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_newRateLimiter(t *testing.T) {
+	tests := []struct {
+		name        string
+		bytesPerSec int64
+		wantNil     bool
+		wantBurst   int
+	}{
+		{"1", 0, true, 0},
+		{"2", -1, true, 0},
+		{"3", 1024, false, 1024},
+		{"4", 10 * 1024 * 1024, false, minRateBurst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.bytesPerSec)
+			if (l == nil) != tt.wantNil {
+				t.Fatalf("newRateLimiter() = %v, want nil %v", l, tt.wantNil)
+			}
+			if l != nil && l.Burst() != tt.wantBurst {
+				t.Errorf("newRateLimiter() burst = %v, want %v", l.Burst(), tt.wantBurst)
+			}
+		})
+	}
+}
+
+func Test_httpGetter_GetRateLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("c"), 300*1024)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name        string
+		bytesPerSec int64
+		wantMin     time.Duration
+	}{
+		{"1", 0, 0},
+		// the first burst is free, the remaining 268KB take about 270ms
+		{"2", 1000 * 1024, 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newHTTPGetter("", "", "", newRateLimiter(tt.bytesPerSec), nil, nil)(svr.URL, "", "", "")
+			start := time.Now()
+			b, err := c.Get(svr.URL)
+			if err != nil {
+				t.Fatalf("httpGetter.Get() error = %v", err)
+			}
+			if b.Len() != len(content) {
+				t.Errorf("httpGetter.Get() read %v bytes, want %v", b.Len(), len(content))
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantMin {
+				t.Errorf("httpGetter.Get() took %v, want at least %v", elapsed, tt.wantMin)
+			}
+		})
+	}
+}
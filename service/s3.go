@@ -0,0 +1,188 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3DefaultRegion = "us-east-1"
+	amzDateFormat   = "20060102T150405Z"
+	// s3Timeout bounds each upload, including the time to send the object
+	s3Timeout = 5 * time.Minute
+)
+
+// S3Writer writes the mirror files as objects of an S3 bucket, under a
+// prefix. Requests are signed with AWS signature version 4 here rather than
+// with the AWS SDK, which is not vendored: a single PUT per object is all the
+// mirror needs, so the credentials only come from the environment, without
+// the shared config files, profiles or instance roles of the SDK.
+type S3Writer struct {
+	client       *http.Client
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	now          func() time.Time
+}
+
+// NewS3Writer returns a writer to the bucket in region, the object keys are
+// the file paths under prefix. The credentials are read from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables, the region defaults to AWS_REGION, then AWS_DEFAULT_REGION. An
+// endpoint (eg: http://minio.local.lan:9000) selects an S3 compatible server
+// addressed with path style URLs instead of AWS.
+func NewS3Writer(bucket string, prefix string, region string, endpoint string) (*S3Writer, error) {
+	if bucket == "" {
+		return nil, errors.New("no S3 bucket given")
+	}
+	s := &S3Writer{
+		client:       &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}, Timeout: s3Timeout},
+		bucket:       bucket,
+		prefix:       strings.Trim(prefix, "/"),
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		now:          time.Now,
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("no S3 credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if s.region == "" {
+			s.region = os.Getenv(env)
+		}
+	}
+	if s.region == "" {
+		s.region = s3DefaultRegion
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		s.endpoint = u
+	}
+	return s, nil
+}
+
+// Write uploads content as the object name under the prefix of the writer,
+// the upload is aborted when ctx is done
+func (s *S3Writer) Write(ctx context.Context, name string, content []byte) error {
+	u := s.objectURL(path.Join(s.prefix, name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.URL.RawPath = s3EscapePath(req.URL.Path)
+	req.ContentLength = int64(len(content))
+	sum := sha256.Sum256(content)
+	s.sign(req, hex.EncodeToString(sum[:]))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("uploading %s: %s %s", u, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// objectURL returns the URL of the object key, virtual hosted style on AWS
+// and path style on other endpoints
+func (s *S3Writer) objectURL(key string) *url.URL {
+	if s.endpoint == nil {
+		return &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", s.bucket, s.region), Path: "/" + key}
+	}
+	u := *s.endpoint
+	u.Path = path.Join("/", u.Path, s.bucket, key)
+	return &u
+}
+
+// sign adds the AWS signature version 4 headers to req, payloadHash is the
+// hex sha256 of its body. All the headers of req are signed.
+func (s *S3Writer) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	scope := strings.Join([]string{now.Format("20060102"), s.region, s3Service, "aws4_request"}, "/")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath escapes every byte of p but the unreserved characters and the
+// slashes, as the canonical URI of S3 requests is
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"k8s.io/helm/pkg/provenance"
+)
+
+// newSigner returns the signatory of the private key named name in keyring,
+// the key is decrypted with passphrase when it is encrypted
+func newSigner(keyring string, name string, passphrase string) (*provenance.Signatory, error) {
+	signer, err := provenance.NewFromKeyring(keyring, name)
+	if err != nil {
+		return nil, fmt.Errorf("loading the signing key %q: %s", name, err)
+	}
+	err = signer.DecryptKey(func(string) ([]byte, error) {
+		return []byte(passphrase), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading the signing key %q: %s", name, err)
+	}
+	return signer, nil
+}
+
+// signChart writes the provenance file of the chart at chartPath, signed with
+// the signing key. content is the chart when it was not streamed to
+// chartPath (eg: it was given to a storage writer), it is signed from a
+// temporary copy.
+func (g *GetService) signChart(ctx context.Context, chartPath string, content []byte) error {
+	name := chartPath
+	if content != nil {
+		tmp, err := ioutil.TempDir("", "helm-mirror")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		// the provenance file names the chart by its base name
+		name = filepath.Join(tmp, path.Base(chartPath))
+		if err := ioutil.WriteFile(name, content, 0600); err != nil {
+			return err
+		}
+	}
+	signature, err := g.signer.ClearSign(name)
+	if err != nil {
+		return fmt.Errorf("signing chart %s: %s", path.Base(chartPath), err)
+	}
+	return g.writeMirrorFile(ctx, chartPath+provSuffix, []byte(signature))
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/provenance"
+	"k8s.io/helm/pkg/repo"
+)
+
+// signingKeyring writes a keyring with the private key of Mirror Signer to
+// name
+func signingKeyring(t *testing.T, name string) {
+	e, err := openpgp.NewEntity("Mirror Signer", "", "signer@mirror.local.lan", nil)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("writing keyring: %s", err)
+	}
+	defer f.Close()
+	if err := e.SerializePrivate(f, nil); err != nil {
+		t.Fatalf("writing keyring: %s", err)
+	}
+}
+
+func TestGetService_GetSigningKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := path.Join(dir, "upstream")
+	os.MkdirAll(upstream, 0755)
+	ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart1", Version: "1.0.0"}}
+	if _, err := chartutil.Save(ch, upstream); err != nil {
+		t.Fatalf("Saving chart: %s", err)
+	}
+	svr := httptest.NewServer(http.FileServer(http.Dir(upstream)))
+	defer svr.Close()
+	index, err := repo.IndexDirectory(upstream, svr.URL)
+	if err != nil {
+		t.Fatalf("Indexing charts: %s", err)
+	}
+	index.WriteFile(path.Join(upstream, indexFileName), 0644)
+	keyring := path.Join(dir, "secring.gpg")
+	signingKeyring(t, keyring)
+	verifier, err := provenance.NewFromKeyring(keyring, "")
+	if err != nil {
+		t.Fatalf("Loading keyring: %s", err)
+	}
+	tests := []struct {
+		name    string
+		key     string
+		opts    []GetOption
+		storage bool
+		wantErr bool
+	}{
+		{"1", "Mirror Signer", nil, false, false},
+		{"2", "signer@mirror.local.lan", nil, true, false},
+		{"3", "Someone Else", nil, false, true},
+		{"4", "Mirror Signer", []GetOption{WithProvenance(true)}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			storage := &mockStorage{}
+			opts := append([]GetOption{WithSigningKey(keyring, tt.key, "")}, tt.opts...)
+			if tt.storage {
+				opts = append(opts, WithStorageWriter(storage))
+			}
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, true, false, false, fakeLogger, "https://mirror.local.lan", "", "", opts...)
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.storage {
+				ioutil.WriteFile(path.Join(workDir, "chart1-1.0.0.tgz"), storage.files["chart1-1.0.0.tgz"], 0644)
+				ioutil.WriteFile(path.Join(workDir, "chart1-1.0.0.tgz.prov"), storage.files["chart1-1.0.0.tgz.prov"], 0644)
+			}
+			chartPath := path.Join(workDir, "chart1-1.0.0.tgz")
+			v, err := verifier.Verify(chartPath, chartPath+provSuffix)
+			if err != nil {
+				t.Fatalf("GetService.Get() provenance file not verified: %s", err)
+			}
+			if _, ok := v.SignedBy.Identities["Mirror Signer <signer@mirror.local.lan>"]; !ok {
+				t.Errorf("GetService.Get() chart signed by %v, want Mirror Signer", v.SignedBy.Identities)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/cmd/helm/search"
+	"k8s.io/helm/pkg/repo"
+)
+
+// ChartSpec is a chart listed in a mirror spec file. It is mirrored at an
+// exact version, at all the versions matching a semver constraint, or at its
+// latest version when it has neither.
+type ChartSpec struct {
+	Name       string `json:"name"`
+	Version    string `json:"version,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+	// Dir is the folder of the chart under the destination folder, the
+	// destination folder itself when empty
+	Dir string `json:"dir,omitempty"`
+}
+
+// mirrorSpec is the content of a mirror spec file
+type mirrorSpec struct {
+	Charts []ChartSpec `json:"charts"`
+}
+
+// LoadMirrorSpec reads the charts of the YAML mirror spec file name, eg:
+//
+//	charts:
+//	- name: nginx
+//	  version: 1.2.3
+//	- name: redis
+//	  constraint: ">=10.0.0, <11.0.0"
+//	  dir: caches
+func LoadMirrorSpec(name string) ([]ChartSpec, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var spec mirrorSpec
+	if err := yaml.Unmarshal(b, &spec); err != nil {
+		return nil, fmt.Errorf("invalid mirror spec %s: %s", name, err)
+	}
+	for i, c := range spec.Charts {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("invalid mirror spec %s: chart %d: %s", name, i+1, err)
+		}
+	}
+	return spec.Charts, nil
+}
+
+func (c ChartSpec) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("no chart name")
+	}
+	if c.Version != "" && c.Constraint != "" {
+		return fmt.Errorf("%s has both a version and a constraint", c.Name)
+	}
+	if c.Constraint != "" {
+		if _, err := semver.NewConstraint(c.Constraint); err != nil {
+			return fmt.Errorf("%s: invalid version constraint %q: %s", c.Name, c.Constraint, err)
+		}
+	}
+	if path.IsAbs(c.Dir) || strings.Contains(c.Dir, `\`) || contains(strings.Split(c.Dir, "/"), "..") {
+		return fmt.Errorf("%s: invalid folder %q, it must be relative to the destination folder", c.Name, c.Dir)
+	}
+	return nil
+}
+
+// errNoChartVersion is the error of a chart of a mirror spec of which no
+// version is found in the repository
+var errNoChartVersion = errors.New("no chart version found in the repository")
+
+// match reports whether version is the version of the spec or matches its
+// constraint, any version does when it has neither
+func (c ChartSpec) match(version string) bool {
+	if c.Version != "" {
+		return version == c.Version
+	}
+	if c.Constraint != "" {
+		v, err := semver.NewVersion(version)
+		if err != nil {
+			return false
+		}
+		constraint, err := semver.NewConstraint(c.Constraint)
+		return err == nil && constraint.Check(v)
+	}
+	return true
+}
+
+// matchSpecs reports whether the chart version of r is one of the specs
+func (g *GetService) matchSpecs(r *search.Result) bool {
+	for _, c := range g.specs {
+		if strings.EqualFold(r.Chart.Name, c.Name) && c.match(r.Chart.Version) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectSpecs keeps the chart versions of the specs among charts, only the
+// newest one for the specs with neither a version nor a constraint. A spec
+// of which no version is kept is an error, unless errors are ignored, then
+// it is recorded in the missing specs.
+func (g *GetService) selectSpecs(charts []*search.Result) ([]*search.Result, error) {
+	latest := map[string]string{}
+	for _, r := range newest(charts, 1) {
+		latest[r.Chart.Name] = r.Chart.Version
+	}
+	g.missingSpecs = nil
+	selected := []*search.Result{}
+	found := make([]bool, len(g.specs))
+	for _, r := range charts {
+		keep := false
+		for i, c := range g.specs {
+			if !strings.EqualFold(r.Chart.Name, c.Name) || !c.match(r.Chart.Version) {
+				continue
+			}
+			if c.Version != "" || c.Constraint != "" || latest[r.Chart.Name] == r.Chart.Version {
+				found[i], keep = true, true
+			}
+		}
+		if keep {
+			selected = append(selected, r)
+		}
+	}
+	for i, c := range g.specs {
+		if found[i] {
+			continue
+		}
+		g.missingSpecs = append(g.missingSpecs, c)
+		if !g.ignoreErrors {
+			return nil, errNoChartVersion
+		}
+	}
+	return selected, nil
+}
+
+// SpecError is the error of one of the charts of a SpecGetService
+type SpecError struct {
+	Chart string
+	Err   error
+}
+
+// SpecGetError is returned by SpecGetService when charts failed and errors
+// are ignored, it holds the error of each one
+type SpecGetError []SpecError
+
+func (e SpecGetError) Error() string {
+	msgs := make([]string, len(e))
+	for i, c := range e {
+		msgs[i] = fmt.Sprintf("%s: %s", c.Chart, c.Err)
+	}
+	return fmt.Sprintf("%d charts failed - %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Is matches target when the error of one of the charts does
+func (e SpecGetError) Is(target error) bool {
+	for _, c := range e {
+		if errors.Is(c.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of the charts that matches target, eg: a
+// *ChartError
+func (e SpecGetError) As(target interface{}) bool {
+	for _, c := range e {
+		if errors.As(c.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// SpecGetService mirrors the charts of a mirror spec from a chart repository,
+// each one in its folder under the destination folder. The charts of a
+// folder are mirrored by a single run, from one download of the index file,
+// and the folders one after the other.
+type SpecGetService struct {
+	dir          string
+	names        []string
+	services     []*GetService
+	ignoreErrors bool
+	logger       Logger
+	stats        *GetStats
+}
+
+// NewSpecGetService returns a new instance of SpecGetService that mirrors the
+// charts of specs from the repository of config to its Name folder. The
+// options apply to every chart. When errors are ignored a chart that fails
+// does not stop the other ones.
+func NewSpecGetService(config repo.Entry, specs []ChartSpec, verbose bool, ignoreErrors bool, logger *log.Logger, newRootURL string, opts ...GetOption) (*SpecGetService, error) {
+	shared := &GetService{logger: logger, verbose: verbose}
+	for _, opt := range opts {
+		if err := opt(shared); err != nil {
+			return nil, err
+		}
+	}
+	s := &SpecGetService{dir: path.Clean(config.Name), ignoreErrors: ignoreErrors, logger: shared.log()}
+	dirs := []string{}
+	folders := map[string][]ChartSpec{}
+	for _, c := range specs {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		dir := path.Clean(c.Dir)
+		// each folder would write the archive over the one of the others,
+		// without the folder in its paths
+		if shared.tarOutput != "" && dir != "." {
+			return nil, fmt.Errorf("chart %s: a tar output cannot be used with the dir of a spec", c.Name)
+		}
+		if _, ok := folders[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		folders[dir] = append(folders[dir], c)
+	}
+	for _, dir := range dirs {
+		names := []string{}
+		for _, c := range folders[dir] {
+			names = append(names, c.Name)
+		}
+		entry := config
+		entry.Name = path.Join(config.Name, dir)
+		g, err := NewGetService(entry, false, verbose, ignoreErrors, logger, folderRootURL(newRootURL, dir), "", "", append(append([]GetOption{}, opts...), withSpecs(folders[dir]))...)
+		if err != nil {
+			return nil, fmt.Errorf("chart %s: %w", strings.Join(names, ", "), err)
+		}
+		s.names = append(s.names, strings.Join(names, ", "))
+		s.services = append(s.services, g.(*GetService))
+	}
+	return s, nil
+}
+
+// folderRootURL returns the root URL of the charts of the folder dir of the
+// mirror, the one of the mirror being newRootURL
+func folderRootURL(newRootURL string, dir string) string {
+	if newRootURL == "" || dir == "." {
+		return newRootURL
+	}
+	return strings.TrimRight(newRootURL, "/") + "/" + dir
+}
+
+// Get mirrors the charts folder by folder, a chart of which no version is
+// found is an error. When errors are not ignored the first folder that fails
+// stops the run and its error is returned, otherwise the errors of all the
+// failed charts are returned in a SpecGetError.
+func (s *SpecGetService) Get(ctx context.Context) error {
+	start := time.Now()
+	defer func() {
+		s.stats = sumStats(s.services, time.Since(start))
+	}()
+	var failed SpecGetError
+	for i, g := range s.services {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := os.MkdirAll(g.dir(), dirMode(g.mode()))
+		if err == nil {
+			err = g.Get(ctx)
+		}
+		name := s.failedChart(i, err)
+		if err != nil && (!s.ignoreErrors || ctx.Err() != nil) {
+			return fmt.Errorf("chart %s: %w", name, err)
+		}
+		for _, c := range g.missingSpecs {
+			s.logger.Printf("WARNING: mirroring chart %s - %s", c.Name, errNoChartVersion)
+			failed = append(failed, SpecError{Chart: c.Name, Err: errNoChartVersion})
+		}
+		if err != nil {
+			s.logger.Printf("WARNING: mirroring chart %s - %s", name, err)
+			failed = append(failed, SpecError{Chart: name, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// failedChart returns the chart named in the error err of the service i, the
+// spec of which no version was found or else all the charts of its folder
+func (s *SpecGetService) failedChart(i int, err error) string {
+	if g := s.services[i]; err == errNoChartVersion && len(g.missingSpecs) > 0 {
+		return g.missingSpecs[0].Name
+	}
+	return s.names[i]
+}
+
+// Fetch downloads the charts folder by folder like Get does, without writing
+// anything, see GetService.Fetch. It is an error when the index file cannot
+// be downloaded for the first folder, the errors of the other folders and the
+// charts of which no version is found are sent with the charts.
+func (s *SpecGetService) Fetch(ctx context.Context) (<-chan FetchedChart, error) {
+	fetched := make(chan FetchedChart)
+	if len(s.services) == 0 {
+		close(fetched)
+		return fetched, nil
+	}
+	first, err := s.services[0].Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("chart %s: %w", s.failedChart(0, err), err)
+	}
+	start := time.Now()
+	go func() {
+		defer func() {
+			s.stats = sumStats(s.services, time.Since(start))
+			close(fetched)
+		}()
+		send := func(f FetchedChart) {
+			select {
+			case fetched <- f:
+			case <-ctx.Done():
+			}
+		}
+		for i, g := range s.services {
+			charts := first
+			if i > 0 {
+				if charts, err = g.Fetch(ctx); err != nil {
+					send(FetchedChart{Name: s.failedChart(i, err), Err: err})
+					continue
+				}
+			}
+			for _, c := range g.missingSpecs {
+				send(FetchedChart{Name: c.Name, Version: c.Version, Err: errNoChartVersion})
+			}
+			// the channel is drained for the downloads of the folder to end
+			for f := range charts {
+				send(f)
+			}
+		}
+	}()
+	return fetched, nil
+}
+
+// Stats returns the statistics of the last run of Get summed over all the
+// charts, or nil when Get was never run
+func (s *SpecGetService) Stats() *GetStats {
+	return s.stats
+}
+
+// Index returns the index file written to the destination folder itself by
+// the last run of Get, the one of the charts without a folder, or nil when
+// there is none. It must not be called while Get is running.
+func (s *SpecGetService) Index() *repo.IndexFile {
+	for _, g := range s.services {
+		if path.Clean(g.dir()) == s.dir {
+			return g.Index()
+		}
+	}
+	return nil
+}
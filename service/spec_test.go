@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestLoadMirrorSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		content string
+		want    []ChartSpec
+		wantErr bool
+	}{
+		{"1", "charts:\n- name: nginx\n  version: 1.2.3\n- name: redis\n  constraint: '>=10.0.0, <11.0.0'\n  dir: caches\n",
+			[]ChartSpec{{Name: "nginx", Version: "1.2.3"}, {Name: "redis", Constraint: ">=10.0.0, <11.0.0", Dir: "caches"}}, false},
+		{"2", "charts:\n- name: nginx\n", []ChartSpec{{Name: "nginx"}}, false},
+		{"3", "charts:\n- version: 1.2.3\n", nil, true},
+		{"4", "charts:\n- name: nginx\n  version: 1.2.3\n  constraint: '>=1.0.0'\n", nil, true},
+		{"5", "charts:\n- name: nginx\n  constraint: '>=1.x.y'\n", nil, true},
+		{"6", "charts:\n- name: nginx\n  dir: ../outside\n", nil, true},
+		{"7", "charts:\n- name: nginx\n  dir: /outside\n", nil, true},
+		{"8", "charts: nginx\n", nil, true},
+		{"9", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := path.Join(dir, tt.name+".yaml")
+			ioutil.WriteFile(name, []byte(tt.content), 0644)
+			got, err := LoadMirrorSpec(name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadMirrorSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadMirrorSpec() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := LoadMirrorSpec(path.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("LoadMirrorSpec() of a missing file did not fail")
+	}
+}
+
+func TestNewSpecGetService(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []ChartSpec
+		opts    []GetOption
+		wantErr bool
+	}{
+		{"1", []ChartSpec{{Name: "chart1"}, {Name: "chart2", Dir: "two"}}, nil, false},
+		{"2", []ChartSpec{{Name: "chart1"}, {Name: "chart2", Dir: "."}}, []GetOption{WithTarOutput("/tmp/mirror.tar")}, false},
+		{"3", []ChartSpec{{Name: "chart1"}, {Name: "chart2", Dir: "two"}}, []GetOption{WithTarOutput("/tmp/mirror.tar")}, true},
+		{"4", []ChartSpec{{Name: ""}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSpecGetService(repo.Entry{Name: "/tmp/mirror", URL: "http://127.0.0.1:1793"}, tt.specs, false, false, fakeLogger, "", tt.opts...); (err != nil) != tt.wantErr {
+				t.Errorf("NewSpecGetService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSpecGetService_Get(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name         string
+		specs        []ChartSpec
+		ignoreErrors bool
+		prune        bool
+		want         []string
+		wantErr      bool
+		wantStats    GetStats
+	}{
+		{"1", []ChartSpec{{Name: "chart1"}, {Name: "chart2", Version: "0.0.0-rc1", Dir: "two"}}, false, false,
+			[]string{"chart1-2.11.0.tgz", "two/chart2-0.0.0-rc1.tgz"}, false, GetStats{Downloaded: 2}},
+		{"2", []ChartSpec{{Name: "chart2", Constraint: ">=0.0.0-0", Dir: "two"}}, false, false,
+			[]string{"two/chart2-0.0.0-rc1.tgz", "two/chart2-1.0.1.tgz"}, false, GetStats{Downloaded: 2}},
+		{"3", []ChartSpec{{Name: "chart2", Version: "7.0.0"}, {Name: "chart1"}}, true, false,
+			[]string{"chart1-2.11.0.tgz"}, true, GetStats{Downloaded: 1}},
+		{"4", []ChartSpec{{Name: "chart2", Version: "7.0.0"}, {Name: "chart1"}}, false, false, []string{}, true, GetStats{}},
+		{"5", []ChartSpec{{Name: "chart1", Dir: "../outside"}}, false, false, nil, true, GetStats{}},
+		// the charts of a folder are kept together by the prune
+		{"6", []ChartSpec{{Name: "chart1"}, {Name: "chart2", Version: "1.0.1"}, {Name: "chart2", Version: "0.0.0-rc1", Dir: "two"}}, false, true,
+			[]string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz", "two/chart2-0.0.0-rc1.tgz"}, false, GetStats{Downloaded: 3}},
+		{"7", []ChartSpec{{Name: "chart1"}, {Name: "chart2"}}, false, false,
+			[]string{"chart1-2.11.0.tgz", "chart2-1.0.1.tgz"}, false, GetStats{Downloaded: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			s, err := NewSpecGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, tt.specs, false, tt.ignoreErrors, fakeLogger, "", WithPrune(tt.prune))
+			if err == nil {
+				err = s.Get(context.Background())
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SpecGetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				return
+			}
+			if _, ok := err.(SpecGetError); err != nil && tt.ignoreErrors && !ok {
+				t.Errorf("SpecGetService.Get() error = %v, want a SpecGetError", err)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			more, _ := filepath.Glob(path.Join(workDir, "*", "*.tgz"))
+			got := []string{}
+			for _, f := range append(files, more...) {
+				rel, _ := filepath.Rel(workDir, f)
+				got = append(got, rel)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SpecGetService.Get() charts = %v, want %v", got, tt.want)
+			}
+			if len(got) > 0 {
+				if _, err := os.Stat(path.Join(workDir, path.Dir(got[0]), indexFileName)); err != nil {
+					t.Errorf("SpecGetService.Get() index file: %s", err)
+				}
+			}
+			// the index file of the destination folder is the one of the
+			// charts without a folder
+			if wantIndex := tt.specs[0].Dir == ""; !tt.wantErr && (s.Index() != nil) != wantIndex {
+				t.Errorf("SpecGetService.Index() = %v, want an index file %v", s.Index(), wantIndex)
+			}
+			st := s.Stats()
+			if st.Downloaded != tt.wantStats.Downloaded || st.Failed != tt.wantStats.Failed {
+				t.Errorf("SpecGetService.Stats() = %+v, want %+v", st, tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestSpecGetService_GetRootURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	specs := []ChartSpec{{Name: "chart1"}, {Name: "chart2", Version: "1.0.1", Dir: "two"}, {Name: "chart2", Version: "0.0.0-rc1", Dir: "two/rc"}}
+	s, err := NewSpecGetService(repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"}, specs, false, false, fakeLogger, "https://m/charts/")
+	if err != nil {
+		t.Fatalf("NewSpecGetService() error = %v", err)
+	}
+	if err := s.Get(context.Background()); err != nil {
+		t.Fatalf("SpecGetService.Get() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		folder  string
+		chart   string
+		version string
+		want    string
+	}{
+		{"1", "", "chart1", "2.11.0", "https://m/charts/chart1-2.11.0.tgz"},
+		{"2", "two", "chart2", "1.0.1", "https://m/charts/two/chart2-1.0.1.tgz"},
+		{"3", "two/rc", "chart2", "0.0.0-rc1", "https://m/charts/two/rc/chart2-0.0.0-rc1.tgz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, err := repo.LoadIndexFile(path.Join(dir, tt.folder, indexFileName))
+			if err != nil {
+				t.Fatalf("loading index file: %s", err)
+			}
+			cv, err := index.Get(tt.chart, tt.version)
+			if err != nil {
+				t.Fatalf("index file of %q: %s", tt.folder, err)
+			}
+			if len(cv.URLs) != 1 || cv.URLs[0] != tt.want {
+				t.Errorf("index file of %q URLs = %v, want %v", tt.folder, cv.URLs, tt.want)
+			}
+			if _, err := os.Stat(path.Join(dir, tt.folder, path.Base(tt.want))); err != nil {
+				t.Errorf("chart of %s: %s", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestSpecGetService_Fetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	specs := []ChartSpec{{Name: "chart1"}, {Name: "chart2", Version: "7.0.0"}, {Name: "chart2", Version: "0.0.0-rc1", Dir: "two"}}
+	tests := []struct {
+		name         string
+		ignoreErrors bool
+		want         []string
+		wantFailed   []string
+		wantErr      bool
+	}{
+		{"1", true, []string{"chart1-2.11.0", "chart2-0.0.0-rc1"}, []string{"chart2-7.0.0"}, false},
+		{"2", false, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			s, err := NewSpecGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, specs, false, tt.ignoreErrors, fakeLogger, "")
+			if err != nil {
+				t.Fatalf("NewSpecGetService() error = %v", err)
+			}
+			fetched, err := s.Fetch(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SpecGetService.Fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got, failed []string
+			for f := range fetched {
+				if f.Err != nil {
+					failed = append(failed, f.Name+"-"+f.Version)
+					continue
+				}
+				got = append(got, f.Name+"-"+f.Version)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("SpecGetService.Fetch() = %v, failed %v, want %v, failed %v", got, failed, tt.want, tt.wantFailed)
+			}
+			if st := s.Stats(); st.Downloaded != len(tt.want) {
+				t.Errorf("SpecGetService.Stats() = %+v, want %d downloaded", st, len(tt.want))
+			}
+			if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+				t.Errorf("SpecGetService.Fetch() wrote to the destination folder: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stateFlushInterval is how often at most the state file is written while the
+// charts are mirrored, rather than after each of them
+const stateFlushInterval = 2 * time.Second
+
+// stateChart is a chart version a run mirrored, as recorded in its state file
+type stateChart struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	Digest  string `json:"digest,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+}
+
+// runState is the state file of a run, it records each chart version once
+// mirrored so a run resumed from it skips them, whether the index has
+// digests or not. The paths of the charts are relative to the destination
+// folder dir.
+type runState struct {
+	mu     sync.Mutex
+	fs     FileSystem
+	dir    string
+	name   string
+	mode   os.FileMode
+	charts map[string]stateChart
+	// flushed is when the state file was last written
+	flushed time.Time
+	now     func() time.Time
+}
+
+// loadRunState reads the state file name of the destination folder dir, a
+// missing file is an empty state
+func loadRunState(fs FileSystem, dir string, name string, mode os.FileMode) (*runState, error) {
+	s := &runState{fs: fs, dir: dir, name: name, mode: mode, charts: map[string]stateChart{}, flushed: time.Now(), now: time.Now}
+	b, err := fs.ReadFile(name)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var content struct {
+		Charts []stateChart `json:"charts"`
+	}
+	if err := json.Unmarshal(b, &content); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %s", name, err)
+	}
+	for _, c := range content.Charts {
+		s.charts[c.Path] = c
+	}
+	return s, nil
+}
+
+// done returns the recorded chart version written to chartPath, if any
+func (s *runState) done(name string, version string, chartPath string) (stateChart, bool) {
+	if s == nil {
+		return stateChart{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.charts[s.rel(chartPath)]
+	return c, ok && c.Name == name && c.Version == version
+}
+
+// add records the chart version of size bytes written to chartPath. The
+// state file is written when it was not for stateFlushInterval, so an
+// interrupted run loses at most the charts of the last interval, which a run
+// resumed from it downloads again.
+func (s *runState) add(name string, version string, chartPath string, sum string, size int64) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rel := s.rel(chartPath)
+	s.charts[rel] = stateChart{Name: name, Version: version, Path: rel, Digest: sum, Size: size}
+	if s.now().Sub(s.flushed) < stateFlushInterval {
+		return nil
+	}
+	return s.write()
+}
+
+// save writes the state file
+func (s *runState) save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write()
+}
+
+// write writes the state file, s.mu must be held
+func (s *runState) write() error {
+	var content struct {
+		Charts []stateChart `json:"charts"`
+	}
+	for _, c := range s.charts {
+		content.Charts = append(content.Charts, c)
+	}
+	sort.Slice(content.Charts, func(i, j int) bool {
+		return content.Charts[i].Path < content.Charts[j].Path
+	})
+	b, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.flushed = s.now()
+	return writeAtomic(s.fs, s.name, b, s.mode)
+}
+
+// rel returns the slash separated path of chartPath in the destination folder
+func (s *runState) rel(chartPath string) string {
+	rel, err := filepath.Rel(s.dir, chartPath)
+	if err != nil {
+		return filepath.ToSlash(chartPath)
+	}
+	return filepath.ToSlash(rel)
+}
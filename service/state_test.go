@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func Test_loadRunState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "valid.json"), []byte(`{"charts":[{"name":"chart1","version":"1.0.0","path":"chart1-1.0.0.tgz"}]}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "invalid.json"), []byte(`{"charts":`), 0644)
+	tests := []struct {
+		name      string
+		file      string
+		chartPath string
+		version   string
+		wantDone  bool
+		wantErr   bool
+	}{
+		{"1", "valid.json", "chart1-1.0.0.tgz", "1.0.0", true, false},
+		{"2", "valid.json", "chart1-1.0.0.tgz", "1.0.1", false, false},
+		{"3", "valid.json", "charts/chart1-1.0.0.tgz", "1.0.0", false, false},
+		{"4", "missing.json", "chart1-1.0.0.tgz", "1.0.0", false, false},
+		{"5", "invalid.json", "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := loadRunState(osFileSystem{}, dir, path.Join(dir, tt.file), 0644)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadRunState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if _, done := s.done("chart1", tt.version, path.Join(dir, tt.chartPath)); done != tt.wantDone {
+				t.Errorf("runState.done() = %v, want %v", done, tt.wantDone)
+			}
+		})
+	}
+}
+
+func Test_runState_add(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "state.json")
+	s, err := loadRunState(osFileSystem{}, dir, name, 0644)
+	if err != nil {
+		t.Fatalf("loadRunState() error = %v", err)
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		save    bool
+		want    int
+	}{
+		// the state file is not written after each chart
+		{"1", 0, false, 0},
+		{"2", stateFlushInterval / 2, false, 0},
+		{"3", stateFlushInterval, false, 3},
+		{"4", time.Millisecond, false, 3},
+		// and once more when the run ends
+		{"5", 0, true, 5},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.elapsed)
+			chart := "chart" + strconv.Itoa(i)
+			if err := s.add(chart, "1.0.0", path.Join(dir, chart+"-1.0.0.tgz"), "", 1); err != nil {
+				t.Fatalf("runState.add() error = %v", err)
+			}
+			if tt.save {
+				if err := s.save(); err != nil {
+					t.Fatalf("runState.save() error = %v", err)
+				}
+			}
+			got := 0
+			if loaded, err := loadRunState(osFileSystem{}, dir, name, 0644); err == nil {
+				got = len(loaded.charts)
+			}
+			if got != tt.want {
+				t.Errorf("runState.add() state file charts = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_GetStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name           string
+		state          string
+		wantDownloaded int
+		wantSkipped    int
+	}{
+		{"1", "", 3, 0},
+		{"2", `{"charts":[{"name":"chart1","version":"2.11.0","path":"chart1-2.11.0.tgz"}]}`, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			stateFile := path.Join(workDir, ".mirror-state.json")
+			if tt.state != "" {
+				ioutil.WriteFile(stateFile, []byte(tt.state), 0644)
+			}
+			opts := []GetOption{WithChartNames([]string{"chart1", "chart2"}), WithStateFile(".mirror-state.json")}
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, true, false, true, fakeLogger, "", "", "", opts...)
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			st := g.(*GetService).Stats()
+			if st.Downloaded != tt.wantDownloaded || st.Skipped != tt.wantSkipped {
+				t.Errorf("GetService.Get() downloaded = %v, skipped = %v, want %v and %v", st.Downloaded, st.Skipped, tt.wantDownloaded, tt.wantSkipped)
+			}
+			s, err := loadRunState(osFileSystem{}, workDir, stateFile, 0644)
+			if err != nil {
+				t.Fatalf("loadRunState() error = %v", err)
+			}
+			for _, c := range []struct{ name, version string }{{"chart1", "2.11.0"}, {"chart2", "1.0.1"}, {"chart2", "0.0.0-rc1"}} {
+				if _, done := s.done(c.name, c.version, path.Join(workDir, chartFileName(c.name, c.version))); !done {
+					t.Errorf("GetService.Get() state file does not record %s(%s)", c.name, c.version)
+				}
+			}
+		})
+	}
+}
+
+func TestGetService_GetStateFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + indexFileName:
+			w.Write([]byte(index))
+		case "/chart1-1.0.0.tgz":
+			w.Write([]byte("chart1"))
+		case "/chart2-1.0.0.tgz":
+			w.Write([]byte("chart2"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer svr.Close()
+	index = "apiVersion: v1\nentries:\n" +
+		"  chart1:\n  - name: chart1\n    version: 1.0.0\n    urls:\n    - " + svr.URL + "/chart1-1.0.0.tgz\n" +
+		"  chart2:\n  - name: chart2\n    version: 1.0.0\n    digest: " + digest([]byte("chart2")) + "\n    urls:\n    - " + svr.URL + "/chart2-1.0.0.tgz\n"
+	tests := []struct {
+		name           string
+		chart          string
+		content        string
+		size           int64
+		wantDownloaded int
+		wantSkipped    int
+	}{
+		{"1", "chart1", "chart1", 6, 1, 1},
+		{"2", "chart1", "ch", 6, 2, 0},
+		{"3", "chart1", "", 6, 2, 0},
+		{"4", "chart2", "chart2", 6, 1, 1},
+		{"5", "chart2", "chart3", 6, 2, 0},
+		{"6", "chart1", "", 0, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			chartName := chartFileName(tt.chart, "1.0.0")
+			ioutil.WriteFile(path.Join(workDir, ".mirror-state.json"), []byte(`{"charts":[{"name":"`+tt.chart+`","version":"1.0.0","path":"`+chartName+`","size":`+strconv.FormatInt(tt.size, 10)+`}]}`), 0644)
+			if tt.content != "" {
+				ioutil.WriteFile(path.Join(workDir, chartName), []byte(tt.content), 0644)
+			}
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, true, false, false, fakeLogger, "", "", "", WithStateFile(".mirror-state.json"))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Fatalf("GetService.Get() error = %v", err)
+			}
+			st := g.(*GetService).Stats()
+			if st.Downloaded != tt.wantDownloaded || st.Skipped != tt.wantSkipped {
+				t.Errorf("GetService.Get() downloaded = %v, skipped = %v, want %v and %v", st.Downloaded, st.Skipped, tt.wantDownloaded, tt.wantSkipped)
+			}
+			if tt.size > 0 {
+				if b, _ := ioutil.ReadFile(path.Join(workDir, chartName)); string(b) != tt.chart {
+					t.Errorf("GetService.Get() chart %s = %q, want %q", chartName, b, tt.chart)
+				}
+			}
+		})
+	}
+}
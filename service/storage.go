@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// StorageWriter writes the files of the mirror to another storage than the
+// destination folder, like an S3 bucket. The name of a file is its slash
+// separated path in the mirror. A write is aborted when ctx is done.
+type StorageWriter interface {
+	Write(ctx context.Context, name string, content []byte) error
+}
+
+// writeMirrorFile writes the file name of the destination folder, or to the
+// storage writer of the service when there is one
+func (g *GetService) writeMirrorFile(ctx context.Context, name string, content []byte) error {
+	if g.storage == nil {
+		return writeChart(ctx, g.fileSystem(), name, content, g.mode())
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(g.dir(), name)
+	if err != nil {
+		return err
+	}
+	return g.storage.Write(ctx, filepath.ToSlash(rel), content)
+}
+
+// storeIndexFiles copies the index file and the other files written to the
+// destination folder at the end of the run to the storage writer
+func (g *GetService) storeIndexFiles(ctx context.Context) error {
+	names := append(g.indexFiles(), checksumsFileName)
+	if g.summaryFile != "" {
+		names = append(names, g.summaryFile)
+	}
+	for _, name := range names {
+		content, err := g.fileSystem().ReadFile(path.Join(g.dir(), name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := g.storage.Write(ctx, filepath.ToSlash(name), content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
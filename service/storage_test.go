@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_GetStorageWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	allFiles := []string{"SHA256SUMS", "chart1-2.11.0.tgz", "chart2-0.0.0-rc1.tgz", "chart2-1.0.1.tgz", "chart3-0.0.1-rc1.tgz", "index.yaml"}
+	tests := []struct {
+		name         string
+		fail         string
+		ignoreErrors bool
+		regenerate   bool
+		skipExisting bool
+		resolve      bool
+		wantErr      bool
+		wantFiles    []string
+	}{
+		{"1", "", true, false, false, false, false, allFiles},
+		{"2", "chart1-2.11.0.tgz", true, false, false, false, false, []string{"SHA256SUMS", "chart2-0.0.0-rc1.tgz", "chart2-1.0.1.tgz", "chart3-0.0.1-rc1.tgz", "index.yaml"}},
+		{"3", "chart1-2.11.0.tgz", false, false, false, false, true, nil},
+		{"4", "index.yaml", true, false, false, false, true, nil},
+		{"5", "", true, true, false, false, true, nil},
+		{"6", "", true, false, true, false, true, nil},
+		{"7", "", true, false, false, true, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			storage := &mockStorage{fail: tt.fail}
+			g := &GetService{
+				config:              repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"},
+				logger:              fakeLogger,
+				ignoreErrors:        tt.ignoreErrors,
+				allVersions:         true,
+				regenerateIndex:     tt.regenerate,
+				skipExisting:        tt.skipExisting,
+				resolveDependencies: tt.resolve,
+				writeChecksums:      true,
+				storage:             storage,
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tgz, _ := filepath.Glob(path.Join(workDir, "*.tgz")); len(tgz) > 0 {
+				t.Errorf("GetService.Get() wrote charts to the destination folder: %v", tgz)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got []string
+			for name := range storage.files {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantFiles) {
+				t.Errorf("GetService.Get() stored files = %v, want %v", got, tt.wantFiles)
+			}
+		})
+	}
+}
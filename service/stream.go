@@ -0,0 +1,205 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"k8s.io/helm/cmd/helm/search"
+	"k8s.io/helm/pkg/repo"
+)
+
+// FetchedChart is a chart version downloaded by Fetch
+type FetchedChart struct {
+	Name    string
+	Version string
+	// URL the chart was downloaded from, the last one tried when it failed
+	URL string
+	// Content of the chart, verified and validated like the charts of Get
+	Content []byte
+	// Err is set when the chart could not be downloaded from any of its URLs,
+	// Content is nil then
+	Err error
+}
+
+// Fetch downloads the charts selected like Get does, with the same filters,
+// retries, limits, pool of workers, overall timeout, metrics and tracing,
+// without writing anything: neither the index file, nor the charts, nor the
+// state file. The charts are sent on the returned channel as they are
+// downloaded, in no particular order, and it is closed once all of them were
+// sent or when ctx is done. The charts over the maximum size are skipped and
+// not sent. The channel must be drained or ctx cancelled for the downloads to
+// end. It is an error when the index file cannot be downloaded, the charts
+// that fail are sent with their error. When the overall timeout expires, a
+// last FetchedChart without name is sent with the error matching
+// ErrRunTimeout before the channel is closed. Like Get it must not be called while
+// the service is running, Stats returns the statistics of the fetch once the
+// channel is closed.
+func (g *GetService) Fetch(ctx context.Context) (<-chan FetchedChart, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	parent := ctx
+	cancel := func() {}
+	if g.overallTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, g.overallTimeout)
+	}
+	// the run was aborted by its own deadline, not by its caller
+	timedOut := func() bool {
+		return g.overallTimeout > 0 && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil
+	}
+	ctx, span := g.startSpan(ctx, "helm-mirror.fetch")
+	span.SetAttribute("repo.name", g.repoName())
+	span.SetAttribute("repo.url", g.config.URL)
+	start := time.Now()
+	g.summary = &summary{}
+	chartRepo, charts, err := g.fetchSelection(ctx)
+	if err != nil {
+		if timedOut() {
+			err = runTimedOut(g.overallTimeout, 0)
+		}
+		endSpan(span, err)
+		cancel()
+		return nil, err
+	}
+
+	fetched := make(chan FetchedChart)
+	go func() {
+		defer func() {
+			g.stats = g.summary.stats(time.Since(start))
+			err := ctx.Err()
+			if timedOut() {
+				err = runTimedOut(g.overallTimeout, g.stats.Downloaded+g.stats.Skipped)
+				select {
+				case fetched <- FetchedChart{Err: err}:
+				case <-parent.Done():
+				}
+			}
+			endSpan(span, err)
+			cancel()
+			close(fetched)
+		}()
+		g.dispatch(ctx, charts, func(ctx context.Context, r *search.Result) {
+			start := time.Now()
+			spanCtx, span := g.startSpan(ctx, "helm-mirror.chart")
+			span.SetAttribute("chart.name", r.Chart.Name)
+			span.SetAttribute("chart.version", r.Chart.Version)
+			f, status := g.fetchChart(spanCtx, chartRepo, r)
+			span.SetAttribute("chart.status", string(status))
+			endSpan(span, f.Err)
+			if status == StatusDownloaded {
+				g.metrics().ObserveDuration(time.Since(start))
+			}
+			g.addResult(r.Chart.Name, r.Chart.Version, status, f.Err)
+			if status == StatusSkipped {
+				return
+			}
+			select {
+			case fetched <- f:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return fetched, nil
+}
+
+// fetchSelection downloads the index file of the repository, without
+// writing it, and returns the chart versions selected from it
+func (g *GetService) fetchSelection(ctx context.Context) (*repo.ChartRepository, []*search.Result, error) {
+	if err := g.prepareClients(); err != nil {
+		return nil, nil, err
+	}
+	config := g.config
+	chartRepo, err := repo.NewChartRepository(&config, g.getters())
+	if err != nil {
+		return nil, nil, err
+	}
+	_, indexSpan := g.startSpan(ctx, "helm-mirror.index")
+	indexSpan.SetAttribute("index.url", config.URL)
+	var content []byte
+	err = g.retryTimes(ctx, config.URL, g.indexRetries, func() error {
+		var ferr error
+		if content, _, ferr = fetchIndexFile(ctx, chartRepo, nil); ferr != nil {
+			return indexDownloadFailed(ferr)
+		}
+		return nil
+	})
+	if err == nil {
+		chartRepo.IndexFile, err = parseIndexFile(content)
+	}
+	endSpan(indexSpan, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	g.log().Event(Event{Event: EventIndexDownloaded, Repo: g.repoName(), URL: config.URL})
+	charts, err := g.selectCharts(chartRepo.IndexFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chartRepo, charts, nil
+}
+
+// fetchChart downloads the chart from the first of its URLs that works, the
+// other ones are fallbacks tried in order. It returns the outcome for the
+// chart, which is skipped when it is over the maximum size.
+func (g *GetService) fetchChart(ctx context.Context, chartRepo *repo.ChartRepository, r *search.Result) (FetchedChart, ChartStatus) {
+	f := FetchedChart{Name: r.Chart.Name, Version: r.Chart.Version}
+	if len(r.Chart.URLs) == 0 {
+		f.Err = &ChartError{Chart: r.Chart.Name, Version: r.Chart.Version, Err: fmt.Errorf("chart %s(%s) has no URL in the index file", r.Chart.Name, r.Chart.Version)}
+		return f, StatusFailed
+	}
+	var err error
+	for _, u := range r.Chart.URLs {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var status ChartStatus
+		f.URL, f.Content, status, err = g.fetchChartURL(ctx, chartRepo, r, u)
+		if err == nil {
+			if status == StatusDownloaded {
+				g.log().Event(Event{Event: EventChartDownloaded, Chart: r.Chart.Name, Version: r.Chart.Version, URL: f.URL})
+			}
+			return f, status
+		}
+	}
+	f.Err = &ChartError{Chart: r.Chart.Name, Version: r.Chart.Version, URL: f.URL, Err: err}
+	return f, StatusFailed
+}
+
+// fetchChartURL downloads and verifies the chart at u, it returns the URL it
+// was downloaded from
+func (g *GetService) fetchChartURL(ctx context.Context, chartRepo *repo.ChartRepository, r *search.Result, u string) (string, []byte, ChartStatus, error) {
+	u = normalizeURL(u)
+	urlParsed, err := url.Parse(u)
+	if err != nil {
+		return u, nil, StatusFailed, err
+	}
+	u = g.absoluteChartURL(u, urlParsed)
+	client := g.chartGetter(chartRepo, urlParsed)
+	release, err := g.hosts.acquire(ctx, urlHost(u))
+	if err != nil {
+		return u, nil, StatusFailed, err
+	}
+	defer release()
+	if g.maxChartBytes > 0 && g.oversized(ctx, client, r, u) {
+		return u, nil, StatusSkipped, nil
+	}
+	b, err := g.fetch(ctx, client, u)
+	if err != nil {
+		return u, nil, StatusFailed, err
+	}
+	err = g.verify(r, u, func(expected string) error {
+		return verifyDigest(b.Bytes(), expected)
+	})
+	if err != nil {
+		return u, nil, StatusFailed, err
+	}
+	if g.validateCharts {
+		if err := validateChart(bytes.NewReader(b.Bytes()), r.Chart.Name, r.Chart.Version); err != nil {
+			return u, nil, StatusFailed, fmt.Errorf("%s: %s", u, err)
+		}
+	}
+	return u, b.Bytes(), StatusDownloaded, nil
+}
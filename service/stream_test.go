@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestGetService_Fetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := path.Join(dir, "upstream")
+	os.MkdirAll(upstream, 0755)
+	for _, v := range []string{"1.0.0", "1.1.0"} {
+		ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart1", Version: v}}
+		if _, err := chartutil.Save(ch, upstream); err != nil {
+			t.Fatalf("Saving chart: %s", err)
+		}
+	}
+	ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: "chart2", Version: "1.0.0"}}
+	if _, err := chartutil.Save(ch, upstream); err != nil {
+		t.Fatalf("Saving chart: %s", err)
+	}
+	svr := httptest.NewServer(http.FileServer(http.Dir(upstream)))
+	defer svr.Close()
+	index, err := repo.IndexDirectory(upstream, svr.URL)
+	if err != nil {
+		t.Fatalf("Indexing charts: %s", err)
+	}
+	// the digest of chart2 no longer matches
+	index.Entries["chart2"][0].Digest = strings.Repeat("0", 64)
+	index.WriteFile(path.Join(upstream, indexFileName), 0644)
+	tests := []struct {
+		name        string
+		allVersions bool
+		chartName   string
+		maxBytes    int64
+		want        []string
+		wantFailed  []string
+	}{
+		{"1", true, "", 0, []string{"chart1-1.0.0", "chart1-1.1.0"}, []string{"chart2-1.0.0"}},
+		{"2", false, "", 0, []string{"chart1-1.1.0"}, []string{"chart2-1.0.0"}},
+		{"3", true, "chart1", 0, []string{"chart1-1.0.0", "chart1-1.1.0"}, nil},
+		// the charts over the maximum size are skipped and not sent
+		{"4", true, "chart1", 1, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: svr.URL}, tt.allVersions, false, false, fakeLogger, "https://mirror.local.lan", tt.chartName, "", WithDigestVerification(true), WithMaxChartSize(tt.maxBytes, false))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			fetched, err := g.Fetch(context.Background())
+			if err != nil {
+				t.Fatalf("GetService.Fetch() error = %v", err)
+			}
+			var got, failed []string
+			for f := range fetched {
+				name := f.Name + "-" + f.Version
+				if f.Err != nil {
+					failed = append(failed, name)
+					continue
+				}
+				b, _ := ioutil.ReadFile(path.Join(upstream, name+".tgz"))
+				if string(f.Content) != string(b) || f.URL != svr.URL+"/"+name+".tgz" {
+					t.Errorf("GetService.Fetch() chart %s from %s does not match", name, f.URL)
+				}
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") || strings.Join(failed, ",") != strings.Join(tt.wantFailed, ",") {
+				t.Errorf("GetService.Fetch() = %v, failed %v, want %v, failed %v", got, failed, tt.want, tt.wantFailed)
+			}
+			if st := g.Stats(); st.Downloaded != len(tt.want) || st.Failed != len(tt.wantFailed) {
+				t.Errorf("GetService.Stats() = %+v, want %d downloaded, %d failed", st, len(tt.want), len(tt.wantFailed))
+			}
+			if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+				t.Errorf("GetService.Fetch() wrote to the destination folder: %v", err)
+			}
+		})
+	}
+	g, _ := NewGetService(repo.Entry{Name: dir, URL: svr.URL + "/missing"}, true, false, false, fakeLogger, "", "", "")
+	if _, err := g.Fetch(context.Background()); err == nil {
+		t.Errorf("GetService.Fetch() without an index file error = nil, want one")
+	}
+}
+
+func TestGetService_FetchOverallTimeout(t *testing.T) {
+	var index string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + indexFileName:
+			w.Write([]byte(index))
+		case "/slow/chart2-1.0.0.tgz":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			w.Write([]byte("chart"))
+		}
+	}))
+	defer svr.Close()
+	tests := []struct {
+		name          string
+		chart2        string
+		timeout       time.Duration
+		parentTimeout time.Duration
+		wantTimeout   bool
+	}{
+		{"1", "/slow/chart2-1.0.0.tgz", 300 * time.Millisecond, 0, true},
+		{"2", "/slow/chart2-1.0.0.tgz", 10 * time.Second, 300 * time.Millisecond, false},
+		{"3", "/chart2-1.0.0.tgz", 10 * time.Second, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index = "apiVersion: v1\nentries:\n" +
+				"  chart1:\n  - name: chart1\n    version: 1.0.0\n    urls:\n    - " + svr.URL + "/chart1-1.0.0.tgz\n" +
+				"  chart2:\n  - name: chart2\n    version: 1.0.0\n    urls:\n    - " + svr.URL + tt.chart2 + "\n"
+			g, err := NewGetService(repo.Entry{Name: "unused", URL: svr.URL}, true, false, false, fakeLogger, "", "", "",
+				WithConcurrency(1), WithOverallTimeout(tt.timeout))
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			ctx := context.Background()
+			if tt.parentTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.parentTimeout)
+				defer cancel()
+			}
+			fetched, err := g.Fetch(ctx)
+			if err != nil {
+				t.Fatalf("GetService.Fetch() error = %v", err)
+			}
+			var last FetchedChart
+			for f := range fetched {
+				last = f
+			}
+			gotTimeout := last.Name == "" && errors.Is(last.Err, ErrRunTimeout)
+			if gotTimeout != tt.wantTimeout {
+				t.Errorf("GetService.Fetch() last chart = %+v, want ErrRunTimeout %v", last, tt.wantTimeout)
+			}
+			if tt.wantTimeout && !strings.Contains(last.Err.Error(), "1 charts completed") {
+				t.Errorf("GetService.Fetch() error = %v, want the number of charts completed", last.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ChartStatus is the outcome of mirroring a chart version
+type ChartStatus string
+
+// Outcomes of mirroring a chart version
+const (
+	StatusDownloaded ChartStatus = "downloaded"
+	StatusSkipped    ChartStatus = "skipped"
+	StatusFailed     ChartStatus = "failed"
+)
+
+// ChartResult records what happened to a chart version during a run
+type ChartResult struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version"`
+	Status  ChartStatus `json:"status"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// GetStats are the statistics of a mirror run
+type GetStats struct {
+	Downloaded int
+	Skipped    int
+	Failed     int
+	// Blocked is the number of chart versions of the blocklist left out
+	Blocked      int
+	BytesWritten int64
+	Duration     time.Duration
+}
+
+// String returns the totals of the run as a sentence
+func (st *GetStats) String() string {
+	s := fmt.Sprintf("%d charts downloaded, %d skipped, %d failed", st.Downloaded, st.Skipped, st.Failed)
+	if st.Blocked > 0 {
+		s += fmt.Sprintf(", %d blocked", st.Blocked)
+	}
+	return s + fmt.Sprintf(", %d bytes written in %s", st.BytesWritten, st.Duration.Round(time.Millisecond))
+}
+
+// summary collects the results of the charts processed by concurrent workers
+type summary struct {
+	mu      sync.Mutex
+	results []ChartResult
+	bytes   int64
+	sums    map[string]string
+	charts  map[string]bool
+	blocked int
+}
+
+func (s *summary) add(name string, version string, status ChartStatus, err error) {
+	r := ChartResult{Name: name, Version: version, Status: status}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	s.mu.Lock()
+	s.results = append(s.results, r)
+	s.mu.Unlock()
+}
+
+// addBytes records n more bytes written or pushed
+func (s *summary) addBytes(n int) {
+	s.mu.Lock()
+	s.bytes += int64(n)
+	s.mu.Unlock()
+}
+
+// addBlocked records n more chart versions left out by the blocklist
+func (s *summary) addBlocked(n int) {
+	s.mu.Lock()
+	s.blocked += n
+	s.mu.Unlock()
+}
+
+// addChecksum records the sha256 sum of the chart file name
+func (s *summary) addChecksum(name string, sum string) {
+	s.mu.Lock()
+	if s.sums == nil {
+		s.sums = map[string]string{}
+	}
+	s.sums[name] = sum
+	s.mu.Unlock()
+}
+
+// addChart records the chart file name written or found up to date
+func (s *summary) addChart(name string) {
+	s.mu.Lock()
+	if s.charts == nil {
+		s.charts = map[string]bool{}
+	}
+	s.charts[name] = true
+	s.mu.Unlock()
+}
+
+// addArtifact records the extra artifact file name written next to a chart
+// or kept from a previous run, so that it is not pruned
+func (s *summary) addArtifact(name string) {
+	s.addChart(name)
+}
+
+// checksums returns the sha256 sums of the chart files by file name
+func (s *summary) checksums() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sums := make(map[string]string, len(s.sums))
+	for name, sum := range s.sums {
+		sums[name] = sum
+	}
+	return sums
+}
+
+// failed returns the results of the charts that could not be downloaded
+func (s *summary) failed() []ChartResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var failed []ChartResult
+	for _, r := range s.results {
+		if r.Status == StatusFailed {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// stats counts the results of the run that lasted d
+func (s *summary) stats(d time.Duration) *GetStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &GetStats{Blocked: s.blocked, BytesWritten: s.bytes, Duration: d}
+	for _, r := range s.results {
+		switch r.Status {
+		case StatusDownloaded:
+			st.Downloaded++
+		case StatusSkipped:
+			st.Skipped++
+		case StatusFailed:
+			st.Failed++
+		}
+	}
+	return st
+}
+
+// writeSummary writes the results as a JSON file
+func writeSummary(fs FileSystem, name string, results []ChartResult, mode os.FileMode, log Printer, ignoreErrors bool) error {
+	if results == nil {
+		results = []ChartResult{}
+	}
+	content, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(fs, name, append(content, '\n'), mode, log, ignoreErrors)
+}
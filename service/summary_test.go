@@ -0,0 +1,158 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/helm/pkg/repo"
+)
+
+func Test_writeSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	s := &summary{}
+	s.add("chart1", "1.0.0", StatusDownloaded, nil)
+	s.add("chart2", "2.0.0", StatusSkipped, nil)
+	s.add("chart3", "3.0.0", StatusFailed, errors.New("not found"))
+	tests := []struct {
+		name    string
+		file    string
+		results []ChartResult
+		want    []ChartResult
+		wantErr bool
+	}{
+		{"1", path.Join(dir, "mirror-summary.json"), s.results, []ChartResult{
+			{Name: "chart1", Version: "1.0.0", Status: StatusDownloaded},
+			{Name: "chart2", Version: "2.0.0", Status: StatusSkipped},
+			{Name: "chart3", Version: "3.0.0", Status: StatusFailed, Error: "not found"},
+		}, false},
+		{"2", path.Join(dir, "empty.json"), nil, []ChartResult{}, false},
+		{"3", "", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := writeSummary(osFileSystem{}, tt.file, tt.results, DefaultFileMode, fakeLogger, false); (err != nil) != tt.wantErr {
+				t.Errorf("writeSummary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			content, err := ioutil.ReadFile(tt.file)
+			if err != nil {
+				t.Fatalf("reading summary: %s", err)
+			}
+			got := []ChartResult{}
+			if err := json.Unmarshal(content, &got); err != nil {
+				t.Fatalf("parsing summary: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("writeSummary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_summary_stats(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []ChartResult
+		bytes   int64
+		want    *GetStats
+	}{
+		{"1", nil, 0, &GetStats{Duration: time.Second}},
+		{"2", []ChartResult{
+			{Name: "chart1", Status: StatusDownloaded},
+			{Name: "chart2", Status: StatusDownloaded},
+			{Name: "chart3", Status: StatusSkipped},
+			{Name: "chart4", Status: StatusFailed},
+		}, 2048, &GetStats{Downloaded: 2, Skipped: 1, Failed: 1, BytesWritten: 2048, Duration: time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &summary{results: tt.results, bytes: tt.bytes}
+			if got := s.stats(time.Second); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("summary.stats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetStats_String(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats GetStats
+		want  string
+	}{
+		{"1", GetStats{}, "0 charts downloaded, 0 skipped, 0 failed, 0 bytes written in 0s"},
+		{"2", GetStats{Downloaded: 3, Skipped: 1, Failed: 2, BytesWritten: 1024, Duration: 1500 * time.Millisecond}, "3 charts downloaded, 1 skipped, 2 failed, 1024 bytes written in 1.5s"},
+		{"3", GetStats{Downloaded: 1, Blocked: 2, Duration: 1234567 * time.Microsecond}, "1 charts downloaded, 0 skipped, 0 failed, 2 blocked, 0 bytes written in 1.235s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stats.String(); got != tt.want {
+				t.Errorf("GetStats.String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetService_reportCompletion(t *testing.T) {
+	tests := []struct {
+		name    string
+		dryRun  bool
+		err     error
+		want    string
+		wantErr string
+	}{
+		{"1", false, nil, "mirror of http://charts done: 2 charts downloaded, 0 skipped, 0 failed, 0 bytes written in 0s", ""},
+		{"2", false, errors.New("boom"), "mirror of http://charts stopped: 2 charts downloaded, 0 skipped, 0 failed, 0 bytes written in 0s - boom", "boom"},
+		{"3", true, nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []Event
+			var gotStats *GetStats
+			var gotErr error
+			g := &GetService{
+				config:      repo.Entry{URL: "http://charts"},
+				eventLogger: eventRecorder(func(e Event) { events = append(events, e) }),
+				dryRun:      tt.dryRun,
+				stats:       &GetStats{Downloaded: 2},
+				completion: func(stats *GetStats, err error) {
+					gotStats, gotErr = stats, err
+				},
+			}
+			g.reportCompletion(tt.err)
+			if tt.want == "" && len(events) > 0 {
+				t.Errorf("GetService.reportCompletion() logged %+v, want nothing", events)
+			}
+			if tt.want != "" && (len(events) != 1 || events[0].Event != EventRunCompleted || events[0].Message != tt.want || events[0].Error != tt.wantErr) {
+				t.Errorf("GetService.reportCompletion() logged %+v, want %q", events, tt.want)
+			}
+			if gotStats != g.stats || gotErr != tt.err {
+				t.Errorf("GetService.reportCompletion() called back with %v, %v", gotStats, gotErr)
+			}
+		})
+	}
+}
+
+// eventRecorder is a Logger calling its function with each event
+type eventRecorder func(e Event)
+
+func (r eventRecorder) Printf(format string, v ...interface{}) {
+	r(Event{Event: EventMessage, Message: fmt.Sprintf(format, v...)})
+}
+
+func (r eventRecorder) Event(e Event) {
+	r(e)
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tarWriter is a StorageWriter appending the files of the mirror to a tar
+// archive, gzipped when its name ends with .gz or .tgz. The archive is
+// written next to its name and only moved into place once closed, so a run
+// that fails does not leave a truncated archive behind.
+type tarWriter struct {
+	mu      sync.Mutex
+	name    string
+	file    *os.File
+	gz      *gzip.Writer
+	tw      *tar.Writer
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// newTarWriter creates the tar archive name, its entries have the given mode
+func newTarWriter(name string, mode os.FileMode) (*tarWriter, error) {
+	f, err := ioutil.TempFile(path.Dir(name), "."+path.Base(name)+".*")
+	if err != nil {
+		return nil, err
+	}
+	t := &tarWriter{name: name, file: f, mode: mode, modTime: time.Now()}
+	var w io.Writer = f
+	if strings.HasSuffix(name, gzSuffix) || strings.HasSuffix(name, ".tgz") {
+		t.gz = gzip.NewWriter(f)
+		w = t.gz
+	}
+	t.tw = tar.NewWriter(w)
+	return t, nil
+}
+
+// Write appends the file name to the archive
+func (t *tarWriter) Write(ctx context.Context, name string, content []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(t.mode.Perm()),
+		Size:     int64(len(content)),
+		ModTime:  t.modTime,
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := t.tw.Write(content)
+	return err
+}
+
+// Close finishes the archive and moves it into place
+func (t *tarWriter) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.tw.Close()
+	if t.gz != nil && err == nil {
+		err = t.gz.Close()
+	}
+	if err == nil {
+		err = t.file.Chmod(t.mode)
+	}
+	if cerr := t.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(t.file.Name(), t.name)
+	}
+	if err != nil {
+		os.Remove(t.file.Name())
+	}
+	return err
+}
+
+// abort removes the archive being written
+func (t *tarWriter) abort() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file.Close()
+	os.Remove(t.file.Name())
+}
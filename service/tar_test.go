@@ -0,0 +1,150 @@
+package service
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+// tarEntries returns the names of the entries of the tar archive name
+func tarEntries(t *testing.T, name string) []string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("Opening tar archive: %s", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(name, gzSuffix) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Opening gzip archive: %s", err)
+		}
+		r = gz
+	}
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Reading tar archive: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Test_tarWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name  string
+		file  string
+		abort bool
+		want  []string
+	}{
+		{"1", "mirror.tar", false, []string{"chart1-1.0.0.tgz", "index.yaml", "stable/chart2-1.0.0.tgz"}},
+		{"2", "mirror.tar.gz", false, []string{"chart1-1.0.0.tgz", "index.yaml", "stable/chart2-1.0.0.tgz"}},
+		{"3", "aborted.tar", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := path.Join(dir, tt.file)
+			w, err := newTarWriter(name, 0644)
+			if err != nil {
+				t.Fatalf("newTarWriter() error = %v", err)
+			}
+			for _, f := range []string{"chart1-1.0.0.tgz", "stable/chart2-1.0.0.tgz", "index.yaml"} {
+				if err := w.Write(context.Background(), f, []byte("content")); err != nil {
+					t.Fatalf("tarWriter.Write() error = %v", err)
+				}
+			}
+			if tt.abort {
+				w.abort()
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("tarWriter.abort() left %s", name)
+				}
+			} else {
+				if err := w.Close(); err != nil {
+					t.Fatalf("tarWriter.Close() error = %v", err)
+				}
+				if got := tarEntries(t, name); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+					t.Errorf("tarWriter entries = %v, want %v", got, tt.want)
+				}
+			}
+			if tmp, _ := filepath.Glob(path.Join(dir, "."+tt.file+".*")); len(tmp) > 0 {
+				t.Errorf("tarWriter left temporary files %v", tmp)
+			}
+		})
+	}
+}
+
+func TestGetService_GetTarOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tests := []struct {
+		name    string
+		layout  Layout
+		want    []string
+		wantErr bool
+	}{
+		{"1", LayoutFlat, []string{"chart1-2.11.0.tgz", "chart2-0.0.0-rc1.tgz", "chart2-1.0.1.tgz", "index.yaml"}, false},
+		{"2", LayoutByName, []string{"chart1/chart1-2.11.0.tgz", "chart2/chart2-0.0.0-rc1.tgz", "chart2/chart2-1.0.1.tgz", "index.yaml"}, false},
+		{"3", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			archive := path.Join(dir, tt.name+".tar.gz")
+			opts := []GetOption{WithChartNames([]string{"chart1", "chart2"}), WithTarOutput(archive), WithLayout(tt.layout)}
+			if tt.wantErr {
+				opts = append(opts, WithRegeneratedIndex(true))
+			}
+			g, err := NewGetService(repo.Entry{Name: workDir, URL: "http://127.0.0.1:1793"}, true, false, true, fakeLogger, "https://mirror.local.lan/charts", "", "", opts...)
+			if err != nil {
+				t.Fatalf("NewGetService() error = %v", err)
+			}
+			if err := g.Get(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("GetService.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := os.Stat(archive); !os.IsNotExist(err) {
+					t.Errorf("GetService.Get() wrote %s", archive)
+				}
+				return
+			}
+			if got := tarEntries(t, archive); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("GetService.Get() archive entries = %v, want %v", got, tt.want)
+			}
+			files, _ := filepath.Glob(path.Join(workDir, "*.tgz"))
+			nested, _ := filepath.Glob(path.Join(workDir, "*", "*.tgz"))
+			if files = append(files, nested...); len(files) > 0 {
+				t.Errorf("GetService.Get() wrote charts to the destination folder: %v", files)
+			}
+		})
+	}
+}
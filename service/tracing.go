@@ -0,0 +1,46 @@
+package service
+
+import "context"
+
+// Tracer starts the spans of a mirror run, eg: to show it in an
+// OpenTelemetry trace through an adapter of its tracer. A run has a
+// helm-mirror.get span, with a helm-mirror.index child span for the index
+// download and a helm-mirror.chart one for each chart download. Its methods
+// are called concurrently by the download workers.
+type Tracer interface {
+	// Start starts a span named name, a child of the span of ctx if any, and
+	// returns a context holding it
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	SetAttribute(key string, value string)
+	// RecordError records err as an event of the span
+	RecordError(err error)
+	End()
+}
+
+// nopSpan is the Span of a service without a tracer
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, string) {}
+func (nopSpan) RecordError(error)           {}
+func (nopSpan) End()                        {}
+
+// startSpan starts a span named name with the tracer of the service, ctx is
+// returned as is with a no-op span when none was set
+func (g *GetService) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if g.tracer == nil {
+		return ctx, nopSpan{}
+	}
+	return g.tracer.Start(ctx, name)
+}
+
+// endSpan records err, if any, and ends span
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openSUSE/helm-mirror/fixtures"
+	"k8s.io/helm/pkg/repo"
+)
+
+type spanKey struct{}
+
+// fakeSpan is a span of fakeTracer
+type fakeSpan struct {
+	tracer *fakeTracer
+	name   string
+	parent string
+	attrs  map[string]string
+	errors []error
+}
+
+func (s *fakeSpan) SetAttribute(key string, value string) {
+	s.tracer.mu.Lock()
+	s.attrs[key] = value
+	s.tracer.mu.Unlock()
+}
+
+func (s *fakeSpan) RecordError(err error) {
+	s.tracer.mu.Lock()
+	s.errors = append(s.errors, err)
+	s.tracer.mu.Unlock()
+}
+
+func (s *fakeSpan) End() {
+	s.tracer.mu.Lock()
+	s.tracer.ended = append(s.tracer.ended, s)
+	s.tracer.mu.Unlock()
+}
+
+// fakeTracer records the spans ended
+type fakeTracer struct {
+	mu    sync.Mutex
+	ended []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &fakeSpan{tracer: t, name: name, attrs: map[string]string{}}
+	if parent, ok := ctx.Value(spanKey{}).(*fakeSpan); ok {
+		s.parent = parent.name
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func TestGetService_GetTracer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	svr := fixtures.StartHTTPServer()
+	defer svr.Shutdown(context.Background())
+	fixtures.WaitForServer("http://127.0.0.1:1793/alive")
+	tracer := &fakeTracer{}
+	g := &GetService{
+		config:       repo.Entry{Name: dir, URL: "http://127.0.0.1:1793"},
+		logger:       fakeLogger,
+		ignoreErrors: true,
+		allVersions:  true,
+		tracer:       tracer,
+	}
+	if err := g.Get(context.Background()); err != nil {
+		t.Fatalf("GetService.Get() error = %v", err)
+	}
+	got := []string{}
+	for _, s := range tracer.ended {
+		desc := s.parent + ">" + s.name
+		if s.name == "helm-mirror.chart" {
+			desc += " " + s.attrs["chart.name"] + " " + s.attrs["chart.status"]
+			if !strings.HasPrefix(s.attrs["chart.url"], "http://127.0.0.1:1793/") {
+				t.Errorf("GetService.Get() chart.url = %v", s.attrs["chart.url"])
+			}
+		}
+		if len(s.errors) > 0 {
+			desc += " error"
+		}
+		got = append(got, desc)
+	}
+	sort.Strings(got)
+	want := []string{
+		">helm-mirror.get",
+		"helm-mirror.get>helm-mirror.chart chart1 downloaded",
+		"helm-mirror.get>helm-mirror.chart chart2 downloaded",
+		"helm-mirror.get>helm-mirror.chart chart2 downloaded",
+		"helm-mirror.get>helm-mirror.chart chart3 downloaded",
+		"helm-mirror.get>helm-mirror.chart chart3 failed error",
+		"helm-mirror.get>helm-mirror.index",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("GetService.Get() spans = %v, want %v", got, want)
+	}
+}
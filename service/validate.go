@@ -0,0 +1,33 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"k8s.io/helm/pkg/chartutil"
+)
+
+// validateChart checks that the archive read from in is a well formed chart
+// with the given name and version
+func validateChart(in io.Reader, name string, version string) error {
+	c, err := chartutil.LoadArchive(in)
+	if err != nil {
+		return fmt.Errorf("not a valid chart archive: %s", err)
+	}
+	if c.Metadata.Name != name || c.Metadata.Version != version {
+		return fmt.Errorf("chart archive is %s(%s), expected %s(%s)", c.Metadata.Name, c.Metadata.Version, name, version)
+	}
+	return nil
+}
+
+// validateChartFile checks the chart archive in the file name like
+// validateChart
+func validateChartFile(name string, chartName string, version string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return validateChart(f, chartName, version)
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func Test_validateChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	archive := packageChart(t, dir, "chart1", "1.0.0", "")
+	tests := []struct {
+		name    string
+		archive []byte
+		chart   string
+		version string
+		wantErr bool
+	}{
+		{"1", archive, "chart1", "1.0.0", false},
+		{"2", archive, "chart2", "1.0.0", true},
+		{"3", archive, "chart1", "1.0.1", true},
+		{"4", []byte("not a chart"), "chart1", "1.0.0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateChart(bytes.NewReader(tt.archive), tt.chart, tt.version); (err != nil) != tt.wantErr {
+				t.Errorf("validateChart() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetService_GetValidateCharts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string][]byte{
+		"/good-1.0.0.tgz":    packageChart(t, dir, "good", "1.0.0", ""),
+		"/renamed-1.0.0.tgz": packageChart(t, dir, "other", "1.0.0", ""),
+		"/broken-1.0.0.tgz":  []byte("not a chart"),
+	}
+	index := repo.NewIndexFile()
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+indexFileName {
+			b, _ := yaml.Marshal(index)
+			w.Write(b)
+			return
+		}
+		if b, ok := files[r.URL.Path]; ok {
+			w.Write(b)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer svr.Close()
+	for _, name := range []string{"good", "renamed", "broken"} {
+		index.Add(&chart.Metadata{ApiVersion: "v1", Name: name, Version: "1.0.0"}, chartFileName(name, "1.0.0"), svr.URL, "")
+	}
+	tests := []struct {
+		name       string
+		validate   bool
+		wantCharts []string
+		wantFailed int
+	}{
+		{"1", false, []string{"broken-1.0.0.tgz", "good-1.0.0.tgz", "renamed-1.0.0.tgz"}, 0},
+		{"2", true, []string{"good-1.0.0.tgz"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := path.Join(dir, tt.name)
+			os.MkdirAll(workDir, 0755)
+			g := &GetService{
+				config:         repo.Entry{Name: workDir, URL: svr.URL},
+				logger:         fakeLogger,
+				ignoreErrors:   true,
+				allVersions:    true,
+				validateCharts: tt.validate,
+			}
+			if err := g.Get(context.Background()); err != nil {
+				t.Errorf("GetService.Get() error = %v", err)
+			}
+			var got []string
+			filepath.Walk(workDir, func(p string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && info.Name() != indexFileName && filepath.Ext(p) != ".yaml" {
+					got = append(got, info.Name())
+				}
+				return nil
+			})
+			if !reflect.DeepEqual(got, tt.wantCharts) {
+				t.Errorf("GetService.Get() files = %v, want %v", got, tt.wantCharts)
+			}
+			if failed := g.Stats().Failed; failed != tt.wantFailed {
+				t.Errorf("GetService.Get() failed = %d, want %d", failed, tt.wantFailed)
+			}
+		})
+	}
+}
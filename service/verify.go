@@ -0,0 +1,147 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VerifyServiceInterface defines a Verify service
+type VerifyServiceInterface interface {
+	Verify() (*VerifyReport, error)
+}
+
+// VerifyService checks the charts of a mirror against its index file
+type VerifyService struct {
+	dir       string
+	verbose   bool
+	logger    *log.Logger
+	indexName string
+}
+
+// VerifyOption is an optional setting of a VerifyService
+type VerifyOption func(*VerifyService)
+
+// WithVerifyIndexFileName names the index file of the mirror, index.yaml by
+// default like WithIndexFileNames. An empty name keeps the default one.
+func WithVerifyIndexFileName(name string) VerifyOption {
+	return func(v *VerifyService) {
+		v.indexName = name
+	}
+}
+
+// VerifyResult is a chart version of the index file that is missing from the
+// mirror or whose file does not match its digest
+type VerifyResult struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Path    string `json:"path,omitempty"`
+	Error   string `json:"error"`
+}
+
+// VerifyReport is the outcome of the verification of a mirror
+type VerifyReport struct {
+	// Verified is the number of chart versions matching their digest
+	Verified int
+	// Unverified is the number of chart versions found without a digest
+	Unverified int
+	Missing    []VerifyResult
+	Corrupt    []VerifyResult
+}
+
+// OK reports whether every chart version of the index file is in the mirror
+// and matches its digest
+func (r *VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// NewVerifyService returns a new instance of VerifyService checking the
+// mirror in the folder dir
+func NewVerifyService(dir string, verbose bool, logger *log.Logger, opts ...VerifyOption) VerifyServiceInterface {
+	v := &VerifyService{
+		dir:     dir,
+		verbose: verbose,
+		logger:  logger,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Verify checks that every chart version of the index file of the mirror is
+// on disk and that its sha256 matches the digest of the index file. A chart
+// is looked up under the path of its URL in the mirror, dropping the leading
+// folders of the path until a file is found, so both the charts that kept
+// the path of their URL and the ones of a rewritten index file are found.
+func (v *VerifyService) Verify() (*VerifyReport, error) {
+	indexName := v.indexName
+	if indexName == "" {
+		indexName = indexFileName
+	}
+	if !validPathElement(indexName) {
+		return nil, fmt.Errorf("invalid index file name %q: it must be a file name", indexName)
+	}
+	index, err := loadIndexFile(osFileSystem{}, path.Join(v.dir, indexName))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(index.Entries))
+	for name := range index.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	report := &VerifyReport{}
+	for _, name := range names {
+		for _, cv := range index.Entries[name] {
+			r := VerifyResult{Name: cv.Name, Version: cv.Version}
+			if len(cv.URLs) == 0 {
+				r.Error = "no URL in the index file"
+				report.Missing = append(report.Missing, r)
+				continue
+			}
+			chartPath, err := v.find(cv.URLs[0])
+			if err != nil {
+				r.Error = err.Error()
+				report.Missing = append(report.Missing, r)
+				continue
+			}
+			r.Path = chartPath
+			if cv.Digest == "" {
+				if v.verbose {
+					v.logger.Printf("chart %s(%s) has no digest, skipping verification", cv.Name, cv.Version)
+				}
+				report.Unverified++
+				continue
+			}
+			if err := verifyFileDigest(chartPath, cv.Digest); err != nil {
+				r.Error = err.Error()
+				report.Corrupt = append(report.Corrupt, r)
+				continue
+			}
+			report.Verified++
+		}
+	}
+	return report, nil
+}
+
+// find returns the file of the mirror of the chart at u
+func (v *VerifyService) find(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	for i := range parts {
+		name := filepath.Join(v.dir, filepath.FromSlash(strings.Join(parts[i:], "/")))
+		if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in %s", u, v.dir)
+}
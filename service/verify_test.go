@@ -0,0 +1,85 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/repo"
+)
+
+func TestVerifyService_Verify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmmirrortests")
+	if err != nil {
+		t.Errorf("Creating tmp directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	mirror := path.Join(dir, "mirror")
+	os.MkdirAll(path.Join(mirror, "stable"), 0755)
+	for _, c := range []struct{ folder, name, version string }{
+		{"", "chart1", "1.0.0"},
+		{"stable", "chart2", "1.0.0"},
+		{"", "chart3", "1.0.0"},
+		{"", "chart4", "1.0.0"},
+	} {
+		ch := &chart.Chart{Metadata: &chart.Metadata{ApiVersion: "v1", Name: c.name, Version: c.version}}
+		if _, err := chartutil.Save(ch, path.Join(mirror, c.folder)); err != nil {
+			t.Fatalf("Saving chart: %s", err)
+		}
+	}
+	index, err := repo.IndexDirectory(mirror, "https://mirror.local.lan/charts")
+	if err != nil {
+		t.Fatalf("Indexing charts: %s", err)
+	}
+	index.Entries["chart4"][0].Digest = ""
+	index.Add(&chart.Metadata{ApiVersion: "v1", Name: "chart5", Version: "1.0.0"}, "chart5-1.0.0.tgz", "https://mirror.local.lan/charts", "0123")
+	b, _ := yaml.Marshal(index)
+	ioutil.WriteFile(path.Join(mirror, indexFileName), b, 0644)
+	ioutil.WriteFile(path.Join(mirror, "mirror-index.yaml"), b, 0644)
+	ioutil.WriteFile(path.Join(mirror, "chart3-1.0.0.tgz"), []byte("corrupt"), 0644)
+
+	tests := []struct {
+		name           string
+		dir            string
+		indexName      string
+		wantVerified   int
+		wantUnverified int
+		wantMissing    []string
+		wantCorrupt    []string
+		wantErr        bool
+	}{
+		{"1", mirror, "", 2, 1, []string{"chart5"}, []string{"chart3"}, false},
+		{"2", path.Join(dir, "missing"), "", 0, 0, nil, nil, true},
+		{"3", mirror, "mirror-index.yaml", 2, 1, []string{"chart5"}, []string{"chart3"}, false},
+		{"4", mirror, "other-index.yaml", 0, 0, nil, nil, true},
+		{"5", mirror, "../mirror/index.yaml", 0, 0, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifyService(tt.dir, true, fakeLogger, WithVerifyIndexFileName(tt.indexName))
+			got, err := v.Verify()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyService.Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Verified != tt.wantVerified || got.Unverified != tt.wantUnverified {
+				t.Errorf("VerifyService.Verify() verified = %v, unverified = %v, want %v and %v", got.Verified, got.Unverified, tt.wantVerified, tt.wantUnverified)
+			}
+			if len(got.Missing) != len(tt.wantMissing) || (len(got.Missing) > 0 && got.Missing[0].Name != tt.wantMissing[0]) {
+				t.Errorf("VerifyService.Verify() missing = %v, want %v", got.Missing, tt.wantMissing)
+			}
+			if len(got.Corrupt) != len(tt.wantCorrupt) || (len(got.Corrupt) > 0 && got.Corrupt[0].Name != tt.wantCorrupt[0]) {
+				t.Errorf("VerifyService.Verify() corrupt = %v, want %v", got.Corrupt, tt.wantCorrupt)
+			}
+			if got.OK() {
+				t.Errorf("VerifyService.Verify() OK = true, want false")
+			}
+		})
+	}
+}